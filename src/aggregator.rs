@@ -19,7 +19,7 @@
 //!   `AppStatus` data locally.
 //! - **register_app**: Registers an application with a remote aggregator if configured.
 
-use chrono::Utc;
+use chrono::{DateTime, Utc};
 use colored::Colorize;
 use dusa_collection_utils::core::logger::LogLevel;
 use dusa_collection_utils::core::types::pathtype::PathType;
@@ -44,6 +44,7 @@ use tokio::time::interval;
 use crate::config_bundle::ApplicationConfig;
 use crate::encryption::{simple_decrypt, simple_encrypt};
 use crate::portal::{ManagerData, ProjectInfo};
+use crate::timestamp;
 
 /// Path where the aggregator stores AIS Manager data.
 pub const AGGREGATOR_PATH: &str = "/tmp/.ais_manager_data";
@@ -492,7 +493,7 @@ pub async fn spawn_flush_task(usage_map: UsageMap, output_dir: PathType) {
                 }
             };
 
-            let now = Utc::now();
+            let now = DateTime::<Utc>::from(timestamp::now());
             let epoch = now.timestamp();
             for ((runner_id, instance_id), acc) in map.drain() {
                 let record = UsageRecord {
@@ -542,7 +543,7 @@ pub async fn flush_metrics_to_disk(
 ) -> Result<(), ErrorArrayItem> {
     let mut map = usage_map.try_write().await?;
 
-    let now = Utc::now();
+    let now = DateTime::<Utc>::from(timestamp::now());
     let epoch = now.timestamp();
 
     for ((runner_id, instance_id), acc) in map.drain() {
@@ -5,8 +5,10 @@ use dusa_collection_utils::{
 use serde::{Deserialize, Serialize};
 
 use crate::{
-    aggregator::Status, config::AppConfig, enviornment::definitions::Enviornment,
-    state_persistence::AppState,
+    aggregator::Status,
+    config::AppConfig,
+    enviornment::definitions::Enviornment,
+    state_persistence::{AppState, ErrorItem},
 };
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
@@ -88,7 +90,8 @@ impl ApplicationConfig {
         self.state.error_log.is_empty()
     }
 
-    pub fn update_error_log(&mut self, mut errors: Vec<ErrorArrayItem>, append: bool) {
+    pub fn update_error_log(&mut self, errors: Vec<ErrorArrayItem>, append: bool) {
+        let mut errors: Vec<ErrorItem> = errors.into_iter().map(ErrorItem::from).collect();
         match append {
             true => {
                 self.state.error_log.append(&mut errors);
@@ -0,0 +1,163 @@
+//! # Config Watch
+//!
+//! Reloads an [`AppConfig`] when its file changes, without relying on `SIGHUP`, which
+//! containers often can't deliver.
+//!
+//! [`watch_config_file`] watches the directory holding the file through the [`notify`]
+//! crate rather than the file itself. Editors and deployment tools usually replace a file
+//! by writing a new one and renaming it over the old, which ends a watch placed on the
+//! file; a watch on the directory keeps seeing the new file without being added again.
+
+use config::ConfigError;
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::core::types::pathtype::PathType;
+use dusa_collection_utils::log;
+use notify::{Event, EventKind, RecommendedWatcher, RecursiveMode, Watcher};
+use std::ffi::OsStr;
+use std::fmt;
+use std::io;
+use std::path::Path;
+use std::time::Duration;
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+
+use crate::config::AppConfig;
+
+/// Returned by [`watch_config_file`]. The watch stops when the watcher is dropped.
+pub struct ConfigWatcher {
+    _watcher: RecommendedWatcher,
+    watch_task: JoinHandle<()>,
+}
+
+impl fmt::Debug for ConfigWatcher {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("ConfigWatcher").finish_non_exhaustive()
+    }
+}
+
+impl Drop for ConfigWatcher {
+    fn drop(&mut self) {
+        self.watch_task.abort();
+    }
+}
+
+/// Calls `on_change` with the result of [`AppConfig::from_file`] whenever the file at
+/// `path` is written, created or renamed into place.
+///
+/// Changes arriving less than `debounce` apart are coalesced: the file is loaded once
+/// `debounce` has passed without another change, so a burst of writes costs one reload.
+/// A file that can't be parsed, e.g. because it is caught half written, is reported as
+/// an `Err` and the watch carries on.
+///
+/// Must be called from within a tokio runtime. `on_change` runs on the runtime, so hand
+/// slow work off to another task.
+///
+/// # Errors
+/// Returns an `Err` if the platform's file watcher is unavailable or the directory of
+/// `path` can't be watched.
+pub fn watch_config_file<F>(
+    path: PathType,
+    debounce: Duration,
+    mut on_change: F,
+) -> io::Result<ConfigWatcher>
+where
+    F: FnMut(Result<AppConfig, ConfigError>) + Send + 'static,
+{
+    let file_path: &Path = path.as_ref();
+    let name = file_path
+        .file_name()
+        .ok_or_else(|| {
+            io::Error::new(
+                io::ErrorKind::InvalidInput,
+                format!("{} does not name a file", file_path.display()),
+            )
+        })?
+        .to_os_string();
+    let dir = match file_path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+
+    let (events_tx, mut events) = mpsc::unbounded_channel();
+    let mut watcher = notify::recommended_watcher(move |event: notify::Result<Event>| {
+        // Sending only fails once the watch task is gone, and then nobody cares.
+        let _ = events_tx.send(event);
+    })
+    .map_err(to_io_error)?;
+    watcher
+        .watch(dir, RecursiveMode::NonRecursive)
+        .map_err(to_io_error)?;
+
+    let watch_task = tokio::spawn(async move {
+        loop {
+            if let Err(err) = next_change(&mut events, &name).await {
+                log!(LogLevel::Error, "Stopped watching {}: {}", path, err);
+                return;
+            }
+            // Wait for the file to settle before loading it.
+            loop {
+                let change = next_change(&mut events, &name);
+                match tokio::time::timeout(debounce, change).await {
+                    Ok(Ok(())) => continue,
+                    Ok(Err(err)) => {
+                        log!(LogLevel::Error, "Stopped watching {}: {}", path, err);
+                        return;
+                    }
+                    Err(_) => break,
+                }
+            }
+            on_change(AppConfig::from_file(&path));
+        }
+    });
+
+    Ok(ConfigWatcher {
+        _watcher: watcher,
+        watch_task,
+    })
+}
+
+/// Waits until the watcher reports a change of `name`. Cancelling the wait loses no
+/// events that haven't been received yet.
+async fn next_change(
+    events: &mut mpsc::UnboundedReceiver<notify::Result<Event>>,
+    name: &OsStr,
+) -> io::Result<()> {
+    loop {
+        let event = match events.recv().await {
+            Some(event) => event.map_err(to_io_error)?,
+            None => {
+                return Err(io::Error::new(
+                    io::ErrorKind::BrokenPipe,
+                    "the file watcher stopped",
+                ))
+            }
+        };
+        if touches(&event, name) {
+            return Ok(());
+        }
+    }
+}
+
+/// Reports whether `event` may have left the file `name` with new content.
+fn touches(event: &Event, name: &OsStr) -> bool {
+    // After a missed event the file may have changed without a report.
+    if event.need_rescan() {
+        return true;
+    }
+    let writes = matches!(
+        event.kind,
+        EventKind::Any | EventKind::Create(_) | EventKind::Modify(_)
+    );
+    writes
+        && event
+            .paths
+            .iter()
+            .any(|path| path.file_name() == Some(name))
+}
+
+fn to_io_error(err: notify::Error) -> io::Error {
+    match err.kind {
+        notify::ErrorKind::Io(err) => err,
+        _ => io::Error::new(io::ErrorKind::Other, err),
+    }
+}
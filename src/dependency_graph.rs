@@ -0,0 +1,150 @@
+//! # Dependency Graph
+//!
+//! Orders applications by their [`AppState::dependencies`], so a supervisor can start
+//! dependencies before the applications that need them and knows what is affected when one
+//! of them goes down.
+
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt;
+
+use crate::state_persistence::AppState;
+
+/// Why a [`DependencyGraph`] couldn't be built or ordered.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum DependencyError {
+    /// Two states share the same name.
+    DuplicateApp(String),
+    /// `app` depends on `dependency`, which isn't part of the graph.
+    UnknownDependency {
+        /// The application declaring the dependency.
+        app: String,
+        /// The missing application.
+        dependency: String,
+    },
+    /// The dependencies form at least one cycle. `apps` holds every application that is on
+    /// a cycle or depends on one, sorted by name.
+    Cyclic {
+        /// The applications that can't be ordered.
+        apps: Vec<String>,
+    },
+}
+
+impl fmt::Display for DependencyError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            DependencyError::DuplicateApp(name) => write!(f, "duplicate application {}", name),
+            DependencyError::UnknownDependency { app, dependency } => {
+                write!(f, "{} depends on unknown application {}", app, dependency)
+            }
+            DependencyError::Cyclic { apps } => {
+                write!(f, "cyclic dependency between {}", apps.join(", "))
+            }
+        }
+    }
+}
+
+impl std::error::Error for DependencyError {}
+
+/// Dependencies between applications, keyed by [`AppState::name`].
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct DependencyGraph {
+    /// Direct dependencies of every application.
+    dependencies: BTreeMap<String, BTreeSet<String>>,
+    /// Applications directly depending on every application.
+    dependents: BTreeMap<String, BTreeSet<String>>,
+}
+
+impl DependencyGraph {
+    /// Builds the graph from the [`AppState::dependencies`] of `states`.
+    ///
+    /// # Errors
+    /// Returns [`DependencyError::DuplicateApp`] if two states have the same name, or
+    /// [`DependencyError::UnknownDependency`] if a dependency isn't one of `states`.
+    /// Cycles are only detected by [`DependencyGraph::topological_order`].
+    pub fn build(states: &[AppState]) -> Result<Self, DependencyError> {
+        let mut graph = Self::default();
+        for state in states {
+            if graph.dependencies.contains_key(&state.name) {
+                return Err(DependencyError::DuplicateApp(state.name.clone()));
+            }
+            graph.dependencies.insert(
+                state.name.clone(),
+                state.dependencies.iter().cloned().collect(),
+            );
+            graph.dependents.insert(state.name.clone(), BTreeSet::new());
+        }
+
+        for (app, dependencies) in &graph.dependencies {
+            for dependency in dependencies {
+                match graph.dependents.get_mut(dependency) {
+                    Some(dependents) => {
+                        dependents.insert(app.clone());
+                    }
+                    None => {
+                        return Err(DependencyError::UnknownDependency {
+                            app: app.clone(),
+                            dependency: dependency.clone(),
+                        })
+                    }
+                }
+            }
+        }
+        Ok(graph)
+    }
+
+    /// Returns every application with its dependencies before it. Applications that don't
+    /// depend on each other are ordered by name, so the result is deterministic.
+    ///
+    /// # Errors
+    /// Returns [`DependencyError::Cyclic`] if the dependencies contain a cycle.
+    pub fn topological_order(&self) -> Result<Vec<String>, DependencyError> {
+        let mut remaining: BTreeMap<&str, usize> = self
+            .dependencies
+            .iter()
+            .map(|(app, dependencies)| (app.as_str(), dependencies.len()))
+            .collect();
+        let mut ready: BTreeSet<&str> = remaining
+            .iter()
+            .filter(|(_, count)| **count == 0)
+            .map(|(app, _)| *app)
+            .collect();
+
+        let mut order = Vec::with_capacity(remaining.len());
+        while let Some(app) = ready.pop_first() {
+            remaining.remove(app);
+            order.push(app.to_string());
+            for dependent in &self.dependents[app] {
+                if let Some(count) = remaining.get_mut(dependent.as_str()) {
+                    *count -= 1;
+                    if *count == 0 {
+                        ready.insert(dependent);
+                    }
+                }
+            }
+        }
+
+        if remaining.is_empty() {
+            Ok(order)
+        } else {
+            Err(DependencyError::Cyclic {
+                apps: remaining.keys().map(|app| app.to_string()).collect(),
+            })
+        }
+    }
+
+    /// Returns the applications that directly depend on `name`, sorted by name.
+    pub fn dependents_of(&self, name: &str) -> Vec<String> {
+        self.dependents
+            .get(name)
+            .map(|dependents| dependents.iter().cloned().collect())
+            .unwrap_or_default()
+    }
+
+    /// Returns the direct dependencies of `name`, sorted by name.
+    pub fn dependencies_of(&self, name: &str) -> Vec<String> {
+        self.dependencies
+            .get(name)
+            .map(|dependencies| dependencies.iter().cloned().collect())
+            .unwrap_or_default()
+    }
+}
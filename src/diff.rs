@@ -0,0 +1,122 @@
+//! # Diff
+//!
+//! Field level comparison of serializable values, used for drift detection between a
+//! running configuration or state and a reference copy.
+//!
+//! Values are compared through their JSON representation: nested structs are walked field
+//! by field and reported with dotted paths (`git.credentials_file`), while arrays and
+//! scalars are compared as a whole. An `Option` that is `None` on one side counts as the
+//! whole field being added or removed.
+
+use serde::Serialize;
+use serde_json::{Map, Value};
+use std::fmt;
+
+/// How a field differs between the baseline and the current value.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum ChangeKind {
+    /// Present in the current value only.
+    Added,
+    /// Present in the baseline only.
+    Removed,
+    /// Present in both, with different values.
+    Modified,
+}
+
+/// A single difference found by [`diff_serialized`].
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord)]
+pub struct FieldChange {
+    /// Dotted path of the field, e.g. `database.pool_size`.
+    pub path: String,
+    /// What kind of change this is.
+    pub kind: ChangeKind,
+    /// JSON rendering of the baseline value, `None` if the field was added.
+    pub baseline: Option<String>,
+    /// JSON rendering of the current value, `None` if the field was removed.
+    pub current: Option<String>,
+}
+
+impl fmt::Display for FieldChange {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        let none = "<none>".to_string();
+        write!(
+            f,
+            "{:?} {}: {} -> {}",
+            self.kind,
+            self.path,
+            self.baseline.as_ref().unwrap_or(&none),
+            self.current.as_ref().unwrap_or(&none)
+        )
+    }
+}
+
+/// Compares `current` against `baseline` and returns every differing field, sorted by path.
+///
+/// # Errors
+/// Returns an `Err` if either value can't be serialized to JSON.
+pub fn diff_serialized<T: Serialize>(
+    baseline: &T,
+    current: &T,
+) -> Result<Vec<FieldChange>, serde_json::Error> {
+    let baseline = serde_json::to_value(baseline)?;
+    let current = serde_json::to_value(current)?;
+
+    let mut changes = Vec::new();
+    diff_values("", &baseline, &current, &mut changes);
+    changes.sort();
+    Ok(changes)
+}
+
+fn diff_values(path: &str, baseline: &Value, current: &Value, changes: &mut Vec<FieldChange>) {
+    match (baseline, current) {
+        (Value::Object(baseline), Value::Object(current)) => {
+            diff_objects(path, baseline, current, changes)
+        }
+        (Value::Null, Value::Null) => {}
+        (Value::Null, current) => changes.push(FieldChange {
+            path: path.to_string(),
+            kind: ChangeKind::Added,
+            baseline: None,
+            current: Some(current.to_string()),
+        }),
+        (baseline, Value::Null) => changes.push(FieldChange {
+            path: path.to_string(),
+            kind: ChangeKind::Removed,
+            baseline: Some(baseline.to_string()),
+            current: None,
+        }),
+        (baseline, current) if baseline != current => changes.push(FieldChange {
+            path: path.to_string(),
+            kind: ChangeKind::Modified,
+            baseline: Some(baseline.to_string()),
+            current: Some(current.to_string()),
+        }),
+        _ => {}
+    }
+}
+
+fn diff_objects(
+    path: &str,
+    baseline: &Map<String, Value>,
+    current: &Map<String, Value>,
+    changes: &mut Vec<FieldChange>,
+) {
+    let null = Value::Null;
+    let mut keys: Vec<&String> = baseline.keys().chain(current.keys()).collect();
+    keys.sort();
+    keys.dedup();
+
+    for key in keys {
+        let child = if path.is_empty() {
+            key.clone()
+        } else {
+            format!("{}.{}", path, key)
+        };
+        diff_values(
+            &child,
+            baseline.get(key).unwrap_or(&null),
+            current.get(key).unwrap_or(&null),
+            changes,
+        );
+    }
+}
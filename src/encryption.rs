@@ -463,4 +463,68 @@ pub fn simple_decrypt(encrypted_cipher_data: &[u8]) -> Result<Vec<u8>, ErrorArra
         .decrypt(nonce, ciphertext)
         .map_err(|err| ErrorArrayItem::new(Errors::InvalidBlockData, err.to_string()))
 }
+
+/// Encrypts the provided data using AES-256 GCM encryption with a caller supplied key, e.g.
+/// one returned by a [`KeyProvider`](crate::key_provider::KeyProvider).
+///
+/// Unlike [`simple_encrypt`], the key is not stored with the data, so only
+/// [`decrypt_with_key`] with the same key can read the result.
+///
+/// # Returns
+/// - `Ok(Stringy)`: A hex-encoded string containing the nonce and ciphertext.
+/// - `Err(ErrorArrayItem)`: An error if `key` is not 32 bytes long or encryption fails.
+pub fn encrypt_with_key(data: &[u8], key: &[u8]) -> Result<Stringy, ErrorArrayItem> {
+    let cipher = keyed_cipher(key)?;
+    let nonce_bytes = rand::thread_rng().gen::<[u8; NONCE_SIZE]>();
+    let ciphertext = cipher
+        .encrypt(Nonce::from_slice(&nonce_bytes), data)
+        .map_err(|e| ErrorArrayItem::new(Errors::InvalidBlockData, e.to_string()))?;
+
+    let mut result = Vec::with_capacity(NONCE_SIZE + ciphertext.len());
+    result.extend_from_slice(&nonce_bytes);
+    result.extend_from_slice(&ciphertext);
+
+    Ok(Stringy::from(hex::encode(result)))
+}
+
+/// Decrypts data produced by [`encrypt_with_key`].
+///
+/// # Returns
+/// - `Ok(Vec<u8>)`: The decrypted plaintext data.
+/// - `Err(ErrorArrayItem)`: An error if `key` is not 32 bytes long, is not the key the data
+///   was encrypted with, or if the data is malformed.
+pub fn decrypt_with_key(
+    encrypted_cipher_data: &[u8],
+    key: &[u8],
+) -> Result<Vec<u8>, ErrorArrayItem> {
+    let cipher = keyed_cipher(key)?;
+    let encrypted_data: Vec<u8> =
+        hex::decode(encrypted_cipher_data).map_err(ErrorArrayItem::from)?;
+
+    if encrypted_data.len() <= NONCE_SIZE {
+        return Err(ErrorArrayItem::new(
+            Errors::InvalidBlockData,
+            "Encrypted data is too short",
+        ));
+    }
+
+    let (nonce, ciphertext) = encrypted_data.split_at(NONCE_SIZE);
+    cipher
+        .decrypt(Nonce::from_slice(nonce), ciphertext)
+        .map_err(|err| ErrorArrayItem::new(Errors::InvalidBlockData, err.to_string()))
+}
+
+fn keyed_cipher(key: &[u8]) -> Result<Aes256Gcm, ErrorArrayItem> {
+    if key.len() != KEY_SIZE {
+        return Err(ErrorArrayItem::new(
+            Errors::InvalidBlockData,
+            format!(
+                "Encryption keys must be {} bytes, got {}",
+                KEY_SIZE,
+                key.len()
+            ),
+        ));
+    }
+    Ok(Aes256Gcm::new(Key::<Aes256Gcm>::from_slice(key)))
+}
 // endregion: Modern Encryption/Decryption
@@ -0,0 +1,111 @@
+//! # Health
+//!
+//! Combines the checks a readiness probe cares about into one verdict per [`AppState`].
+//! [`check_health`] runs them in this order and reports the first that fails:
+//!
+//! 1. **Crash**: the latest recorded event is `crashed`.
+//! 2. **Fatal errors**: [`AppState::error_log`] holds an error of [`Severity::Fatal`].
+//! 3. **Liveness**: [`AppState::pid`] doesn't belong to a running process.
+//! 4. **Resources**: the process uses more RAM or CPU than [`AppState::config`] allows,
+//!    see [`check_resource_usage`].
+//!
+//! The cheap checks on the state itself come first, so a crashed application isn't
+//! reported as merely dead and `/proc` is only read for applications that look healthy.
+//! Liveness and resources are read from `/proc` together; on platforms other than Linux
+//! they can't be checked and [`check_health`] returns [`HealthIssue::CheckFailed`].
+
+use std::fmt;
+use std::io;
+
+use crate::resource_limits::{check_resource_usage, ResourceReport};
+use crate::state_persistence::{AppState, Severity};
+
+/// Why [`check_health`] considers an application unhealthy. The `Display` output is the
+/// human readable reason.
+#[derive(Debug, Clone, PartialEq)]
+pub enum HealthIssue {
+    /// The latest event is a crash, recorded at `timestamp` with `detail`.
+    Crashed { timestamp: u64, detail: String },
+    /// The error log holds `count` fatal errors, the latest with message `latest`.
+    FatalErrors { count: usize, latest: String },
+    /// No process with the recorded PID is running. A PID of `0` was never set.
+    NotRunning { pid: u32 },
+    /// The process is over its RAM or CPU limit.
+    ResourcesExceeded(ResourceReport),
+    /// The process couldn't be inspected, e.g. because `/proc` couldn't be read.
+    CheckFailed(String),
+}
+
+impl fmt::Display for HealthIssue {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            HealthIssue::Crashed { timestamp, detail } if detail.is_empty() => {
+                write!(f, "crashed at {}", timestamp)
+            }
+            HealthIssue::Crashed { timestamp, detail } => {
+                write!(f, "crashed at {}: {}", timestamp, detail)
+            }
+            HealthIssue::FatalErrors { count, latest } => {
+                write!(f, "{} fatal error(s), latest: {}", count, latest)
+            }
+            HealthIssue::NotRunning { pid: 0 } => write!(f, "no process recorded"),
+            HealthIssue::NotRunning { pid } => write!(f, "process {} is not running", pid),
+            HealthIssue::ResourcesExceeded(report) => {
+                let mut over = Vec::new();
+                if report.ram_exceeded {
+                    over.push(format!("RAM at {} bytes", report.ram_bytes));
+                }
+                if report.cpu_exceeded {
+                    over.push(format!("CPU at {:.1}%", report.cpu_percent));
+                }
+                write!(f, "over resource limits: {}", over.join(", "))
+            }
+            HealthIssue::CheckFailed(message) => write!(f, "health check failed: {}", message),
+        }
+    }
+}
+
+impl std::error::Error for HealthIssue {}
+
+/// Runs the checks of the [module documentation](crate::health) against `state` and
+/// returns the first that fails, `Ok` if the application is healthy.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::health::check_health;
+/// # use artisan_middleware::state_persistence::AppState;
+/// # fn probe(state: &AppState) -> (bool, String) {
+/// match check_health(state) {
+///     Ok(()) => (true, "ok".to_string()),
+///     Err(issue) => (false, issue.to_string()),
+/// }
+/// # }
+/// ```
+pub fn check_health(state: &AppState) -> Result<(), HealthIssue> {
+    if let Some(event) = state.events.last().filter(|event| event.kind == "crashed") {
+        return Err(HealthIssue::Crashed {
+            timestamp: event.timestamp,
+            detail: event.detail.clone(),
+        });
+    }
+
+    let fatal = state.errors_at_least(Severity::Fatal);
+    if let Some(latest) = fatal.last() {
+        return Err(HealthIssue::FatalErrors {
+            count: fatal.len(),
+            latest: latest.err_mesg.to_string(),
+        });
+    }
+
+    if state.pid == 0 {
+        return Err(HealthIssue::NotRunning { pid: 0 });
+    }
+    match check_resource_usage(&state.config, state.pid) {
+        Ok(report) if report.exceeded() => Err(HealthIssue::ResourcesExceeded(report)),
+        Ok(_) => Ok(()),
+        Err(err) if err.kind() == io::ErrorKind::NotFound => {
+            Err(HealthIssue::NotRunning { pid: state.pid })
+        }
+        Err(err) => Err(HealthIssue::CheckFailed(err.to_string())),
+    }
+}
@@ -0,0 +1,278 @@
+//! # HTTP Server
+//!
+//! The minimal HTTP/1.1 server behind the [state receiver](crate::state_push) and the
+//! [state server](crate::state_server): one request per connection, bodies delimited by
+//! `Content-Length`, and a synchronous handler that turns a [`Request`] into a
+//! [`Response`]. Chunked request bodies and ambiguous `Content-Length` headers are refused.
+//!
+//! At most [`MAX_CONNECTIONS`] connections are served at once, further ones wait to be
+//! accepted, and a client has [`REQUEST_TIMEOUT`] to send its request, so slow or stalled
+//! clients can't tie up the server.
+
+use std::io;
+use std::sync::Arc;
+use std::time::Duration;
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::log;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::Semaphore;
+use tokio::task::JoinHandle;
+
+/// Largest request line and header block accepted.
+const MAX_HEAD_LEN: usize = 16 * 1024;
+
+/// Connections served at the same time.
+pub(crate) const MAX_CONNECTIONS: usize = 256;
+
+/// Time a client has to send the whole request, and to take the whole response.
+pub(crate) const REQUEST_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// A parsed request.
+pub(crate) struct Request {
+    pub(crate) method: String,
+    /// The request target as sent, path and query, e.g. `/state/output?lines=50`.
+    pub(crate) target: String,
+    headers: Vec<(String, String)>,
+    pub(crate) body: Vec<u8>,
+}
+
+impl Request {
+    /// Returns the value of the header `name`, compared case insensitively.
+    pub(crate) fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|(key, _)| key.eq_ignore_ascii_case(name))
+            .map(|(_, value)| value.as_str())
+    }
+}
+
+/// A response to write back.
+pub(crate) struct Response {
+    status: u16,
+    headers: Vec<(&'static str, String)>,
+    body: Vec<u8>,
+}
+
+impl Response {
+    /// A response with an empty body.
+    pub(crate) fn new(status: u16) -> Self {
+        Self {
+            status,
+            headers: Vec::new(),
+            body: Vec::new(),
+        }
+    }
+
+    /// A plain text response, e.g. an error message.
+    pub(crate) fn text<S: Into<String>>(status: u16, message: S) -> Self {
+        Self::new(status).body("text/plain; charset=utf-8", message.into().into_bytes())
+    }
+
+    /// Adds the header `name`.
+    pub(crate) fn header<V: Into<String>>(mut self, name: &'static str, value: V) -> Self {
+        self.headers.push((name, value.into()));
+        self
+    }
+
+    /// Sets the body and its `Content-Type`.
+    pub(crate) fn body(self, content_type: &str, body: Vec<u8>) -> Self {
+        Self { body, ..self }.header("Content-Type", content_type)
+    }
+
+    fn encode(&self) -> Vec<u8> {
+        let mut head = format!("HTTP/1.1 {} {}\r\n", self.status, reason(self.status));
+        for (name, value) in &self.headers {
+            head.push_str(&format!("{}: {}\r\n", name, value));
+        }
+        head.push_str(&format!(
+            "Content-Length: {}\r\nConnection: close\r\n\r\n",
+            self.body.len()
+        ));
+        let mut data = head.into_bytes();
+        data.extend_from_slice(&self.body);
+        data
+    }
+}
+
+/// Accepts connections on `listener` until the returned task is aborted, answering each
+/// with `handler`. Bodies over `max_body` bytes are refused with `413`.
+pub(crate) fn serve<H>(listener: TcpListener, max_body: u64, handler: H) -> JoinHandle<()>
+where
+    H: Fn(Request) -> Response + Send + Sync + 'static,
+{
+    let handler = Arc::new(handler);
+    let connections = Arc::new(Semaphore::new(MAX_CONNECTIONS));
+    tokio::spawn(async move {
+        loop {
+            let Ok(permit) = Arc::clone(&connections).acquire_owned().await else {
+                break;
+            };
+            match listener.accept().await {
+                Ok((stream, peer)) => {
+                    let handler = Arc::clone(&handler);
+                    tokio::spawn(async move {
+                        let _permit = permit;
+                        if let Err(err) =
+                            handle_connection(stream, max_body, handler.as_ref()).await
+                        {
+                            log!(
+                                LogLevel::Debug,
+                                "HTTP connection from {} failed: {}",
+                                peer,
+                                err
+                            );
+                        }
+                    });
+                }
+                Err(err) => {
+                    log!(LogLevel::Error, "Failed to accept HTTP connection: {}", err);
+                    break;
+                }
+            }
+        }
+    })
+}
+
+async fn handle_connection<H>(mut stream: TcpStream, max_body: u64, handler: &H) -> io::Result<()>
+where
+    H: Fn(Request) -> Response,
+{
+    let response =
+        match tokio::time::timeout(REQUEST_TIMEOUT, read_request(&mut stream, max_body)).await {
+            Ok(request) => match request? {
+                Ok(request) => handler(request),
+                Err(response) => response,
+            },
+            Err(_) => Response::text(408, "request not received in time"),
+        };
+    let write = async {
+        stream.write_all(&response.encode()).await?;
+        stream.shutdown().await
+    };
+    match tokio::time::timeout(REQUEST_TIMEOUT, write).await {
+        Ok(result) => result,
+        Err(_) => Err(io::ErrorKind::TimedOut.into()),
+    }
+}
+
+/// Reads one request. Requests that can't be served produce the response to send instead.
+async fn read_request(
+    stream: &mut TcpStream,
+    max_body: u64,
+) -> io::Result<Result<Request, Response>> {
+    let mut data = Vec::new();
+    let head_end = loop {
+        if let Some(pos) = data.windows(4).position(|window| window == b"\r\n\r\n") {
+            break pos;
+        }
+        if data.len() > MAX_HEAD_LEN {
+            return Ok(Err(Response::text(431, "request header too large")));
+        }
+        let mut buf = [0; 4096];
+        let read = stream.read(&mut buf).await?;
+        if read == 0 {
+            return Err(io::ErrorKind::UnexpectedEof.into());
+        }
+        data.extend_from_slice(&buf[..read]);
+    };
+
+    let head = match std::str::from_utf8(&data[..head_end]) {
+        Ok(head) => head,
+        Err(_) => return Ok(Err(Response::text(400, "request header is not UTF-8"))),
+    };
+    let mut lines = head.split("\r\n");
+    let mut request_line = lines.next().unwrap_or_default().split(' ');
+    let (method, target) = match (request_line.next(), request_line.next()) {
+        (Some(method), Some(target)) if !method.is_empty() => (method, target),
+        _ => return Ok(Err(Response::text(400, "malformed request line"))),
+    };
+    let mut headers = Vec::new();
+    for line in lines {
+        match line.split_once(':') {
+            Some((name, value)) => {
+                headers.push((name.trim().to_string(), value.trim().to_string()))
+            }
+            None => return Ok(Err(Response::text(400, "malformed header"))),
+        }
+    }
+
+    let mut request = Request {
+        method: method.to_string(),
+        target: target.to_string(),
+        headers,
+        body: Vec::new(),
+    };
+    if request.header("Transfer-Encoding").is_some() {
+        return Ok(Err(Response::text(411, "chunked bodies are not supported")));
+    }
+    let len = match content_length(&request) {
+        Ok(len) => len,
+        Err(response) => return Ok(Err(response)),
+    };
+    if max_body > 0 && len > max_body {
+        return Ok(Err(Response::text(413, "request body too large")));
+    }
+
+    let mut body = data.split_off(head_end + 4);
+    if (body.len() as u64) < len {
+        stream
+            .take(len - body.len() as u64)
+            .read_to_end(&mut body)
+            .await?;
+        if (body.len() as u64) < len {
+            return Err(io::ErrorKind::UnexpectedEof.into());
+        }
+    }
+    body.truncate(len as usize);
+    request.body = body;
+    Ok(Ok(request))
+}
+
+/// Returns the body length announced by the request, `0` without a `Content-Length`.
+/// Repeated headers and lists are refused rather than guessed at, since a proxy in front
+/// might pick a different value and see a different request.
+fn content_length(request: &Request) -> Result<u64, Response> {
+    let mut values = request
+        .headers
+        .iter()
+        .filter(|(name, _)| name.eq_ignore_ascii_case("Content-Length"))
+        .map(|(_, value)| value);
+    let len = match (values.next(), values.next()) {
+        (None, _) => return Ok(0),
+        (Some(value), None) => value,
+        (Some(_), Some(_)) => return Err(Response::text(400, "repeated Content-Length")),
+    };
+    // `u64::from_str` accepts a leading `+`, HTTP only digits.
+    match len.bytes().all(|byte| byte.is_ascii_digit()) {
+        true => len
+            .parse()
+            .map_err(|_| Response::text(400, "invalid Content-Length")),
+        false => Err(Response::text(400, "invalid Content-Length")),
+    }
+}
+
+/// Compares without stopping at the first difference, so response times don't reveal how
+/// much of a guessed credential was right.
+pub(crate) fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0, |diff, (x, y)| diff | (x ^ y)) == 0
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        204 => "No Content",
+        400 => "Bad Request",
+        401 => "Unauthorized",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        408 => "Request Timeout",
+        411 => "Length Required",
+        413 => "Payload Too Large",
+        415 => "Unsupported Media Type",
+        431 => "Request Header Fields Too Large",
+        500 => "Internal Server Error",
+        _ => "",
+    }
+}
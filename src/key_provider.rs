@@ -0,0 +1,124 @@
+//! # Key Provider
+//!
+//! Supplies the AES-256 key used by
+//! [`StatePersistence::save_state_encrypted`](crate::state_persistence::StatePersistence::save_state_encrypted)
+//! and
+//! [`StatePersistence::load_state_encrypted`](crate::state_persistence::StatePersistence::load_state_encrypted),
+//! so callers don't have to hold the raw key themselves.
+//!
+//! [`StaticKeyProvider`], [`EnvKeyProvider`] and [`FileKeyProvider`] cover keys held in
+//! memory, in the environment and on disk. Implement [`KeyProvider`] to fetch keys from a
+//! secret manager or KMS instead. Providers are asked for the key on every save and load,
+//! so a rotated key is picked up without touching the call sites.
+
+use std::fmt;
+use std::future::Future;
+use std::path::PathBuf;
+use std::pin::Pin;
+
+use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+
+/// The future returned by [`KeyProvider::key`].
+pub type KeyFuture<'a> = Pin<Box<dyn Future<Output = Result<Vec<u8>, ErrorArrayItem>> + Send + 'a>>;
+
+/// A source of encryption keys, see the [module documentation](crate::key_provider).
+pub trait KeyProvider: Send + Sync {
+    /// Returns the current key. AES-256 needs exactly 32 bytes; the encryption functions
+    /// reject keys of any other length.
+    fn key(&self) -> KeyFuture<'_>;
+}
+
+/// Hands out a key held in memory.
+#[derive(Clone)]
+pub struct StaticKeyProvider {
+    key: Vec<u8>,
+}
+
+impl StaticKeyProvider {
+    /// Provides `key` on every call.
+    pub fn new<K: Into<Vec<u8>>>(key: K) -> Self {
+        Self { key: key.into() }
+    }
+}
+
+impl KeyProvider for StaticKeyProvider {
+    fn key(&self) -> KeyFuture<'_> {
+        Box::pin(async move { Ok(self.key.clone()) })
+    }
+}
+
+impl fmt::Debug for StaticKeyProvider {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("StaticKeyProvider").finish_non_exhaustive()
+    }
+}
+
+/// Reads a hex encoded key from an environment variable, e.g. one injected by the service
+/// manager.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct EnvKeyProvider {
+    var: String,
+}
+
+impl EnvKeyProvider {
+    /// Reads the key from the variable `var` on every call.
+    pub fn new<S: Into<String>>(var: S) -> Self {
+        Self { var: var.into() }
+    }
+}
+
+impl KeyProvider for EnvKeyProvider {
+    fn key(&self) -> KeyFuture<'_> {
+        Box::pin(async move {
+            let value = std::env::var(&self.var).map_err(|err| {
+                ErrorArrayItem::new(
+                    Errors::ConfigParsing,
+                    format!("Encryption key variable {}: {}", self.var, err),
+                )
+            })?;
+            decode_hex_key(value.trim(), &self.var)
+        })
+    }
+}
+
+/// Reads a key from a file, either as the raw bytes or hex encoded. Whitespace around a
+/// hex encoded key is ignored.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FileKeyProvider {
+    path: PathBuf,
+}
+
+impl FileKeyProvider {
+    /// Reads the key from `path` on every call.
+    pub fn new<P: Into<PathBuf>>(path: P) -> Self {
+        Self { path: path.into() }
+    }
+}
+
+impl KeyProvider for FileKeyProvider {
+    fn key(&self) -> KeyFuture<'_> {
+        Box::pin(async move {
+            let data = tokio::fs::read(&self.path).await.map_err(|err| {
+                ErrorArrayItem::new(
+                    Errors::ReadingFile,
+                    format!("Encryption key file {}: {}", self.path.display(), err),
+                )
+            })?;
+            // A 32 byte key stored as hex takes 64 bytes, so the lengths can't be confused.
+            if data.len() == 32 {
+                return Ok(data);
+            }
+            let text = String::from_utf8_lossy(&data);
+            decode_hex_key(text.trim(), &self.path.display().to_string())
+        })
+    }
+}
+
+fn decode_hex_key(value: &str, source: &str) -> Result<Vec<u8>, ErrorArrayItem> {
+    hex::decode(value).map_err(|err| {
+        ErrorArrayItem::new(
+            Errors::InvalidBlockData,
+            format!("Encryption key in {} is not valid hex: {}", source, err),
+        )
+    })
+}
@@ -8,39 +8,93 @@ pub mod api;
 pub mod cli;
 pub mod config;
 pub mod config_bundle;
+#[cfg(target_os = "linux")]
+pub mod config_watch;
 pub mod control;
+pub mod dependency_graph;
+pub mod diff;
 pub mod encryption;
 pub mod enviornment;
 pub mod git_actions;
+pub mod health;
 pub mod historics;
+#[cfg(target_os = "linux")]
+pub(crate) mod http_server;
 pub mod identity;
+pub mod key_provider;
+pub mod lifecycle;
+pub mod logging;
+#[cfg(target_os = "linux")]
+pub mod name_claim;
 #[cfg(target_os = "linux")]
 pub mod network;
 pub mod notifications;
 pub mod portal;
 #[cfg(target_os = "linux")]
 pub mod process_manager;
+pub mod resource_limits;
 #[cfg(target_os = "linux")]
 pub mod resource_monitor;
+#[cfg(unix)]
+pub mod shutdown;
+pub mod state_archive;
+pub mod state_batch;
+#[cfg(unix)]
+pub mod state_broadcast;
+pub mod state_bundle;
+#[cfg(feature = "cbor")]
+pub mod state_cbor;
+pub mod state_cluster;
+pub mod state_delta;
+pub mod state_fs;
+pub mod state_hub;
+pub mod state_index;
+pub mod state_marshal;
+pub mod state_metrics;
+pub mod state_output;
 pub mod state_persistence;
 #[cfg(target_os = "linux")]
+pub mod state_push;
+pub mod state_recovery;
+pub mod state_remote;
+pub mod state_render;
+#[cfg(target_os = "linux")]
+pub mod state_server;
+pub mod state_split;
+pub mod state_store;
+pub mod state_transaction;
+pub mod state_wal;
+pub mod support_bundle;
+#[cfg(target_os = "linux")]
 pub mod systemd;
 pub mod timestamp;
+pub mod tls;
 #[cfg(target_os = "linux")]
 pub mod users;
 pub mod version;
+pub(crate) mod zip;
 
 pub const RELEASEINFO: VersionCode = VersionCode::ReleaseCandidate;
 
 // // tests
 #[path = "../src/tests/encryption.rs"]
 mod encryption_test;
+
+#[path = "../src/tests/key_provider.rs"]
+mod key_provider_test;
+
 #[path = "../src/tests/process_manager.rs"]
 mod process_manager_test;
 
+#[path = "../src/tests/dependency_graph.rs"]
+mod dependency_graph_test;
+
 #[path = "../src/tests/identity.rs"]
 mod identity_test;
 
+#[path = "../src/tests/lifecycle.rs"]
+mod lifecycle_test;
+
 #[path = "../src/tests/git_action.rs"]
 mod git_action_test;
 
@@ -50,10 +104,122 @@ mod notification_test;
 #[path = "../src/tests/state_persistence.rs"]
 mod state_persistence_test;
 
+#[path = "../src/tests/state_store.rs"]
+mod state_store_test;
+
+#[path = "../src/tests/state_transaction.rs"]
+mod state_transaction_test;
+
+#[path = "../src/tests/state_wal.rs"]
+mod state_wal_test;
+
+#[path = "../src/tests/state_fs.rs"]
+mod state_fs_test;
+
+#[path = "../src/tests/timestamp.rs"]
+mod timestamp_test;
+
+#[path = "../src/tests/tls.rs"]
+mod tls_test;
+
+#[cfg(unix)]
+#[path = "../src/tests/state_remote.rs"]
+mod state_remote_test;
+
+#[cfg(unix)]
+#[path = "../src/tests/state_batch.rs"]
+mod state_batch_test;
+
+#[cfg(unix)]
+#[path = "../src/tests/state_broadcast.rs"]
+mod state_broadcast_test;
+
+#[path = "../src/tests/state_archive.rs"]
+mod state_archive_test;
+
+#[path = "../src/tests/state_bundle.rs"]
+mod state_bundle_test;
+
+#[cfg(feature = "cbor")]
+#[path = "../src/tests/state_cbor.rs"]
+mod state_cbor_test;
+
+#[path = "../src/tests/state_hub.rs"]
+mod state_hub_test;
+
+#[path = "../src/tests/state_index.rs"]
+mod state_index_test;
+
+#[path = "../src/tests/state_metrics.rs"]
+mod state_metrics_test;
+
+#[path = "../src/tests/state_render.rs"]
+mod state_render_test;
+
+#[path = "../src/tests/state_split.rs"]
+mod state_split_test;
+
+#[path = "../src/tests/state_output.rs"]
+mod state_output_test;
+
+#[cfg(target_os = "linux")]
+#[path = "../src/tests/state_push.rs"]
+mod state_push_test;
+
+#[cfg(target_os = "linux")]
+#[path = "../src/tests/state_server.rs"]
+mod state_server_test;
+
+#[path = "../src/tests/state_marshal.rs"]
+mod state_marshal_test;
+
+#[cfg(unix)]
+#[path = "../src/tests/shutdown.rs"]
+mod shutdown_test;
+
+#[path = "../src/tests/support_bundle.rs"]
+mod support_bundle_test;
+
+#[path = "../src/tests/config.rs"]
+mod config_test;
+
+#[cfg(target_os = "linux")]
+#[path = "../src/tests/config_watch.rs"]
+mod config_watch_test;
+
 #[cfg(target_os = "linux")]
 #[path = "../src/tests/resource_monitor.rs"]
 mod resource_monitor_test;
 
+#[cfg(target_os = "linux")]
+#[path = "../src/tests/resource_limits.rs"]
+mod resource_limits_test;
+
 #[cfg(target_os = "linux")]
 #[path = "../src/tests/network.rs"]
 mod network_test;
+
+#[path = "../src/tests/state_recovery.rs"]
+mod state_recovery_test;
+
+#[path = "../src/tests/health.rs"]
+mod health_test;
+
+#[path = "../src/tests/state_cluster.rs"]
+mod state_cluster_test;
+
+#[path = "../src/tests/logging.rs"]
+mod logging_test;
+
+#[path = "../src/tests/version.rs"]
+mod version_test;
+
+#[path = "../src/tests/state_delta.rs"]
+mod state_delta_test;
+
+#[cfg(target_os = "linux")]
+#[path = "../src/tests/name_claim.rs"]
+mod name_claim_test;
+
+#[path = "../src/tests/state_fuzz.rs"]
+mod state_fuzz_test;
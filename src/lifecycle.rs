@@ -0,0 +1,357 @@
+//! # Lifecycle
+//!
+//! Drives an [`AppState`] through init, start, stop and restart, leaving the actual process
+//! handling to caller supplied [`Hooks`].
+//!
+//! | Action    | Allowed from                              | Resulting status |
+//! |-----------|-------------------------------------------|------------------|
+//! | `init`    | `Unknown`, `Building`, `Stopped`          | `Stopped`        |
+//! | `start`   | `Stopped`, `Starting`                     | `Running`        |
+//! | `stop`    | `Starting`, `Running`, `Idle`, `Warning`  | `Stopped`        |
+//! | `restart` | `Running`, `Idle`, `Warning`, `Stopped`   | `Running`        |
+//!
+//! Every successful action records an [`Event`](crate::state_persistence::Event), which bumps
+//! [`AppState::event_counter`], and stamps [`AppState::last_updated`]; `start` and
+//! `restart` also stamp [`AppState::started_at`]. A failing hook leaves the state as it was.
+//!
+//! [`replay_events`] derives a state from such a timeline again, e.g. to check that a stored
+//! state matches the events it claims to have gone through.
+
+use std::fmt;
+
+use dusa_collection_utils::core::errors::ErrorArrayItem;
+
+use crate::aggregator::Status;
+use crate::state_persistence::{AppState, Event};
+use crate::timestamp::current_timestamp;
+
+/// A callback run as part of a lifecycle action, e.g. spawning or killing the process.
+pub type Hook = Box<dyn FnMut(&mut AppState) -> Result<(), ErrorArrayItem> + Send>;
+
+/// Callbacks for the [`LifecycleManager`] actions. Missing hooks are skipped.
+#[derive(Default)]
+pub struct Hooks {
+    /// Runs on [`LifecycleManager::init`].
+    pub on_init: Option<Hook>,
+    /// Runs on [`LifecycleManager::start`], and on restart when no `on_restart` is set.
+    pub on_start: Option<Hook>,
+    /// Runs on [`LifecycleManager::stop`], and on restart of a running application when no
+    /// `on_restart` is set.
+    pub on_stop: Option<Hook>,
+    /// Replaces `on_stop` followed by `on_start` on [`LifecycleManager::restart`].
+    pub on_restart: Option<Hook>,
+}
+
+impl fmt::Debug for Hooks {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("Hooks")
+            .field("on_init", &self.on_init.is_some())
+            .field("on_start", &self.on_start.is_some())
+            .field("on_stop", &self.on_stop.is_some())
+            .field("on_restart", &self.on_restart.is_some())
+            .finish()
+    }
+}
+
+/// The actions a [`LifecycleManager`] performs.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LifecycleAction {
+    /// [`LifecycleManager::init`].
+    Init,
+    /// [`LifecycleManager::start`].
+    Start,
+    /// [`LifecycleManager::stop`].
+    Stop,
+    /// [`LifecycleManager::restart`].
+    Restart,
+}
+
+impl LifecycleAction {
+    /// Returns whether the action may be taken from `status`, see the
+    /// [module documentation](crate::lifecycle).
+    pub fn allowed_from(self, status: Status) -> bool {
+        match self {
+            LifecycleAction::Init => {
+                matches!(status, Status::Unknown | Status::Building | Status::Stopped)
+            }
+            LifecycleAction::Start => matches!(status, Status::Stopped | Status::Starting),
+            LifecycleAction::Stop => matches!(
+                status,
+                Status::Starting | Status::Running | Status::Idle | Status::Warning
+            ),
+            LifecycleAction::Restart => matches!(
+                status,
+                Status::Running | Status::Idle | Status::Warning | Status::Stopped
+            ),
+        }
+    }
+
+    /// Returns the status the action leaves the application in.
+    pub fn resulting_status(self) -> Status {
+        match self {
+            LifecycleAction::Init | LifecycleAction::Stop => Status::Stopped,
+            LifecycleAction::Start | LifecycleAction::Restart => Status::Running,
+        }
+    }
+
+    /// Returns the action that records events of `kind`, or `None` if no action does.
+    pub fn from_event(kind: &str) -> Option<Self> {
+        match kind {
+            "initialized" => Some(LifecycleAction::Init),
+            "started" => Some(LifecycleAction::Start),
+            "stopped" => Some(LifecycleAction::Stop),
+            "restarted" => Some(LifecycleAction::Restart),
+            _ => None,
+        }
+    }
+
+    /// Kind of the event recorded once the action succeeds.
+    fn event(self) -> &'static str {
+        match self {
+            LifecycleAction::Init => "initialized",
+            LifecycleAction::Start => "started",
+            LifecycleAction::Stop => "stopped",
+            LifecycleAction::Restart => "restarted",
+        }
+    }
+}
+
+impl fmt::Display for LifecycleAction {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            LifecycleAction::Init => write!(f, "init"),
+            LifecycleAction::Start => write!(f, "start"),
+            LifecycleAction::Stop => write!(f, "stop"),
+            LifecycleAction::Restart => write!(f, "restart"),
+        }
+    }
+}
+
+/// Why a lifecycle action failed.
+#[derive(Debug, Clone)]
+pub enum LifecycleError {
+    /// `action` isn't allowed while the application is `from`.
+    InvalidTransition {
+        /// The attempted action.
+        action: LifecycleAction,
+        /// The status at the time.
+        from: Status,
+    },
+    /// The hook of `action` returned `error`.
+    Hook {
+        /// The action whose hook failed.
+        action: LifecycleAction,
+        /// The error returned by the hook.
+        error: ErrorArrayItem,
+    },
+}
+
+impl fmt::Display for LifecycleError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            LifecycleError::InvalidTransition { action, from } => {
+                write!(f, "cannot {} an application that is {:?}", action, from)
+            }
+            LifecycleError::Hook { action, error } => {
+                write!(f, "{} hook failed: {}", action, error.err_mesg)
+            }
+        }
+    }
+}
+
+impl std::error::Error for LifecycleError {}
+
+/// Why [`replay_events`] rejected an event.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ReplayError {
+    /// The event at `index` is older than the state it was applied to.
+    BeforeInitial {
+        /// Position of the event in the replayed slice.
+        index: usize,
+        /// When the event was recorded.
+        timestamp: u64,
+        /// [`AppState::last_updated`] of the initial state.
+        last_updated: u64,
+    },
+    /// The event at `index` records `action`, which isn't allowed while the application
+    /// is `from`.
+    InvalidTransition {
+        /// Position of the event in the replayed slice.
+        index: usize,
+        /// The action the event records.
+        action: LifecycleAction,
+        /// The status at that point of the replay.
+        from: Status,
+    },
+}
+
+impl fmt::Display for ReplayError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            ReplayError::BeforeInitial {
+                index,
+                timestamp,
+                last_updated,
+            } => write!(
+                f,
+                "event {} at {} precedes the initial state updated at {}",
+                index, timestamp, last_updated
+            ),
+            ReplayError::InvalidTransition {
+                index,
+                action,
+                from,
+            } => write!(
+                f,
+                "event {} can't {} an application that is {:?}",
+                index, action, from
+            ),
+        }
+    }
+}
+
+impl std::error::Error for ReplayError {}
+
+/// Applies `events` to a copy of `initial` the way a [`LifecycleManager`] recorded them and
+/// returns the result.
+///
+/// Events are applied oldest first; events with the same timestamp keep their order in
+/// `events`. Each one is appended to [`AppState::events`], bumps
+/// [`AppState::event_counter`] and stamps [`AppState::last_updated`] with its timestamp.
+/// Events of a [`LifecycleAction`] also move the status like the action does and, when the
+/// application ends up running, stamp [`AppState::started_at`]. Events of other kinds leave
+/// the status alone.
+///
+/// Replaying the events recorded since a trusted copy of a state and comparing the result
+/// with the stored state shows whether either was altered.
+///
+/// # Errors
+/// Returns [`ReplayError::BeforeInitial`] for events older than `initial` and
+/// [`ReplayError::InvalidTransition`] for actions the status at that point doesn't allow.
+pub fn replay_events(initial: &AppState, events: &[Event]) -> Result<AppState, ReplayError> {
+    let mut order: Vec<usize> = (0..events.len()).collect();
+    order.sort_by_key(|&index| events[index].timestamp);
+
+    let mut state = initial.clone();
+    for index in order {
+        let event = &events[index];
+        if event.timestamp < initial.last_updated {
+            return Err(ReplayError::BeforeInitial {
+                index,
+                timestamp: event.timestamp,
+                last_updated: initial.last_updated,
+            });
+        }
+
+        if let Some(action) = LifecycleAction::from_event(&event.kind) {
+            if !action.allowed_from(state.status) {
+                return Err(ReplayError::InvalidTransition {
+                    index,
+                    action,
+                    from: state.status,
+                });
+            }
+            state.status = action.resulting_status();
+            if state.status == Status::Running {
+                state.started_at = event.timestamp;
+            }
+        }
+        state.last_updated = event.timestamp;
+        state.push_event(event.clone());
+    }
+    Ok(state)
+}
+
+/// Owns an [`AppState`] and moves it through its lifecycle, see the
+/// [module documentation](crate::lifecycle) for the transitions.
+#[derive(Debug)]
+pub struct LifecycleManager {
+    state: AppState,
+    hooks: Hooks,
+}
+
+impl LifecycleManager {
+    /// Takes over `state` with the given hooks.
+    pub fn new(state: AppState, hooks: Hooks) -> Self {
+        Self { state, hooks }
+    }
+
+    /// Returns the managed state.
+    pub fn state(&self) -> &AppState {
+        &self.state
+    }
+
+    /// Gives the state back, e.g. to persist it.
+    pub fn into_state(self) -> AppState {
+        self.state
+    }
+
+    /// Prepares a new or stopped application, leaving it [`Status::Stopped`].
+    pub fn init(&mut self) -> Result<(), LifecycleError> {
+        self.transition(LifecycleAction::Init, |hooks, state| {
+            run(&mut hooks.on_init, state)
+        })
+    }
+
+    /// Starts the application, leaving it [`Status::Running`].
+    pub fn start(&mut self) -> Result<(), LifecycleError> {
+        self.transition(LifecycleAction::Start, |hooks, state| {
+            run(&mut hooks.on_start, state)
+        })
+    }
+
+    /// Stops the application, leaving it [`Status::Stopped`].
+    pub fn stop(&mut self) -> Result<(), LifecycleError> {
+        self.transition(LifecycleAction::Stop, |hooks, state| {
+            run(&mut hooks.on_stop, state)
+        })
+    }
+
+    /// Restarts the application, or starts it if it is stopped, leaving it
+    /// [`Status::Running`].
+    pub fn restart(&mut self) -> Result<(), LifecycleError> {
+        self.transition(LifecycleAction::Restart, |hooks, state| {
+            if hooks.on_restart.is_some() {
+                return run(&mut hooks.on_restart, state);
+            }
+            if state.status != Status::Stopped {
+                run(&mut hooks.on_stop, state)?;
+            }
+            run(&mut hooks.on_start, state)
+        })
+    }
+
+    fn transition<F>(&mut self, action: LifecycleAction, hook: F) -> Result<(), LifecycleError>
+    where
+        F: FnOnce(&mut Hooks, &mut AppState) -> Result<(), ErrorArrayItem>,
+    {
+        if !action.allowed_from(self.state.status) {
+            return Err(LifecycleError::InvalidTransition {
+                action,
+                from: self.state.status,
+            });
+        }
+
+        // Hooks work on a copy, so a failure can't leave a half updated state behind.
+        let mut state = self.state.clone();
+        hook(&mut self.hooks, &mut state)
+            .map_err(|error| LifecycleError::Hook { action, error })?;
+
+        let now = current_timestamp();
+        state.status = action.resulting_status();
+        state.last_updated = now;
+        if state.status == Status::Running {
+            state.started_at = now;
+        }
+        state.record_event(action.event(), "");
+        self.state = state;
+        Ok(())
+    }
+}
+
+fn run(hook: &mut Option<Hook>, state: &mut AppState) -> Result<(), ErrorArrayItem> {
+    match hook {
+        Some(hook) => hook(state),
+        None => Ok(()),
+    }
+}
@@ -0,0 +1,179 @@
+//! # Logging
+//!
+//! A [`Logger`] writing records as configured in [`AppConfig::log`] and filtered by
+//! [`AppConfig::log_level`], for services that need a log file or JSON output rather than
+//! the colored console output of the `log!` macro.
+//!
+//! Without an [`output_path`](LogConfig::output_path) records go to standard error. A log
+//! file is rotated once writing a record would take it past
+//! [`max_size_mb`](LogConfig::max_size_mb): `<path>.1` becomes `<path>.2` and so on, the
+//! current file becomes `<path>.1`, and files beyond
+//! [`max_backups`](LogConfig::max_backups) are deleted.
+
+use chrono::{DateTime, SecondsFormat, Utc};
+use dusa_collection_utils::core::logger::LogLevel;
+use std::fmt;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+use crate::config::{log_level_at_least, AppConfig, LogConfig, LogFormat};
+use crate::state_persistence::sibling_path;
+use crate::timestamp::now;
+
+/// Writes log records, see the [module documentation](crate::logging). Safe to share
+/// between threads.
+pub struct Logger {
+    app_name: String,
+    level: LogLevel,
+    format: LogFormat,
+    output: Mutex<Output>,
+}
+
+enum Output {
+    Stderr,
+    File(RotatingFile),
+}
+
+impl Logger {
+    /// Builds the logger described by `cfg`, with the defaults of [`LogConfig`] if
+    /// [`AppConfig::log`] is unset. Opens the log file, creating it if needed.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the log file can't be opened.
+    pub fn from_config(cfg: &AppConfig) -> io::Result<Self> {
+        let log = cfg.log.clone().unwrap_or_default();
+        let output = match &log.output_path {
+            Some(path) => Output::File(RotatingFile::open(path.into(), &log)?),
+            None => Output::Stderr,
+        };
+        Ok(Self {
+            app_name: cfg.app_name.to_string(),
+            level: cfg.log_level.clone(),
+            format: log.format,
+            output: Mutex::new(output),
+        })
+    }
+
+    /// Returns `true` if records of `level` are written.
+    pub fn enabled(&self, level: &LogLevel) -> bool {
+        log_level_at_least(level, &self.level)
+    }
+
+    /// Writes `message` at `level`, or nothing if the level is below the configured one.
+    ///
+    /// # Errors
+    /// Returns an `Err` if writing or rotating the log file fails.
+    pub fn log(&self, level: LogLevel, message: &str) -> io::Result<()> {
+        if !self.enabled(&level) {
+            return Ok(());
+        }
+        let record = self.format_record(&level, message);
+        let mut output = self
+            .output
+            .lock()
+            .unwrap_or_else(|poisoned| poisoned.into_inner());
+        match &mut *output {
+            Output::Stderr => io::stderr().lock().write_all(record.as_bytes()),
+            Output::File(file) => file.write_record(record.as_bytes()),
+        }
+    }
+
+    fn format_record(&self, level: &LogLevel, message: &str) -> String {
+        let timestamp = DateTime::<Utc>::from(now()).to_rfc3339_opts(SecondsFormat::Millis, true);
+        let level = format!("{:?}", level);
+        match self.format {
+            LogFormat::Text => format!(
+                "{} {:<5} {}: {}\n",
+                timestamp, level, self.app_name, message
+            ),
+            LogFormat::Json => {
+                let record = serde_json::json!({
+                    "timestamp": timestamp,
+                    "level": level,
+                    "app": self.app_name,
+                    "message": message,
+                });
+                format!("{}\n", record)
+            }
+        }
+    }
+}
+
+impl fmt::Debug for Logger {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("Logger")
+            .field("app_name", &self.app_name)
+            .field("level", &self.level)
+            .field("format", &self.format)
+            .finish_non_exhaustive()
+    }
+}
+
+/// A log file with size based rotation.
+struct RotatingFile {
+    path: PathBuf,
+    file: File,
+    size: u64,
+    max_size: u64,
+    max_backups: u32,
+}
+
+impl RotatingFile {
+    fn open(path: PathBuf, log: &LogConfig) -> io::Result<Self> {
+        let file = open_append(&path)?;
+        let size = file.metadata()?.len();
+        Ok(Self {
+            path,
+            file,
+            size,
+            max_size: u64::from(log.max_size_mb) * 1024 * 1024,
+            max_backups: log.max_backups,
+        })
+    }
+
+    fn write_record(&mut self, record: &[u8]) -> io::Result<()> {
+        // A record larger than the limit still goes into a file of its own.
+        if self.max_size > 0 && self.size > 0 && self.size + record.len() as u64 > self.max_size {
+            self.rotate()?;
+        }
+        self.file.write_all(record)?;
+        self.size += record.len() as u64;
+        Ok(())
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        let backup = |index: u32| sibling_path(&self.path, &format!(".{}", index));
+        if self.max_backups == 0 {
+            fs::remove_file(&self.path)?;
+        } else {
+            remove_if_exists(&backup(self.max_backups))?;
+            for index in (1..self.max_backups).rev() {
+                rename_if_exists(&backup(index), &backup(index + 1))?;
+            }
+            fs::rename(&self.path, backup(1))?;
+        }
+        self.file = open_append(&self.path)?;
+        self.size = 0;
+        Ok(())
+    }
+}
+
+fn open_append(path: &Path) -> io::Result<File> {
+    OpenOptions::new().create(true).append(true).open(path)
+}
+
+fn remove_if_exists(path: &Path) -> io::Result<()> {
+    match fs::remove_file(path) {
+        Err(err) if err.kind() != io::ErrorKind::NotFound => Err(err),
+        _ => Ok(()),
+    }
+}
+
+fn rename_if_exists(from: &Path, to: &Path) -> io::Result<()> {
+    match fs::rename(from, to) {
+        Err(err) if err.kind() != io::ErrorKind::NotFound => Err(err),
+        _ => Ok(()),
+    }
+}
@@ -0,0 +1,188 @@
+//! # Name Claim
+//!
+//! Keeps two processes sharing a state directory from using the same application name and
+//! overwriting each other's files. [`claim_app_name`] records the claiming PID in
+//! `<dir>/<name>.claim` and hands back a [`NameClaim`] that deletes the file again when it
+//! is released or dropped.
+//!
+//! A claim held by a process that is no longer running is stale and simply taken over, so
+//! a crash never locks a name for good. Claims are checked and written while holding an
+//! exclusive `flock` on `<dir>/<name>.claim.lock`, so two processes reclaiming the same
+//! stale name can't both win.
+
+use std::fmt;
+use std::fs::{self, File, OpenOptions};
+use std::io;
+use std::os::unix::io::AsRawFd;
+use std::path::{Path, PathBuf};
+
+use crate::process_manager::is_pid_active;
+use crate::state_fs::write_atomic;
+use crate::state_persistence::{check_app_name, sibling_path};
+
+/// Returned by [`claim_app_name`].
+#[derive(Debug)]
+pub enum ClaimError {
+    /// `name` is claimed by the running process `pid`.
+    NameTaken { name: String, pid: u32 },
+    /// The claim file couldn't be read or written, or the arguments are invalid.
+    Io(io::Error),
+}
+
+impl fmt::Display for ClaimError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            ClaimError::NameTaken { name, pid } => {
+                write!(f, "application name {:?} is claimed by PID {}", name, pid)
+            }
+            ClaimError::Io(err) => write!(f, "failed to claim application name: {}", err),
+        }
+    }
+}
+
+impl std::error::Error for ClaimError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            ClaimError::NameTaken { .. } => None,
+            ClaimError::Io(err) => Some(err),
+        }
+    }
+}
+
+impl From<io::Error> for ClaimError {
+    fn from(err: io::Error) -> Self {
+        ClaimError::Io(err)
+    }
+}
+
+/// A claimed application name, see [`claim_app_name`]. Dropping it releases the name.
+#[derive(Debug)]
+pub struct NameClaim {
+    path: PathBuf,
+    pid: u32,
+    released: bool,
+}
+
+impl NameClaim {
+    /// Returns the path of the claim file.
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Returns the PID the name is claimed for.
+    pub fn pid(&self) -> u32 {
+        self.pid
+    }
+
+    /// Releases the name, like dropping the claim but reporting failures. A claim file
+    /// that was taken over by another PID in the meantime is left alone.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the claim file can't be read or deleted.
+    pub fn release(mut self) -> io::Result<()> {
+        self.released = true;
+        release_claim(&self.path, self.pid)
+    }
+}
+
+impl Drop for NameClaim {
+    fn drop(&mut self) {
+        if !self.released {
+            let _ = release_claim(&self.path, self.pid);
+        }
+    }
+}
+
+/// Claims `name` in the state directory `dir` for the process `pid`.
+///
+/// Claiming succeeds if the name is unclaimed, if it is claimed by a process that isn't
+/// running any more, or if it is already claimed by `pid` itself, e.g. a PID reused after
+/// a reboot. In the last case both claims share the file, and releasing either releases
+/// the name.
+///
+/// # Errors
+/// - Returns [`ClaimError::NameTaken`] if another running process holds the name.
+/// - Returns [`ClaimError::Io`] if `name` isn't a plain file name, `pid` is `0`, or the
+///   claim file can't be read or written.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::name_claim::claim_app_name;
+/// # fn run() -> Result<(), Box<dyn std::error::Error>> {
+/// let claim = claim_app_name("/var/lib/artisan".as_ref(), "billing-api", std::process::id())?;
+/// // ... run the application, writing /var/lib/artisan/billing-api.state ...
+/// claim.release()?;
+/// # Ok(())
+/// # }
+/// ```
+pub fn claim_app_name(dir: &Path, name: &str, pid: u32) -> Result<NameClaim, ClaimError> {
+    check_app_name(name)?;
+    if pid == 0 {
+        return Err(invalid_input("PID 0 can't claim a name".to_string()).into());
+    }
+
+    let path = dir.join(format!("{}.claim", name));
+    let _lock = lock_claim(&path)?;
+    if let Some(holder) = read_claim(&path)? {
+        if holder != pid && holder_alive(holder)? {
+            return Err(ClaimError::NameTaken {
+                name: name.to_string(),
+                pid: holder,
+            });
+        }
+    }
+
+    // A claim only matters while its holder runs, so it needn't survive a crash.
+    write_atomic(&path, format!("{}\n", pid).as_bytes(), None, false)?;
+    Ok(NameClaim {
+        path,
+        pid,
+        released: false,
+    })
+}
+
+/// Deletes the claim at `path` if it still belongs to `pid`.
+fn release_claim(path: &Path, pid: u32) -> io::Result<()> {
+    let _lock = lock_claim(path)?;
+    if read_claim(path)? != Some(pid) {
+        return Ok(());
+    }
+    match fs::remove_file(path) {
+        Err(err) if err.kind() != io::ErrorKind::NotFound => Err(err),
+        _ => Ok(()),
+    }
+}
+
+/// Takes the exclusive lock guarding the claim at `path`, released when the file closes.
+fn lock_claim(path: &Path) -> io::Result<File> {
+    let lock = OpenOptions::new()
+        .create(true)
+        .write(true)
+        .open(sibling_path(path, ".lock"))?;
+    if unsafe { libc::flock(lock.as_raw_fd(), libc::LOCK_EX) } != 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(lock)
+}
+
+/// Returns the PID recorded in the claim at `path`, `None` if there is no claim. A claim
+/// that doesn't hold a PID can't belong to a running process and counts as none.
+fn read_claim(path: &Path) -> io::Result<Option<u32>> {
+    match fs::read_to_string(path) {
+        Ok(content) => Ok(content.trim().parse().ok().filter(|pid| *pid != 0)),
+        Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(err) => Err(err),
+    }
+}
+
+fn holder_alive(pid: u32) -> io::Result<bool> {
+    match i32::try_from(pid) {
+        Ok(pid) => is_pid_active(pid),
+        // No process can have a PID beyond the range of pid_t.
+        Err(_) => Ok(false),
+    }
+}
+
+fn invalid_input(message: String) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidInput, message)
+}
@@ -740,6 +740,42 @@ pub fn is_pid_active(pid: i32) -> io::Result<bool> {
     }
 }
 
+/// Checks whether the process recorded in `state.pid` is still running, see
+/// [`is_pid_active`]. A PID of `0` means the state was never attached to a process and is
+/// reported as not alive.
+///
+/// Note that an exited child which hasn't been reaped yet still counts as alive.
+///
+/// # Errors
+/// Returns an `Err` if the PID is out of range or the check fails for another reason.
+pub fn is_process_alive(state: &AppState) -> io::Result<bool> {
+    if state.pid == 0 {
+        return Ok(false);
+    }
+    let pid = i32::try_from(state.pid).map_err(|_| {
+        io::Error::new(
+            io::ErrorKind::InvalidInput,
+            format!("PID {} is out of range", state.pid),
+        )
+    })?;
+    is_pid_active(pid)
+}
+
+/// Polls [`is_process_alive`] every `interval` and resolves once the process in
+/// `state.pid` has exited.
+///
+/// To give up waiting, drop the future, e.g. by wrapping it in [`tokio::time::timeout`] or
+/// racing it against a shutdown signal in `tokio::select!`.
+///
+/// # Errors
+/// Returns an `Err` if a liveness check fails.
+pub async fn wait_for_process(state: &AppState, interval: Duration) -> io::Result<()> {
+    while is_process_alive(state)? {
+        tokio::time::sleep(interval).await;
+    }
+    Ok(())
+}
+
 use bytes::BytesMut;
 
 async fn read_stream_to_buffer<R>(mut reader: R, buffer: LockWithTimeout<RollingBuffer>)
@@ -0,0 +1,139 @@
+//! # Resource Limits
+//!
+//! Checks a running process against the [`AppConfig::max_ram_usage`] and
+//! [`AppConfig::max_cpu_usage`] limits.
+//!
+//! Usage is read from `/proc/<pid>` and is only available on Linux. On other platforms
+//! [`check_resource_usage`] fails with [`io::ErrorKind::Unsupported`].
+
+use std::io;
+
+use crate::config::AppConfig;
+
+/// Resource usage of a process compared against the configured limits.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct ResourceReport {
+    /// Resident set size in bytes.
+    pub ram_bytes: u64,
+    /// CPU time used over the lifetime of the process, as a percentage of one core.
+    pub cpu_percent: f64,
+    /// `true` if `ram_bytes` is above [`AppConfig::max_ram_usage`].
+    pub ram_exceeded: bool,
+    /// `true` if `cpu_percent` is above [`AppConfig::max_cpu_usage`].
+    pub cpu_exceeded: bool,
+}
+
+impl ResourceReport {
+    /// Returns `true` if any limit is exceeded.
+    pub fn exceeded(&self) -> bool {
+        self.ram_exceeded || self.cpu_exceeded
+    }
+}
+
+/// Measures the RAM and CPU usage of `pid` and compares it with the limits in `cfg`.
+/// A limit of `0` means unlimited and is never exceeded.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::config::AppConfig;
+/// # use artisan_middleware::resource_limits::check_resource_usage;
+/// # fn check(cfg: &AppConfig) -> std::io::Result<()> {
+/// let report = check_resource_usage(cfg, std::process::id())?;
+/// if report.exceeded() {
+///     eprintln!("over quota: {:?}", report);
+/// }
+/// # Ok(())
+/// # }
+/// ```
+///
+/// # Errors
+/// Returns an `Err` of kind [`io::ErrorKind::NotFound`] if the process doesn't exist,
+/// [`io::ErrorKind::InvalidData`] if `/proc` can't be parsed and
+/// [`io::ErrorKind::Unsupported`] on platforms other than Linux.
+pub fn check_resource_usage(cfg: &AppConfig, pid: u32) -> io::Result<ResourceReport> {
+    let (ram_bytes, cpu_percent) = imp::usage(pid)?;
+
+    Ok(ResourceReport {
+        ram_bytes,
+        cpu_percent,
+        ram_exceeded: cfg.max_ram_usage > 0 && ram_bytes > cfg.max_ram_bytes(),
+        cpu_exceeded: cfg.max_cpu_usage > 0 && cpu_percent > cfg.max_cpu_usage as f64,
+    })
+}
+
+#[cfg(target_os = "linux")]
+mod imp {
+    use std::io;
+
+    /// Returns the resident set size in bytes and the lifetime CPU percentage of `pid`.
+    pub(super) fn usage(pid: u32) -> io::Result<(u64, f64)> {
+        let status = std::fs::read_to_string(format!("/proc/{}/status", pid))?;
+        let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid))?;
+        let uptime = std::fs::read_to_string("/proc/uptime")?;
+
+        // Kernel threads have no VmRSS line.
+        let ram_bytes = match status.lines().find(|line| line.starts_with("VmRSS:")) {
+            Some(line) => {
+                let kib: u64 = line
+                    .split_whitespace()
+                    .nth(1)
+                    .and_then(|value| value.parse().ok())
+                    .ok_or_else(|| invalid(format!("invalid VmRSS line: {}", line)))?;
+                kib * 1024
+            }
+            None => 0,
+        };
+
+        // The command name in parentheses may contain spaces, so split after it.
+        let fields: Vec<&str> = stat
+            .rsplit_once(')')
+            .map(|(_, rest)| rest.split_whitespace().collect())
+            .ok_or_else(|| invalid(format!("invalid stat for pid {}", pid)))?;
+        // Fields after the command name start at field 3 (state); utime is 14, stime 15
+        // and starttime 22, see proc(5).
+        let field = |index: usize| -> io::Result<f64> {
+            fields
+                .get(index - 3)
+                .and_then(|value| value.parse().ok())
+                .ok_or_else(|| invalid(format!("missing stat field {} for pid {}", index, pid)))
+        };
+        let cpu_ticks = field(14)? + field(15)?;
+        let start_ticks = field(22)?;
+
+        let system_uptime: f64 = uptime
+            .split_whitespace()
+            .next()
+            .and_then(|value| value.parse().ok())
+            .ok_or_else(|| invalid("invalid /proc/uptime".to_string()))?;
+
+        let ticks_per_second = unsafe { libc::sysconf(libc::_SC_CLK_TCK) } as f64;
+        if ticks_per_second <= 0.0 {
+            return Err(invalid("unable to read clock ticks per second".to_string()));
+        }
+
+        let running = system_uptime - start_ticks / ticks_per_second;
+        let cpu_percent = if running > 0.0 {
+            cpu_ticks / ticks_per_second / running * 100.0
+        } else {
+            0.0
+        };
+
+        Ok((ram_bytes, cpu_percent))
+    }
+
+    fn invalid(message: String) -> io::Error {
+        io::Error::new(io::ErrorKind::InvalidData, message)
+    }
+}
+
+#[cfg(not(target_os = "linux"))]
+mod imp {
+    use std::io;
+
+    pub(super) fn usage(_pid: u32) -> io::Result<(u64, f64)> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            "resource usage checks are only supported on linux",
+        ))
+    }
+}
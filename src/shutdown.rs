@@ -0,0 +1,135 @@
+//! # Shutdown
+//!
+//! Flushes a final [`AppState`] to disk when the process is asked to terminate.
+//!
+//! [`install_shutdown_handler`] listens for the given signals on the tokio runtime. On the
+//! first one it saves the state returned by the getter, marked [`Status::Stopped`] and
+//! stamped with the current time, then exits the process with the conventional
+//! `128 + signal` exit code.
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::core::types::pathtype::PathType;
+use dusa_collection_utils::log;
+use std::io;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use tokio::signal::unix::{signal, SignalKind};
+
+use crate::aggregator::Status;
+use crate::state_fs::OsFileSystem;
+use crate::state_persistence::{AppState, StatePersistence};
+use crate::timestamp::current_timestamp;
+
+/// Returned by [`install_shutdown_handler`].
+#[derive(Debug, Clone)]
+pub struct ShutdownHandle {
+    enabled: Arc<AtomicBool>,
+}
+
+impl ShutdownHandle {
+    /// Stops saving the state on shutdown.
+    ///
+    /// Tokio can't hand a signal back to its default disposition once it has been
+    /// registered, so the handler keeps running and still exits the process when a signal
+    /// arrives; it just skips the save.
+    pub fn cancel(&self) {
+        self.enabled.store(false, Ordering::SeqCst);
+    }
+
+    /// Returns `true` until [`ShutdownHandle::cancel`] is called.
+    pub fn is_active(&self) -> bool {
+        self.enabled.load(Ordering::SeqCst)
+    }
+}
+
+/// Saves `get()` to `path` when any of `signals` (e.g. `libc::SIGTERM`) is received, then
+/// exits the process.
+///
+/// The saved copy has its status set to [`Status::Stopped`] and `last_updated` set to now.
+/// It is written to a temporary file and renamed into place, so an interrupted save never
+/// leaves a truncated state behind.
+///
+/// Must be called from within a tokio runtime.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::shutdown::install_shutdown_handler;
+/// # use artisan_middleware::state_store::StateStore;
+/// # use dusa_collection_utils::core::types::pathtype::PathType;
+/// # fn run(store: StateStore, path: PathType) -> std::io::Result<()> {
+/// let handle = install_shutdown_handler(
+///     path,
+///     move || store.snapshot(),
+///     &[libc::SIGTERM, libc::SIGINT],
+/// )?;
+/// # Ok(())
+/// # }
+/// ```
+///
+/// # Errors
+/// Returns an `Err` if a signal handler can't be registered.
+pub fn install_shutdown_handler<F>(
+    path: PathType,
+    get: F,
+    signals: &[i32],
+) -> io::Result<ShutdownHandle>
+where
+    F: Fn() -> AppState + Send + Sync + 'static,
+{
+    install_with_exit(path, get, signals, |code| std::process::exit(code))
+}
+
+/// [`install_shutdown_handler`] with a replaceable exit function, so tests don't take the
+/// test runner down with them.
+pub(crate) fn install_with_exit<F>(
+    path: PathType,
+    get: F,
+    signals: &[i32],
+    exit: fn(i32),
+) -> io::Result<ShutdownHandle>
+where
+    F: Fn() -> AppState + Send + Sync + 'static,
+{
+    let mut streams = Vec::with_capacity(signals.len());
+    for &signo in signals {
+        streams.push((signo, signal(SignalKind::from_raw(signo))?));
+    }
+
+    let handle = ShutdownHandle {
+        enabled: Arc::new(AtomicBool::new(true)),
+    };
+    let enabled = Arc::clone(&handle.enabled);
+    let get = Arc::new(get);
+    // Serializes the handlers, so a second signal can't exit while the first one is saving.
+    let saving = Arc::new(Mutex::new(()));
+
+    for (signo, mut stream) in streams {
+        let enabled = Arc::clone(&enabled);
+        let get = Arc::clone(&get);
+        let saving = Arc::clone(&saving);
+        let path = path.clone();
+        tokio::spawn(async move {
+            if stream.recv().await.is_none() {
+                return;
+            }
+            log!(LogLevel::Info, "Received signal {}, shutting down", signo);
+
+            let _guard = saving
+                .lock()
+                .unwrap_or_else(|poisoned| poisoned.into_inner());
+            if enabled.swap(false, Ordering::SeqCst) {
+                let mut state = get();
+                state.status = Status::Stopped;
+                state.last_updated = current_timestamp();
+                match StatePersistence::save_state_fs(&OsFileSystem, &state, &path) {
+                    Ok(()) => log!(LogLevel::Info, "Final state saved to {}", path),
+                    Err(err) => log!(LogLevel::Error, "Failed to save final state: {}", err),
+                }
+            }
+
+            exit(128 + signo);
+        });
+    }
+
+    Ok(handle)
+}
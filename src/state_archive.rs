@@ -0,0 +1,173 @@
+//! # State Archive
+//!
+//! Bundles the state files of a directory into one zip archive, e.g. to attach the history
+//! of a host to a support ticket, and unpacks such archives again.
+//!
+//! Every state file is stored byte for byte under its original name, so extracted files
+//! load exactly like the originals. Next to them the archive holds a [`MANIFEST_NAME`]
+//! entry with an [`ArchiveManifest`] describing its content.
+//!
+//! Both directions work on the filesystem synchronously; call them from
+//! [`tokio::task::spawn_blocking`] inside async code.
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::log;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io::{self, BufWriter};
+use std::path::Path;
+
+use crate::state_persistence::{
+    check_app_name, check_state_size, state_text, AppState, StateFormat,
+};
+use crate::timestamp::current_timestamp;
+use crate::zip::{read_zip, ZipWriter};
+
+/// Name of the manifest entry inside an archive.
+pub const MANIFEST_NAME: &str = "manifest.json";
+
+/// Describes the content of a state archive.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ArchiveManifest {
+    /// Unix timestamp (seconds) at which the archive was written.
+    pub created_at: u64,
+    /// Number of state files in the archive.
+    pub file_count: usize,
+    /// One entry per state file, sorted by file name.
+    pub states: Vec<ArchivedState>,
+}
+
+/// A state file listed in an [`ArchiveManifest`].
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ArchivedState {
+    /// Name of the file inside the archive, and of the original file.
+    pub file: String,
+    /// [`AppState::name`] of the stored state.
+    pub name: String,
+    /// [`AppState::last_updated`] of the stored state.
+    pub last_updated: u64,
+}
+
+/// Writes every state file directly inside `dir` for which `filter` returns `true` into a
+/// zip archive at `dest`, along with a manifest, and returns that manifest.
+///
+/// State files are recognised by the extensions in [`StateFormat::SUPPORTED_EXTENSIONS`].
+/// Files that can't be decoded are logged and left out, since `filter` can't judge them.
+///
+/// # Errors
+/// Returns an `Err` if `dir` can't be listed, a file can't be read or `dest` can't be
+/// written.
+pub fn archive_states<F>(dir: &Path, dest: &Path, filter: F) -> io::Result<ArchiveManifest>
+where
+    F: Fn(&AppState) -> bool,
+{
+    let mut paths = Vec::new();
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_file() && StateFormat::from_path(&path).is_some() {
+            paths.push(path);
+        }
+    }
+    paths.sort();
+
+    let mut files = Vec::new();
+    let mut states = Vec::new();
+    for path in paths {
+        let data = fs::read(&path)?;
+        let state = match decode_state_file(&path, data.clone()) {
+            Ok(state) => state,
+            Err(err) => {
+                log!(
+                    LogLevel::Warn,
+                    "Leaving {} out of the archive: {}",
+                    path.display(),
+                    err
+                );
+                continue;
+            }
+        };
+        if !filter(&state) {
+            continue;
+        }
+
+        let file = path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .ok_or_else(|| {
+                io::Error::new(
+                    io::ErrorKind::InvalidData,
+                    format!("{} has no UTF-8 file name", path.display()),
+                )
+            })?
+            .to_string();
+        states.push(ArchivedState {
+            file: file.clone(),
+            name: state.name,
+            last_updated: state.last_updated,
+        });
+        files.push((file, data));
+    }
+
+    let manifest = ArchiveManifest {
+        created_at: current_timestamp(),
+        file_count: files.len(),
+        states,
+    };
+
+    let mut zip = ZipWriter::new(BufWriter::new(fs::File::create(dest)?), manifest.created_at);
+    zip.add(MANIFEST_NAME, &serde_json::to_vec_pretty(&manifest)?)?;
+    for (name, data) in &files {
+        zip.add(name, data)?;
+    }
+    zip.finish()?;
+
+    Ok(manifest)
+}
+
+/// Unpacks the state files of the archive at `src` into `dir`, creating it if needed and
+/// replacing files of the same name, and returns the archive's manifest. The manifest
+/// itself is not written out.
+///
+/// # Errors
+/// Returns an `Err` of kind [`io::ErrorKind::InvalidData`] if `src` is not a valid archive,
+/// has no manifest or an entry name that isn't a plain file name, before anything is
+/// written, and passes filesystem errors through.
+pub fn extract_archive(src: &Path, dir: &Path) -> io::Result<ArchiveManifest> {
+    let entries = read_zip(&fs::read(src)?)?;
+
+    let mut manifest = None;
+    let mut files = Vec::new();
+    for (name, data) in entries {
+        if name == MANIFEST_NAME {
+            manifest = Some(serde_json::from_slice::<ArchiveManifest>(&data)?);
+        } else if check_app_name(&name).is_ok() {
+            files.push((name, data));
+        } else {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("refusing to extract archive entry {:?}", name),
+            ));
+        }
+    }
+    let manifest = manifest.ok_or_else(|| {
+        io::Error::new(
+            io::ErrorKind::InvalidData,
+            format!("{} has no {}", src.display(), MANIFEST_NAME),
+        )
+    })?;
+
+    fs::create_dir_all(dir)?;
+    for (name, data) in files {
+        fs::write(dir.join(name), data)?;
+    }
+
+    Ok(manifest)
+}
+
+fn decode_state_file(path: &Path, data: Vec<u8>) -> Result<AppState, Box<dyn std::error::Error>> {
+    check_state_size(data.len() as u64)?;
+    let content = state_text(data)?;
+    StateFormat::from_path(path)
+        .unwrap_or(StateFormat::Encrypted)
+        .decode(&content)
+}
@@ -0,0 +1,449 @@
+//! # State Batch
+//!
+//! Saving and loading many [`AppState`]s at once, for supervisors that manage a whole
+//! directory of applications. Each state lives in `<dir>/<name>.state`, in the same
+//! format as [`StatePersistence::save_state`](crate::state_persistence::StatePersistence::save_state).
+//!
+//! Files are processed in parallel on tokio's blocking pool. A failure on one file never
+//! stops the others; all failures are collected into a single [`MultiError`].
+//!
+//! [`gc_state_directory`] removes the files of applications that are no longer managed,
+//! [`gc_stale_states`] the ones of applications that have been stopped for a long time.
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::log;
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::Semaphore;
+use tokio::task::JoinSet;
+
+use crate::aggregator::Status;
+use crate::state_fs::{sync_directory, write_atomic};
+use crate::state_persistence::{
+    check_app_name, check_state_size, decode_state, encode_state, read_state_file, state_text,
+    AppState, StateFormat, StateHeader,
+};
+use crate::timestamp::current_timestamp;
+
+/// File extension used for state files inside a state directory.
+pub const STATE_FILE_EXTENSION: &str = "state";
+
+/// Default number of files processed at the same time.
+pub const DEFAULT_BATCH_CONCURRENCY: usize = 8;
+
+/// Collects the per-file failures of a batch operation.
+#[derive(Debug, Default)]
+pub struct MultiError {
+    /// The file that failed and why, in no particular order.
+    pub errors: Vec<(PathBuf, io::Error)>,
+}
+
+impl MultiError {
+    /// Returns `true` if no file failed.
+    pub fn is_empty(&self) -> bool {
+        self.errors.is_empty()
+    }
+
+    /// Returns the number of files that failed.
+    pub fn len(&self) -> usize {
+        self.errors.len()
+    }
+}
+
+impl fmt::Display for MultiError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{} state file(s) failed", self.errors.len())?;
+        for (path, err) in &self.errors {
+            write!(f, "\n  {}: {}", path.display(), err)?;
+        }
+        Ok(())
+    }
+}
+
+impl std::error::Error for MultiError {}
+
+/// Returns the path `state` is stored at inside `dir`. The name isn't checked; the
+/// batch writers reject names that aren't a plain file name before using this path.
+pub fn state_file_path(dir: &Path, state: &AppState) -> PathBuf {
+    dir.join(format!("{}.{}", state.name, STATE_FILE_EXTENSION))
+}
+
+/// Writes every state to `<dir>/<state.name>.state`, processing at most `concurrency`
+/// files at a time (`0` behaves like `1`).
+///
+/// Each file is written to a temporary sibling first and renamed into place, so readers
+/// never observe a half written state. On unix the file is created with permissions `mode`;
+/// elsewhere `mode` is ignored.
+///
+/// # Errors
+/// Returns a [`MultiError`] listing every state that could not be written, including
+/// states whose name isn't a plain file name and states sharing their name with another
+/// one; none of the states of a duplicated name are written. The other states are still
+/// written.
+pub async fn save_state_directory(
+    dir: &Path,
+    states: &[AppState],
+    mode: u32,
+    concurrency: usize,
+) -> Result<(), MultiError> {
+    let mut counts: HashMap<&str, usize> = HashMap::new();
+    for state in states {
+        *counts.entry(state.name.as_str()).or_default() += 1;
+    }
+
+    let jobs = states.iter().map(|state| {
+        let path = state_file_path(dir, state);
+        let checked = match counts[state.name.as_str()] {
+            1 => check_app_name(&state.name),
+            _ => Err(io::Error::new(
+                io::ErrorKind::InvalidInput,
+                format!("application name {:?} is used more than once", state.name),
+            )),
+        };
+        let state = state.clone();
+        (path.clone(), move || {
+            checked?;
+            write_state_file(&path, &state, Some(mode), false)
+        })
+    });
+
+    let (_, errors) = run_blocking(jobs, concurrency).await;
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// When [`save_state_batch`] flushes what it wrote to stable storage.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum SyncMode {
+    /// Leave flushing to the operating system.
+    Never,
+    /// `fsync` every file before renaming it into place.
+    EachFile,
+    /// `fsync` the directory once after all files were renamed, which makes the renames
+    /// durable with a single call instead of one per file.
+    DirectoryOnce,
+}
+
+/// Options for [`save_state_batch`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct BatchSaveOptions {
+    /// Permissions of the written files on unix.
+    pub mode: u32,
+    /// Number of files written at the same time; `0` behaves like `1`.
+    pub concurrency: usize,
+    /// When to flush to stable storage.
+    pub sync: SyncMode,
+}
+
+impl Default for BatchSaveOptions {
+    fn default() -> Self {
+        Self {
+            mode: 0o644,
+            concurrency: DEFAULT_BATCH_CONCURRENCY,
+            sync: SyncMode::DirectoryOnce,
+        }
+    }
+}
+
+/// Writes every state to `<dir>/<key>.state`, where `key` is its entry in `states`.
+/// Like [`save_state_directory`] each file is replaced atomically and one failure doesn't
+/// stop the other writes; `opts.sync` controls how the result is flushed.
+///
+/// # Errors
+/// Returns a [`MultiError`] listing every file that failed, including keys that aren't a
+/// plain file name and the directory itself if the final directory sync fails.
+pub async fn save_state_batch(
+    dir: &Path,
+    states: &BTreeMap<String, AppState>,
+    opts: BatchSaveOptions,
+) -> Result<(), MultiError> {
+    let sync_files = opts.sync == SyncMode::EachFile;
+    let jobs = states.iter().map(|(name, state)| {
+        let path = dir.join(format!("{}.{}", name, STATE_FILE_EXTENSION));
+        let state = state.clone();
+        let mode = opts.mode;
+        let checked = check_app_name(name);
+        (path.clone(), move || {
+            checked?;
+            write_state_file(&path, &state, Some(mode), sync_files)
+        })
+    });
+
+    let (_, mut errors) = run_blocking(jobs, opts.concurrency).await;
+    if opts.sync == SyncMode::DirectoryOnce {
+        let dir_path = dir.to_path_buf();
+        let synced = tokio::task::spawn_blocking(move || sync_directory(&dir_path))
+            .await
+            .unwrap_or_else(|err| Err(io::Error::new(io::ErrorKind::Other, err)));
+        if let Err(err) = synced {
+            errors.errors.push((dir.to_path_buf(), err));
+        }
+    }
+
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// Loads every `*.state` file in `dir`, processing at most `concurrency` files at a time
+/// (`0` behaves like `1`). The states are returned sorted by name.
+///
+/// # Errors
+/// Returns a [`MultiError`] if the directory can't be listed or any file fails to load.
+pub async fn load_state_directory(
+    dir: &Path,
+    concurrency: usize,
+) -> Result<Vec<AppState>, MultiError> {
+    let paths = list_state_files(dir).await.map_err(|err| MultiError {
+        errors: vec![(dir.to_path_buf(), err)],
+    })?;
+
+    let jobs = paths.into_iter().map(|path| {
+        let job_path = path.clone();
+        (path, move || load_state_file(&job_path))
+    });
+
+    let (mut states, errors) = run_blocking(jobs, concurrency).await;
+    if !errors.is_empty() {
+        return Err(errors);
+    }
+    states.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(states)
+}
+
+/// Sets the status of every application in `dir` for which `filter` returns `true`, e.g.
+/// to mark a whole host stopped for maintenance, processing at most `concurrency` files at
+/// a time (`0` behaves like `1`). Updated states get [`AppState::last_updated`] stamped
+/// and are written back atomically, keeping the permissions of the file they replace.
+///
+/// Returns the paths of the updated files, sorted, together with the files that failed to
+/// load or save. States rejected by `filter` are left untouched and not listed.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::aggregator::Status;
+/// # use artisan_middleware::state_batch::set_status_for_all;
+/// # async fn maintenance(dir: &std::path::Path) {
+/// let (stopped, errors) =
+///     set_status_for_all(dir, Status::Stopped, |state| state.status == Status::Running, 8)
+///         .await;
+/// if !errors.is_empty() {
+///     eprintln!("{}", errors);
+/// }
+/// # }
+/// ```
+pub async fn set_status_for_all<F>(
+    dir: &Path,
+    status: Status,
+    filter: F,
+    concurrency: usize,
+) -> (Vec<PathBuf>, MultiError)
+where
+    F: Fn(&AppState) -> bool + Send + Sync + 'static,
+{
+    let paths = match list_state_files(dir).await {
+        Ok(paths) => paths,
+        Err(err) => {
+            let errors = MultiError {
+                errors: vec![(dir.to_path_buf(), err)],
+            };
+            return (Vec::new(), errors);
+        }
+    };
+
+    let filter = Arc::new(filter);
+    let jobs = paths.into_iter().map(|path| {
+        let filter = Arc::clone(&filter);
+        (path.clone(), move || {
+            let mut state = load_state_file(&path)?;
+            if !filter(&state) {
+                return Ok(None);
+            }
+            state.status = status;
+            state.last_updated = current_timestamp();
+            write_state_file(&path, &state, None, false)?;
+            Ok(Some(path))
+        })
+    });
+
+    let (updated, errors) = run_blocking(jobs, concurrency).await;
+    let mut updated: Vec<PathBuf> = updated.into_iter().flatten().collect();
+    updated.sort();
+    (updated, errors)
+}
+
+/// Returns the state files in `dir` whose stored [`AppState::name`] is not in `known_names`,
+/// without deleting anything. Files that can't be read or decrypted are logged and skipped,
+/// since there is no way to tell who they belong to.
+///
+/// # Errors
+/// Returns an `Err` if the directory can't be listed.
+pub async fn list_orphaned_states(dir: &Path, known_names: &[&str]) -> io::Result<Vec<PathBuf>> {
+    let orphaned = read_headers(dir)
+        .await?
+        .into_iter()
+        .filter(|(_, header)| !known_names.contains(&header.name.as_str()))
+        .map(|(path, _)| path)
+        .collect();
+    Ok(orphaned)
+}
+
+/// Deletes the state files found by [`list_orphaned_states`] and returns their paths.
+///
+/// # Errors
+/// Returns an `Err` if the directory can't be listed or a file can't be removed.
+/// Files removed before the failure stay removed.
+pub async fn gc_state_directory(dir: &Path, known_names: &[&str]) -> io::Result<Vec<PathBuf>> {
+    let orphaned = list_orphaned_states(dir, known_names).await?;
+    remove_state_files(&orphaned, "orphaned").await?;
+    Ok(orphaned)
+}
+
+/// Finds state files in `dir` whose application is [`Status::Stopped`] and whose
+/// [`AppState::last_updated`] is older than `max_age`, and deletes them unless `dry_run`
+/// is set. Returns the paths that were (or, in a dry run, would be) removed.
+///
+/// Unreadable files are logged and skipped, as in [`list_orphaned_states`].
+///
+/// # Errors
+/// Returns an `Err` if the directory can't be listed or a file can't be removed.
+/// Files removed before the failure stay removed.
+pub async fn gc_stale_states(
+    dir: &Path,
+    max_age: Duration,
+    dry_run: bool,
+) -> io::Result<Vec<PathBuf>> {
+    let cutoff = current_timestamp().saturating_sub(max_age.as_secs());
+    let stale: Vec<PathBuf> = read_headers(dir)
+        .await?
+        .into_iter()
+        .filter(|(_, header)| header.status == Status::Stopped && header.last_updated < cutoff)
+        .map(|(path, _)| path)
+        .collect();
+
+    if !dry_run {
+        remove_state_files(&stale, "stale").await?;
+    }
+    Ok(stale)
+}
+
+/// Reads the [`StateHeader`] of every state file in `dir`, logging and skipping the ones
+/// that can't be read or decrypted.
+async fn read_headers(dir: &Path) -> io::Result<Vec<(PathBuf, StateHeader)>> {
+    let mut headers = Vec::new();
+    for path in list_state_files(dir).await? {
+        let header: StateHeader = match read_state_file(&path)
+            .await
+            .map_err(|err| err.into())
+            .and_then(|content| decode_state(&content))
+        {
+            Ok(header) => header,
+            Err(err) => {
+                log!(
+                    LogLevel::Warn,
+                    "Skipping unreadable state file {}: {}",
+                    path.display(),
+                    err
+                );
+                continue;
+            }
+        };
+        headers.push((path, header));
+    }
+    Ok(headers)
+}
+
+async fn remove_state_files(paths: &[PathBuf], reason: &str) -> io::Result<()> {
+    for path in paths {
+        tokio::fs::remove_file(path).await?;
+        log!(
+            LogLevel::Info,
+            "Removed {} state file {}",
+            reason,
+            path.display()
+        );
+    }
+    Ok(())
+}
+
+/// Lists the `*.state` files directly inside `dir`, sorted by path.
+async fn list_state_files(dir: &Path) -> io::Result<Vec<PathBuf>> {
+    let mut paths = Vec::new();
+    let mut entries = tokio::fs::read_dir(dir).await?;
+    while let Some(entry) = entries.next_entry().await? {
+        let path = entry.path();
+        if path.extension().and_then(|ext| ext.to_str()) == Some(STATE_FILE_EXTENSION) {
+            paths.push(path);
+        }
+    }
+    paths.sort();
+    Ok(paths)
+}
+
+/// Runs every job on the blocking pool, at most `concurrency` at a time, separating the
+/// successful results from the failures.
+async fn run_blocking<I, F, T>(jobs: I, concurrency: usize) -> (Vec<T>, MultiError)
+where
+    I: IntoIterator<Item = (PathBuf, F)>,
+    F: FnOnce() -> io::Result<T> + Send + 'static,
+    T: Send + 'static,
+{
+    let permits = Arc::new(Semaphore::new(concurrency.max(1)));
+    let mut set = JoinSet::new();
+
+    for (path, job) in jobs {
+        let permits = Arc::clone(&permits);
+        set.spawn(async move {
+            let result = match permits.acquire_owned().await {
+                Ok(_permit) => tokio::task::spawn_blocking(job)
+                    .await
+                    .unwrap_or_else(|err| Err(io::Error::new(io::ErrorKind::Other, err))),
+                Err(err) => Err(io::Error::new(io::ErrorKind::Other, err)),
+            };
+            (path, result)
+        });
+    }
+
+    let mut values = Vec::new();
+    let mut errors = MultiError::default();
+    while let Some(joined) = set.join_next().await {
+        match joined {
+            Ok((_, Ok(value))) => values.push(value),
+            Ok((path, Err(err))) => errors.errors.push((path, err)),
+            // The spawned future itself never panics; a join error means the runtime shut down.
+            Err(err) => errors
+                .errors
+                .push((PathBuf::new(), io::Error::new(io::ErrorKind::Other, err))),
+        }
+    }
+    (values, errors)
+}
+
+fn write_state_file(
+    path: &Path,
+    state: &AppState,
+    mode: Option<u32>,
+    sync: bool,
+) -> io::Result<()> {
+    let data = encode_state(state).map_err(to_io_error)?;
+    write_atomic(path, data.as_bytes(), mode, sync)
+}
+
+fn load_state_file(path: &Path) -> io::Result<AppState> {
+    check_state_size(std::fs::metadata(path)?.len())?;
+    let content = state_text(std::fs::read(path)?)?;
+    StateFormat::Encrypted.decode(&content).map_err(to_io_error)
+}
+
+fn to_io_error(err: Box<dyn std::error::Error>) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, err.to_string())
+}
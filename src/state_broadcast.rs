@@ -0,0 +1,226 @@
+//! # State Broadcast
+//!
+//! Pushes live [`AppState`] updates to other processes on the same host over a Unix domain
+//! socket.
+//!
+//! A [`StateBroadcaster`] listens on [`Aggregator::socket_path`] and sends every state passed
+//! to [`StateBroadcaster::broadcast`] to all connected [`StateSubscriber`]s. Each message is
+//! framed as a 4 byte big-endian length followed by the JSON encoded state. A subscriber
+//! that doesn't take a frame within [`SUBSCRIBER_WRITE_TIMEOUT`] is disconnected, so one
+//! stalled reader can't hold up the others.
+
+use std::io;
+use std::os::unix::fs::{FileTypeExt, PermissionsExt};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::log;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{UnixListener, UnixStream};
+use tokio::sync::Mutex;
+use tokio::task::{JoinHandle, JoinSet};
+
+use crate::config::Aggregator;
+use crate::state_persistence::{state_from_value, AppState};
+
+/// Largest frame a [`StateSubscriber`] accepts, guarding against reading garbage lengths.
+pub const MAX_FRAME_LEN: u32 = 16 * 1024 * 1024;
+
+/// How long [`StateBroadcaster::broadcast`] waits for a subscriber to take a frame before
+/// dropping it.
+pub const SUBSCRIBER_WRITE_TIMEOUT: Duration = Duration::from_secs(1);
+
+/// Sends [`AppState`] updates to every client connected to its socket.
+///
+/// The socket file is removed when the broadcaster is dropped.
+pub struct StateBroadcaster {
+    path: PathBuf,
+    clients: Arc<Mutex<Vec<UnixStream>>>,
+    accept_task: JoinHandle<()>,
+}
+
+impl StateBroadcaster {
+    /// Listens on `config.socket_path`, applying `config.socket_permission` if set. A stale
+    /// socket left behind by a previous run, i.e. one nobody accepts connections on any
+    /// more, is replaced.
+    ///
+    /// Must be called from within a tokio runtime.
+    ///
+    /// # Errors
+    /// - Returns an `Err` of kind [`io::ErrorKind::AddrInUse`] if another broadcaster is
+    ///   still listening on the socket.
+    /// - Returns an `Err` of kind [`io::ErrorKind::AlreadyExists`] if the path exists but
+    ///   isn't a socket.
+    /// - Returns an `Err` if the socket can't be bound or its permissions can't be set.
+    pub fn bind(config: &Aggregator) -> io::Result<Self> {
+        let path = PathBuf::from(&config.socket_path);
+        remove_stale_socket(&path)?;
+
+        let listener = UnixListener::bind(&path)?;
+        if let Some(mode) = config.socket_permission {
+            std::fs::set_permissions(&path, std::fs::Permissions::from_mode(mode))?;
+        }
+
+        let clients = Arc::new(Mutex::new(Vec::new()));
+        let accept_clients = Arc::clone(&clients);
+        let accept_task = tokio::spawn(async move {
+            loop {
+                match listener.accept().await {
+                    Ok((stream, _)) => accept_clients.lock().await.push(stream),
+                    Err(err) => {
+                        log!(
+                            LogLevel::Error,
+                            "Failed to accept state subscriber: {}",
+                            err
+                        );
+                        break;
+                    }
+                }
+            }
+        });
+
+        Ok(Self {
+            path,
+            clients,
+            accept_task,
+        })
+    }
+
+    /// Returns the path of the listening socket.
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Returns the number of currently connected subscribers.
+    pub async fn subscriber_count(&self) -> usize {
+        self.clients.lock().await.len()
+    }
+
+    /// Sends `state` to every connected subscriber at once. Subscribers that can't be
+    /// written to, or don't take the frame within [`SUBSCRIBER_WRITE_TIMEOUT`], are
+    /// disconnected and dropped.
+    ///
+    /// # Errors
+    /// Returns an `Err` if `state` can't be encoded or is larger than [`MAX_FRAME_LEN`].
+    pub async fn broadcast(&self, state: &AppState) -> io::Result<()> {
+        let frame: Arc<[u8]> = encode_frame(state)?.into();
+
+        let mut clients = self.clients.lock().await;
+        let mut writes = JoinSet::new();
+        for mut client in clients.drain(..) {
+            let frame = Arc::clone(&frame);
+            writes.spawn(async move {
+                match tokio::time::timeout(SUBSCRIBER_WRITE_TIMEOUT, client.write_all(&frame)).await
+                {
+                    Ok(Ok(())) => Some(client),
+                    Ok(Err(err)) => {
+                        log!(LogLevel::Debug, "Dropping state subscriber: {}", err);
+                        None
+                    }
+                    Err(_) => {
+                        log!(LogLevel::Debug, "Dropping stalled state subscriber");
+                        None
+                    }
+                }
+            });
+        }
+        while let Some(written) = writes.join_next().await {
+            if let Ok(Some(client)) = written {
+                clients.push(client);
+            }
+        }
+
+        Ok(())
+    }
+}
+
+impl Drop for StateBroadcaster {
+    fn drop(&mut self) {
+        self.accept_task.abort();
+        let _ = std::fs::remove_file(&self.path);
+    }
+}
+
+/// Receives [`AppState`] updates from a [`StateBroadcaster`].
+pub struct StateSubscriber {
+    stream: UnixStream,
+}
+
+impl StateSubscriber {
+    /// Connects to the broadcaster listening on `socket_path`.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the socket can't be reached.
+    pub async fn connect<P: AsRef<Path>>(socket_path: P) -> io::Result<Self> {
+        let stream = UnixStream::connect(socket_path).await?;
+        Ok(Self { stream })
+    }
+
+    /// Waits for the next broadcast state.
+    ///
+    /// # Errors
+    /// Returns an `Err` of kind [`io::ErrorKind::UnexpectedEof`] once the broadcaster goes
+    /// away, or [`io::ErrorKind::InvalidData`] if a frame is oversized or not a valid state.
+    pub async fn receive(&mut self) -> io::Result<AppState> {
+        let len = self.stream.read_u32().await?;
+        if len > MAX_FRAME_LEN {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("state frame of {} bytes exceeds {}", len, MAX_FRAME_LEN),
+            ));
+        }
+
+        let mut body = vec![0; len as usize];
+        self.stream.read_exact(&mut body).await?;
+        serde_json::from_slice(&body)
+            .and_then(state_from_value)
+            .map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))
+    }
+}
+
+/// Removes the socket at `path` if nothing is listening on it any more.
+fn remove_stale_socket(path: &Path) -> io::Result<()> {
+    match std::fs::symlink_metadata(path) {
+        Ok(metadata) if metadata.file_type().is_socket() => {}
+        Ok(_) => {
+            return Err(io::Error::new(
+                io::ErrorKind::AlreadyExists,
+                format!("{} exists and is not a socket", path.display()),
+            ))
+        }
+        Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(()),
+        Err(err) => return Err(err),
+    }
+
+    if std::os::unix::net::UnixStream::connect(path).is_ok() {
+        return Err(io::Error::new(
+            io::ErrorKind::AddrInUse,
+            format!("{} is in use by another broadcaster", path.display()),
+        ));
+    }
+    match std::fs::remove_file(path) {
+        Err(err) if err.kind() != io::ErrorKind::NotFound => Err(err),
+        _ => Ok(()),
+    }
+}
+
+fn encode_frame(state: &AppState) -> io::Result<Vec<u8>> {
+    let body =
+        serde_json::to_vec(state).map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))?;
+    let len = u32::try_from(body.len())
+        .ok()
+        .filter(|len| *len <= MAX_FRAME_LEN)
+        .ok_or_else(|| {
+            io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("state of {} bytes exceeds {}", body.len(), MAX_FRAME_LEN),
+            )
+        })?;
+
+    let mut frame = Vec::with_capacity(4 + body.len());
+    frame.extend_from_slice(&len.to_be_bytes());
+    frame.extend_from_slice(&body);
+    Ok(frame)
+}
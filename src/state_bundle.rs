@@ -0,0 +1,129 @@
+//! # State Bundle
+//!
+//! Several [`AppState`]s stored together in one file, for supervisors that manage a group
+//! of related processes and want them saved and loaded as a unit.
+//!
+//! Bundles are written as pretty printed JSON, keyed by [`AppState::name`]:
+//!
+//! ```json
+//! {
+//!   "apps": {
+//!     "api": { "name": "api", ... },
+//!     "worker": { "name": "worker", ... }
+//!   }
+//! }
+//! ```
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::Path;
+
+use crate::state_fs::write_atomic_async;
+use crate::state_persistence::{read_state_file, state_from_value, unwrap_state_error, AppState};
+
+/// A group of [`AppState`]s, keyed by their name.
+#[derive(Serialize, Deserialize, Debug, Clone, Default, PartialEq, Eq)]
+pub struct StateBundle {
+    /// The states in the bundle, keyed by [`AppState::name`].
+    pub apps: BTreeMap<String, AppState>,
+}
+
+impl StateBundle {
+    /// Creates an empty bundle.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the state named `name`.
+    pub fn get(&self, name: &str) -> Option<&AppState> {
+        self.apps.get(name)
+    }
+
+    /// Returns the state named `name` for modification.
+    pub fn get_mut(&mut self, name: &str) -> Option<&mut AppState> {
+        self.apps.get_mut(name)
+    }
+
+    /// Adds `state` under its [`AppState::name`], returning the state it replaced.
+    pub fn set(&mut self, state: AppState) -> Option<AppState> {
+        self.apps.insert(state.name.clone(), state)
+    }
+
+    /// Removes and returns the state named `name`.
+    pub fn remove(&mut self, name: &str) -> Option<AppState> {
+        self.apps.remove(name)
+    }
+
+    /// Returns the number of states in the bundle.
+    pub fn len(&self) -> usize {
+        self.apps.len()
+    }
+
+    /// Returns `true` if the bundle holds no states.
+    pub fn is_empty(&self) -> bool {
+        self.apps.is_empty()
+    }
+
+    /// Writes the bundle to `path` as pretty printed JSON. The data goes to `<path>.tmp`
+    /// first and is then renamed into place, so readers see either the old or the new
+    /// bundle as a whole.
+    ///
+    /// # Errors
+    /// Returns an `Err` if serialization, writing or renaming fails.
+    pub async fn save(&self, path: &PathType) -> Result<(), Box<dyn std::error::Error>> {
+        save_json(self, path.as_ref()).await
+    }
+
+    /// Loads a bundle written by [`StateBundle::save`]. Gzip compressed files are accepted,
+    /// and the size limit of [`StatePersistence::max_state_file_bytes`] applies.
+    ///
+    /// [`StatePersistence::max_state_file_bytes`]: crate::state_persistence::StatePersistence::max_state_file_bytes
+    ///
+    /// # Errors
+    /// Returns an `Err` if the file is unreadable, too large or not a valid bundle.
+    pub async fn load(path: &PathType) -> Result<Self, Box<dyn std::error::Error>> {
+        let raw: RawBundle = load_json(path.as_ref()).await?;
+        Ok(StateBundle {
+            apps: decode_states(raw.apps)?,
+        })
+    }
+}
+
+/// Writes `value` to `path` as pretty printed JSON with [`write_atomic`], for files holding
+/// several states such as bundles and clusters.
+///
+/// [`write_atomic`]: crate::state_fs::write_atomic
+pub(crate) async fn save_json<T: Serialize>(
+    value: &T,
+    path: &Path,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let content = serde_json::to_vec_pretty(value)?;
+    write_atomic_async(path, content, None, true).await?;
+    Ok(())
+}
+
+/// Reads JSON written by [`save_json`], accepting gzip and applying the state size limit.
+pub(crate) async fn load_json<T: DeserializeOwned>(
+    path: &Path,
+) -> Result<T, Box<dyn std::error::Error>> {
+    let content = read_state_file(path).await.map_err(unwrap_state_error)?;
+    Ok(serde_json::from_str(&content)?)
+}
+
+/// Decodes the states of a multi-state file, keeping the unknown fields of each.
+pub(crate) fn decode_states(
+    raw: BTreeMap<String, serde_json::Value>,
+) -> Result<BTreeMap<String, AppState>, Box<dyn std::error::Error>> {
+    raw.into_iter()
+        .map(|(key, state)| Ok((key, state_from_value(state)?)))
+        .collect()
+}
+
+/// A [`StateBundle`] before its states are decoded, so each can keep its unknown fields
+/// through [`state_from_value`].
+#[derive(Deserialize)]
+struct RawBundle {
+    apps: BTreeMap<String, serde_json::Value>,
+}
@@ -0,0 +1,46 @@
+//! # State CBOR
+//!
+//! Encodes [`AppState`] as [CBOR](https://www.rfc-editor.org/rfc/rfc8949) for consumers
+//! that would rather not parse JSON. Only available with the `cbor` feature.
+//!
+//! The encoding follows the JSON form field for field: maps keyed by the same names,
+//! integers as CBOR integers and floats in the shortest lossless width. Encoding and
+//! decoding are done by [`ciborium`]. When decoding, byte strings and maps with non-text
+//! keys are rejected, since the JSON form has neither.
+
+use std::io::{self, Read, Write};
+
+use serde_json::Value;
+
+use crate::state_persistence::{state_from_value, AppState};
+
+/// Writes `state` to `w` as a single CBOR item.
+///
+/// # Errors
+/// Returns an `Err` if the state can't be serialized or writing to `w` fails.
+pub fn encode_state_cbor<W: Write>(mut w: W, state: &AppState) -> io::Result<()> {
+    let value = serde_json::to_value(state)?;
+    ciborium::ser::into_writer(&value, &mut w).map_err(|err| match err {
+        ciborium::ser::Error::Io(err) => err,
+        ciborium::ser::Error::Value(message) => invalid(message),
+    })?;
+    w.flush()
+}
+
+/// Reads one CBOR item from `r` and converts it into an [`AppState`]. Unknown top-level
+/// keys are kept in [`AppState::extra`], as for JSON.
+///
+/// # Errors
+/// Returns an `Err` of kind [`io::ErrorKind::InvalidData`] if the input is not valid CBOR,
+/// nests too deeply or doesn't describe a state, and passes read errors through.
+pub fn decode_state_cbor<R: Read>(r: R) -> io::Result<AppState> {
+    let value: Value = ciborium::de::from_reader(r).map_err(|err| match err {
+        ciborium::de::Error::Io(err) => err,
+        other => invalid(other.to_string()),
+    })?;
+    state_from_value(value).map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))
+}
+
+fn invalid(message: String) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message)
+}
@@ -0,0 +1,106 @@
+//! # State Cluster
+//!
+//! The [`AppState`]s reported by the nodes of a cluster, stored together in one file and
+//! keyed by node ID rather than by application name like a
+//! [`StateBundle`](crate::state_bundle::StateBundle):
+//!
+//! ```json
+//! {
+//!   "cluster_name": "eu-west",
+//!   "last_updated": 1700000000,
+//!   "nodes": {
+//!     "node-1": { "name": "api", ... },
+//!     "node-2": { "name": "api", ... }
+//!   }
+//! }
+//! ```
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+use crate::state_bundle::{decode_states, load_json, save_json};
+use crate::state_persistence::AppState;
+
+/// The per node states of a cluster.
+#[derive(Serialize, Deserialize, Debug, Clone, Default, PartialEq, Eq)]
+pub struct ClusterState {
+    /// Name of the cluster.
+    pub cluster_name: String,
+
+    /// The newest [`AppState::last_updated`] merged so far, Unix seconds.
+    pub last_updated: u64,
+
+    /// The latest state of every node, keyed by node ID.
+    pub nodes: BTreeMap<String, AppState>,
+}
+
+impl ClusterState {
+    /// Creates a cluster without nodes.
+    pub fn new<S: Into<String>>(cluster_name: S) -> Self {
+        Self {
+            cluster_name: cluster_name.into(),
+            ..Self::default()
+        }
+    }
+
+    /// Stores `state` as the state of `node_id` and advances
+    /// [`ClusterState::last_updated`]. Returns `false`, leaving the cluster unchanged, if
+    /// the stored state of the node is newer, e.g. when reports arrive out of order.
+    pub fn merge_node<S: Into<String>>(&mut self, node_id: S, state: AppState) -> bool {
+        let node_id = node_id.into();
+        if let Some(stored) = self.nodes.get(&node_id) {
+            if stored.last_updated > state.last_updated {
+                return false;
+            }
+        }
+        self.last_updated = self.last_updated.max(state.last_updated);
+        self.nodes.insert(node_id, state);
+        true
+    }
+
+    /// Returns the state of `node_id`.
+    pub fn node(&self, node_id: &str) -> Option<&AppState> {
+        self.nodes.get(node_id)
+    }
+
+    /// Removes and returns the state of `node_id`.
+    pub fn remove_node(&mut self, node_id: &str) -> Option<AppState> {
+        self.nodes.remove(node_id)
+    }
+
+    /// Writes the cluster to `path` as pretty printed JSON. The data goes to `<path>.tmp`
+    /// first and is then renamed into place, so readers see either the old or the new
+    /// cluster as a whole.
+    ///
+    /// # Errors
+    /// Returns an `Err` if serialization, writing or renaming fails.
+    pub async fn save(&self, path: &PathType) -> Result<(), Box<dyn std::error::Error>> {
+        save_json(self, path.as_ref()).await
+    }
+
+    /// Loads a cluster written by [`ClusterState::save`]. Gzip compressed files are
+    /// accepted, and the size limit of [`StatePersistence::max_state_file_bytes`] applies.
+    ///
+    /// [`StatePersistence::max_state_file_bytes`]: crate::state_persistence::StatePersistence::max_state_file_bytes
+    ///
+    /// # Errors
+    /// Returns an `Err` if the file is unreadable, too large or not a valid cluster.
+    pub async fn load(path: &PathType) -> Result<Self, Box<dyn std::error::Error>> {
+        let raw: RawCluster = load_json(path.as_ref()).await?;
+        Ok(ClusterState {
+            cluster_name: raw.cluster_name,
+            last_updated: raw.last_updated,
+            nodes: decode_states(raw.nodes)?,
+        })
+    }
+}
+
+/// A [`ClusterState`] before its states are decoded, so each can keep its unknown fields
+/// through [`state_from_value`](crate::state_persistence::state_from_value).
+#[derive(Deserialize)]
+struct RawCluster {
+    cluster_name: String,
+    last_updated: u64,
+    nodes: BTreeMap<String, serde_json::Value>,
+}
@@ -0,0 +1,435 @@
+//! # State Delta
+//!
+//! Incremental state saving for large, frequently updated states: instead of rewriting
+//! the whole file on every save, [`DeltaWriter::save`] appends the changes since the last
+//! save to `<path>.patch` as a JSON Patch ([RFC 6902](https://www.rfc-editor.org/rfc/rfc6902)),
+//! and [`apply_deltas`] rebuilds the current state from the snapshot at `path` plus the
+//! accumulated patches.
+//!
+//! Every [`DeltaWriter::compact_after`] patches the writer compacts: it writes a full
+//! snapshot and deletes the patch file, which keeps [`apply_deltas`] bounded.
+//!
+//! Each line of the patch file is one record, `{"base":"...","ops":[...]}`, where `base`
+//! is the SHA-256 of the snapshot the patch applies to. A crash between writing a new
+//! snapshot and deleting the old patches thus leaves patches that [`apply_deltas`]
+//! recognises as stale and skips. For encrypted `.state` files `ops` holds the patch
+//! encrypted like the snapshot, so the sidecar is no easier to read than the state itself.
+//!
+//! Arrays that only grew at the end, or lost entries at the front while growing at the
+//! end as capped output buffers do, are patched by removing and appending entries. Other
+//! arrays of unchanged length are compared entry by entry, and any remaining change
+//! replaces the array as a whole.
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+use sha2::{Digest, Sha256};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use tokio::fs::{self, OpenOptions};
+use tokio::io::AsyncWriteExt;
+
+use crate::encryption::{simple_decrypt, simple_encrypt};
+use crate::state_fs::write_atomic_async;
+use crate::state_persistence::{
+    read_state_file, sibling_path, state_from_value, unwrap_state_error, AppState, StateFormat,
+};
+
+/// Default for [`DeltaWriter::compact_after`].
+pub const DEFAULT_COMPACT_AFTER: usize = 64;
+
+/// One operation of a JSON Patch. `path` is a JSON Pointer
+/// ([RFC 6901](https://www.rfc-editor.org/rfc/rfc6901)) such as `/stdout/-`.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(tag = "op", rename_all = "lowercase")]
+pub enum PatchOp {
+    /// Inserts `value`, or sets it if an object member of that name exists. `-` as the
+    /// last array index appends.
+    Add { path: String, value: Value },
+    /// Removes the value at `path`.
+    Remove { path: String },
+    /// Replaces the existing value at `path`.
+    Replace { path: String, value: Value },
+    /// Fails the patch unless the value at `path` equals `value`.
+    Test { path: String, value: Value },
+}
+
+/// Returned by [`apply_patch`] when an operation can't be applied.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PatchError {
+    /// The pointer of the failing operation.
+    pub path: String,
+    /// What went wrong.
+    pub reason: String,
+}
+
+impl fmt::Display for PatchError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "patch failed at {:?}: {}", self.path, self.reason)
+    }
+}
+
+impl std::error::Error for PatchError {}
+
+/// Returns the operations turning `base` into `current`, see the
+/// [module documentation](crate::state_delta) for how arrays are compared.
+pub fn diff_patch(base: &Value, current: &Value) -> Vec<PatchOp> {
+    let mut ops = Vec::new();
+    diff_into(&mut String::new(), base, current, &mut ops);
+    ops
+}
+
+/// Applies `ops` to `document` in order.
+///
+/// # Errors
+/// Returns a [`PatchError`] at the first operation that doesn't apply, e.g. a removal of
+/// a missing member or a failed test. `document` may be partly patched then.
+pub fn apply_patch(document: &mut Value, ops: &[PatchOp]) -> Result<(), PatchError> {
+    for op in ops {
+        match op {
+            PatchOp::Add { path, value } => add(document, path, value.clone())?,
+            PatchOp::Remove { path } => remove(document, path)?,
+            PatchOp::Replace { path, value } => {
+                *lookup(document, path)? = value.clone();
+            }
+            PatchOp::Test { path, value } => {
+                if lookup(document, path)? != value {
+                    return Err(patch_error(path, "test failed"));
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Saves an [`AppState`] to one path as a snapshot plus patches, see the
+/// [module documentation](crate::state_delta).
+#[derive(Debug)]
+pub struct DeltaWriter {
+    path: PathBuf,
+    patch_path: PathBuf,
+    format: StateFormat,
+    compact_after: usize,
+    /// The state as last persisted and the hash of the snapshot its patches apply to.
+    last: Option<(Value, String)>,
+    patches: usize,
+}
+
+impl DeltaWriter {
+    /// Creates a writer for the snapshot at `path`, in the [`StateFormat`] implied by its
+    /// extension, patching to `<path>.patch`. The first save writes a full snapshot.
+    pub fn new(path: &PathType) -> Self {
+        let path = path.to_path_buf();
+        Self {
+            patch_path: sibling_path(&path, ".patch"),
+            format: StateFormat::from_path(&path).unwrap_or(StateFormat::Encrypted),
+            path,
+            compact_after: DEFAULT_COMPACT_AFTER,
+            last: None,
+            patches: 0,
+        }
+    }
+
+    /// Compacts once `patches` patches have accumulated. `0` writes a full snapshot on
+    /// every save.
+    pub fn with_compact_after(mut self, patches: usize) -> Self {
+        self.compact_after = patches;
+        self
+    }
+
+    /// Returns the number of patches after which the writer compacts.
+    pub fn compact_after(&self) -> usize {
+        self.compact_after
+    }
+
+    /// Returns the path of the patch file.
+    pub fn patch_path(&self) -> &Path {
+        &self.patch_path
+    }
+
+    /// Returns the number of patches written since the last snapshot.
+    pub fn pending_patches(&self) -> usize {
+        self.patches
+    }
+
+    /// Persists `state`: appends a patch against the previously saved state, or writes a
+    /// full snapshot on the first save and once [`DeltaWriter::compact_after`] patches
+    /// have accumulated. Saving an unchanged state writes nothing.
+    ///
+    /// # Errors
+    /// Returns an `Err` if encoding or writing fails. The writer then snapshots on the
+    /// next save, as the patch file may have been left incomplete.
+    pub async fn save(&mut self, state: &AppState) -> Result<(), Box<dyn std::error::Error>> {
+        let current = serde_json::to_value(state)?;
+        let Some((previous, base)) = &self.last else {
+            return self.compact(state).await;
+        };
+        let ops = diff_patch(previous, &current);
+        if ops.is_empty() {
+            return Ok(());
+        }
+        if self.patches >= self.compact_after {
+            return self.compact(state).await;
+        }
+
+        let record = PatchRecord {
+            base: base.clone(),
+            ops: self.encode_ops(&ops)?,
+        };
+        let mut line = serde_json::to_string(&record)?;
+        line.push('\n');
+        if let Err(err) = append_line(&self.patch_path, &line).await {
+            self.last = None;
+            return Err(err.into());
+        }
+        if let Some((previous, _)) = &mut self.last {
+            *previous = current;
+        }
+        self.patches += 1;
+        Ok(())
+    }
+
+    /// Writes `state` as a full snapshot and deletes the patch file.
+    ///
+    /// # Errors
+    /// Returns an `Err` if encoding, writing or deleting fails.
+    pub async fn compact(&mut self, state: &AppState) -> Result<(), Box<dyn std::error::Error>> {
+        self.last = None;
+        let encoded = self.format.encode(state)?;
+        write_atomic_async(&self.path, encoded.clone().into_bytes(), None, true).await?;
+        match fs::remove_file(&self.patch_path).await {
+            Err(err) if err.kind() != std::io::ErrorKind::NotFound => return Err(err.into()),
+            _ => {}
+        }
+        // Patch against what apply_deltas will read back, in case the format is lossy.
+        let persisted = serde_json::to_value(self.format.decode(&encoded)?)?;
+        self.last = Some((persisted, content_hash(&encoded)));
+        self.patches = 0;
+        Ok(())
+    }
+
+    fn encode_ops(&self, ops: &[PatchOp]) -> Result<Value, Box<dyn std::error::Error>> {
+        let ops = serde_json::to_value(ops)?;
+        if self.format != StateFormat::Encrypted {
+            return Ok(ops);
+        }
+        let encrypted = simple_encrypt(ops.to_string().as_bytes()).map_err(|e| {
+            std::io::Error::new(std::io::ErrorKind::InvalidData, e.err_mesg.to_string())
+        })?;
+        Ok(Value::String(encrypted.to_string()))
+    }
+}
+
+/// Rebuilds the state saved by a [`DeltaWriter`] from the snapshot at `path` and the
+/// patches in `<path>.patch` that apply to it. A missing patch file means the snapshot is
+/// current; patches left over from an earlier snapshot and a record torn by a crash are
+/// skipped.
+///
+/// # Errors
+/// Returns an `Err` if the snapshot can't be read or decoded, or if a patch for it can't
+/// be decoded or applied.
+pub async fn apply_deltas(path: &PathType) -> Result<AppState, Box<dyn std::error::Error>> {
+    let path: &Path = path.as_ref();
+    let format = StateFormat::from_path(path).unwrap_or(StateFormat::Encrypted);
+    let content = read_state_file(path).await.map_err(unwrap_state_error)?;
+    let state = format.decode(&content)?;
+
+    let patches = match fs::read_to_string(sibling_path(path, ".patch")).await {
+        Ok(patches) => patches,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(state),
+        Err(err) => return Err(err.into()),
+    };
+    // Only newline terminated records were fully written.
+    let complete = match patches.rfind('\n') {
+        Some(end) => &patches[..end],
+        None => "",
+    };
+
+    let base = content_hash(&content);
+    let mut document = serde_json::to_value(&state)?;
+    for line in complete.lines() {
+        let record: PatchRecord = serde_json::from_str(line)?;
+        if record.base != base {
+            continue;
+        }
+        let ops: Vec<PatchOp> = match record.ops {
+            Value::String(encrypted) => {
+                let decrypted = simple_decrypt(encrypted.as_bytes()).map_err(|_| {
+                    std::io::Error::new(std::io::ErrorKind::InvalidData, "Decryption failed")
+                })?;
+                serde_json::from_slice(&decrypted)?
+            }
+            ops => serde_json::from_value(ops)?,
+        };
+        apply_patch(&mut document, &ops)?;
+    }
+    Ok(state_from_value(document)?)
+}
+
+#[derive(Serialize, Deserialize)]
+struct PatchRecord {
+    base: String,
+    ops: Value,
+}
+
+fn content_hash(content: &str) -> String {
+    hex::encode(Sha256::digest(content.as_bytes()))
+}
+
+async fn append_line(path: &Path, line: &str) -> std::io::Result<()> {
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)
+        .await?;
+    file.write_all(line.as_bytes()).await?;
+    file.sync_data().await
+}
+
+fn diff_into(path: &mut String, base: &Value, current: &Value, ops: &mut Vec<PatchOp>) {
+    match (base, current) {
+        (Value::Object(base), Value::Object(current)) => diff_objects(path, base, current, ops),
+        (Value::Array(base), Value::Array(current)) => diff_arrays(path, base, current, ops),
+        (base, current) if base != current => ops.push(PatchOp::Replace {
+            path: path.clone(),
+            value: current.clone(),
+        }),
+        _ => {}
+    }
+}
+
+fn diff_objects(
+    path: &mut String,
+    base: &Map<String, Value>,
+    current: &Map<String, Value>,
+    ops: &mut Vec<PatchOp>,
+) {
+    let len = path.len();
+    for (key, value) in base {
+        push_token(path, key);
+        match current.get(key) {
+            Some(current) => diff_into(path, value, current, ops),
+            None => ops.push(PatchOp::Remove { path: path.clone() }),
+        }
+        path.truncate(len);
+    }
+    for (key, value) in current {
+        if !base.contains_key(key) {
+            push_token(path, key);
+            ops.push(PatchOp::Add {
+                path: path.clone(),
+                value: value.clone(),
+            });
+            path.truncate(len);
+        }
+    }
+}
+
+fn diff_arrays(path: &mut String, base: &[Value], current: &[Value], ops: &mut Vec<PatchOp>) {
+    // The fewest entries to drop from the front so that `current` continues `base`. Always
+    // found, in the worst case by dropping everything.
+    let dropped = (0..=base.len())
+        .find(|&dropped| current.starts_with(&base[dropped..]))
+        .unwrap_or(base.len());
+    let kept = base.len() - dropped;
+    if dropped + current.len() - kept < current.len() {
+        for _ in 0..dropped {
+            ops.push(PatchOp::Remove {
+                path: format!("{}/0", path),
+            });
+        }
+        for value in &current[kept..] {
+            ops.push(PatchOp::Add {
+                path: format!("{}/-", path),
+                value: value.clone(),
+            });
+        }
+    } else if base.len() == current.len() {
+        let len = path.len();
+        for (index, (base, current)) in base.iter().zip(current).enumerate() {
+            push_token(path, &index.to_string());
+            diff_into(path, base, current, ops);
+            path.truncate(len);
+        }
+    } else {
+        ops.push(PatchOp::Replace {
+            path: path.clone(),
+            value: Value::Array(current.to_vec()),
+        });
+    }
+}
+
+/// Appends `token` to a JSON Pointer, escaping `~` and `/`.
+fn push_token(path: &mut String, token: &str) {
+    path.push('/');
+    path.push_str(&token.replace('~', "~0").replace('/', "~1"));
+}
+
+/// Splits a JSON Pointer into the pointer of its parent and its unescaped last token.
+fn split_pointer(path: &str) -> Result<(&str, String), PatchError> {
+    if path.is_empty() {
+        return Err(patch_error(
+            path,
+            "the whole document can't be added or removed",
+        ));
+    }
+    let (parent, token) = path
+        .rsplit_once('/')
+        .ok_or_else(|| patch_error(path, "pointer must start with '/'"))?;
+    Ok((parent, token.replace("~1", "/").replace("~0", "~")))
+}
+
+fn lookup<'a>(document: &'a mut Value, path: &str) -> Result<&'a mut Value, PatchError> {
+    if !path.is_empty() && !path.starts_with('/') {
+        return Err(patch_error(path, "pointer must start with '/'"));
+    }
+    document
+        .pointer_mut(path)
+        .ok_or_else(|| patch_error(path, "no such value"))
+}
+
+fn add(document: &mut Value, path: &str, value: Value) -> Result<(), PatchError> {
+    let (parent, token) = split_pointer(path)?;
+    match lookup(document, parent)? {
+        Value::Object(map) => {
+            map.insert(token, value);
+        }
+        Value::Array(array) if token == "-" => array.push(value),
+        Value::Array(array) => {
+            let index = array_index(path, &token, array.len() + 1)?;
+            array.insert(index, value);
+        }
+        _ => return Err(patch_error(path, "parent is not an object or array")),
+    }
+    Ok(())
+}
+
+fn remove(document: &mut Value, path: &str) -> Result<(), PatchError> {
+    let (parent, token) = split_pointer(path)?;
+    match lookup(document, parent)? {
+        Value::Object(map) => {
+            map.remove(&token)
+                .ok_or_else(|| patch_error(path, "no such value"))?;
+        }
+        Value::Array(array) => {
+            let index = array_index(path, &token, array.len())?;
+            array.remove(index);
+        }
+        _ => return Err(patch_error(path, "parent is not an object or array")),
+    }
+    Ok(())
+}
+
+fn array_index(path: &str, token: &str, len: usize) -> Result<usize, PatchError> {
+    match token.parse::<usize>() {
+        Ok(index) if index < len && (index == 0 || !token.starts_with('0')) => Ok(index),
+        _ => Err(patch_error(path, "array index out of range")),
+    }
+}
+
+fn patch_error(path: &str, reason: &str) -> PatchError {
+    PatchError {
+        path: path.to_string(),
+        reason: reason.to_string(),
+    }
+}
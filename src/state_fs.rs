@@ -0,0 +1,280 @@
+use std::collections::BTreeMap;
+use std::fs::File;
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex, MutexGuard};
+use std::time::SystemTime;
+
+use crate::state_persistence::sibling_path;
+use crate::timestamp;
+
+/// Metadata returned by [`FileSystem::stat`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FileStat {
+    /// Size of the file in bytes.
+    pub len: u64,
+    /// Last modification time.
+    pub modified: SystemTime,
+}
+
+/// The minimal set of file operations the state persistence code needs.
+///
+/// [`OsFileSystem`] is backed by `std::fs`; [`MemFileSystem`] keeps everything in memory,
+/// which makes tests fast and deterministic without touching disk.
+pub trait FileSystem: Send + Sync {
+    /// Reads the whole file at `path`.
+    fn read_file(&self, path: &Path) -> io::Result<Vec<u8>>;
+
+    /// Creates or truncates the file at `path` and writes `data` to it.
+    fn write_file(&self, path: &Path, data: &[u8]) -> io::Result<()>;
+
+    /// Moves the file at `from` to `to`, replacing `to` if it exists.
+    fn rename(&self, from: &Path, to: &Path) -> io::Result<()>;
+
+    /// Replaces the file at `path` with `data` so that readers see either the old or the
+    /// new content. By default `data` is written to `<path>.tmp` and renamed over `path`.
+    fn replace_file(&self, path: &Path, data: &[u8]) -> io::Result<()> {
+        let tmp_path = sibling_path(path, ".tmp");
+        self.write_file(&tmp_path, data)?;
+        self.rename(&tmp_path, path)
+    }
+
+    /// Returns metadata for the file at `path`.
+    fn stat(&self, path: &Path) -> io::Result<FileStat>;
+}
+
+/// [`FileSystem`] implementation that talks to the real filesystem.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct OsFileSystem;
+
+impl FileSystem for OsFileSystem {
+    fn read_file(&self, path: &Path) -> io::Result<Vec<u8>> {
+        std::fs::read(path)
+    }
+
+    fn write_file(&self, path: &Path, data: &[u8]) -> io::Result<()> {
+        std::fs::write(path, data)
+    }
+
+    fn rename(&self, from: &Path, to: &Path) -> io::Result<()> {
+        std::fs::rename(from, to)
+    }
+
+    /// Goes through [`write_atomic`], keeping the mode of the replaced file and syncing.
+    fn replace_file(&self, path: &Path, data: &[u8]) -> io::Result<()> {
+        write_atomic(path, data, None, true)
+    }
+
+    fn stat(&self, path: &Path) -> io::Result<FileStat> {
+        let metadata = std::fs::metadata(path)?;
+        Ok(FileStat {
+            len: metadata.len(),
+            modified: metadata.modified()?,
+        })
+    }
+}
+
+/// Writes `data` to `<path>.tmp` and renames it over `path`, so readers never see a
+/// partial file. The temporary file is removed again if anything fails.
+///
+/// With `Some(mode)` the file gets exactly that mode, regardless of the umask; with `None`
+/// it keeps the mode of the file it replaces, or gets the default for a new file. With
+/// `sync` the file is synced before the rename and the directory after it, so the new
+/// content survives a crash.
+pub(crate) fn write_atomic(
+    path: &Path,
+    data: &[u8],
+    mode: Option<u32>,
+    sync: bool,
+) -> io::Result<()> {
+    write_atomic_with(path, mode, sync, |file| file.write_all(data))
+}
+
+/// Like [`write_atomic`], but lets `write` fill the temporary file, for content that is
+/// serialized straight to disk.
+pub(crate) fn write_atomic_with(
+    path: &Path,
+    mode: Option<u32>,
+    sync: bool,
+    write: impl FnOnce(&mut File) -> io::Result<()>,
+) -> io::Result<()> {
+    let tmp_path = sibling_path(path, ".tmp");
+    let result = write_tmp_file(path, &tmp_path, mode, sync, write)
+        .and_then(|_| std::fs::rename(&tmp_path, path));
+    if result.is_err() {
+        let _ = std::fs::remove_file(&tmp_path);
+        return result;
+    }
+    if sync {
+        sync_directory(parent_dir(path))?;
+    }
+    Ok(())
+}
+
+/// [`write_atomic`] on tokio's blocking pool.
+pub(crate) async fn write_atomic_async(
+    path: &Path,
+    data: Vec<u8>,
+    mode: Option<u32>,
+    sync: bool,
+) -> io::Result<()> {
+    let path = path.to_path_buf();
+    tokio::task::spawn_blocking(move || write_atomic(&path, &data, mode, sync))
+        .await
+        .unwrap_or_else(|err| Err(io::Error::new(io::ErrorKind::Other, err)))
+}
+
+#[cfg(unix)]
+fn write_tmp_file(
+    path: &Path,
+    tmp_path: &Path,
+    mode: Option<u32>,
+    sync: bool,
+    write: impl FnOnce(&mut File) -> io::Result<()>,
+) -> io::Result<()> {
+    use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+
+    let mode = match mode {
+        Some(mode) => Some(mode),
+        None => match std::fs::metadata(path) {
+            Ok(metadata) => Some(metadata.permissions().mode() & 0o7777),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => None,
+            Err(err) => return Err(err),
+        },
+    };
+    let mut options = std::fs::OpenOptions::new();
+    options.write(true).create(true).truncate(true);
+    if let Some(mode) = mode {
+        options.mode(mode);
+    }
+    let mut file = options.open(tmp_path)?;
+    if let Some(mode) = mode {
+        // The umask applies to `mode` on creation, so set it explicitly as well.
+        file.set_permissions(std::fs::Permissions::from_mode(mode))?;
+    }
+    write(&mut file)?;
+    if sync {
+        file.sync_all()?;
+    }
+    Ok(())
+}
+
+// File modes don't exist on other platforms, so `mode` is ignored there.
+#[cfg(not(unix))]
+fn write_tmp_file(
+    _path: &Path,
+    tmp_path: &Path,
+    _mode: Option<u32>,
+    sync: bool,
+    write: impl FnOnce(&mut File) -> io::Result<()>,
+) -> io::Result<()> {
+    let mut file = File::create(tmp_path)?;
+    write(&mut file)?;
+    if sync {
+        file.sync_all()?;
+    }
+    Ok(())
+}
+
+/// Returns the directory holding `path`, `.` for a bare file name.
+fn parent_dir(path: &Path) -> &Path {
+    match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    }
+}
+
+/// Flushes the entries of `dir`, making renames into it durable.
+#[cfg(unix)]
+pub(crate) fn sync_directory(dir: &Path) -> io::Result<()> {
+    File::open(dir)?.sync_all()
+}
+
+// Directories can't be opened for syncing on other platforms; renames are durable there.
+#[cfg(not(unix))]
+pub(crate) fn sync_directory(_dir: &Path) -> io::Result<()> {
+    Ok(())
+}
+
+/// In-memory [`FileSystem`] for tests. Clones share the same files.
+///
+/// Directories are not modelled: any path can be written to.
+///
+/// # Example
+/// ```rust
+/// # use artisan_middleware::state_fs::{FileSystem, MemFileSystem};
+/// # use std::path::Path;
+/// let fs = MemFileSystem::new();
+/// fs.write_file(Path::new("/tmp/app.state"), b"data").unwrap();
+/// assert_eq!(fs.read_file(Path::new("/tmp/app.state")).unwrap(), b"data");
+/// ```
+#[derive(Debug, Clone, Default)]
+pub struct MemFileSystem {
+    files: Arc<Mutex<BTreeMap<PathBuf, MemFile>>>,
+}
+
+#[derive(Debug, Clone)]
+struct MemFile {
+    data: Vec<u8>,
+    modified: SystemTime,
+}
+
+impl MemFileSystem {
+    /// Creates an empty in-memory filesystem.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the paths of all files currently stored, in sorted order.
+    pub fn paths(&self) -> Vec<PathBuf> {
+        self.files().keys().cloned().collect()
+    }
+
+    fn files(&self) -> MutexGuard<'_, BTreeMap<PathBuf, MemFile>> {
+        self.files
+            .lock()
+            .unwrap_or_else(|poisoned| poisoned.into_inner())
+    }
+}
+
+fn not_found(path: &Path) -> io::Error {
+    io::Error::new(
+        io::ErrorKind::NotFound,
+        format!("{} does not exist", path.display()),
+    )
+}
+
+impl FileSystem for MemFileSystem {
+    fn read_file(&self, path: &Path) -> io::Result<Vec<u8>> {
+        self.files()
+            .get(path)
+            .map(|file| file.data.clone())
+            .ok_or_else(|| not_found(path))
+    }
+
+    fn write_file(&self, path: &Path, data: &[u8]) -> io::Result<()> {
+        let file = MemFile {
+            data: data.to_vec(),
+            modified: timestamp::now(),
+        };
+        self.files().insert(path.to_path_buf(), file);
+        Ok(())
+    }
+
+    fn rename(&self, from: &Path, to: &Path) -> io::Result<()> {
+        let mut files = self.files();
+        let file = files.remove(from).ok_or_else(|| not_found(from))?;
+        files.insert(to.to_path_buf(), file);
+        Ok(())
+    }
+
+    fn stat(&self, path: &Path) -> io::Result<FileStat> {
+        self.files()
+            .get(path)
+            .map(|file| FileStat {
+                len: file.data.len() as u64,
+                modified: file.modified,
+            })
+            .ok_or_else(|| not_found(path))
+    }
+}
@@ -0,0 +1,143 @@
+//! # State Hub
+//!
+//! Keeps the latest [`AppState`] reported for every application name and notifies
+//! watchers whenever it changes.
+//!
+//! The hub is transport agnostic: a server for any protocol forwards received states to
+//! [`StateHub::push`] and streams a [`StateWatcher`] to each client. Names that were only
+//! watched are forgotten again once their last watcher is dropped.
+
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex, Weak};
+
+use tokio::sync::broadcast;
+
+use crate::state_persistence::AppState;
+
+/// Number of updates a slow watcher may fall behind before it skips to newer ones.
+pub const WATCH_BUFFER: usize = 64;
+
+#[derive(Debug)]
+struct Entry {
+    latest: Option<AppState>,
+    updates: broadcast::Sender<AppState>,
+}
+
+impl Entry {
+    fn new() -> Self {
+        Self {
+            latest: None,
+            updates: broadcast::channel(WATCH_BUFFER).0,
+        }
+    }
+}
+
+/// Shared registry of the latest state per [`AppState::name`]. Clones refer to the same
+/// registry.
+#[derive(Debug, Clone, Default)]
+pub struct StateHub {
+    entries: Arc<Mutex<Entries>>,
+}
+
+type Entries = HashMap<String, Entry>;
+
+impl StateHub {
+    /// Creates an empty hub.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Stores `state` as the latest state for its name and sends it to the watchers of
+    /// that name. Returns `false`, without notifying anyone, if it equals the stored state.
+    pub fn push(&self, state: AppState) -> bool {
+        let mut entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        let entry = entries.entry(state.name.clone()).or_insert_with(Entry::new);
+        if entry.latest.as_ref() == Some(&state) {
+            return false;
+        }
+
+        // Sending only fails when nobody is watching, which is fine.
+        let _ = entry.updates.send(state.clone());
+        entry.latest = Some(state);
+        true
+    }
+
+    /// Returns the latest state stored for `name`.
+    pub fn latest(&self, name: &str) -> Option<AppState> {
+        let entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        entries.get(name).and_then(|entry| entry.latest.clone())
+    }
+
+    /// Returns the names that have a stored state, in no particular order.
+    pub fn names(&self) -> Vec<String> {
+        let entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        entries
+            .iter()
+            .filter(|(_, entry)| entry.latest.is_some())
+            .map(|(name, _)| name.clone())
+            .collect()
+    }
+
+    /// Starts watching `name`. The watcher receives every state pushed after this call;
+    /// use [`StateHub::latest`] for the current one.
+    pub fn watch(&self, name: &str) -> StateWatcher {
+        let mut entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        let entry = entries.entry(name.to_string()).or_insert_with(Entry::new);
+        StateWatcher {
+            name: name.to_string(),
+            updates: Some(entry.updates.subscribe()),
+            entries: Arc::downgrade(&self.entries),
+        }
+    }
+
+    #[cfg(test)]
+    pub(crate) fn entry_count(&self) -> usize {
+        self.entries
+            .lock()
+            .unwrap_or_else(|err| err.into_inner())
+            .len()
+    }
+}
+
+/// Receives the states pushed to a [`StateHub`] for one name.
+#[derive(Debug)]
+pub struct StateWatcher {
+    name: String,
+    // Only `None` while dropping.
+    updates: Option<broadcast::Receiver<AppState>>,
+    // Weak, so that watchers alone don't keep the hub and its senders alive.
+    entries: Weak<Mutex<Entries>>,
+}
+
+impl StateWatcher {
+    /// Waits for the next pushed state. A watcher more than [`WATCH_BUFFER`] updates behind
+    /// skips the ones it missed. Returns `None` once every handle to the hub is dropped.
+    pub async fn changed(&mut self) -> Option<AppState> {
+        let updates = self.updates.as_mut()?;
+        loop {
+            match updates.recv().await {
+                Ok(state) => return Some(state),
+                Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                Err(broadcast::error::RecvError::Closed) => return None,
+            }
+        }
+    }
+}
+
+impl Drop for StateWatcher {
+    /// Removes the entry of a name nobody pushed a state for once its last watcher goes.
+    fn drop(&mut self) {
+        drop(self.updates.take());
+        let entries = match self.entries.upgrade() {
+            Some(entries) => entries,
+            None => return,
+        };
+        let mut entries = entries.lock().unwrap_or_else(|err| err.into_inner());
+        let unused = entries.get(&self.name).map_or(false, |entry| {
+            entry.latest.is_none() && entry.updates.receiver_count() == 0
+        });
+        if unused {
+            entries.remove(&self.name);
+        }
+    }
+}
@@ -0,0 +1,131 @@
+//! # State Index
+//!
+//! An in-memory catalog of the state files in a directory, holding just enough of every
+//! state to list the managed applications. Building it decodes only the
+//! [`StateHeader`] of each file, so large output buffers and error logs are skipped.
+//!
+//! State files are recognised by the extensions in [`StateFormat::SUPPORTED_EXTENSIONS`].
+//! Like [`list_orphaned_states`](crate::state_batch::list_orphaned_states), files that
+//! can't be read or decoded are logged and left out.
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::core::version::SoftwareVersion;
+use dusa_collection_utils::log;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use crate::aggregator::Status;
+use crate::state_persistence::{
+    decode_state, read_state_file, unwrap_state_error, StateFormat, StateHeader,
+};
+
+/// One state file of a [`StateIndex`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StateIndexEntry {
+    /// The file the entry was read from.
+    pub path: PathBuf,
+    /// See [`AppState::name`](crate::state_persistence::AppState::name).
+    pub name: String,
+    /// See [`AppState::status`](crate::state_persistence::AppState::status).
+    pub status: Status,
+    /// See [`AppState::pid`](crate::state_persistence::AppState::pid).
+    pub pid: u32,
+    /// See [`AppState::last_updated`](crate::state_persistence::AppState::last_updated).
+    pub last_updated: u64,
+    /// See [`AppState::version`](crate::state_persistence::AppState::version).
+    pub version: SoftwareVersion,
+}
+
+/// The applications stored in a directory, see the [module documentation](crate::state_index).
+#[derive(Debug, Clone)]
+pub struct StateIndex {
+    dir: PathBuf,
+    entries: Vec<StateIndexEntry>,
+}
+
+impl StateIndex {
+    /// Scans `dir` and indexes every state file directly inside it.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the directory can't be listed.
+    pub async fn build(dir: &Path) -> io::Result<Self> {
+        let mut index = Self {
+            dir: dir.to_path_buf(),
+            entries: Vec::new(),
+        };
+        index.refresh().await?;
+        Ok(index)
+    }
+
+    /// Scans the directory again, replacing every entry. The index is left unchanged if
+    /// the directory can't be listed.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the directory can't be listed.
+    pub async fn refresh(&mut self) -> io::Result<()> {
+        let mut paths = Vec::new();
+        let mut dir_entries = tokio::fs::read_dir(&self.dir).await?;
+        while let Some(entry) = dir_entries.next_entry().await? {
+            let path = entry.path();
+            if entry.file_type().await?.is_file() && StateFormat::from_path(&path).is_some() {
+                paths.push(path);
+            }
+        }
+        paths.sort();
+
+        let mut entries = Vec::with_capacity(paths.len());
+        for path in paths {
+            match read_header(&path).await {
+                Ok(header) => entries.push(StateIndexEntry {
+                    path,
+                    name: header.name,
+                    status: header.status,
+                    pid: header.pid,
+                    last_updated: header.last_updated,
+                    version: header.version,
+                }),
+                Err(err) => log!(
+                    LogLevel::Warn,
+                    "Leaving unreadable state file {} out of the index: {}",
+                    path.display(),
+                    err
+                ),
+            }
+        }
+        self.entries = entries;
+        Ok(())
+    }
+
+    /// Returns the directory the index covers.
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// Returns every entry, sorted by file path.
+    pub fn all(&self) -> &[StateIndexEntry] {
+        &self.entries
+    }
+
+    /// Returns the entry of the application called `name`, the first by path if several
+    /// files claim it.
+    pub fn by_name(&self, name: &str) -> Option<&StateIndexEntry> {
+        self.entries.iter().find(|entry| entry.name == name)
+    }
+
+    /// Returns the entries whose application is `status`.
+    pub fn filter_by_status(&self, status: Status) -> Vec<&StateIndexEntry> {
+        self.entries
+            .iter()
+            .filter(|entry| entry.status == status)
+            .collect()
+    }
+}
+
+async fn read_header(path: &Path) -> Result<StateHeader, Box<dyn std::error::Error>> {
+    let content = read_state_file(path).await.map_err(unwrap_state_error)?;
+    match StateFormat::from_path(path).unwrap_or(StateFormat::Encrypted) {
+        StateFormat::Encrypted => decode_state(&content),
+        StateFormat::Toml => Ok(toml::from_str(&content)?),
+        StateFormat::Json => Ok(serde_json::from_str(&content)?),
+    }
+}
@@ -0,0 +1,201 @@
+//! # State Marshal
+//!
+//! JSON encoding of [`AppState`] with optional human readable timestamps.
+//!
+//! Timestamps are stored as Unix seconds, which is compact but opaque when reading a state
+//! by hand. With [`StateMarshaler::human_timestamps`] set, every timestamp field
+//! ([`AppState::last_updated`], [`AppState::started_at`], the first element of each
+//! [`Output`](crate::state_persistence::Output),
+//! [`Event::timestamp`](crate::state_persistence::Event::timestamp) and
+//! [`ErrorItem::first_seen`] and [`ErrorItem::next_retry_at`]) is emitted as an RFC 3339
+//! string such as `"2025-02-07T14:05:00Z"` instead.
+//!
+//! [`ErrorItem::first_seen`]: crate::state_persistence::ErrorItem::first_seen
+//! [`ErrorItem::next_retry_at`]: crate::state_persistence::ErrorItem::next_retry_at
+//!
+//! For schemaless key-value sinks, [`state_to_flat_map`] and [`state_from_flat_map`] convert
+//! between an [`AppState`] and a single level map with dotted keys such as
+//! `config.log_level`.
+
+use chrono::{DateTime, SecondsFormat, Utc};
+use serde::de::Error as _;
+use serde_json::{Map, Value};
+use std::collections::BTreeMap;
+
+use crate::state_persistence::{state_from_value, AppState};
+use crate::support_bundle::redact_secrets;
+use crate::timestamp::{datetime_to_unix_timestamp, unix_timestamp_to_datetime};
+
+/// Encodes and decodes [`AppState`] as JSON.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct StateMarshaler {
+    /// Emit timestamps as RFC 3339 strings instead of Unix seconds.
+    pub human_timestamps: bool,
+}
+
+impl StateMarshaler {
+    /// Encodes `state` as JSON. Without [`StateMarshaler::human_timestamps`] this is exactly
+    /// `serde_json::to_vec(state)`.
+    pub fn marshal(&self, state: &AppState) -> Result<Vec<u8>, serde_json::Error> {
+        if !self.human_timestamps {
+            return serde_json::to_vec(state);
+        }
+
+        let mut value = serde_json::to_value(state)?;
+        convert_timestamps(&mut value, &mut |timestamp| {
+            if let Some(seconds) = timestamp.as_u64() {
+                *timestamp = Value::String(
+                    unix_timestamp_to_datetime(seconds).to_rfc3339_opts(SecondsFormat::Secs, true),
+                );
+            }
+            Ok(())
+        })?;
+        serde_json::to_vec(&value)
+    }
+
+    /// Decodes an [`AppState`] from JSON. Timestamps may be given either as Unix seconds or
+    /// as RFC 3339 strings, whatever [`StateMarshaler::human_timestamps`] is set to.
+    pub fn unmarshal(&self, data: &[u8]) -> Result<AppState, serde_json::Error> {
+        let mut value: Value = serde_json::from_slice(data)?;
+        convert_timestamps(&mut value, &mut |timestamp| {
+            if let Some(text) = timestamp.as_str() {
+                let datetime = DateTime::parse_from_rfc3339(text).map_err(|err| {
+                    serde_json::Error::custom(format!("invalid timestamp {:?}: {}", text, err))
+                })?;
+                *timestamp = Value::from(datetime_to_unix_timestamp(datetime.with_timezone(&Utc)));
+            }
+            Ok(())
+        })?;
+        state_from_value(value)
+    }
+}
+
+/// Flattens `state` into a single level map. Nested objects are expanded into dotted keys
+/// (`config.log_level`, `config.database.pool_size`), arrays are kept whole as values and
+/// every top level array `field` gets an extra `field_count` entry such as
+/// `error_log_count`.
+///
+/// Secrets such as `config.database.url` are redacted like in a
+/// [support bundle](crate::support_bundle), since the map is meant for telemetry sinks. A
+/// state rebuilt by [`state_from_flat_map`] thus holds `[redacted]` in their place.
+///
+/// # Example
+/// ```rust
+/// # use artisan_middleware::state_marshal::state_to_flat_map;
+/// # use artisan_middleware::state_persistence::AppState;
+/// # fn push(state: &AppState) -> Result<(), serde_json::Error> {
+/// let map = state_to_flat_map(state)?;
+/// println!("{} errors", map["error_log_count"]);
+/// # Ok(())
+/// # }
+/// ```
+pub fn state_to_flat_map(state: &AppState) -> Result<BTreeMap<String, Value>, serde_json::Error> {
+    let mut map = BTreeMap::new();
+    let mut value = serde_json::to_value(state)?;
+    redact_secrets(&mut value, "");
+    if let Value::Object(fields) = value {
+        for (key, value) in fields {
+            if let Value::Array(items) = &value {
+                map.insert(format!("{}_count", key), Value::from(items.len()));
+            }
+            flatten_into(&mut map, key, value);
+        }
+    }
+    Ok(map)
+}
+
+/// Rebuilds an [`AppState`] from a map produced by [`state_to_flat_map`]. The derived
+/// `_count` entries are ignored.
+///
+/// # Errors
+/// Returns an `Err` if a key is both a value and the prefix of a dotted key, or if the
+/// rebuilt value isn't a valid state.
+pub fn state_from_flat_map(map: &BTreeMap<String, Value>) -> Result<AppState, serde_json::Error> {
+    let mut root = Map::new();
+    for (key, value) in map {
+        let derived = !key.contains('.')
+            && key.strip_suffix("_count").map_or(false, |field| {
+                matches!(map.get(field), Some(Value::Array(_)))
+            });
+        if derived {
+            continue;
+        }
+
+        let mut parts: Vec<&str> = key.split('.').collect();
+        let last = parts.pop().unwrap_or_default();
+        let mut object = &mut root;
+        for part in parts {
+            object = match object
+                .entry(part)
+                .or_insert_with(|| Value::Object(Map::new()))
+            {
+                Value::Object(object) => object,
+                _ => return Err(conflicting_key(key)),
+            };
+        }
+        if object.insert(last.to_string(), value.clone()).is_some() {
+            return Err(conflicting_key(key));
+        }
+    }
+    state_from_value(Value::Object(root))
+}
+
+fn flatten_into(map: &mut BTreeMap<String, Value>, key: String, value: Value) {
+    match value {
+        // Empty objects are kept as-is so they survive the round trip.
+        Value::Object(fields) if !fields.is_empty() => {
+            for (field, value) in fields {
+                flatten_into(map, format!("{}.{}", key, field), value);
+            }
+        }
+        value => {
+            map.insert(key, value);
+        }
+    }
+}
+
+fn conflicting_key(key: &str) -> serde_json::Error {
+    serde_json::Error::custom(format!("flat map key {:?} conflicts with another key", key))
+}
+
+/// Calls `convert` on every timestamp inside a serialized [`AppState`].
+fn convert_timestamps<F>(state: &mut Value, convert: &mut F) -> Result<(), serde_json::Error>
+where
+    F: FnMut(&mut Value) -> Result<(), serde_json::Error>,
+{
+    for field in ["last_updated", "stared_at", "started_at"] {
+        if let Some(timestamp) = state.get_mut(field) {
+            convert(timestamp)?;
+        }
+    }
+
+    for stream in ["stdout", "stderr"] {
+        if let Some(Value::Array(outputs)) = state.get_mut(stream) {
+            for output in outputs {
+                if let Some(timestamp) = output.get_mut(0) {
+                    convert(timestamp)?;
+                }
+            }
+        }
+    }
+
+    if let Some(Value::Array(events)) = state.get_mut("events") {
+        for event in events {
+            if let Some(timestamp) = event.get_mut("timestamp") {
+                convert(timestamp)?;
+            }
+        }
+    }
+
+    if let Some(Value::Array(errors)) = state.get_mut("error_log") {
+        for error in errors {
+            for field in ["first_seen", "next_retry_at"] {
+                if let Some(timestamp) = error.get_mut(field) {
+                    convert(timestamp)?;
+                }
+            }
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,183 @@
+//! # State Metrics
+//!
+//! Renders an [`AppState`] in the Prometheus text exposition format so it can be served
+//! from a `/metrics` endpoint or dropped into a node exporter textfile directory.
+//!
+//! Every sample carries an `app` label with [`AppState::name`]. The exported families are:
+//!
+//! | Metric                        | Type    | Source                                 |
+//! |-------------------------------|---------|----------------------------------------|
+//! | `artisan_app_pid`             | gauge   | [`AppState::pid`]                      |
+//! | `artisan_app_event_counter`   | counter | [`AppState::event_counter`]            |
+//! | `artisan_app_error_count`     | gauge   | length of [`AppState::error_log`]      |
+//! | `artisan_app_stdout_lines`    | gauge   | length of [`AppState::stdout`]         |
+//! | `artisan_app_stderr_lines`    | gauge   | length of [`AppState::stderr`]         |
+//! | `artisan_app_uptime_seconds`  | gauge   | now minus [`AppState::started_at`]     |
+//! | `artisan_app_status`          | gauge   | always `1`, with a `status` label      |
+//!
+//! For InfluxDB, [`render_influx`] encodes the same numbers as a single line of the line
+//! protocol.
+
+use std::fmt::Write;
+
+use crate::state_persistence::AppState;
+use crate::state_store::StateStore;
+use crate::timestamp::current_timestamp;
+
+/// Produces Prometheus metrics for the state held by a [`StateStore`].
+///
+/// The store's lock is only held in shared mode, and only while rendering.
+#[derive(Debug, Clone)]
+pub struct StateCollector {
+    store: StateStore,
+}
+
+impl StateCollector {
+    /// Creates a collector reading from `store`.
+    pub fn new(store: StateStore) -> Self {
+        Self { store }
+    }
+
+    /// Renders the current state in the Prometheus text format.
+    pub fn gather(&self) -> String {
+        let now = current_timestamp();
+        self.store.inspect(|state| render_prometheus(state, now))
+    }
+}
+
+/// Renders `state` in the Prometheus text format, computing the uptime against `now`
+/// (a Unix timestamp in seconds). A state that was never started reports an uptime of `0`.
+pub fn render_prometheus(state: &AppState, now: u64) -> String {
+    let app = escape_label_value(&state.name);
+    let uptime = match state.started_at {
+        0 => 0,
+        started => now.saturating_sub(started),
+    };
+
+    let mut out = String::new();
+    let mut sample = |name: &str, kind: &str, help: &str, labels: &str, value: u64| {
+        // Writing into a String can't fail.
+        let _ = writeln!(out, "# HELP {} {}", name, help);
+        let _ = writeln!(out, "# TYPE {} {}", name, kind);
+        let _ = writeln!(out, "{}{{app=\"{}\"{}}} {}", name, app, labels, value);
+    };
+
+    sample(
+        "artisan_app_pid",
+        "gauge",
+        "PID of the application process.",
+        "",
+        state.pid as u64,
+    );
+    sample(
+        "artisan_app_event_counter",
+        "counter",
+        "Number of events recorded by the application.",
+        "",
+        state.event_counter as u64,
+    );
+    sample(
+        "artisan_app_error_count",
+        "gauge",
+        "Number of entries in the error log.",
+        "",
+        state.error_log.len() as u64,
+    );
+    sample(
+        "artisan_app_stdout_lines",
+        "gauge",
+        "Number of captured stdout lines.",
+        "",
+        state.stdout.len() as u64,
+    );
+    sample(
+        "artisan_app_stderr_lines",
+        "gauge",
+        "Number of captured stderr lines.",
+        "",
+        state.stderr.len() as u64,
+    );
+    sample(
+        "artisan_app_uptime_seconds",
+        "gauge",
+        "Seconds since the application was started.",
+        "",
+        uptime,
+    );
+    sample(
+        "artisan_app_status",
+        "gauge",
+        "Current lifecycle status of the application.",
+        &format!(",status=\"{:?}\"", state.status),
+        1,
+    );
+
+    out
+}
+
+/// Renders `state` as one InfluxDB line protocol point in `measurement`, timestamped with
+/// [`AppState::last_updated`] in nanoseconds (the protocol's default precision).
+///
+/// Tags are `environment`, `log_level`, `name` and `status`; empty tags are left out.
+/// Fields are the integers `pid`, `event_counter`, `max_ram_usage`, `max_cpu_usage`,
+/// `error_count`, `stdout_lines` and `stderr_lines`.
+///
+/// # Example
+/// ```rust
+/// # use artisan_middleware::state_metrics::render_influx;
+/// # use artisan_middleware::state_persistence::AppState;
+/// # fn push(state: &AppState) {
+/// let line = render_influx(state, "artisan_app");
+/// // artisan_app,environment=production,log_level=Info,name=api,status=Running pid=42i,... 1700000000000000000
+/// # }
+/// ```
+pub fn render_influx(state: &AppState, measurement: &str) -> String {
+    let tags = [
+        ("environment", state.config.environment.clone()),
+        ("log_level", format!("{:?}", state.config.log_level)),
+        ("name", state.name.clone()),
+        ("status", format!("{:?}", state.status)),
+    ];
+    let fields = [
+        ("pid", state.pid as u64),
+        ("event_counter", state.event_counter as u64),
+        ("max_ram_usage", state.config.max_ram_usage as u64),
+        ("max_cpu_usage", state.config.max_cpu_usage as u64),
+        ("error_count", state.error_log.len() as u64),
+        ("stdout_lines", state.stdout.len() as u64),
+        ("stderr_lines", state.stderr.len() as u64),
+    ];
+
+    let mut line = escape_influx(measurement, &[',', ' ']);
+    for (key, value) in tags.iter().filter(|(_, value)| !value.is_empty()) {
+        let _ = write!(line, ",{}={}", key, escape_influx(value, &[',', '=', ' ']));
+    }
+    for (i, (key, value)) in fields.iter().enumerate() {
+        let separator = if i == 0 { ' ' } else { ',' };
+        let _ = write!(line, "{}{}={}i", separator, key, value);
+    }
+    let _ = write!(line, " {}", state.last_updated as u128 * 1_000_000_000);
+
+    line
+}
+
+/// Backslash-escapes `special` characters, plus backslashes themselves. Newlines can't be
+/// escaped in the line protocol and are replaced by spaces first.
+fn escape_influx(value: &str, special: &[char]) -> String {
+    let mut escaped = String::with_capacity(value.len());
+    for c in value.chars() {
+        let c = if c == '\n' { ' ' } else { c };
+        if c == '\\' || special.contains(&c) {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+fn escape_label_value(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
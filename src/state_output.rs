@@ -0,0 +1,140 @@
+//! # State Output
+//!
+//! Helpers for digging through the captured [`AppState::stdout`] and [`AppState::stderr`]
+//! lines of an application.
+//!
+//! [`AppState::stdout`]: crate::state_persistence::AppState::stdout
+//! [`AppState::stderr`]: crate::state_persistence::AppState::stderr
+
+use regex::Regex;
+use std::fmt;
+use std::time::Duration;
+
+use crate::state_persistence::{AppState, Output, OutputTarget};
+use crate::timestamp::current_timestamp;
+
+/// How much of a stream has been captured and evicted, see [`output_overflow_summary`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct OutputSummary {
+    /// Lines ever appended to the stream.
+    pub total_lines_written: u64,
+    /// Lines evicted to stay within the output limit.
+    pub total_lines_dropped: u64,
+    /// Lines currently kept.
+    pub current_line_count: usize,
+    /// Timestamp of the oldest kept line, `0` if there is none.
+    pub oldest_timestamp: u64,
+}
+
+/// Returned when a search pattern is not a valid regular expression.
+#[derive(Debug, Clone)]
+pub struct InvalidPatternError {
+    /// The pattern that failed to compile.
+    pub pattern: String,
+    source: regex::Error,
+}
+
+impl fmt::Display for InvalidPatternError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "Invalid pattern {:?}: {}", self.pattern, self.source)
+    }
+}
+
+impl std::error::Error for InvalidPatternError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        Some(&self.source)
+    }
+}
+
+fn compile(pattern: &str) -> Result<Regex, InvalidPatternError> {
+    Regex::new(pattern).map_err(|source| InvalidPatternError {
+        pattern: pattern.to_string(),
+        source,
+    })
+}
+
+/// Returns the lines of `outputs` whose text matches the regular expression `pattern`.
+///
+/// # Errors
+/// Returns an [`InvalidPatternError`] if `pattern` doesn't compile.
+pub fn search_output(
+    outputs: &[Output],
+    pattern: &str,
+) -> Result<Vec<Output>, InvalidPatternError> {
+    let regex = compile(pattern)?;
+    Ok(outputs
+        .iter()
+        .filter(|output| regex.is_match(&output.1))
+        .cloned()
+        .collect())
+}
+
+/// Like [`search_output`], but returns every match together with up to `before` preceding
+/// and `after` following lines, like `grep -B/-A`.
+///
+/// Matches whose context windows overlap or touch are merged into a single group, so no
+/// line is ever returned twice.
+///
+/// # Errors
+/// Returns an [`InvalidPatternError`] if `pattern` doesn't compile.
+pub fn search_output_context(
+    outputs: &[Output],
+    pattern: &str,
+    before: usize,
+    after: usize,
+) -> Result<Vec<Vec<Output>>, InvalidPatternError> {
+    let regex = compile(pattern)?;
+
+    // Half-open index ranges of every group, merged as we go.
+    let mut ranges: Vec<(usize, usize)> = Vec::new();
+    for (index, output) in outputs.iter().enumerate() {
+        if !regex.is_match(&output.1) {
+            continue;
+        }
+        let start = index.saturating_sub(before);
+        let end = (index + after + 1).min(outputs.len());
+        match ranges.last_mut() {
+            Some(last) if start <= last.1 => last.1 = last.1.max(end),
+            _ => ranges.push((start, end)),
+        }
+    }
+
+    Ok(ranges
+        .into_iter()
+        .map(|(start, end)| outputs[start..end].to_vec())
+        .collect())
+}
+
+/// Returns the lines of `outputs` captured between `from` and `to`, both inclusive Unix
+/// timestamps in **seconds** like every other [`AppState`] timestamp.
+///
+/// A `to` of `0` leaves the range open ended. If `from` is after `to` nothing matches.
+///
+/// [`AppState`]: crate::state_persistence::AppState
+pub fn filter_output_by_time_range(outputs: &[Output], from: u64, to: u64) -> Vec<Output> {
+    let to = if to == 0 { u64::MAX } else { to };
+    outputs
+        .iter()
+        .filter(|output| output.0 >= from && output.0 <= to)
+        .cloned()
+        .collect()
+}
+
+/// Returns the lines of `outputs` captured within the last `window`.
+pub fn filter_output_since(outputs: &[Output], window: Duration) -> Vec<Output> {
+    let from = current_timestamp().saturating_sub(window.as_secs());
+    filter_output_by_time_range(outputs, from, 0)
+}
+
+/// Summarises the `target` stream of `state`, combining its
+/// [`OutputMeta`](crate::state_persistence::OutputMeta) counters with the lines still kept.
+pub fn output_overflow_summary(state: &AppState, target: OutputTarget) -> OutputSummary {
+    let outputs = state.outputs(target);
+    let meta = state.output_meta(target);
+    OutputSummary {
+        total_lines_written: meta.lines_written,
+        total_lines_dropped: meta.lines_dropped,
+        current_line_count: outputs.len(),
+        oldest_timestamp: outputs.first().map_or(0, |output| output.0),
+    }
+}
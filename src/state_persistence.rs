@@ -1,20 +1,219 @@
+use chrono::{DateTime, Utc};
 use colored::Colorize;
 use dusa_collection_utils::core::errors::Errors;
 use dusa_collection_utils::core::logger::{set_log_level, LogLevel};
 use dusa_collection_utils::core::types::pathtype::PathType;
 use dusa_collection_utils::core::types::stringy::Stringy;
 use dusa_collection_utils::core::version::SoftwareVersion;
+use flate2::read::GzDecoder;
+use serde::de::DeserializeOwned;
 use serde::{Deserialize, Serialize};
-use std::{fmt, fs};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fmt;
+use std::future::Future;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncSeekExt};
 
 use crate::aggregator::{Metrics, Status};
 use crate::config::AppConfig;
-use crate::encryption::{simple_decrypt, simple_encrypt};
+use crate::diff::diff_serialized;
+use crate::encryption::{decrypt_with_key, encrypt_with_key, simple_decrypt, simple_encrypt};
 use crate::git_actions::GitServer;
-use crate::timestamp::{current_timestamp, format_unix_timestamp};
+use crate::key_provider::KeyProvider;
+use crate::state_fs::{write_atomic, write_atomic_async, write_atomic_with, FileSystem};
+use crate::timestamp::{
+    current_timestamp, datetime_to_unix_timestamp, format_unix_timestamp,
+    unix_timestamp_to_datetime,
+};
 use dusa_collection_utils::core::errors::ErrorArrayItem;
 use dusa_collection_utils::log;
 
+/// A single captured line of standard output or standard error.
+///
+/// The first element is a Unix timestamp in **seconds**, the second is the line itself.
+pub type Output = (u64, String);
+
+/// Selects which captured stream of an [`AppState`] an operation applies to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum OutputTarget {
+    /// [`AppState::stdout`]
+    Stdout,
+    /// [`AppState::stderr`]
+    Stderr,
+}
+
+/// Counters of a captured stream kept next to its lines, see [`AppState::stdout_meta`].
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord)]
+pub struct OutputMeta {
+    /// Lines appended through [`AppState::append_output`].
+    #[serde(default)]
+    pub lines_written: u64,
+    /// Lines [`AppState::append_output`] evicted to stay within its limit.
+    #[serde(default)]
+    pub lines_dropped: u64,
+}
+
+/// Default number of lines kept per stream, matching the supervisor's rolling buffers.
+pub const DEFAULT_OUTPUT_LIMIT: usize = 500;
+
+/// Number of entries kept in [`AppState::events`]; older events are dropped first.
+pub const EVENT_LOG_LIMIT: usize = 500;
+
+/// A single entry of the [`AppState::events`] timeline.
+#[derive(Serialize, Deserialize, Debug, PartialEq, Eq, PartialOrd, Ord, Clone)]
+pub struct Event {
+    /// Unix timestamp (seconds) at which the event was recorded.
+    pub timestamp: u64,
+
+    /// What happened, e.g. `started`, `stopped`, `crashed` or `config-reloaded`.
+    pub kind: String,
+
+    /// Free form details about the event.
+    pub detail: String,
+}
+
+/// How serious an [`ErrorItem`] is. Ordered from least to most severe.
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    /// Something went wrong but the application carried on.
+    Warn,
+    /// An operation failed. Entries written before severities existed decode as this.
+    #[default]
+    Error,
+    /// The application can't continue.
+    Fatal,
+}
+
+impl Severity {
+    fn is_default(&self) -> bool {
+        *self == Severity::default()
+    }
+}
+
+impl fmt::Display for Severity {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        let name = match self {
+            Severity::Warn => "warn",
+            Severity::Error => "error",
+            Severity::Fatal => "fatal",
+        };
+        f.write_str(name)
+    }
+}
+
+/// An entry of [`AppState::error_log`]: an [`ErrorArrayItem`] tagged with a [`Severity`].
+///
+/// The error's fields are stored inline and the severity is left out when it is
+/// [`Severity::Error`], so the encoding matches the plain `ErrorArrayItem` entries written
+/// by older releases. Derefs to the wrapped [`ErrorArrayItem`].
+#[derive(Serialize, Deserialize, Debug, PartialEq, Eq, PartialOrd, Ord, Clone)]
+pub struct ErrorItem {
+    /// The recorded error.
+    #[serde(flatten)]
+    pub error: ErrorArrayItem,
+
+    /// How serious the error is.
+    #[serde(default, skip_serializing_if = "Severity::is_default")]
+    pub severity: Severity,
+
+    /// How often the failed operation has been retried, see [`ErrorItem::record_retry`].
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub retry_count: u32,
+
+    /// Unix timestamp (seconds) before which the operation should not be retried.
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub next_retry_at: u64,
+
+    /// Unix timestamp (seconds) at which [`AppState::append_error`] recorded the error, `0`
+    /// if it was added otherwise or by a release that didn't track it. See
+    /// [`AppState::prune_old_errors`].
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub first_seen: u64,
+
+    /// Structured details for alerting, e.g. `file`, `line` or `request_id`. See
+    /// [`ErrorItem::with_context`].
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub context: BTreeMap<String, String>,
+}
+
+impl ErrorItem {
+    /// Wraps `error` with the given severity.
+    pub fn new(severity: Severity, error: ErrorArrayItem) -> Self {
+        Self {
+            error,
+            severity,
+            retry_count: 0,
+            next_retry_at: 0,
+            first_seen: 0,
+            context: BTreeMap::new(),
+        }
+    }
+
+    /// Attaches the context entry `key`, replacing an earlier value.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_persistence::{ErrorItem, Severity};
+    /// # use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    /// let error = ErrorArrayItem::new(Errors::GeneralError, "upstream timed out");
+    /// let item = ErrorItem::new(Severity::Error, error)
+    ///     .with_context("request_id", "b41c")
+    ///     .with_context("file", "upstream.rs");
+    /// assert_eq!(item.context("request_id"), Some("b41c"));
+    /// ```
+    pub fn with_context<K: Into<String>, V: Into<String>>(mut self, key: K, value: V) -> Self {
+        self.context.insert(key.into(), value.into());
+        self
+    }
+
+    /// Returns the context entry `key`, if set.
+    pub fn context(&self, key: &str) -> Option<&str> {
+        self.context.get(key).map(String::as_str)
+    }
+
+    /// Returns `true` if fewer than `max_retries` retries have been made and the backoff set
+    /// by the last [`ErrorItem::record_retry`] has passed at `now` (Unix seconds).
+    pub fn should_retry(&self, max_retries: u32, now: u64) -> bool {
+        self.retry_count < max_retries && now >= self.next_retry_at
+    }
+
+    /// Counts a retry and holds off the next one until `backoff` from now, rounded down to
+    /// whole seconds like every other timestamp.
+    pub fn record_retry(&mut self, backoff: Duration) {
+        self.retry_count = self.retry_count.saturating_add(1);
+        self.next_retry_at = current_timestamp().saturating_add(backoff.as_secs());
+    }
+}
+
+fn is_zero<T: Default + PartialEq>(value: &T) -> bool {
+    *value == T::default()
+}
+
+impl From<ErrorArrayItem> for ErrorItem {
+    fn from(error: ErrorArrayItem) -> Self {
+        Self::new(Severity::default(), error)
+    }
+}
+
+impl std::ops::Deref for ErrorItem {
+    type Target = ErrorArrayItem;
+
+    fn deref(&self) -> &ErrorArrayItem {
+        &self.error
+    }
+}
+
+impl fmt::Display for ErrorItem {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "[{}] {}", self.severity, self.error)
+    }
+}
+
 /// Represents the application’s overall state, including:
 /// - **Application name and version**  
 /// - **Status** (e.g., running, stopped)  
@@ -22,6 +221,9 @@ use dusa_collection_utils::log;
 /// - **Logs of any encountered errors**  
 /// - **Configuration** settings  
 /// - **Timestamps** for when the state was last updated
+///
+/// Every timestamp stored on an `AppState` (including the per-line [`Output`] timestamps)
+/// is a Unix timestamp in **seconds**, as produced by [`current_timestamp`].
 #[derive(Serialize, Deserialize, Debug, PartialEq, Eq, PartialOrd, Ord, Clone)]
 pub struct AppState {
     /// Name of the crate or application.
@@ -39,18 +241,23 @@ pub struct AppState {
     /// The PID of the running application process.
     pub pid: u32,
 
-    /// A Unix timestamp representing when the state was last updated.
+    /// A Unix timestamp (seconds) representing when the state was last updated.
     pub last_updated: u64,
 
-    /// A Unix timestamp created when the application was initially launched
-    pub stared_at: u64,
+    /// A Unix timestamp (seconds) created when the application was initially launched
+    ///
+    /// Stored under the historical key `stared_at` so older readers keep working; the
+    /// corrected key `started_at` is accepted as well, see
+    /// [`StatePersistence::migrate_started_at`].
+    #[serde(rename = "stared_at", alias = "started_at")]
+    pub started_at: u64,
 
     /// An incrementing counter used to detect if the application is actively performing actions
     /// (e.g., each critical operation increases it by 1).
     pub event_counter: u32,
 
     /// A list of errors at the Artisan Infrastructure level to assist with runner post mordems
-    pub error_log: Vec<ErrorArrayItem>,
+    pub error_log: Vec<ErrorItem>,
 
     /// Configuration settings loaded from external sources (e.g., a config file).
     pub config: AppConfig,
@@ -59,10 +266,528 @@ pub struct AppState {
     pub system_application: bool,
 
     /// The captured output of the standart output with timestamps
-    pub stdout: Vec<(u64, String)>,
+    pub stdout: Vec<Output>,
 
     /// The captured output of the standart error with timestamps
-    pub stderr: Vec<(u64, String)>,
+    pub stderr: Vec<Output>,
+
+    /// How many lines were written to and evicted from [`AppState::stdout`].
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub stdout_meta: OutputMeta,
+
+    /// How many lines were written to and evicted from [`AppState::stderr`].
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub stderr_meta: OutputMeta,
+
+    /// Timeline of notable events, oldest first, capped at [`EVENT_LOG_LIMIT`] entries.
+    /// See [`AppState::record_event`].
+    #[serde(default)]
+    pub events: Vec<Event>,
+
+    /// Incremented by every [`StatePersistence::save_state_cas`], used to detect concurrent
+    /// writers. Plain saves leave it untouched.
+    #[serde(default)]
+    pub generation: u64,
+
+    /// Free form metadata attached by the supervisor, e.g. `deploy_sha`, `region` or `owner`.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub labels: BTreeMap<String, String>,
+
+    /// Simple markers such as `production`, `canary` or `critical`, each listed once in the
+    /// order they were added. See [`AppState::add_tag`].
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tags: Vec<String>,
+
+    /// Names of the applications this one requires to be running, see
+    /// [`DependencyGraph`](crate::dependency_graph::DependencyGraph).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub dependencies: Vec<String>,
+
+    /// Top level keys of the loaded file that this version doesn't know, e.g. fields added
+    /// by a newer agent. They are written back unchanged on save, so older tooling doesn't
+    /// delete data it can't interpret.
+    #[serde(flatten, skip_deserializing)]
+    pub extra: ExtraFields,
+}
+
+/// Unrecognised top level keys of a state file, see [`AppState::extra`].
+///
+/// `null` values are not kept, since TOML can't represent them.
+#[derive(Serialize, Deserialize, Debug, Clone, Default, PartialEq, Eq)]
+#[serde(transparent)]
+pub struct ExtraFields(pub BTreeMap<String, serde_json::Value>);
+
+impl std::ops::Deref for ExtraFields {
+    type Target = BTreeMap<String, serde_json::Value>;
+
+    fn deref(&self) -> &Self::Target {
+        &self.0
+    }
+}
+
+impl std::ops::DerefMut for ExtraFields {
+    fn deref_mut(&mut self) -> &mut Self::Target {
+        &mut self.0
+    }
+}
+
+// JSON values have no natural order; compare their text so `AppState` stays `Ord`.
+impl Ord for ExtraFields {
+    fn cmp(&self, other: &Self) -> std::cmp::Ordering {
+        let text = |fields: &Self| -> Vec<(String, String)> {
+            fields
+                .0
+                .iter()
+                .map(|(key, value)| (key.clone(), value.to_string()))
+                .collect()
+        };
+        text(self).cmp(&text(other))
+    }
+}
+
+impl PartialOrd for ExtraFields {
+    fn partial_cmp(&self, other: &Self) -> Option<std::cmp::Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl AppState {
+    /// Returns [`AppState::last_updated`] as a UTC datetime.
+    pub fn last_updated_time(&self) -> DateTime<Utc> {
+        unix_timestamp_to_datetime(self.last_updated)
+    }
+
+    /// Returns [`AppState::started_at`] as a UTC datetime.
+    pub fn started_at_time(&self) -> DateTime<Utc> {
+        unix_timestamp_to_datetime(self.started_at)
+    }
+
+    /// Stores `time` in [`AppState::last_updated`], truncated to whole seconds.
+    pub fn set_last_updated(&mut self, time: DateTime<Utc>) {
+        self.last_updated = datetime_to_unix_timestamp(time);
+    }
+
+    /// Stores `time` in [`AppState::started_at`], truncated to whole seconds.
+    pub fn set_started_at(&mut self, time: DateTime<Utc>) {
+        self.started_at = datetime_to_unix_timestamp(time);
+    }
+
+    /// Returns the captured lines of the given stream.
+    pub fn outputs(&self, target: OutputTarget) -> &Vec<Output> {
+        match target {
+            OutputTarget::Stdout => &self.stdout,
+            OutputTarget::Stderr => &self.stderr,
+        }
+    }
+
+    /// Returns the lines of the given stream captured between `start` and `end`, both
+    /// inclusive Unix timestamps in seconds. An empty slice if `start` is after `end`.
+    ///
+    /// The bounds are found by binary search, relying on lines being in timestamp order as
+    /// [`AppState::append_output`] keeps them; [`filter_output_by_time_range`] handles
+    /// buffers that aren't.
+    ///
+    /// [`filter_output_by_time_range`]: crate::state_output::filter_output_by_time_range
+    pub fn outputs_between(&self, target: OutputTarget, start: u64, end: u64) -> &[Output] {
+        let outputs = self.outputs(target);
+        let from = outputs.partition_point(|output| output.0 < start);
+        let to = outputs.partition_point(|output| output.0 <= end);
+        &outputs[from..to.max(from)]
+    }
+
+    /// Returns the stdout lines captured between `start` and `end`, see
+    /// [`AppState::outputs_between`].
+    pub fn stdout_between(&self, start: u64, end: u64) -> &[Output] {
+        self.outputs_between(OutputTarget::Stdout, start, end)
+    }
+
+    /// Returns the stderr lines captured between `start` and `end`, see
+    /// [`AppState::outputs_between`].
+    pub fn stderr_between(&self, start: u64, end: u64) -> &[Output] {
+        self.outputs_between(OutputTarget::Stderr, start, end)
+    }
+
+    /// Returns the captured lines of the given stream mutably.
+    pub fn outputs_mut(&mut self, target: OutputTarget) -> &mut Vec<Output> {
+        match target {
+            OutputTarget::Stdout => &mut self.stdout,
+            OutputTarget::Stderr => &mut self.stderr,
+        }
+    }
+
+    /// Returns the counters of the given stream.
+    pub fn output_meta(&self, target: OutputTarget) -> &OutputMeta {
+        match target {
+            OutputTarget::Stdout => &self.stdout_meta,
+            OutputTarget::Stderr => &self.stderr_meta,
+        }
+    }
+
+    /// Appends `line` to the given stream with the current timestamp, dropping the oldest
+    /// lines so that no more than `limit` remain. Returns the number of lines dropped, which
+    /// is also added to the stream's [`OutputMeta`].
+    pub fn append_output(&mut self, target: OutputTarget, line: String, limit: usize) -> usize {
+        let outputs = self.outputs_mut(target);
+        outputs.push((current_timestamp(), line));
+        let dropped = outputs.len().saturating_sub(limit);
+        outputs.drain(..dropped);
+
+        let meta = match target {
+            OutputTarget::Stdout => &mut self.stdout_meta,
+            OutputTarget::Stderr => &mut self.stderr_meta,
+        };
+        meta.lines_written += 1;
+        meta.lines_dropped += dropped as u64;
+        dropped
+    }
+
+    /// Appends an [`Event`] stamped with the current time and bumps [`AppState::event_counter`].
+    /// Once more than [`EVENT_LOG_LIMIT`] events are stored the oldest ones are dropped.
+    pub fn record_event<K: Into<String>, D: Into<String>>(&mut self, kind: K, detail: D) {
+        self.push_event(Event {
+            timestamp: current_timestamp(),
+            kind: kind.into(),
+            detail: detail.into(),
+        });
+    }
+
+    /// Like [`AppState::record_event`], but keeps the timestamp of `event`.
+    pub fn push_event(&mut self, event: Event) {
+        self.events.push(event);
+        if self.events.len() > EVENT_LOG_LIMIT {
+            let excess = self.events.len() - EVENT_LOG_LIMIT;
+            self.events.drain(..excess);
+        }
+        self.event_counter += 1;
+    }
+
+    /// Sets the label `key` to `value`, replacing any previous value.
+    pub fn set_label<K: Into<String>, V: Into<String>>(&mut self, key: K, value: V) {
+        self.labels.insert(key.into(), value.into());
+    }
+
+    /// Returns the value of the label `key`, if set.
+    pub fn label(&self, key: &str) -> Option<&str> {
+        self.labels.get(key).map(String::as_str)
+    }
+
+    /// Removes the label `key`, returning its previous value.
+    pub fn remove_label(&mut self, key: &str) -> Option<String> {
+        self.labels.remove(key)
+    }
+
+    /// Adds `tag` unless it is already present. Returns `true` if it was added.
+    pub fn add_tag<T: Into<String>>(&mut self, tag: T) -> bool {
+        let tag = tag.into();
+        if self.has_tag(&tag) {
+            return false;
+        }
+        self.tags.push(tag);
+        true
+    }
+
+    /// Removes `tag`, returning `true` if it was present.
+    pub fn remove_tag(&mut self, tag: &str) -> bool {
+        let before = self.tags.len();
+        self.tags.retain(|existing| existing != tag);
+        self.tags.len() != before
+    }
+
+    /// Returns `true` if the state carries `tag`.
+    pub fn has_tag(&self, tag: &str) -> bool {
+        self.tags.iter().any(|existing| existing == tag)
+    }
+
+    /// Prepares the state for a restart of the same application: clears the error log and
+    /// captured output along with its counters, resets the event counter, sets the status to [`Status::Starting`]
+    /// and stamps [`AppState::started_at`] and [`AppState::last_updated`] with the current
+    /// time. Identity (name, version, labels) and [`AppState::config`] are kept.
+    pub fn reset_for_restart(&mut self) {
+        let now = current_timestamp();
+        self.error_log.clear();
+        self.stdout.clear();
+        self.stderr.clear();
+        self.stdout_meta = OutputMeta::default();
+        self.stderr_meta = OutputMeta::default();
+        self.event_counter = 0;
+        self.status = Status::Starting;
+        self.started_at = now;
+        self.last_updated = now;
+    }
+
+    /// Appends `error` to [`AppState::error_log`] with the given severity, stamped with the
+    /// current time as its [`ErrorItem::first_seen`].
+    pub fn append_error(&mut self, severity: Severity, error: ErrorArrayItem) {
+        self.error_log.push(ErrorItem {
+            first_seen: current_timestamp(),
+            ..ErrorItem::new(severity, error)
+        });
+    }
+
+    /// Removes the errors first seen more than `max_age` before [`AppState::last_updated`]
+    /// and returns how many were removed. Errors without a [`ErrorItem::first_seen`]
+    /// timestamp are kept, since their age is unknown.
+    pub fn prune_old_errors(&mut self, max_age: Duration) -> usize {
+        let max_age = max_age.as_secs();
+        let last_updated = self.last_updated;
+        let before = self.error_log.len();
+        self.error_log.retain(|item| {
+            item.first_seen == 0 || last_updated.saturating_sub(item.first_seen) <= max_age
+        });
+        before - self.error_log.len()
+    }
+
+    /// Returns the logged errors that are at least as severe as `severity`, oldest first.
+    pub fn errors_at_least(&self, severity: Severity) -> Vec<&ErrorItem> {
+        self.error_log
+            .iter()
+            .filter(|error| error.severity >= severity)
+            .collect()
+    }
+
+    /// Returns the most recently logged error, `None` if the log is empty.
+    pub fn last_error(&self) -> Option<&ErrorItem> {
+        self.error_log.last()
+    }
+
+    /// Returns the logged errors of type `err_type`, oldest first.
+    pub fn errors_of_type(&self, err_type: &Errors) -> Vec<&ErrorItem> {
+        self.error_log
+            .iter()
+            .filter(|error| error.err_type == *err_type)
+            .collect()
+    }
+
+    /// Stores `value` in [`AppState::data`] as JSON. The field stays a plain string on the
+    /// wire, so states written this way are still readable by older releases.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_persistence::AppState;
+    /// # use std::collections::BTreeMap;
+    /// # fn store(state: &mut AppState) -> Result<(), serde_json::Error> {
+    /// let mut ports = BTreeMap::new();
+    /// ports.insert("http".to_string(), 8080u16);
+    /// state.set_data(&ports)?;
+    ///
+    /// let ports: BTreeMap<String, u16> = state.data_as()?;
+    /// # Ok(())
+    /// # }
+    /// ```
+    ///
+    /// # Errors
+    /// Returns an `Err` if `value` can't be serialized.
+    pub fn set_data<T: Serialize>(&mut self, value: &T) -> Result<(), serde_json::Error> {
+        self.data = serde_json::to_string(value)?;
+        Ok(())
+    }
+
+    /// Parses [`AppState::data`] as JSON into `T`, the counterpart of [`AppState::set_data`].
+    ///
+    /// # Errors
+    /// Returns an `Err` if the field isn't valid JSON for `T`, including when it is empty.
+    pub fn data_as<T: DeserializeOwned>(&self) -> Result<T, serde_json::Error> {
+        serde_json::from_str(&self.data)
+    }
+
+    /// Takes a copy of the whole state that [`StateCheckpoint::restore`] can roll back to,
+    /// giving a lightweight transaction around in-memory edits.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_persistence::AppState;
+    /// # fn apply(state: &mut AppState) -> Result<(), String> { Ok(()) }
+    /// # fn edit(state: &mut AppState) {
+    /// let checkpoint = state.checkpoint();
+    /// state.event_counter += 1;
+    /// if apply(state).is_err() {
+    ///     checkpoint.restore(state);
+    /// }
+    /// # }
+    /// ```
+    pub fn checkpoint(&self) -> StateCheckpoint {
+        StateCheckpoint {
+            snapshot: self.clone(),
+        }
+    }
+
+    /// Brings the state into a canonical form, so states holding the same information
+    /// compare, [hash](AppState::content_hash) and serialize the same regardless of how
+    /// they were built:
+    /// - [`AppState::stdout`], [`AppState::stderr`] and [`AppState::events`] are sorted by
+    ///   timestamp, keeping the order of entries with the same timestamp.
+    /// - Runs of identical entries in [`AppState::error_log`] are collapsed into one.
+    /// - Repeated [`AppState::tags`] are dropped, keeping the first.
+    /// - `null` values are removed from [`AppState::extra`], since saving as TOML drops them.
+    ///
+    /// Timestamps are left alone; compare with [`AppState::equal_with`] to ignore them.
+    pub fn normalize(&mut self) {
+        self.stdout.sort_by_key(|(timestamp, _)| *timestamp);
+        self.stderr.sort_by_key(|(timestamp, _)| *timestamp);
+        self.events.sort_by_key(|event| event.timestamp);
+        self.error_log.dedup();
+
+        let mut seen = std::collections::BTreeSet::new();
+        self.tags.retain(|tag| seen.insert(tag.clone()));
+        self.extra.retain(|_, value| !value.is_null());
+    }
+
+    /// Returns a hex SHA-256 over the JSON encoding of the state, which is canonical since
+    /// struct fields are emitted in declaration order and maps are sorted. Equal states
+    /// always hash the same, across processes and releases that don't change the format.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the state can't be serialized.
+    pub fn content_hash(&self) -> Result<String, serde_json::Error> {
+        let encoded = serde_json::to_vec(self)?;
+        Ok(hex::encode(Sha256::digest(&encoded)))
+    }
+
+    /// Compares two states like `==`, except for the volatile fields `opts` asks to ignore.
+    /// With [`EqualOptions::default`] this is a full comparison.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_persistence::{AppState, EqualOptions};
+    /// # fn same(a: &AppState, b: &AppState) -> bool {
+    /// let opts = EqualOptions {
+    ///     ignore_timestamps: true,
+    ///     ignore_logs: true,
+    ///     ..EqualOptions::default()
+    /// };
+    /// a.equal_with(b, opts)
+    /// # }
+    /// ```
+    pub fn equal_with(&self, other: &AppState, opts: EqualOptions) -> bool {
+        let (mut a, mut b) = (self.clone(), other.clone());
+        for state in [&mut a, &mut b] {
+            if opts.ignore_timestamps {
+                state.last_updated = 0;
+                state.started_at = 0;
+            }
+            if opts.ignore_logs {
+                state.stdout.clear();
+                state.stderr.clear();
+                state.stdout_meta = OutputMeta::default();
+                state.stderr_meta = OutputMeta::default();
+            }
+            if opts.ignore_pid {
+                state.pid = 0;
+            }
+        }
+        a == b
+    }
+}
+
+/// Fields [`AppState::equal_with`] leaves out of the comparison.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct EqualOptions {
+    /// Ignore [`AppState::last_updated`] and [`AppState::started_at`].
+    pub ignore_timestamps: bool,
+    /// Ignore the captured [`AppState::stdout`] and [`AppState::stderr`] lines and their
+    /// [`OutputMeta`] counters.
+    pub ignore_logs: bool,
+    /// Ignore [`AppState::pid`].
+    pub ignore_pid: bool,
+}
+
+/// A snapshot taken by [`AppState::checkpoint`]. Dropping it keeps the edits made since.
+#[derive(Debug, Clone)]
+#[must_use = "a checkpoint does nothing unless restored"]
+pub struct StateCheckpoint {
+    snapshot: AppState,
+}
+
+impl StateCheckpoint {
+    /// Overwrites `state` with the snapshot, undoing every change made since the checkpoint.
+    pub fn restore(self, state: &mut AppState) {
+        *state = self.snapshot;
+    }
+
+    /// Returns the state as it was when the checkpoint was taken.
+    pub fn snapshot(&self) -> &AppState {
+        &self.snapshot
+    }
+}
+
+/// Returns the states whose label `key` is set to `value`.
+pub fn filter_states_by_label<'a>(
+    states: &'a [AppState],
+    key: &str,
+    value: &str,
+) -> Vec<&'a AppState> {
+    states
+        .iter()
+        .filter(|state| state.label(key) == Some(value))
+        .collect()
+}
+
+/// Returns the states tagged with `tag`.
+pub fn filter_states_by_tag<'a>(states: &'a [AppState], tag: &str) -> Vec<&'a AppState> {
+    states.iter().filter(|state| state.has_tag(tag)).collect()
+}
+
+/// Errors sharing the same type and message across several states, see [`aggregate_errors`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AggregatedError {
+    /// Type of the grouped errors.
+    pub err_type: Errors,
+    /// Message of the grouped errors.
+    pub err_mesg: String,
+    /// Number of matching [`AppState::error_log`] entries over all states.
+    pub count: usize,
+    /// Names of the states that logged the error, sorted and without duplicates.
+    pub affected_apps: Vec<String>,
+    /// Earliest [`AppState::last_updated`] of the affected states.
+    pub first_seen: u64,
+    /// Latest [`AppState::last_updated`] of the affected states.
+    pub last_seen: u64,
+}
+
+/// Groups the error logs of `states` by error type and message, most frequent first.
+///
+/// Error log entries carry no timestamp of their own, so `first_seen` and `last_seen` are
+/// the oldest and newest `last_updated` of the states containing the error.
+pub fn aggregate_errors(states: &[AppState]) -> Vec<AggregatedError> {
+    // Keyed by the printed type name, so the map doesn't depend on `Errors` being `Ord`.
+    let mut groups: BTreeMap<(String, String), AggregatedError> = BTreeMap::new();
+
+    for state in states {
+        for error in &state.error_log {
+            let key = (format!("{:?}", error.err_type), error.err_mesg.to_string());
+            let entry = groups.entry(key).or_insert_with(|| AggregatedError {
+                err_type: error.err_type.clone(),
+                err_mesg: error.err_mesg.to_string(),
+                count: 0,
+                affected_apps: Vec::new(),
+                first_seen: state.last_updated,
+                last_seen: state.last_updated,
+            });
+            entry.count += 1;
+            if !entry.affected_apps.contains(&state.name) {
+                entry.affected_apps.push(state.name.clone());
+            }
+            entry.first_seen = entry.first_seen.min(state.last_updated);
+            entry.last_seen = entry.last_seen.max(state.last_updated);
+        }
+    }
+
+    let mut aggregated: Vec<AggregatedError> = groups.into_values().collect();
+    for entry in &mut aggregated {
+        entry.affected_apps.sort();
+    }
+    // Stable, so equally frequent errors stay ordered by type and message.
+    aggregated.sort_by(|a, b| b.count.cmp(&a.count));
+    aggregated
+}
+
+/// Number of bytes from each end of a file hashed by
+/// [`StatePersistence::state_file_fingerprint`].
+pub const FINGERPRINT_SAMPLE_BYTES: usize = 4096;
+
+/// Returns the timestamp of a captured [`Output`] line as a UTC datetime.
+pub fn output_time(output: &Output) -> DateTime<Utc> {
+    unix_timestamp_to_datetime(output.0)
 }
 
 impl fmt::Display for AppState {
@@ -89,9 +814,10 @@ impl fmt::Display for AppState {
             for (i, error) in self.error_log.iter().enumerate() {
                 writeln!(
                     f,
-                    "    {}: {:#?} - {}",
+                    "    {}: {:#?} ({}) - {}",
                     format!("Error {}", i + 1).bold().yellow(),
                     error.err_type,
+                    error.severity,
                     error.err_mesg
                 )?;
             }
@@ -249,63 +975,1218 @@ impl fmt::Display for AppState {
     }
 }
 
-/// Provides utility methods for loading and saving [`AppState`] from/to disk.
-pub struct StatePersistence;
+/// On-disk representations an [`AppState`] can be stored in, see
+/// [`StatePersistence::save_state_auto`] and [`StatePersistence::load_state_auto`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum StateFormat {
+    /// TOML encrypted with [`simple_encrypt`], as written by [`StatePersistence::save_state`].
+    /// Used for `.state` files and as the fallback for unknown extensions.
+    Encrypted,
+    /// Plain TOML (`.toml`).
+    Toml,
+    /// Plain JSON (`.json`).
+    Json,
+}
 
-impl StatePersistence {
-    /// Derives the default save path for the application state using `/tmp/.<app_name>.state`.
-    ///
-    /// # Example
-    /// ```rust
-    /// # use artisan_middleware::state_persistence::StatePersistence;
-    /// # use artisan_middleware::config::AppConfig;
-    /// let config = AppConfig::dummy();
-    /// let path = StatePersistence::get_state_path(&config);
-    /// println!("State file path: {:?}", path);
-    /// ```
-    pub fn get_state_path(config: &AppConfig) -> PathType {
-        PathType::Content(format!("/tmp/.{}.state", config.app_name))
-    }
+impl StateFormat {
+    /// File extensions recognised by [`StateFormat::from_path`].
+    pub const SUPPORTED_EXTENSIONS: &'static [&'static str] = &["state", "toml", "json"];
 
-    /// Saves the provided [`AppState`] to the specified `path`.  
-    /// The data is serialized to TOML, then encrypted with [`simple_encrypt`].
-    ///
-    /// # Errors
-    /// - Returns an `Err` if serialization, encryption, or writing to the file fails.
-    pub async fn save_state(
-        state: &AppState,
-        path: &PathType,
-    ) -> Result<(), Box<dyn std::error::Error>> {
-        let toml_str: Stringy = toml::to_string(state)?.into();
-        let state_data = simple_encrypt(toml_str.as_bytes()).map_err(|e| {
-            std::io::Error::new(std::io::ErrorKind::InvalidData, e.err_mesg.to_string())
-        })?;
+    /// Picks the format implied by the extension of `path`, if it is one of
+    /// [`StateFormat::SUPPORTED_EXTENSIONS`]. The comparison ignores case.
+    pub fn from_path(path: &Path) -> Option<Self> {
+        let extension = path.extension()?.to_str()?.to_ascii_lowercase();
+        match extension.as_str() {
+            "state" => Some(StateFormat::Encrypted),
+            "toml" => Some(StateFormat::Toml),
+            "json" => Some(StateFormat::Json),
+            _ => None,
+        }
+    }
 
-        fs::write(path, state_data.to_string())?;
-        Ok(())
+    /// Serializes `state` in this format.
+    pub fn encode(&self, state: &AppState) -> Result<String, Box<dyn std::error::Error>> {
+        match self {
+            StateFormat::Encrypted => encode_state(state),
+            StateFormat::Toml => Ok(toml::to_string(state)?),
+            StateFormat::Json => Ok(serde_json::to_string_pretty(state)?),
+        }
     }
 
-    /// Loads an [`AppState`] from the specified `path`.  
-    /// Reads the file, then decrypts it with [`simple_decrypt`], and finally deserializes from TOML.
-    ///
-    /// # Errors
-    /// - Returns an `Err` if decryption or TOML deserialization fails, or if the file is unreadable.
-    pub async fn load_state(path: &PathType) -> Result<AppState, Box<dyn std::error::Error>> {
-        let encrypted_content: Stringy = fs::read_to_string(path)?.into();
-        let content = simple_decrypt(encrypted_content.as_bytes()).map_err(|_| {
-            std::io::Error::new(std::io::ErrorKind::InvalidData, "Decryption failed")
-        })?;
+    /// Deserializes an [`AppState`] stored in this format. Unknown top level keys are kept
+    /// in [`AppState::extra`], unknown nested keys are ignored.
+    pub fn decode(&self, content: &str) -> Result<AppState, Box<dyn std::error::Error>> {
+        let mut unknown = Vec::new();
+        let mut collect = |path: serde_ignored::Path| collect_top_level(&mut unknown, path);
 
-        let cipher_string = String::from_utf8(content).map_err(|_| {
-            std::io::Error::new(
-                std::io::ErrorKind::InvalidData,
-                "Failed to convert to string",
-            )
-        })?;
+        let decrypted;
+        let text = match self {
+            StateFormat::Encrypted => {
+                decrypted = decrypt_state_text(content)?;
+                decrypted.as_str()
+            }
+            StateFormat::Toml | StateFormat::Json => content,
+        };
+        let mut state: AppState = match self {
+            StateFormat::Json => {
+                let mut deserializer = serde_json::Deserializer::from_str(text);
+                let state = serde_ignored::deserialize(&mut deserializer, &mut collect)?;
+                deserializer.end()?;
+                state
+            }
+            StateFormat::Encrypted | StateFormat::Toml => {
+                serde_ignored::deserialize(toml::Deserializer::new(text), &mut collect)?
+            }
+        };
+        if unknown.is_empty() {
+            return Ok(state);
+        }
 
-        let state: AppState = toml::from_str(&cipher_string)?;
+        // Only parse the document a second time when there is something to keep.
+        let document = match self {
+            StateFormat::Json => serde_json::from_str(text)?,
+            StateFormat::Encrypted | StateFormat::Toml => {
+                serde_json::to_value(toml::from_str::<toml::Table>(text)?)?
+            }
+        };
+        keep_extra(&mut state, unknown, document);
         Ok(state)
     }
+
+    /// Like [`StateFormat::decode`], but fails with [`StateError::UnknownFields`] if the
+    /// content has keys that don't belong to [`AppState`] or any of the structs nested in
+    /// it, instead of silently ignoring them.
+    ///
+    /// Keys next to the fields of an [`ErrorItem`] are not checked, since its error is
+    /// stored inline.
+    pub fn decode_strict(&self, content: &str) -> Result<AppState, Box<dyn std::error::Error>> {
+        let mut unknown = Vec::new();
+        let mut collect = |path: serde_ignored::Path| unknown.push(path.to_string());
+        let state: AppState = match self {
+            StateFormat::Encrypted => {
+                let text = decrypt_state_text(content)?;
+                serde_ignored::deserialize(toml::Deserializer::new(&text), &mut collect)?
+            }
+            StateFormat::Toml => {
+                serde_ignored::deserialize(toml::Deserializer::new(content), &mut collect)?
+            }
+            StateFormat::Json => {
+                let mut deserializer = serde_json::Deserializer::from_str(content);
+                let state = serde_ignored::deserialize(&mut deserializer, &mut collect)?;
+                deserializer.end()?;
+                state
+            }
+        };
+
+        if unknown.is_empty() {
+            Ok(state)
+        } else {
+            Err(Box::new(StateError::UnknownFields { fields: unknown }))
+        }
+    }
+}
+
+/// The handful of [`AppState`] fields needed to list applications, as returned by
+/// [`StatePersistence::load_state_header`].
+#[derive(Serialize, Deserialize, Debug, PartialEq, Eq, Clone)]
+pub struct StateHeader {
+    /// See [`AppState::name`].
+    pub name: String,
+
+    /// See [`AppState::version`].
+    pub version: SoftwareVersion,
+
+    /// See [`AppState::status`].
+    pub status: Status,
+
+    /// See [`AppState::pid`].
+    pub pid: u32,
+
+    /// See [`AppState::last_updated`].
+    pub last_updated: u64,
+
+    /// See [`AppState::config`].
+    pub config: AppConfig,
+}
+
+/// Used by [`StatePersistence::load_state_config`] to skip everything but the config.
+#[derive(Deserialize)]
+struct ConfigOnly {
+    config: AppConfig,
+}
+
+/// Typed failures of [`StatePersistence`] operations. They are returned boxed like every
+/// other error, use `downcast_ref::<StateError>()` to tell them apart.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum StateError {
+    /// [`StatePersistence::save_state_cas`] found a different generation on disk than the
+    /// caller expected; reload the state and retry.
+    GenerationConflict {
+        /// The generation the caller based its changes on.
+        expected: u64,
+        /// The generation currently stored.
+        found: u64,
+    },
+    /// A strict load found keys that are not part of [`AppState`], see
+    /// [`StateFormat::decode_strict`].
+    UnknownFields {
+        /// Dotted paths of the unexpected keys, e.g. `config.unknown_field`.
+        fields: Vec<String>,
+    },
+    /// A state file is larger than [`StatePersistence::max_state_file_bytes`] and was not
+    /// read.
+    TooLarge {
+        /// Size of the file, or of its decompressed content, in bytes. For compressed files
+        /// this is only counted up to the first byte over the limit.
+        size: u64,
+        /// The limit in effect.
+        limit: u64,
+    },
+    /// A state file exists but holds no data, typically left behind by a write that was
+    /// interrupted after truncating the file. [`StatePersistence::load_or_init`] treats it
+    /// like a missing file.
+    Empty,
+    /// [`StatePersistence::verify_state_file`] decoded a state, saved it again and got a
+    /// different state back.
+    RoundTripMismatch {
+        /// Dotted paths of the fields that changed, see [`diff_serialized`].
+        fields: Vec<String>,
+    },
+}
+
+impl fmt::Display for StateError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            StateError::GenerationConflict { expected, found } => write!(
+                f,
+                "State generation conflict: expected {}, found {}",
+                expected, found
+            ),
+            StateError::UnknownFields { fields } => {
+                write!(f, "Unknown fields in state: {}", fields.join(", "))
+            }
+            StateError::TooLarge { size, limit } => write!(
+                f,
+                "State file of {} bytes exceeds the limit of {} bytes",
+                size, limit
+            ),
+            StateError::Empty => write!(f, "State file is empty"),
+            StateError::RoundTripMismatch { fields } => {
+                write!(f, "State changed when saved again: {}", fields.join(", "))
+            }
+        }
+    }
+}
+
+impl std::error::Error for StateError {}
+
+/// Used by [`StatePersistence::save_state_cas`] to read the stored generation.
+#[derive(Deserialize)]
+struct GenerationOnly {
+    #[serde(default)]
+    generation: u64,
+}
+
+/// Default for [`StatePersistence::max_state_file_bytes`], far above any healthy state.
+pub const DEFAULT_MAX_STATE_FILE_BYTES: u64 = 64 * 1024 * 1024;
+
+static MAX_STATE_FILE_BYTES: AtomicU64 = AtomicU64::new(DEFAULT_MAX_STATE_FILE_BYTES);
+
+/// Provides utility methods for loading and saving [`AppState`] from/to disk.
+pub struct StatePersistence;
+
+/// Options for [`StatePersistence::load_state_with_options`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct LoadOptions {
+    /// Reject keys that are not part of [`AppState`], see [`StateFormat::decode_strict`].
+    pub strict: bool,
+}
+
+/// Options for [`StatePersistence::save_state_with_options`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct SaveOptions {
+    /// Write [`AppState::stdout`] and [`AppState::stderr`] as empty lists, for applications
+    /// whose output is collected elsewhere. Their [`OutputMeta`] counters are kept.
+    pub exclude_logs: bool,
+    /// Create missing parent directories of the path first, with permissions
+    /// [`DEFAULT_STATE_DIR_MODE`] on unix.
+    pub ensure_parent_dir: bool,
+}
+
+/// Permissions of the directories created for [`SaveOptions::ensure_parent_dir`], before
+/// the umask applies.
+pub const DEFAULT_STATE_DIR_MODE: u32 = 0o755;
+
+/// Outcome of [`StatePersistence::save_state_with_size_limit`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SizeLimitReport {
+    /// Number of stdout and stderr lines left out of the saved state.
+    pub dropped_lines: usize,
+    /// Size of the written file in bytes.
+    pub size: u64,
+    /// `true` if the file is larger than the limit even without any captured output.
+    pub exceeded: bool,
+}
+
+/// Controls how [`StatePersistence::save_state_with_retry`] backs off on transient failures.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RetryOptions {
+    /// Total number of attempts, including the first one. `0` behaves like `1`.
+    pub max_attempts: u32,
+    /// Delay before the first retry; doubled after every failed attempt.
+    pub initial_delay: Duration,
+    /// Upper bound for the delay between two attempts.
+    pub max_delay: Duration,
+}
+
+impl Default for RetryOptions {
+    fn default() -> Self {
+        Self {
+            max_attempts: 5,
+            initial_delay: Duration::from_millis(50),
+            max_delay: Duration::from_secs(2),
+        }
+    }
+}
+
+impl StatePersistence {
+    /// Derives the default save path for the application state using `/tmp/.<app_name>.state`.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_persistence::StatePersistence;
+    /// # use artisan_middleware::config::AppConfig;
+    /// let config = AppConfig::dummy();
+    /// let path = StatePersistence::get_state_path(&config);
+    /// println!("State file path: {:?}", path);
+    /// ```
+    pub fn get_state_path(config: &AppConfig) -> PathType {
+        PathType::Content(format!("/tmp/.{}.state", config.app_name))
+    }
+
+    /// Returns the size above which state files are rejected with [`StateError::TooLarge`]
+    /// instead of being read, [`DEFAULT_MAX_STATE_FILE_BYTES`] unless changed. The limit
+    /// applies to the file on disk and to the decompressed content of gzip files.
+    pub fn max_state_file_bytes() -> u64 {
+        MAX_STATE_FILE_BYTES.load(Ordering::Relaxed)
+    }
+
+    /// Changes the limit returned by [`StatePersistence::max_state_file_bytes`] for every
+    /// loader in the process. `0` disables the check.
+    pub fn set_max_state_file_bytes(limit: u64) {
+        MAX_STATE_FILE_BYTES.store(limit, Ordering::Relaxed);
+    }
+
+    /// Saves the provided [`AppState`] to the specified `path`.  
+    /// The data is serialized to TOML, then encrypted with [`simple_encrypt`].
+    ///
+    /// The parent directory of `path` must exist; use
+    /// [`StatePersistence::save_state_ensure_dir`] to create it.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization, encryption, or writing to the file fails.
+    pub async fn save_state(
+        state: &AppState,
+        path: &PathType,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        let state_data = encode_state(state)?;
+        tokio::fs::write(path, state_data).await?;
+        Ok(())
+    }
+
+    /// Saves the provided [`AppState`] like [`StatePersistence::save_state`], creating the
+    /// missing parent directories of `path` first. On unix new directories get permissions
+    /// `dir_mode` (before the umask applies); elsewhere `dir_mode` is ignored.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if a directory can't be created, or if serialization, encryption,
+    ///   or writing to the file fails.
+    pub async fn save_state_ensure_dir(
+        state: &AppState,
+        path: &PathType,
+        dir_mode: u32,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        create_parent_dir(path.as_ref(), dir_mode).await?;
+        Self::save_state(state, path).await
+    }
+
+    /// Saves the provided [`AppState`] to the specified `path`, encrypted with the key
+    /// returned by `provider` instead of one stored alongside the data.
+    ///
+    /// The provider is asked for the key on every call, so rotated keys are used as soon as
+    /// the provider returns them. Files written with an older key need that key to be read.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the provider fails or returns a key that isn't 32 bytes long,
+    ///   or if serialization, encryption, or writing to the file fails.
+    pub async fn save_state_encrypted(
+        state: &AppState,
+        path: &PathType,
+        provider: &dyn KeyProvider,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        let key = provider.key().await?;
+        let toml_str = toml::to_string(state)?;
+        let state_data = encrypt_with_key(toml_str.as_bytes(), &key)?;
+        tokio::fs::write(path, state_data.to_string()).await?;
+        Ok(())
+    }
+
+    /// Drops the errors older than `max_age` with [`AppState::prune_old_errors`], then
+    /// saves `state` like [`StatePersistence::save_state`]. The data is written to
+    /// `<path>.tmp`, synced and renamed over `path`, so readers never see a partial file.
+    /// Returns how many errors were pruned.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization, encryption, writing or renaming fails. The
+    ///   errors are pruned from `state` even then.
+    pub async fn save_state_pruned(
+        state: &mut AppState,
+        path: &PathType,
+        max_age: Duration,
+    ) -> Result<usize, Box<dyn std::error::Error>> {
+        let pruned = state.prune_old_errors(max_age);
+        let state_data = encode_state(state)?;
+        let path: &Path = path.as_ref();
+        write_atomic_async(path, state_data.into_bytes(), None, true).await?;
+        Ok(pruned)
+    }
+
+    /// Saves the provided [`AppState`] through `fs` instead of the real filesystem,
+    /// using the same format as [`StatePersistence::save_state`].
+    ///
+    /// The file is replaced with [`FileSystem::replace_file`]; on the [`OsFileSystem`] that
+    /// writes it to `<path>.tmp`, keeps the mode of the old file, syncs and renames it.
+    ///
+    /// [`OsFileSystem`]: crate::state_fs::OsFileSystem
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization, encryption, writing or renaming fails.
+    pub fn save_state_fs(
+        fs: &dyn FileSystem,
+        state: &AppState,
+        path: &PathType,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        let state_data = encode_state(state)?;
+        fs.replace_file(path.as_ref(), state_data.as_bytes())?;
+        Ok(())
+    }
+
+    /// Saves `state` as [`StateFormat::Json`], writing it to the file as it is serialized
+    /// instead of building the whole document in memory first. Use it for states with
+    /// large output buffers, where the document can be many times the size of the state.
+    ///
+    /// The file is byte for byte what [`StateFormat::encode`] produces. It is written to
+    /// `<path>.tmp` first, synced and then renamed over `path`, keeping the mode of the old
+    /// file.
+    ///
+    /// This does blocking I/O; inside async code, call it through
+    /// [`tokio::task::spawn_blocking`].
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization, writing or renaming fails.
+    pub fn stream_save_state(
+        state: &AppState,
+        path: &PathType,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        write_atomic_with(path.as_ref(), None, true, |file| {
+            let mut writer = std::io::BufWriter::new(file);
+            serde_json::to_writer_pretty(&mut writer, state)?;
+            writer.flush()
+        })?;
+        Ok(())
+    }
+
+    /// Saves `state` only if the generation stored at `path` is still `expected_generation`
+    /// (a missing file counts as generation `0`), giving optimistic concurrency control
+    /// between writers. On success the stored and the in-memory [`AppState::generation`]
+    /// become `expected_generation + 1`.
+    ///
+    /// The check and the write happen under an exclusive `flock` on `<path>.lock`, so
+    /// concurrent writers on unix can't interleave. The new state is written to a temporary
+    /// file and renamed into place.
+    ///
+    /// # Errors
+    /// - Returns a [`StateError::GenerationConflict`] if another writer got there first.
+    /// - Returns an `Err` of kind [`std::io::ErrorKind::InvalidData`] if
+    ///   `expected_generation` is `u64::MAX`, since the next one can't be represented.
+    /// - Returns an `Err` if the stored state can't be read, or if writing fails.
+    pub async fn save_state_cas(
+        state: &mut AppState,
+        path: &PathType,
+        expected_generation: u64,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        let generation = expected_generation.checked_add(1).ok_or_else(|| {
+            std::io::Error::new(
+                std::io::ErrorKind::InvalidData,
+                format!("generation {} can't be incremented", expected_generation),
+            )
+        })?;
+        let mut next = state.clone();
+        next.generation = generation;
+        let path_buf = path.to_path_buf();
+
+        tokio::task::spawn_blocking(move || cas_write(&path_buf, &next, expected_generation))
+            .await
+            .map_err(|err| std::io::Error::new(std::io::ErrorKind::Other, err))?
+            .map_err(|err| -> Box<dyn std::error::Error> { err })?;
+
+        state.generation = generation;
+        Ok(())
+    }
+
+    /// Same as [`StatePersistence::save_state`], but gives up once `timeout` has elapsed.
+    ///
+    /// The write itself runs on tokio's blocking pool, so a stalled filesystem (NFS, FUSE)
+    /// can't hold the caller past the deadline.
+    ///
+    /// # Errors
+    /// - Returns an [`std::io::ErrorKind::TimedOut`] error if the deadline passes first.
+    /// - Otherwise returns whatever [`StatePersistence::save_state`] returns.
+    pub async fn save_state_with_timeout(
+        state: &AppState,
+        path: &PathType,
+        timeout: Duration,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        match tokio::time::timeout(timeout, Self::save_state(state, path)).await {
+            Ok(result) => result,
+            Err(_) => Err(Box::new(std::io::Error::new(
+                std::io::ErrorKind::TimedOut,
+                format!("Timed out saving state to {}", path),
+            ))),
+        }
+    }
+
+    /// Saves `state` like [`StatePersistence::save_state`], dropping its oldest captured
+    /// output first if the encoded file would be larger than `max_bytes`.
+    ///
+    /// Lines are dropped alternately from the front of [`AppState::stdout`] and
+    /// [`AppState::stderr`], as few as needed to fit. `state` itself is left untouched.
+    /// If the state is still too large without any output it is saved anyway, and
+    /// [`SizeLimitReport::exceeded`] is set.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization, encryption, or writing to the file fails.
+    pub async fn save_state_with_size_limit(
+        state: &AppState,
+        path: &PathType,
+        max_bytes: u64,
+    ) -> Result<SizeLimitReport, Box<dyn std::error::Error>> {
+        let total = state.stdout.len() + state.stderr.len();
+        let trimmed = |dropped: usize| -> Result<String, Box<dyn std::error::Error>> {
+            let (stdout, stderr) =
+                split_dropped_lines(dropped, state.stdout.len(), state.stderr.len());
+            let mut copy = state.clone();
+            copy.stdout.drain(..stdout);
+            copy.stderr.drain(..stderr);
+            encode_state(&copy)
+        };
+
+        let mut dropped = 0;
+        let mut data = trimmed(0)?;
+        if data.len() as u64 > max_bytes {
+            let all_dropped = trimmed(total)?;
+            dropped = total;
+            if all_dropped.len() as u64 <= max_bytes {
+                // The encoded size shrinks with every dropped line, so search for the fewest
+                // lines that have to go. `high` lines always fit, `low - 1` never do.
+                let (mut low, mut high, mut fitting) = (1, total, all_dropped);
+                while low < high {
+                    let mid = low + (high - low) / 2;
+                    let candidate = trimmed(mid)?;
+                    if candidate.len() as u64 > max_bytes {
+                        low = mid + 1;
+                    } else {
+                        high = mid;
+                        fitting = candidate;
+                    }
+                }
+                dropped = high;
+                data = fitting;
+            } else {
+                data = all_dropped;
+            }
+        }
+
+        tokio::fs::write(path, &data).await?;
+        Ok(SizeLimitReport {
+            dropped_lines: dropped,
+            size: data.len() as u64,
+            exceeded: data.len() as u64 > max_bytes,
+        })
+    }
+
+    /// Saves the provided [`AppState`] like [`StatePersistence::save_state`], retrying with
+    /// exponential backoff when the write fails with a transient I/O error
+    /// (`EINTR`, `EAGAIN` or `ENOSPC`).
+    ///
+    /// # Errors
+    /// - Any non transient error is returned immediately.
+    /// - Once `opts.max_attempts` is exhausted the last error is returned.
+    pub async fn save_state_with_retry(
+        state: &AppState,
+        path: &PathType,
+        opts: RetryOptions,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        retry_transient(opts, || Self::save_state(state, path)).await
+    }
+
+    /// Loads an [`AppState`] from the specified `path`.  
+    /// Reads the file, then decrypts it with [`simple_decrypt`], and finally deserializes from TOML.
+    ///
+    /// Files starting with the gzip magic bytes are decompressed first, so compressed and
+    /// plain state files can share one load path regardless of their names.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if decryption or TOML deserialization fails, or if the file is unreadable.
+    pub async fn load_state(path: &PathType) -> Result<AppState, Box<dyn std::error::Error>> {
+        let encrypted_content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        StateFormat::Encrypted.decode(&encrypted_content)
+    }
+
+    /// Loads an [`AppState`] written by [`StatePersistence::save_state_encrypted`] from the
+    /// specified `path`, decrypting it with the key returned by `provider`.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the provider fails, the file is unreadable, the key doesn't
+    ///   match, or TOML deserialization fails.
+    pub async fn load_state_encrypted(
+        path: &PathType,
+        provider: &dyn KeyProvider,
+    ) -> Result<AppState, Box<dyn std::error::Error>> {
+        let key = provider.key().await?;
+        let encrypted_content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        let content = decrypt_with_key(encrypted_content.as_bytes(), &key)?;
+        StateFormat::Toml.decode(&String::from_utf8(content)?)
+    }
+
+    /// Loads an [`AppState`] through `fs` instead of the real filesystem.
+    /// See [`StatePersistence::load_state`] for the format.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the file is unreadable, or if decryption or deserialization fails.
+    pub fn load_state_fs(
+        fs: &dyn FileSystem,
+        path: &PathType,
+    ) -> Result<AppState, Box<dyn std::error::Error>> {
+        check_state_size(fs.stat(path.as_ref())?.len).map_err(unwrap_state_error)?;
+        let data = fs.read_file(path.as_ref())?;
+        let encrypted_content = state_text(data).map_err(unwrap_state_error)?;
+        StateFormat::Encrypted.decode(&encrypted_content)
+    }
+
+    /// Loads the state at `path` like [`StatePersistence::load_state`]. If the file doesn't
+    /// exist or is empty ([`StateError::Empty`]), the state returned by `init` is saved there
+    /// instead and returned.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the file exists but can't be loaded, e.g. because it is
+    ///   malformed, or if saving the new state fails.
+    pub async fn load_or_init<F>(
+        path: &PathType,
+        init: F,
+    ) -> Result<AppState, Box<dyn std::error::Error>>
+    where
+        F: FnOnce() -> AppState,
+    {
+        match Self::load_state(path).await {
+            Ok(state) => Ok(state),
+            Err(err) if is_missing_or_empty(err.as_ref()) => {
+                let state = init();
+                Self::save_state(&state, path).await?;
+                Ok(state)
+            }
+            Err(err) => Err(err),
+        }
+    }
+
+    /// Saves `state` in the [`StateFormat`] implied by the extension of `path`.
+    /// Paths without a recognised extension use [`StateFormat::Encrypted`], like
+    /// [`StatePersistence::save_state`].
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization or writing to the file fails.
+    pub async fn save_state_auto(
+        state: &AppState,
+        path: &PathType,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        let format = StateFormat::from_path(path.as_ref()).unwrap_or(StateFormat::Encrypted);
+        let content = format.encode(state)?;
+        tokio::fs::write(path, content).await?;
+        Ok(())
+    }
+
+    /// Saves `state` in the [`StateFormat`] implied by the extension of `path`, like
+    /// [`StatePersistence::save_state_auto`], applying `opts`. `state` itself is left
+    /// untouched.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if serialization or writing to the file fails.
+    pub async fn save_state_with_options(
+        state: &AppState,
+        path: &PathType,
+        opts: SaveOptions,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        if opts.ensure_parent_dir {
+            create_parent_dir(path.as_ref(), DEFAULT_STATE_DIR_MODE).await?;
+        }
+        if !opts.exclude_logs {
+            return Self::save_state_auto(state, path).await;
+        }
+        let mut copy = state.clone();
+        copy.stdout.clear();
+        copy.stderr.clear();
+        Self::save_state_auto(&copy, path).await
+    }
+
+    /// Loads an [`AppState`] in the [`StateFormat`] implied by the extension of `path`.
+    /// Paths without a recognised extension are tried as [`StateFormat::Encrypted`].
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the file is unreadable or can't be decoded.
+    /// - For unrecognised extensions the error lists the supported ones.
+    pub async fn load_state_auto(path: &PathType) -> Result<AppState, Box<dyn std::error::Error>> {
+        let content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        match StateFormat::from_path(path.as_ref()) {
+            Some(format) => format.decode(&content),
+            None => StateFormat::Encrypted.decode(&content).map_err(|err| {
+                std::io::Error::new(
+                    std::io::ErrorKind::InvalidInput,
+                    format!(
+                        "Unrecognised state file format for {} ({}); supported extensions: .{}",
+                        path,
+                        err,
+                        StateFormat::SUPPORTED_EXTENSIONS.join(", .")
+                    ),
+                )
+                .into()
+            }),
+        }
+    }
+
+    /// Loads an [`AppState`] in the [`StateFormat`] implied by the extension of `path`, like
+    /// [`StatePersistence::load_state_auto`], applying `opts`.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the file is unreadable or can't be decoded.
+    /// - With [`LoadOptions::strict`], returns [`StateError::UnknownFields`] listing every
+    ///   unexpected key.
+    pub async fn load_state_with_options(
+        path: &PathType,
+        opts: LoadOptions,
+    ) -> Result<AppState, Box<dyn std::error::Error>> {
+        if !opts.strict {
+            return Self::load_state_auto(path).await;
+        }
+        let content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        StateFormat::from_path(path.as_ref())
+            .unwrap_or(StateFormat::Encrypted)
+            .decode_strict(&content)
+    }
+
+    /// Checks that the state file at `path` is understood completely by this version of the
+    /// crate, e.g. one written by an older release or another host.
+    ///
+    /// The file is decoded in the [`StateFormat`] implied by its extension like
+    /// [`StatePersistence::load_state_strict`], encoded in the same format and decoded again.
+    /// Both states must be equal, so a field renamed or retyped on either side makes the
+    /// check fail instead of being dropped or defaulted silently. The file is not modified.
+    ///
+    /// # Errors
+    /// - Returns [`StateError::UnknownFields`] for keys this version doesn't know.
+    /// - Returns [`StateError::RoundTripMismatch`] listing the fields that didn't survive
+    ///   being saved again.
+    /// - Returns an `Err` if the file is unreadable or can't be decoded.
+    pub async fn verify_state_file(path: &PathType) -> Result<(), Box<dyn std::error::Error>> {
+        let format = StateFormat::from_path(path.as_ref()).unwrap_or(StateFormat::Encrypted);
+        let content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        let state = format.decode_strict(&content)?;
+        let reloaded = format.decode_strict(&format.encode(&state)?)?;
+        if state == reloaded {
+            return Ok(());
+        }
+
+        let fields = diff_serialized(&state, &reloaded)?
+            .into_iter()
+            .map(|change| change.path)
+            .collect();
+        Err(Box::new(StateError::RoundTripMismatch { fields }))
+    }
+
+    /// Shorthand for [`StatePersistence::load_state_with_options`] in strict mode.
+    ///
+    /// # Errors
+    /// - Same as [`StatePersistence::load_state_with_options`].
+    pub async fn load_state_strict(
+        path: &PathType,
+    ) -> Result<AppState, Box<dyn std::error::Error>> {
+        Self::load_state_with_options(path, LoadOptions { strict: true }).await
+    }
+
+    /// Loads only the [`StateHeader`] fields of the state stored at `path`.
+    ///
+    /// The file still has to be read and decrypted as a whole, but the captured output,
+    /// error log and event history are skipped instead of being deserialized, which is
+    /// what dominates for states with large stdout/stderr buffers. The config and PID are
+    /// part of the header.
+    ///
+    /// # Errors
+    /// - Same as [`StatePersistence::load_state`].
+    pub async fn load_state_header(
+        path: &PathType,
+    ) -> Result<StateHeader, Box<dyn std::error::Error>> {
+        let encrypted_content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        decode_state(&encrypted_content)
+    }
+
+    /// Loads only the [`AppConfig`] stored in the state at `path`, skipping the rest of the
+    /// state like [`StatePersistence::load_state_header`] does.
+    ///
+    /// # Errors
+    /// - Same as [`StatePersistence::load_state`].
+    pub async fn load_state_config(
+        path: &PathType,
+    ) -> Result<AppConfig, Box<dyn std::error::Error>> {
+        let encrypted_content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+        let state: ConfigOnly = decode_state(&encrypted_content)?;
+        Ok(state.config)
+    }
+
+    /// Same as [`StatePersistence::load_state`], but gives up once `timeout` has elapsed.
+    ///
+    /// # Errors
+    /// - Returns an [`std::io::ErrorKind::TimedOut`] error if the deadline passes first.
+    /// - Otherwise returns whatever [`StatePersistence::load_state`] returns.
+    pub async fn load_state_with_timeout(
+        path: &PathType,
+        timeout: Duration,
+    ) -> Result<AppState, Box<dyn std::error::Error>> {
+        match tokio::time::timeout(timeout, Self::load_state(path)).await {
+            Ok(result) => result,
+            Err(_) => Err(Box::new(std::io::Error::new(
+                std::io::ErrorKind::TimedOut,
+                format!("Timed out loading state from {}", path),
+            ))),
+        }
+    }
+
+    /// Renames the top level key `stared_at` of the state file at `path` to `started_at`,
+    /// in place and in the [`StateFormat`] implied by its extension. Returns `false`,
+    /// leaving the file alone, if it has no `stared_at` key.
+    ///
+    /// Both keys load into [`AppState::started_at`], but saving writes `stared_at` until
+    /// every reader understands the new key, so only migrate files whose readers do.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the file can't be read, decoded or rewritten, or already has
+    ///   both keys.
+    pub async fn migrate_started_at(path: &PathType) -> Result<bool, Box<dyn std::error::Error>> {
+        let format = StateFormat::from_path(path.as_ref()).unwrap_or(StateFormat::Encrypted);
+        let content = read_state_file(path.as_ref())
+            .await
+            .map_err(unwrap_state_error)?;
+
+        let migrated = match format {
+            StateFormat::Json => {
+                let mut document: serde_json::Value = serde_json::from_str(&content)?;
+                let Some(fields) = document.as_object_mut() else {
+                    return Err("state file is not an object".into());
+                };
+                let (old, new) = (
+                    fields.contains_key("stared_at"),
+                    fields.contains_key("started_at"),
+                );
+                if !needs_started_at_migration(old, new)? {
+                    return Ok(false);
+                }
+                if let Some(value) = fields.remove("stared_at") {
+                    fields.insert("started_at".to_string(), value);
+                }
+                serde_json::to_string_pretty(&document)?
+            }
+            StateFormat::Toml | StateFormat::Encrypted => {
+                let text = match format {
+                    StateFormat::Encrypted => decrypt_state_text(&content)?,
+                    _ => content,
+                };
+                let mut document: toml::Table = toml::from_str(&text)?;
+                let (old, new) = (
+                    document.contains_key("stared_at"),
+                    document.contains_key("started_at"),
+                );
+                if !needs_started_at_migration(old, new)? {
+                    return Ok(false);
+                }
+                if let Some(value) = document.remove("stared_at") {
+                    document.insert("started_at".to_string(), value);
+                }
+                let text = toml::to_string(&document)?;
+                match format {
+                    StateFormat::Encrypted => simple_encrypt(text.as_bytes())
+                        .map_err(|e| {
+                            std::io::Error::new(
+                                std::io::ErrorKind::InvalidData,
+                                e.err_mesg.to_string(),
+                            )
+                        })?
+                        .to_string(),
+                    _ => text,
+                }
+            }
+        };
+
+        write_atomic_async(path.as_ref(), migrated.into_bytes(), None, true).await?;
+        Ok(true)
+    }
+
+    /// Returns a cheap fingerprint of the file at `path`: a hex SHA-256 over its size,
+    /// modification time and first and last [`FINGERPRINT_SAMPLE_BYTES`] bytes. Only those
+    /// bytes are read, so callers caching parsed states can skip reloading a file whose
+    /// fingerprint didn't change.
+    ///
+    /// A rewrite that keeps size, mtime and both ends identical goes unnoticed; use
+    /// [`AppState::content_hash`] when that matters.
+    ///
+    /// # Errors
+    /// - Returns an `Err` if the file can't be opened or read.
+    pub async fn state_file_fingerprint(
+        path: &PathType,
+    ) -> Result<String, Box<dyn std::error::Error>> {
+        let mut file = tokio::fs::File::open(path).await?;
+        let metadata = file.metadata().await?;
+        let size = metadata.len();
+        let modified = metadata
+            .modified()?
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap_or_default();
+
+        let mut hasher = Sha256::new();
+        hasher.update(size.to_le_bytes());
+        hasher.update(modified.as_secs().to_le_bytes());
+        hasher.update(modified.subsec_nanos().to_le_bytes());
+
+        let sample = FINGERPRINT_SAMPLE_BYTES as u64;
+        let mut head = vec![0; size.min(sample) as usize];
+        file.read_exact(&mut head).await?;
+        hasher.update(&head);
+        if size > sample {
+            let tail_start = size.saturating_sub(sample).max(sample);
+            let mut tail = vec![0; (size - tail_start) as usize];
+            file.seek(std::io::SeekFrom::Start(tail_start)).await?;
+            file.read_exact(&mut tail).await?;
+            hasher.update(&tail);
+        }
+
+        Ok(hex::encode(hasher.finalize()))
+    }
+}
+
+/// Splits `dropped` lines between stdout and stderr, taking them alternately starting
+/// with stdout and continuing with the other stream once one runs out.
+fn split_dropped_lines(dropped: usize, stdout: usize, stderr: usize) -> (usize, usize) {
+    let from_stdout = ((dropped + 1) / 2).min(stdout);
+    let from_stderr = (dropped - from_stdout).min(stderr);
+    let from_stdout = (dropped - from_stderr).min(stdout);
+    (from_stdout, from_stderr)
+}
+
+fn is_missing_or_empty(err: &(dyn std::error::Error + 'static)) -> bool {
+    match err.downcast_ref::<std::io::Error>() {
+        Some(io_err) => io_err.kind() == std::io::ErrorKind::NotFound,
+        None => err.downcast_ref::<StateError>() == Some(&StateError::Empty),
+    }
+}
+
+/// Creates the missing parent directories of `path`, see
+/// [`StatePersistence::save_state_ensure_dir`].
+async fn create_parent_dir(path: &Path, mode: u32) -> std::io::Result<()> {
+    let parent = match path.parent() {
+        Some(parent) if !parent.as_os_str().is_empty() => parent,
+        _ => return Ok(()),
+    };
+    let mut builder = tokio::fs::DirBuilder::new();
+    builder.recursive(true);
+    #[cfg(unix)]
+    builder.mode(mode);
+    #[cfg(not(unix))]
+    let _ = mode;
+    builder.create(parent).await
+}
+
+/// Returns `path` with `suffix` appended to its file name, e.g. `app.state.tmp`.
+pub(crate) fn sibling_path(path: &Path, suffix: &str) -> PathBuf {
+    let mut sibling = path.as_os_str().to_owned();
+    sibling.push(suffix);
+    PathBuf::from(sibling)
+}
+
+/// Checks that `name` can be used as a file name inside a state directory, i.e. that it
+/// is a single path component that can't reach outside of it on any platform.
+pub(crate) fn check_app_name(name: &str) -> std::io::Result<()> {
+    if name.is_empty() || name == "." || name == ".." || name.contains(['/', '\\', '\0']) {
+        return Err(std::io::Error::new(
+            std::io::ErrorKind::InvalidInput,
+            format!("invalid application name {:?}", name),
+        ));
+    }
+    Ok(())
+}
+
+/// The blocking part of [`StatePersistence::save_state_cas`].
+fn cas_write(
+    path: &Path,
+    state: &AppState,
+    expected_generation: u64,
+) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    let lock = std::fs::OpenOptions::new()
+        .create(true)
+        .write(true)
+        .open(sibling_path(path, ".lock"))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::io::AsRawFd;
+        // The lock is released when `lock` is closed at the end of this function.
+        if unsafe { libc::flock(lock.as_raw_fd(), libc::LOCK_EX) } != 0 {
+            return Err(std::io::Error::last_os_error().into());
+        }
+    }
+
+    let found = match std::fs::read(path) {
+        Ok(data) => {
+            let stored: GenerationOnly =
+                decode_state(&state_text(data)?).map_err(|err| err.to_string())?;
+            stored.generation
+        }
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => 0,
+        Err(err) => return Err(err.into()),
+    };
+    if found != expected_generation {
+        return Err(Box::new(StateError::GenerationConflict {
+            expected: expected_generation,
+            found,
+        }));
+    }
+
+    let data = encode_state(state).map_err(|err| err.to_string())?;
+    write_atomic(path, data.as_bytes(), None, true)?;
+
+    drop(lock);
+    Ok(())
+}
+
+/// The first two bytes of every gzip stream.
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+
+/// Reads a state file, see [`state_text`]. Files over
+/// [`StatePersistence::max_state_file_bytes`] are rejected before being read.
+pub(crate) async fn read_state_file(path: &Path) -> std::io::Result<String> {
+    check_state_size(tokio::fs::metadata(path).await?.len())?;
+    state_text(tokio::fs::read(path).await?)
+}
+
+/// Fails with a [`StateError::TooLarge`] wrapped in an [`std::io::Error`] if `size` is over
+/// [`StatePersistence::max_state_file_bytes`].
+pub(crate) fn check_state_size(size: u64) -> std::io::Result<()> {
+    let limit = StatePersistence::max_state_file_bytes();
+    if limit > 0 && size > limit {
+        return Err(std::io::Error::new(
+            std::io::ErrorKind::InvalidData,
+            StateError::TooLarge { size, limit },
+        ));
+    }
+    Ok(())
+}
+
+/// Unwraps a [`StateError`] carried by an [`std::io::Error`], so callers can downcast the
+/// returned box to it. Other errors are boxed unchanged.
+pub(crate) fn unwrap_state_error(err: std::io::Error) -> Box<dyn std::error::Error> {
+    let is_state_error = err
+        .get_ref()
+        .map_or(false, |inner| inner.is::<StateError>());
+    if is_state_error {
+        return err.into_inner().expect("checked for an inner error above");
+    }
+    err.into()
+}
+
+/// Deserializes an [`AppState`] from an already parsed JSON document, keeping unknown top
+/// level keys in [`AppState::extra`] like [`StateFormat::decode`] does. Every loader that
+/// goes through `serde_json::Value` should use this instead of `serde_json::from_value`.
+pub(crate) fn state_from_value(document: serde_json::Value) -> Result<AppState, serde_json::Error> {
+    let mut unknown = Vec::new();
+    let mut state: AppState =
+        serde_ignored::deserialize(&document, |path| collect_top_level(&mut unknown, path))?;
+    keep_extra(&mut state, unknown, document);
+    Ok(state)
+}
+
+/// Records `path` in `unknown` if it is a top level key.
+fn collect_top_level(unknown: &mut Vec<String>, path: serde_ignored::Path) {
+    if let serde_ignored::Path::Map {
+        parent: serde_ignored::Path::Root,
+        key,
+    } = path
+    {
+        unknown.push(key);
+    }
+}
+
+/// Decides whether [`StatePersistence::migrate_started_at`] has a key to rename, given
+/// which of the two keys a state file has.
+fn needs_started_at_migration(
+    stared_at: bool,
+    started_at: bool,
+) -> Result<bool, Box<dyn std::error::Error>> {
+    match (stared_at, started_at) {
+        (true, true) => Err("state file has both stared_at and started_at".into()),
+        (stared_at, _) => Ok(stared_at),
+    }
+}
+
+/// Moves the `unknown` keys of `document` into [`AppState::extra`], dropping `null`s.
+fn keep_extra(state: &mut AppState, unknown: Vec<String>, mut document: serde_json::Value) {
+    if let Some(fields) = document.as_object_mut() {
+        for key in unknown {
+            match fields.remove(&key) {
+                Some(serde_json::Value::Null) | None => {}
+                Some(value) => {
+                    state.extra.insert(key, value);
+                }
+            }
+        }
+    }
+}
+
+/// Turns the raw bytes of a state file into text, transparently decompressing gzip data.
+/// Empty content fails with [`StateError::Empty`]. Decompression stops as soon as the content exceeds
+/// [`StatePersistence::max_state_file_bytes`].
+pub(crate) fn state_text(data: Vec<u8>) -> std::io::Result<String> {
+    if data.is_empty() {
+        return Err(empty_state());
+    }
+    let data = if data.starts_with(&GZIP_MAGIC) {
+        let limit = StatePersistence::max_state_file_bytes();
+        let cap = if limit > 0 { limit + 1 } else { u64::MAX };
+        let mut decompressed = Vec::new();
+        GzDecoder::new(data.as_slice())
+            .take(cap)
+            .read_to_end(&mut decompressed)?;
+        check_state_size(decompressed.len() as u64)?;
+        if decompressed.is_empty() {
+            return Err(empty_state());
+        }
+        decompressed
+    } else {
+        data
+    };
+
+    String::from_utf8(data).map_err(|_| {
+        std::io::Error::new(
+            std::io::ErrorKind::InvalidData,
+            "State file is not valid UTF-8",
+        )
+    })
+}
+
+fn empty_state() -> std::io::Error {
+    std::io::Error::new(std::io::ErrorKind::InvalidData, StateError::Empty)
+}
+
+/// Serializes `state` to TOML and encrypts it, producing the on-disk representation.
+pub(crate) fn encode_state(state: &AppState) -> Result<String, Box<dyn std::error::Error>> {
+    let toml_str: Stringy = toml::to_string(state)?.into();
+    let state_data = simple_encrypt(toml_str.as_bytes()).map_err(|e| {
+        std::io::Error::new(std::io::ErrorKind::InvalidData, e.err_mesg.to_string())
+    })?;
+    Ok(state_data.to_string())
+}
+
+/// Reverses [`encode_state`]. `T` may be [`AppState`] or any subset of its fields.
+pub(crate) fn decode_state<T: DeserializeOwned>(
+    encrypted_content: &str,
+) -> Result<T, Box<dyn std::error::Error>> {
+    let cipher_string = decrypt_state_text(encrypted_content)?;
+    let state: T = toml::from_str(&cipher_string)?;
+    Ok(state)
+}
+
+/// Decrypts the on-disk representation back into TOML text.
+pub(crate) fn decrypt_state_text(
+    encrypted_content: &str,
+) -> Result<String, Box<dyn std::error::Error>> {
+    let content = simple_decrypt(encrypted_content.as_bytes())
+        .map_err(|_| std::io::Error::new(std::io::ErrorKind::InvalidData, "Decryption failed"))?;
+
+    let cipher_string = String::from_utf8(content).map_err(|_| {
+        std::io::Error::new(
+            std::io::ErrorKind::InvalidData,
+            "Failed to convert to string",
+        )
+    })?;
+    Ok(cipher_string)
+}
+
+/// Runs `op` until it succeeds, fails with a non transient error, or `opts.max_attempts`
+/// is used up, sleeping between attempts as described by [`RetryOptions`].
+pub(crate) async fn retry_transient<F, Fut, T>(
+    opts: RetryOptions,
+    mut op: F,
+) -> Result<T, Box<dyn std::error::Error>>
+where
+    F: FnMut() -> Fut,
+    Fut: Future<Output = Result<T, Box<dyn std::error::Error>>>,
+{
+    let mut delay = opts.initial_delay.min(opts.max_delay);
+    let mut attempt: u32 = 1;
+
+    loop {
+        match op().await {
+            Ok(value) => return Ok(value),
+            Err(err) if attempt < opts.max_attempts && is_transient_io_error(err.as_ref()) => {
+                log!(
+                    LogLevel::Warn,
+                    "Transient error on attempt {} of {}: {}, retrying in {:?}",
+                    attempt,
+                    opts.max_attempts,
+                    err,
+                    delay
+                );
+                tokio::time::sleep(delay).await;
+                delay = delay
+                    .checked_mul(2)
+                    .unwrap_or(opts.max_delay)
+                    .min(opts.max_delay);
+                attempt += 1;
+            }
+            Err(err) => return Err(err),
+        }
+    }
+}
+
+/// Returns `true` for I/O errors that are worth retrying (`EINTR`, `EAGAIN`, `ENOSPC`).
+fn is_transient_io_error(err: &(dyn std::error::Error + 'static)) -> bool {
+    match err.downcast_ref::<std::io::Error>() {
+        Some(io_err) => matches!(
+            io_err.kind(),
+            std::io::ErrorKind::Interrupted
+                | std::io::ErrorKind::WouldBlock
+                | std::io::ErrorKind::StorageFull
+        ),
+        None => false,
+    }
 }
 
 /// Updates an [`AppState`] with a new timestamp, increments the event counter, and saves it.
@@ -317,7 +2198,7 @@ impl StatePersistence {
 /// - `metrics`: Optional resource usage metrics to associate with this update.
 ///
 /// # Note
-/// - If saving fails, logs the error and pushes an [`ErrorArrayItem`] to `state.error_log`.
+/// - If saving fails, logs the error and pushes an [`ErrorItem`] to `state.error_log`.
 pub async fn update_state(state: &mut AppState, path: &PathType, _metrics: Option<Metrics>) {
     state.last_updated = current_timestamp();
     state.event_counter += 1;
@@ -325,10 +2206,10 @@ pub async fn update_state(state: &mut AppState, path: &PathType, _metrics: Optio
     // Attempt to save the state to disk
     if let Err(err) = StatePersistence::save_state(state, path).await {
         log!(LogLevel::Error, "Failed to save state: {}", err);
-        state.error_log.push(ErrorArrayItem::new(
-            Errors::GeneralError,
-            format!("{}", err),
-        ));
+        state.append_error(
+            Severity::Error,
+            ErrorArrayItem::new(Errors::GeneralError, format!("{}", err)),
+        );
     }
 
     log!(LogLevel::Trace, "State Updated");
@@ -339,10 +2220,13 @@ pub async fn update_state(state: &mut AppState, path: &PathType, _metrics: Optio
 pub async fn wind_down_state(state: &mut AppState, state_path: &PathType) {
     state.data = String::from("Terminated");
     state.status = Status::Stopping;
-    state.error_log.push(ErrorArrayItem::new(
-        Errors::GeneralError,
-        "Wind down requested - check logs".to_owned(),
-    ));
+    state.append_error(
+        Severity::Warn,
+        ErrorArrayItem::new(
+            Errors::GeneralError,
+            "Wind down requested - check logs".to_owned(),
+        ),
+    );
     update_state(state, &state_path, None).await;
 }
 
@@ -350,7 +2234,7 @@ pub async fn wind_down_state(state: &mut AppState, state_path: &PathType) {
 /// and saves the updated state.
 pub async fn log_error(state: &mut AppState, error: ErrorArrayItem, path: &PathType) {
     log!(LogLevel::Error, "{}", error);
-    state.error_log.push(error);
+    state.append_error(Severity::Error, error);
     state.status = Status::Warning;
     update_state(state, path, None).await;
 }
@@ -0,0 +1,221 @@
+//! # State Push
+//!
+//! Replicates [`AppState`]s from remote supervisors to a central aggregator over HTTP.
+//!
+//! Supervisors call [`push_state`], which POSTs the state as JSON, optionally gzip
+//! compressed and authenticated with a bearer token. The aggregator runs a
+//! [`StateReceiver`] that decodes every pushed state and hands it to a callback.
+//!
+//! The receiver speaks plain HTTP; put it behind a TLS terminating proxy when pushes cross
+//! untrusted networks.
+
+use std::fmt;
+use std::io::{self, Write};
+use std::net::SocketAddr;
+use std::time::Duration;
+
+use dusa_collection_utils::core::errors::ErrorArrayItem;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use tokio::net::{TcpListener, ToSocketAddrs};
+use tokio::task::JoinHandle;
+
+use crate::http_server::{self, constant_time_eq, Request, Response};
+use crate::state_persistence::{
+    check_state_size, state_from_value, state_text, AppState, StatePersistence,
+};
+
+/// Options for [`push_state`].
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct PushOptions {
+    /// Gives up on the request after this long. No timeout when `None`.
+    pub timeout: Option<Duration>,
+    /// Sent as `Authorization: Bearer <token>`.
+    pub auth_token: Option<String>,
+    /// Gzip the body and send `Content-Encoding: gzip`.
+    pub compress: bool,
+}
+
+/// Why [`push_state`] failed.
+#[derive(Debug)]
+pub enum PushError {
+    /// The state couldn't be encoded.
+    Encode(io::Error),
+    /// The request couldn't be sent or timed out.
+    Request(reqwest::Error),
+    /// The receiver answered with a status other than `2xx`.
+    Rejected {
+        /// The HTTP status code.
+        status: u16,
+        /// The response body, usually the reason.
+        message: String,
+    },
+}
+
+impl fmt::Display for PushError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            PushError::Encode(err) => write!(f, "failed to encode state: {}", err),
+            PushError::Request(err) => write!(f, "failed to push state: {}", err),
+            PushError::Rejected { status, message } => {
+                write!(f, "state push rejected with status {}: {}", status, message)
+            }
+        }
+    }
+}
+
+impl std::error::Error for PushError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            PushError::Encode(err) => Some(err),
+            PushError::Request(err) => Some(err),
+            PushError::Rejected { .. } => None,
+        }
+    }
+}
+
+/// POSTs `state` as JSON to `url`.
+///
+/// # Errors
+/// Returns [`PushError::Request`] if the receiver can't be reached in time and
+/// [`PushError::Rejected`] if it doesn't accept the state.
+pub async fn push_state(url: &str, state: &AppState, opts: &PushOptions) -> Result<(), PushError> {
+    let mut body = serde_json::to_vec(state).map_err(|err| PushError::Encode(err.into()))?;
+    if opts.compress {
+        let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+        body = encoder
+            .write_all(&body)
+            .and_then(|_| encoder.finish())
+            .map_err(PushError::Encode)?;
+    }
+
+    let mut request = reqwest::Client::new()
+        .post(url)
+        .header(reqwest::header::CONTENT_TYPE, "application/json")
+        .body(body);
+    if opts.compress {
+        request = request.header(reqwest::header::CONTENT_ENCODING, "gzip");
+    }
+    if let Some(token) = &opts.auth_token {
+        request = request.bearer_auth(token);
+    }
+    if let Some(timeout) = opts.timeout {
+        request = request.timeout(timeout);
+    }
+
+    let response = request.send().await.map_err(PushError::Request)?;
+    let status = response.status();
+    if status.is_success() {
+        return Ok(());
+    }
+    Err(PushError::Rejected {
+        status: status.as_u16(),
+        message: response.text().await.unwrap_or_default(),
+    })
+}
+
+/// Called by a [`StateReceiver`] with every pushed state. An `Err` is reported back to the
+/// pusher as `500`, with [`ErrorArrayItem::err_mesg`] as the message.
+pub type ReceiveHook = Box<dyn Fn(AppState) -> Result<(), ErrorArrayItem> + Send + Sync>;
+
+/// Accepts states sent by [`push_state`] on any path.
+///
+/// A request must be a `POST` with `Content-Type: application/json`; the body may be gzip
+/// compressed and is held to [`StatePersistence::max_state_file_bytes`], compressed and
+/// decompressed. Accepted states are answered with `204`. The listener stops when the
+/// receiver is dropped.
+pub struct StateReceiver {
+    addr: SocketAddr,
+    accept_task: JoinHandle<()>,
+}
+
+impl StateReceiver {
+    /// Listens on `addr` and calls `on_receive` with every accepted state. When
+    /// `auth_token` is set, pushes without the matching bearer token are refused with
+    /// `401`.
+    ///
+    /// Must be called from within a tokio runtime. `on_receive` runs on the runtime, so
+    /// hand slow work off to another task.
+    ///
+    /// # Errors
+    /// Returns an `Err` if `addr` can't be bound.
+    pub async fn bind<A, F>(addr: A, auth_token: Option<String>, on_receive: F) -> io::Result<Self>
+    where
+        A: ToSocketAddrs,
+        F: Fn(AppState) -> Result<(), ErrorArrayItem> + Send + Sync + 'static,
+    {
+        let listener = TcpListener::bind(addr).await?;
+        let addr = listener.local_addr()?;
+        let on_receive: ReceiveHook = Box::new(on_receive);
+        let accept_task = http_server::serve(
+            listener,
+            StatePersistence::max_state_file_bytes(),
+            move |request| receive(request, auth_token.as_deref(), &on_receive),
+        );
+        Ok(Self { addr, accept_task })
+    }
+
+    /// Returns the address the receiver listens on, e.g. to learn the port picked for
+    /// `127.0.0.1:0`.
+    pub fn local_addr(&self) -> SocketAddr {
+        self.addr
+    }
+}
+
+impl fmt::Debug for StateReceiver {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("StateReceiver")
+            .field("addr", &self.addr)
+            .finish()
+    }
+}
+
+impl Drop for StateReceiver {
+    fn drop(&mut self) {
+        self.accept_task.abort();
+    }
+}
+
+fn receive(request: Request, auth_token: Option<&str>, on_receive: &ReceiveHook) -> Response {
+    if request.method != "POST" {
+        return Response::text(405, "only POST is supported").header("Allow", "POST");
+    }
+    if let Some(token) = auth_token {
+        let expected = format!("Bearer {}", token);
+        let given = request.header("Authorization").unwrap_or_default();
+        if !constant_time_eq(given.as_bytes(), expected.as_bytes()) {
+            return Response::text(401, "missing or invalid bearer token")
+                .header("WWW-Authenticate", "Bearer");
+        }
+    }
+
+    let content_type = request.header("Content-Type").unwrap_or_default();
+    let media_type = content_type.split(';').next().unwrap_or_default().trim();
+    if !media_type.eq_ignore_ascii_case("application/json") {
+        return Response::text(415, "expected Content-Type: application/json");
+    }
+    // `state_text` recognises gzip by its magic bytes, the header only has to be sensible.
+    match request.header("Content-Encoding") {
+        None => {}
+        Some(encoding)
+            if encoding.eq_ignore_ascii_case("identity")
+                || encoding.eq_ignore_ascii_case("gzip") => {}
+        Some(encoding) => {
+            return Response::text(415, format!("unsupported Content-Encoding {}", encoding))
+        }
+    }
+
+    let state = check_state_size(request.body.len() as u64)
+        .and_then(|_| state_text(request.body))
+        .and_then(|text| serde_json::from_str(&text).map_err(io::Error::from))
+        .and_then(|value| state_from_value(value).map_err(io::Error::from));
+    let state = match state {
+        Ok(state) => state,
+        Err(err) => return Response::text(400, format!("invalid state: {}", err)),
+    };
+
+    match on_receive(state) {
+        Ok(()) => Response::new(204),
+        Err(err) => Response::text(500, err.err_mesg.to_string()),
+    }
+}
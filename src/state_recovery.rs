@@ -0,0 +1,245 @@
+//! # State Recovery
+//!
+//! Salvages what it can from a damaged state file, e.g. one truncated by a crash in the
+//! middle of a write, for forensic inspection after the fact.
+//!
+//! [`load_state_best_effort`] reads the top level fields one at a time and keeps every
+//! field that decodes, so a file cut off in the middle of its output buffers still yields
+//! the name, version and config written before the damage. Encrypted files can only be
+//! salvaged if they still decrypt; a truncated ciphertext fails authentication as a whole.
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+use dusa_collection_utils::core::version::SoftwareVersion;
+use serde::de::{MapAccess, Visitor};
+use serde::{Deserialize, Deserializer};
+use serde_json::{Map, Value};
+use std::fmt;
+
+use crate::aggregator::Status;
+use crate::config::AppConfig;
+use crate::state_persistence::{
+    decrypt_state_text, read_state_file, unwrap_state_error, AppState, StateFormat,
+};
+
+/// A part of a state file [`load_state_best_effort`] couldn't decode.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RecoveryError {
+    /// The top level field affected, if known.
+    pub field: Option<String>,
+    /// What went wrong.
+    pub message: String,
+}
+
+impl fmt::Display for RecoveryError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match &self.field {
+            Some(field) => write!(f, "field {}: {}", field, self.message),
+            None => write!(f, "{}", self.message),
+        }
+    }
+}
+
+impl std::error::Error for RecoveryError {}
+
+/// The result of [`load_state_best_effort`].
+#[derive(Debug, Clone)]
+pub struct RecoveredState {
+    /// The state with every recovered field. Fields that weren't recovered hold
+    /// placeholders: empty strings and collections, zeros, [`Status::Unknown`], the built-in
+    /// default config and [`SoftwareVersion::dummy`].
+    pub state: AppState,
+    /// The top level fields taken from the file, sorted by name.
+    pub recovered_fields: Vec<String>,
+    /// Everything that couldn't be decoded.
+    pub errors: Vec<RecoveryError>,
+}
+
+impl RecoveredState {
+    /// Returns `true` if `field` was taken from the file rather than being a placeholder.
+    pub fn is_recovered(&self, field: &str) -> bool {
+        self.recovered_fields.iter().any(|name| name == field)
+    }
+}
+
+/// Loads as much of the state file at `path` as can be decoded, in the [`StateFormat`]
+/// implied by its extension.
+///
+/// JSON files are read up to the first syntax error. TOML files drop the lines around
+/// each syntax error and keep the rest. A field whose value is present but doesn't fit
+/// [`AppState`] is left out and reported as well.
+///
+/// # Errors
+/// Returns an `Err` if the file can't be read or, for encrypted files, decrypted, since
+/// nothing can be recovered then.
+pub async fn load_state_best_effort(
+    path: &PathType,
+) -> Result<RecoveredState, Box<dyn std::error::Error>> {
+    let content = read_state_file(path.as_ref())
+        .await
+        .map_err(unwrap_state_error)?;
+
+    let mut errors = Vec::new();
+    let fields = match StateFormat::from_path(path.as_ref()).unwrap_or(StateFormat::Encrypted) {
+        StateFormat::Encrypted => toml_fields(&decrypt_state_text(&content)?, &mut errors),
+        StateFormat::Toml => toml_fields(&content, &mut errors),
+        StateFormat::Json => json_fields(&content, &mut errors),
+    };
+
+    let mut merged = serde_json::to_value(placeholder_state()?)?;
+    let mut recovered_fields = Vec::new();
+    for (name, value) in fields {
+        // The placeholder holds the serialized key already; the alias would be a duplicate.
+        let name = match name.as_str() {
+            "started_at" => "stared_at".to_string(),
+            _ => name,
+        };
+        let Value::Object(map) = &mut merged else {
+            unreachable!("AppState serializes to an object");
+        };
+        let previous = map.insert(name.clone(), value);
+        match AppState::deserialize(&merged) {
+            Ok(_) => recovered_fields.push(name),
+            Err(err) => {
+                errors.push(RecoveryError {
+                    field: Some(name.clone()),
+                    message: err.to_string(),
+                });
+                if let Value::Object(map) = &mut merged {
+                    match previous {
+                        Some(previous) => map.insert(name, previous),
+                        None => map.remove(&name),
+                    };
+                }
+            }
+        }
+    }
+
+    // Keep the order independent of whether serde_json was built with `preserve_order`.
+    recovered_fields.sort();
+
+    let state = StateFormat::Json.decode(&merged.to_string())?;
+    Ok(RecoveredState {
+        state,
+        recovered_fields,
+        errors,
+    })
+}
+
+fn placeholder_state() -> Result<AppState, Box<dyn std::error::Error>> {
+    Ok(AppState {
+        name: String::new(),
+        version: SoftwareVersion::dummy(),
+        data: String::new(),
+        status: Status::Unknown,
+        pid: 0,
+        last_updated: 0,
+        started_at: 0,
+        event_counter: 0,
+        error_log: Vec::new(),
+        config: AppConfig::defaults()?,
+        system_application: false,
+        stdout: Vec::new(),
+        stderr: Vec::new(),
+        stdout_meta: Default::default(),
+        stderr_meta: Default::default(),
+        events: Vec::new(),
+        generation: 0,
+        labels: Default::default(),
+        tags: Vec::new(),
+        dependencies: Vec::new(),
+        extra: Default::default(),
+    })
+}
+
+/// Reads the top level fields of a TOML document, dropping the lines of every syntax
+/// error until the remainder parses.
+fn toml_fields(text: &str, errors: &mut Vec<RecoveryError>) -> Vec<(String, Value)> {
+    let mut lines: Vec<&str> = text.lines().collect();
+    loop {
+        let document = lines.join("\n");
+        let err = match toml::from_str::<toml::Table>(&document) {
+            Ok(table) => {
+                return table
+                    .into_iter()
+                    .filter_map(|(name, value)| Some((name, serde_json::to_value(value).ok()?)))
+                    .collect()
+            }
+            Err(err) => err,
+        };
+
+        let span = match err.span() {
+            Some(span) if !lines.is_empty() => span,
+            _ => {
+                errors.push(RecoveryError {
+                    field: None,
+                    message: err.message().to_string(),
+                });
+                return Vec::new();
+            }
+        };
+        let last_line = lines.len() - 1;
+        let first = document[..span.start].matches('\n').count().min(last_line);
+        let last = document[..span.end.max(span.start)]
+            .matches('\n')
+            .count()
+            .min(last_line);
+        errors.push(RecoveryError {
+            field: toml_key(lines[first]),
+            message: err.message().to_string(),
+        });
+        lines.drain(first..=last);
+    }
+}
+
+/// Returns the key assigned on `line`, if it is a top level `key = value` line.
+fn toml_key(line: &str) -> Option<String> {
+    let (key, _) = line.split_once('=')?;
+    let key = key.trim();
+    if key.is_empty() || key.starts_with(['[', '#']) {
+        return None;
+    }
+    Some(key.trim_matches('"').to_string())
+}
+
+/// Reads the top level fields of a JSON object up to the first syntax error.
+fn json_fields(text: &str, errors: &mut Vec<RecoveryError>) -> Vec<(String, Value)> {
+    let mut fields = Map::new();
+    let mut current = None;
+    let collector = FieldCollector {
+        fields: &mut fields,
+        current: &mut current,
+    };
+    if let Err(err) = serde_json::Deserializer::from_str(text).deserialize_map(collector) {
+        errors.push(RecoveryError {
+            field: current,
+            message: err.to_string(),
+        });
+    }
+    fields.into_iter().collect()
+}
+
+/// Collects the entries of a JSON object one by one, so the entries before a syntax error
+/// survive it.
+struct FieldCollector<'a> {
+    fields: &'a mut Map<String, Value>,
+    /// The key whose value is being read.
+    current: &'a mut Option<String>,
+}
+
+impl<'de> Visitor<'de> for FieldCollector<'_> {
+    type Value = ();
+
+    fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "a state object")
+    }
+
+    fn visit_map<A: MapAccess<'de>>(self, mut map: A) -> Result<(), A::Error> {
+        while let Some(key) = map.next_key::<String>()? {
+            *self.current = Some(key.clone());
+            let value = map.next_value()?;
+            self.fields.insert(key, value);
+            *self.current = None;
+        }
+        Ok(())
+    }
+}
@@ -0,0 +1,210 @@
+//! # State Remote
+//!
+//! Loads a state file from another host over SSH, for inspecting machines that can be
+//! reached with `ssh` but not mounted.
+//!
+//! The system `ssh` client does the work, so host keys, agents and `~/.ssh/config` behave
+//! exactly as they do on the command line. It runs in batch mode, so a missing key fails
+//! instead of prompting for a password. Set `SSH_PATH` to use a client other than the
+//! `ssh` found on `PATH`.
+
+use std::fmt;
+use std::path::PathBuf;
+use std::process::Stdio;
+use std::time::Duration;
+
+use tokio::process::Command;
+
+use crate::state_persistence::{
+    check_state_size, state_text, unwrap_state_error, AppState, StateFormat,
+};
+
+const SSH_PATH: &str = "ssh";
+
+/// Exit status of the remote command when the file doesn't exist, `EX_NOINPUT` from
+/// `sysexits.h`.
+const NOT_FOUND_STATUS: i32 = 66;
+
+/// Exit status of `ssh` itself failing, as opposed to the remote command.
+const SSH_FAILED_STATUS: i32 = 255;
+
+/// How [`load_state_ssh`] authenticates.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SshAuth {
+    /// Whatever the client is configured to use: the agent, default keys, `~/.ssh/config`.
+    Default,
+    /// Only the private key at this path.
+    IdentityFile(PathBuf),
+}
+
+/// The host and account [`load_state_ssh`] connects to.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SshTarget {
+    /// `host` or `host:port`, IPv6 addresses in brackets, e.g. `[::1]:2222`.
+    pub addr: String,
+    /// The remote user to log in as.
+    pub user: String,
+    /// How to authenticate.
+    pub auth: SshAuth,
+}
+
+/// Why a remote state couldn't be loaded.
+#[derive(Debug)]
+pub enum RemoteStateError {
+    /// The server rejected every key offered for `destination` (`user@host`).
+    AuthFailed {
+        /// The `user@host` that was tried.
+        destination: String,
+    },
+    /// `path` doesn't exist on the remote host.
+    NotFound {
+        /// The remote path.
+        path: String,
+    },
+    /// Connecting or reading took longer than the timeout.
+    TimedOut(Duration),
+    /// `ssh` failed or the remote file couldn't be read, with the client's message.
+    Ssh(String),
+    /// The file was read but isn't a valid state.
+    Decode(Box<dyn std::error::Error>),
+}
+
+impl fmt::Display for RemoteStateError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            RemoteStateError::AuthFailed { destination } => {
+                write!(f, "ssh authentication failed for {}", destination)
+            }
+            RemoteStateError::NotFound { path } => write!(f, "remote state {} not found", path),
+            RemoteStateError::TimedOut(timeout) => {
+                write!(f, "remote state not loaded within {:?}", timeout)
+            }
+            RemoteStateError::Ssh(message) => write!(f, "ssh failed: {}", message),
+            RemoteStateError::Decode(err) => write!(f, "invalid remote state: {}", err),
+        }
+    }
+}
+
+impl std::error::Error for RemoteStateError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            RemoteStateError::Decode(err) => Some(err.as_ref()),
+            _ => None,
+        }
+    }
+}
+
+/// Reads the state file at `remote_path` on `target` and decodes it like
+/// [`StatePersistence::load_state`](crate::state_persistence::StatePersistence::load_state),
+/// giving up after `timeout`. The size limit of local loads applies as well.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::state_remote::{load_state_ssh, SshAuth, SshTarget};
+/// # use std::time::Duration;
+/// # async fn inspect() -> Result<(), Box<dyn std::error::Error>> {
+/// let target = SshTarget {
+///     addr: "app01.internal".to_string(),
+///     user: "ops".to_string(),
+///     auth: SshAuth::Default,
+/// };
+/// let state = load_state_ssh(&target, "/tmp/.app.state", Duration::from_secs(10)).await?;
+/// println!("{} is {}", state.name, state.status);
+/// # Ok(())
+/// # }
+/// ```
+///
+/// # Errors
+/// Returns [`RemoteStateError::AuthFailed`] if the login is rejected,
+/// [`RemoteStateError::NotFound`] if the file doesn't exist, [`RemoteStateError::TimedOut`]
+/// once `timeout` passes and [`RemoteStateError::Decode`] if the content isn't a state.
+pub async fn load_state_ssh(
+    target: &SshTarget,
+    remote_path: &str,
+    timeout: Duration,
+) -> Result<AppState, RemoteStateError> {
+    let (host, port) = split_addr(&target.addr);
+
+    let mut command =
+        Command::new(std::env::var("SSH_PATH").unwrap_or_else(|_| SSH_PATH.to_string()));
+    command
+        .args(["-o", "BatchMode=yes"])
+        .arg("-o")
+        .arg(format!("ConnectTimeout={}", timeout.as_secs().max(1)));
+    if let Some(port) = port {
+        command.args(["-p", port]);
+    }
+    if let SshAuth::IdentityFile(path) = &target.auth {
+        command
+            .arg("-i")
+            .arg(path)
+            .args(["-o", "IdentitiesOnly=yes"]);
+    }
+    command
+        .args(["-l", &target.user, "--", host])
+        .arg(remote_command(remote_path))
+        .env("LC_ALL", "C")
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+
+    let output = match tokio::time::timeout(timeout, command.output()).await {
+        Ok(output) => output.map_err(|err| RemoteStateError::Ssh(err.to_string()))?,
+        Err(_) => return Err(RemoteStateError::TimedOut(timeout)),
+    };
+
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr).trim().to_string();
+        return Err(match output.status.code() {
+            Some(NOT_FOUND_STATUS) => RemoteStateError::NotFound {
+                path: remote_path.to_string(),
+            },
+            // `ssh` has no exit status of its own for a rejected login; with `LC_ALL=C` its
+            // message is stable, though.
+            Some(SSH_FAILED_STATUS) if stderr.contains("Permission denied") => {
+                RemoteStateError::AuthFailed {
+                    destination: format!("{}@{}", target.user, host),
+                }
+            }
+            _ => RemoteStateError::Ssh(stderr),
+        });
+    }
+
+    check_state_size(output.stdout.len() as u64)
+        .and_then(|_| state_text(output.stdout))
+        .map_err(|err| RemoteStateError::Decode(unwrap_state_error(err)))
+        .and_then(|content| {
+            StateFormat::Encrypted
+                .decode(&content)
+                .map_err(RemoteStateError::Decode)
+        })
+}
+
+/// Returns the shell command printing the file at `path`, exiting with
+/// [`NOT_FOUND_STATUS`] if there is none.
+fn remote_command(path: &str) -> String {
+    format!(
+        "test -e {0} || exit {1}; LC_ALL=C exec cat -- {0}",
+        shell_quote(path),
+        NOT_FOUND_STATUS
+    )
+}
+
+/// Splits `host:port`, leaving `host` alone and stripping the brackets of `[v6]:port`.
+fn split_addr(addr: &str) -> (&str, Option<&str>) {
+    if let Some(rest) = addr.strip_prefix('[') {
+        if let Some((host, after)) = rest.split_once(']') {
+            return (host, after.strip_prefix(':'));
+        }
+    }
+    match addr.rsplit_once(':') {
+        Some((host, port)) if !host.contains(':') => (host, Some(port)),
+        _ => (addr, None),
+    }
+}
+
+/// Quotes `value` for the remote POSIX shell.
+fn shell_quote(value: &str) -> String {
+    format!("'{}'", value.replace('\'', "'\\''"))
+}
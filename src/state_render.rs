@@ -0,0 +1,352 @@
+//! # State Render
+//!
+//! Lightweight templating for printing [`AppState`] fields from CLI tools.
+//!
+//! A template is plain text with `{{field}}` placeholders, for example
+//! `"{{name}} {{status}} {{uptime}}"`. The supported fields are:
+//!
+//! | Field            | Value                                                   |
+//! |------------------|---------------------------------------------------------|
+//! | `name`           | [`AppState::name`]                                      |
+//! | `version`        | [`AppState::version`]                                   |
+//! | `status`         | [`AppState::status`], without colors                    |
+//! | `pid`            | [`AppState::pid`]                                       |
+//! | `data`           | [`AppState::data`]                                      |
+//! | `uptime`         | `HH:MM:SS` since [`AppState::started_at`], `-` if unset |
+//! | `started_at`     | [`AppState::started_at`] as a readable date             |
+//! | `last_updated`   | [`AppState::last_updated`] as a readable date           |
+//! | `event_counter`  | [`AppState::event_counter`]                             |
+//! | `error_count`    | number of entries in [`AppState::error_log`]            |
+//! | `stdout_lines`   | number of captured stdout lines                         |
+//! | `stderr_lines`   | number of captured stderr lines                         |
+//! | `max_ram`        | the RAM limit, e.g. `512.0 MiB`, or `unlimited`         |
+//! | `max_cpu`        | the configured CPU limit                                |
+//!
+//! Two built-in layouts are available through [`builtin_template`]: `short` and `full`.
+//!
+//! For a readable dump of a whole state, see [`print_state`].
+
+use chrono::SecondsFormat;
+use colored::{ColoredString, Colorize};
+use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+use std::fmt;
+use std::io::{self, IsTerminal, Write};
+
+use crate::state_persistence::{output_time, AppState, Output};
+use crate::timestamp::{current_timestamp, format_unix_timestamp};
+
+/// One line summary: name, status and uptime.
+pub const SHORT_TEMPLATE: &str = "{{name}} {{status}} {{uptime}}";
+
+/// Multi line overview of the most useful fields.
+pub const FULL_TEMPLATE: &str = "Name: {{name}}
+Version: {{version}}
+Status: {{status}}
+PID: {{pid}}
+Uptime: {{uptime}}
+Started At: {{started_at}}
+Last Updated: {{last_updated}}
+Events: {{event_counter}}
+Errors: {{error_count}}
+Stdout Lines: {{stdout_lines}}
+Stderr Lines: {{stderr_lines}}
+RAM Limit: {{max_ram}}
+CPU Limit: {{max_cpu}}";
+
+/// Returns the built-in template registered under `name` (`short` or `full`).
+pub fn builtin_template(name: &str) -> Option<&'static str> {
+    match name {
+        "short" => Some(SHORT_TEMPLATE),
+        "full" => Some(FULL_TEMPLATE),
+        _ => None,
+    }
+}
+
+/// Formats a byte count using binary units, e.g. `1536` becomes `1.5 KiB`.
+pub fn format_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 6] = ["B", "KiB", "MiB", "GiB", "TiB", "PiB"];
+
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut value = bytes as f64;
+    let mut unit = 0;
+    while value >= 1024.0 && unit < UNITS.len() - 1 {
+        value /= 1024.0;
+        unit += 1;
+    }
+    format!("{:.1} {}", value, UNITS[unit])
+}
+
+/// Returned by [`parse_bytes`] for input that isn't a byte size.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ParseBytesError {
+    /// The rejected input.
+    pub input: String,
+}
+
+impl fmt::Display for ParseBytesError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(
+            f,
+            "Invalid byte size {:?}, expected e.g. 512MiB or 4GiB",
+            self.input
+        )
+    }
+}
+
+impl std::error::Error for ParseBytesError {}
+
+/// Parses a byte count written like [`format_bytes`] output, e.g. `4GiB`, `1.5 KiB` or
+/// `2048`. Units are binary and case insensitive; `K`, `KB` and `KiB` all mean 1024 bytes,
+/// as is common for memory sizes, and likewise up to `P`. Fractions are rounded to the
+/// nearest byte.
+///
+/// # Errors
+/// Returns a [`ParseBytesError`] for an unknown unit, a malformed number or a value that
+/// doesn't fit in a `u64`.
+pub fn parse_bytes(input: &str) -> Result<u64, ParseBytesError> {
+    let error = || ParseBytesError {
+        input: input.to_string(),
+    };
+
+    let text = input.trim();
+    let split = text
+        .find(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .unwrap_or(text.len());
+    let (number, unit) = text.split_at(split);
+    let multiplier: u64 = match unit.trim().to_ascii_lowercase().as_str() {
+        "" | "b" => 1,
+        "k" | "kb" | "kib" => 1 << 10,
+        "m" | "mb" | "mib" => 1 << 20,
+        "g" | "gb" | "gib" => 1 << 30,
+        "t" | "tb" | "tib" => 1 << 40,
+        "p" | "pb" | "pib" => 1 << 50,
+        _ => return Err(error()),
+    };
+
+    if number.contains('.') {
+        let bytes = number.parse::<f64>().map_err(|_| error())? * multiplier as f64;
+        // `u64::MAX as f64` rounds up to 2^64, which itself doesn't fit.
+        if !bytes.is_finite() || bytes >= u64::MAX as f64 {
+            return Err(error());
+        }
+        Ok(bytes.round() as u64)
+    } else {
+        number
+            .parse::<u64>()
+            .ok()
+            .and_then(|value| value.checked_mul(multiplier))
+            .ok_or_else(error)
+    }
+}
+
+/// Replaces every `{{field}}` placeholder in `template` with what `lookup` returns for the
+/// trimmed field name. Returns the error of `unterminated` for a `{{` without a matching
+/// `}}`, and the first error of `lookup`.
+pub(crate) fn expand_placeholders<E>(
+    template: &str,
+    unterminated: impl FnOnce() -> E,
+    mut lookup: impl FnMut(&str) -> Result<String, E>,
+) -> Result<String, E> {
+    let mut output = String::with_capacity(template.len());
+    let mut rest = template;
+
+    while let Some(start) = rest.find("{{") {
+        output.push_str(&rest[..start]);
+        let after = &rest[start + 2..];
+        let end = match after.find("}}") {
+            Some(end) => end,
+            None => return Err(unterminated()),
+        };
+        output.push_str(&lookup(after[..end].trim())?);
+        rest = &after[end + 2..];
+    }
+    output.push_str(rest);
+
+    Ok(output)
+}
+
+/// Formats a number of seconds as `HH:MM:SS`.
+fn format_duration(seconds: u64) -> String {
+    format!(
+        "{:02}:{:02}:{:02}",
+        seconds / 3600,
+        (seconds % 3600) / 60,
+        seconds % 60
+    )
+}
+
+impl AppState {
+    /// Renders `template`, replacing every `{{field}}` placeholder with the matching value.
+    /// See the [module documentation](crate::state_render) for the list of fields.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_persistence::AppState;
+    /// # fn print(state: &AppState) {
+    /// let line = state.render("{{name}} ({{pid}})").unwrap();
+    /// println!("{}", line);
+    /// # }
+    /// ```
+    ///
+    /// # Errors
+    /// Returns an error if the template has an unterminated `{{` or names an unknown field.
+    pub fn render(&self, template: &str) -> Result<String, ErrorArrayItem> {
+        expand_placeholders(
+            template,
+            || {
+                ErrorArrayItem::new(
+                    Errors::GeneralError,
+                    format!("Unterminated placeholder in template: {}", template),
+                )
+            },
+            |field| self.render_field(field),
+        )
+    }
+
+    /// Renders the built-in template registered under `name`, see [`builtin_template`].
+    ///
+    /// # Errors
+    /// Returns an error if no built-in template has that name.
+    pub fn render_builtin(&self, name: &str) -> Result<String, ErrorArrayItem> {
+        let template = builtin_template(name).ok_or_else(|| {
+            ErrorArrayItem::new(
+                Errors::GeneralError,
+                format!("Unknown template {}, expected short or full", name),
+            )
+        })?;
+        self.render(template)
+    }
+
+    fn render_field(&self, field: &str) -> Result<String, ErrorArrayItem> {
+        let value = match field {
+            "name" => self.name.clone(),
+            "version" => self.version.to_string(),
+            "status" => format!("{:?}", self.status),
+            "pid" => self.pid.to_string(),
+            "data" => self.data.clone(),
+            "uptime" => match self.started_at {
+                0 => "-".to_string(),
+                started => format_duration(current_timestamp().saturating_sub(started)),
+            },
+            "started_at" => format_unix_timestamp(self.started_at),
+            "last_updated" => format_unix_timestamp(self.last_updated),
+            "event_counter" => self.event_counter.to_string(),
+            "error_count" => self.error_log.len().to_string(),
+            "stdout_lines" => self.stdout.len().to_string(),
+            "stderr_lines" => self.stderr.len().to_string(),
+            "max_ram" => self.config.max_ram_human(),
+            "max_cpu" => self.config.max_cpu_usage.to_string(),
+            unknown => {
+                return Err(ErrorArrayItem::new(
+                    Errors::GeneralError,
+                    format!("Unknown template field {}", unknown),
+                ))
+            }
+        };
+        Ok(value)
+    }
+}
+
+/// Controls the output of [`print_state`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct PrintOptions {
+    /// Emit ANSI colors.
+    pub color: bool,
+    /// Also print every captured stdout and stderr line.
+    pub verbose: bool,
+}
+
+impl PrintOptions {
+    /// Options for printing to stdout; colors are enabled only if stdout is a terminal.
+    pub fn for_stdout(verbose: bool) -> Self {
+        Self {
+            color: io::stdout().is_terminal(),
+            verbose,
+        }
+    }
+}
+
+/// Writes a human friendly table of the key fields of `state` to `w`.
+/// With [`PrintOptions::verbose`] the captured output follows, each line prefixed with its
+/// RFC 3339 timestamp.
+///
+/// # Example
+/// ```rust
+/// # use artisan_middleware::state_persistence::AppState;
+/// # use artisan_middleware::state_render::{print_state, PrintOptions};
+/// # fn dump(state: &AppState) -> std::io::Result<()> {
+/// print_state(&mut std::io::stdout(), state, PrintOptions::for_stdout(false))?;
+/// # Ok(())
+/// # }
+/// ```
+///
+/// # Errors
+/// Returns any error reported by `w`.
+pub fn print_state<W: Write>(w: &mut W, state: &AppState, opts: PrintOptions) -> io::Result<()> {
+    let paint = |text: &str, style: fn(&str) -> ColoredString| -> String {
+        if opts.color {
+            style(text).to_string()
+        } else {
+            text.to_string()
+        }
+    };
+
+    let status = if opts.color {
+        state.status.to_string()
+    } else {
+        format!("{:?}", state.status)
+    };
+    let uptime = match state.started_at {
+        0 => "-".to_string(),
+        started => format_duration(current_timestamp().saturating_sub(started)),
+    };
+    let rows = [
+        ("Name", state.name.clone()),
+        ("Version", state.version.to_string()),
+        ("Status", status),
+        ("PID", state.pid.to_string()),
+        ("Uptime", uptime),
+        ("Started At", format_unix_timestamp(state.started_at)),
+        ("Last Updated", format_unix_timestamp(state.last_updated)),
+        ("Events", state.event_counter.to_string()),
+        ("Errors", state.error_log.len().to_string()),
+        ("Stdout Lines", state.stdout.len().to_string()),
+        ("Stderr Lines", state.stderr.len().to_string()),
+    ];
+
+    writeln!(w, "{}", paint("AppState", |s| s.bold().underline().cyan()))?;
+    for (label, value) in rows {
+        // Pad before painting so escape codes don't throw off the alignment.
+        writeln!(
+            w,
+            "  {} {}",
+            paint(&format!("{:<14}", label), |s| s.bold().yellow()),
+            value
+        )?;
+    }
+
+    if opts.verbose {
+        print_outputs(w, &paint("Stdout", |s| s.bold().green()), &state.stdout)?;
+        print_outputs(w, &paint("Stderr", |s| s.bold().red()), &state.stderr)?;
+    }
+
+    Ok(())
+}
+
+fn print_outputs<W: Write>(w: &mut W, title: &str, outputs: &[Output]) -> io::Result<()> {
+    writeln!(w, "{}:", title)?;
+    if outputs.is_empty() {
+        writeln!(w, "  None")?;
+    }
+    for output in outputs {
+        writeln!(
+            w,
+            "  {} {}",
+            output_time(output).to_rfc3339_opts(SecondsFormat::Secs, true),
+            output.1
+        )?;
+    }
+    Ok(())
+}
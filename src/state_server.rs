@@ -0,0 +1,197 @@
+//! # State Server
+//!
+//! Serves the live state of a [`StateStore`] as JSON over HTTP, for health dashboards and
+//! other read-only consumers:
+//!
+//! | Path | Body |
+//! |------|------|
+//! | `GET /state` | the whole [`AppState`] |
+//! | `GET /state/config` | [`AppState::config`] |
+//! | `GET /state/errors` | [`AppState::error_log`] |
+//! | `GET /state/output?target=stdout&lines=50` | the last `lines` entries of `target` |
+//!
+//! `target` is `stdout` (the default) or `stderr`; without `lines` the whole buffer is
+//! returned. Every response, errors included, is `application/json`; errors are an object
+//! with an `error` message. Secrets such as the database URL are redacted like in a
+//! [support bundle](crate::support_bundle), and requests with a body are refused.
+//!
+//! Like the [state receiver](crate::state_push), the server speaks plain HTTP. Put it behind
+//! a TLS terminating proxy before enabling [basic auth](StateServer::set_basic_auth) on
+//! untrusted networks.
+
+use base64::Engine;
+use serde::Serialize;
+use std::fmt;
+use std::io;
+use std::net::SocketAddr;
+use std::sync::{Arc, RwLock};
+
+use tokio::net::{TcpListener, ToSocketAddrs};
+use tokio::task::JoinHandle;
+
+use crate::http_server::{self, constant_time_eq, Request, Response};
+use crate::state_persistence::{AppState, Output, OutputTarget};
+use crate::state_store::StateStore;
+use crate::support_bundle::redact_secrets;
+
+/// Largest request body accepted. Every endpoint is a `GET`, so none is expected.
+const MAX_BODY: u64 = 8 * 1024;
+
+/// Serves a [`StateStore`], see the [module documentation](crate::state_server). The
+/// listener stops when the server is dropped.
+pub struct StateServer {
+    addr: SocketAddr,
+    credentials: Arc<RwLock<Option<String>>>,
+    accept_task: JoinHandle<()>,
+}
+
+impl StateServer {
+    /// Listens on `addr` and answers every request from the current content of `store`.
+    ///
+    /// Must be called from within a tokio runtime.
+    ///
+    /// # Errors
+    /// Returns an `Err` if `addr` can't be bound.
+    pub async fn bind<A: ToSocketAddrs>(addr: A, store: StateStore) -> io::Result<Self> {
+        let listener = TcpListener::bind(addr).await?;
+        let addr = listener.local_addr()?;
+        let credentials = Arc::new(RwLock::new(None));
+        let expected = Arc::clone(&credentials);
+        let accept_task = http_server::serve(listener, MAX_BODY, move |request| {
+            let expected = expected
+                .read()
+                .unwrap_or_else(|poisoned| poisoned.into_inner());
+            respond(&request, expected.as_deref(), &store)
+        });
+        Ok(Self {
+            addr,
+            credentials,
+            accept_task,
+        })
+    }
+
+    /// Refuses requests without the given HTTP basic auth credentials with `401` from now
+    /// on, replacing credentials set earlier.
+    pub fn set_basic_auth(&self, user: &str, password: &str) {
+        let encoded =
+            base64::engine::general_purpose::STANDARD.encode(format!("{}:{}", user, password));
+        let mut credentials = self
+            .credentials
+            .write()
+            .unwrap_or_else(|poisoned| poisoned.into_inner());
+        *credentials = Some(format!("Basic {}", encoded));
+    }
+
+    /// Returns the address the server listens on, e.g. to learn the port picked for
+    /// `127.0.0.1:0`.
+    pub fn local_addr(&self) -> SocketAddr {
+        self.addr
+    }
+}
+
+impl fmt::Debug for StateServer {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("StateServer")
+            .field("addr", &self.addr)
+            .finish()
+    }
+}
+
+impl Drop for StateServer {
+    fn drop(&mut self) {
+        self.accept_task.abort();
+    }
+}
+
+fn respond(request: &Request, credentials: Option<&str>, store: &StateStore) -> Response {
+    if request.method != "GET" {
+        return error(405, "only GET is supported").header("Allow", "GET");
+    }
+    if !request.body.is_empty() {
+        return error(400, "GET requests must not have a body");
+    }
+    if let Some(expected) = credentials {
+        let given = request.header("Authorization").unwrap_or_default();
+        if !constant_time_eq(given.as_bytes(), expected.as_bytes()) {
+            return error(401, "missing or invalid credentials")
+                .header("WWW-Authenticate", "Basic realm=\"state\"");
+        }
+    }
+
+    let (path, query) = request
+        .target
+        .split_once('?')
+        .unwrap_or((request.target.as_str(), ""));
+    match path {
+        "/state" => store.inspect(|state| redacted_json(state, "")),
+        "/state/config" => store.inspect(|state| redacted_json(&state.config, "/config")),
+        "/state/errors" => store.inspect(|state| json(&state.error_log)),
+        "/state/output" => match OutputQuery::parse(query) {
+            Ok(query) => store.inspect(|state| json(query.select(state))),
+            Err(message) => error(400, message),
+        },
+        _ => error(404, format!("no such endpoint {}", path)),
+    }
+}
+
+/// The parameters of `/state/output`.
+struct OutputQuery {
+    target: OutputTarget,
+    lines: Option<usize>,
+}
+
+impl OutputQuery {
+    fn parse(query: &str) -> Result<Self, String> {
+        let mut parsed = Self {
+            target: OutputTarget::Stdout,
+            lines: None,
+        };
+        for (key, value) in url::form_urlencoded::parse(query.as_bytes()) {
+            match key.as_ref() {
+                "target" => {
+                    parsed.target = match value.as_ref() {
+                        "stdout" => OutputTarget::Stdout,
+                        "stderr" => OutputTarget::Stderr,
+                        other => return Err(format!("unknown output target {:?}", other)),
+                    }
+                }
+                "lines" => match value.parse() {
+                    Ok(lines) => parsed.lines = Some(lines),
+                    Err(_) => return Err(format!("invalid line count {:?}", value)),
+                },
+                _ => {}
+            }
+        }
+        Ok(parsed)
+    }
+
+    fn select<'a>(&self, state: &'a AppState) -> &'a [Output] {
+        let outputs = state.outputs(self.target);
+        let lines = self.lines.unwrap_or(outputs.len()).min(outputs.len());
+        &outputs[outputs.len() - lines..]
+    }
+}
+
+fn json<T: Serialize + ?Sized>(value: &T) -> Response {
+    match serde_json::to_vec(value) {
+        Ok(body) => Response::new(200).body("application/json", body),
+        Err(err) => error(500, format!("failed to encode state: {}", err)),
+    }
+}
+
+/// Like [`json`] for `value` found at the JSON pointer `prefix` of the state, with its
+/// secrets redacted.
+fn redacted_json<T: Serialize>(value: &T, prefix: &str) -> Response {
+    match serde_json::to_value(value) {
+        Ok(mut value) => {
+            redact_secrets(&mut value, prefix);
+            json(&value)
+        }
+        Err(err) => error(500, format!("failed to encode state: {}", err)),
+    }
+}
+
+fn error<S: Into<String>>(status: u16, message: S) -> Response {
+    let body = serde_json::json!({ "error": message.into() }).to_string();
+    Response::new(status).body("application/json", body.into_bytes())
+}
@@ -0,0 +1,184 @@
+//! # Split State
+//!
+//! Stores an [`AppState`] as three files so that frequent small updates don't rewrite the
+//! captured output every time:
+//!
+//! | File                 | Content                                      |
+//! |----------------------|----------------------------------------------|
+//! | `<base>.json`        | every field except `stdout` and `stderr`     |
+//! | `<base>.stdout.json` | [`AppState::stdout`]                         |
+//! | `<base>.stderr.json` | [`AppState::stderr`]                         |
+//!
+//! Each file is replaced atomically through a temporary file and rename. The store
+//! remembers what it last wrote or read for each output file and skips rewriting it while
+//! the output is unchanged. An output skipped by a lazy load is only written again once it
+//! was loaded or marked dirty with [`SplitStateStore::mark_output_dirty`].
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+use serde_json::Value;
+use std::collections::hash_map::DefaultHasher;
+use std::hash::{Hash, Hasher};
+use std::path::PathBuf;
+
+use crate::state_fs::write_atomic_async;
+use crate::state_persistence::{sibling_path, state_from_value, AppState, Output, OutputTarget};
+
+/// What the store knows about one output file.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Sidecar {
+    /// Nothing was written or read yet, the next save writes the file.
+    Unknown,
+    /// A lazy load skipped the file, so the state in memory doesn't hold its lines. Saves
+    /// leave the file alone until it is loaded or marked dirty.
+    Unloaded,
+    /// The file holds the output with this hash.
+    Synced(u64),
+}
+
+/// Saves and loads an [`AppState`] split into a core file and two output files, see the
+/// [module documentation](crate::state_split).
+#[derive(Debug)]
+pub struct SplitStateStore {
+    base: PathBuf,
+    lazy: bool,
+    stdout: Sidecar,
+    stderr: Sidecar,
+}
+
+impl SplitStateStore {
+    /// Creates a store for the files starting with `base`, e.g. `/var/lib/app/api` for
+    /// `/var/lib/app/api.json` and its output files.
+    pub fn new(base: &PathType) -> Self {
+        Self {
+            base: base.to_path_buf(),
+            lazy: false,
+            stdout: Sidecar::Unknown,
+            stderr: Sidecar::Unknown,
+        }
+    }
+
+    /// With `lazy` set, [`SplitStateStore::load`] leaves `stdout` and `stderr` empty until
+    /// they are read with [`SplitStateStore::load_outputs`].
+    pub fn with_lazy(mut self, lazy: bool) -> Self {
+        self.lazy = lazy;
+        self
+    }
+
+    /// Returns the path of the core state file.
+    pub fn core_path(&self) -> PathBuf {
+        sibling_path(&self.base, ".json")
+    }
+
+    /// Returns the path of the file holding the `target` output.
+    pub fn output_path(&self, target: OutputTarget) -> PathBuf {
+        match target {
+            OutputTarget::Stdout => sibling_path(&self.base, ".stdout.json"),
+            OutputTarget::Stderr => sibling_path(&self.base, ".stderr.json"),
+        }
+    }
+
+    /// Saves `state`. The core file is always written; an output file only if its lines
+    /// changed since this store last wrote or read it.
+    ///
+    /// An output that was skipped by a lazy load is left alone on disk, whatever `state`
+    /// holds for it, unless it was marked with [`SplitStateStore::mark_output_dirty`].
+    ///
+    /// # Errors
+    /// Returns an `Err` if serialization or writing any of the files fails.
+    pub async fn save(&mut self, state: &AppState) -> Result<(), Box<dyn std::error::Error>> {
+        let mut core = serde_json::to_value(state)?;
+        if let Some(fields) = core.as_object_mut() {
+            fields.remove("stdout");
+            fields.remove("stderr");
+        }
+        write_atomic_async(&self.core_path(), serde_json::to_vec(&core)?, None, true).await?;
+
+        for target in [OutputTarget::Stdout, OutputTarget::Stderr] {
+            let outputs = state.outputs(target);
+            let hash = output_hash(outputs);
+            let skip = match *self.sidecar(target) {
+                Sidecar::Unknown => false,
+                Sidecar::Unloaded => true,
+                Sidecar::Synced(synced) => synced == hash,
+            };
+            if skip {
+                continue;
+            }
+
+            let data = serde_json::to_vec(outputs)?;
+            write_atomic_async(&self.output_path(target), data, None, true).await?;
+            *self.sidecar_mut(target) = Sidecar::Synced(hash);
+        }
+        Ok(())
+    }
+
+    /// Loads the state, merging the core file with both output files. A missing output
+    /// file counts as no output. In lazy mode the output files aren't read.
+    ///
+    /// # Errors
+    /// Returns an `Err` if a file can't be read or isn't valid JSON for its part.
+    pub async fn load(&mut self) -> Result<AppState, Box<dyn std::error::Error>> {
+        let mut core: Value = serde_json::from_slice(&tokio::fs::read(self.core_path()).await?)?;
+        if let Some(fields) = core.as_object_mut() {
+            fields.insert("stdout".to_string(), Value::Array(Vec::new()));
+            fields.insert("stderr".to_string(), Value::Array(Vec::new()));
+        }
+        let mut state = state_from_value(core)?;
+
+        for target in [OutputTarget::Stdout, OutputTarget::Stderr] {
+            if self.lazy {
+                *self.sidecar_mut(target) = Sidecar::Unloaded;
+            } else {
+                self.load_outputs(&mut state, target).await?;
+            }
+        }
+        Ok(state)
+    }
+
+    /// Reads the `target` output file into `state`, replacing its lines in memory, and
+    /// returns them. This is how a lazily loaded state gets its output.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the file can't be read or isn't a valid list of lines.
+    pub async fn load_outputs<'a>(
+        &mut self,
+        state: &'a mut AppState,
+        target: OutputTarget,
+    ) -> Result<&'a Vec<Output>, Box<dyn std::error::Error>> {
+        let outputs: Vec<Output> = match tokio::fs::read(self.output_path(target)).await {
+            Ok(data) => serde_json::from_slice(&data)?,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => Vec::new(),
+            Err(err) => return Err(err.into()),
+        };
+
+        *self.sidecar_mut(target) = Sidecar::Synced(output_hash(&outputs));
+        *state.outputs_mut(target) = outputs;
+        Ok(state.outputs(target))
+    }
+
+    /// Makes the next save write the `target` output file, e.g. after replacing or
+    /// clearing the lines of an output that a lazy load skipped.
+    pub fn mark_output_dirty(&mut self, target: OutputTarget) {
+        *self.sidecar_mut(target) = Sidecar::Unknown;
+    }
+
+    fn sidecar(&self, target: OutputTarget) -> &Sidecar {
+        match target {
+            OutputTarget::Stdout => &self.stdout,
+            OutputTarget::Stderr => &self.stderr,
+        }
+    }
+
+    fn sidecar_mut(&mut self, target: OutputTarget) -> &mut Sidecar {
+        match target {
+            OutputTarget::Stdout => &mut self.stdout,
+            OutputTarget::Stderr => &mut self.stderr,
+        }
+    }
+}
+
+fn output_hash(outputs: &[Output]) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    outputs.hash(&mut hasher);
+    hasher.finish()
+}
@@ -0,0 +1,552 @@
+//! # State Store
+//!
+//! An in-memory, thread-safe owner of an [`AppState`]. The store can be cloned freely,
+//! every clone refers to the same underlying state.
+//!
+//! Besides plain reads and updates, the store hands out [`OutputWriter`]s that turn
+//! raw bytes written by a child process into timestamped [`AppState::stdout`] /
+//! [`AppState::stderr`] lines.
+//!
+//! Callbacks registered with [`StateStore::on_change`] are told which fields every
+//! [`StateStore::update`] changed, so consumers can react to a status change without
+//! re-rendering on every appended output line.
+//!
+//! A store created with [`StateStore::persistent`] also writes the state to disk after
+//! every update, optionally coalescing rapid updates into one write. [`DebouncedSaver`]
+//! coalesces writes the same way for callers that keep the state themselves.
+
+use dusa_collection_utils::core::logger::LogLevel;
+use dusa_collection_utils::core::types::pathtype::PathType;
+use dusa_collection_utils::log;
+use std::fmt;
+use std::io::{self, Write};
+use std::pin::Pin;
+use std::sync::{Arc, Mutex, MutexGuard, RwLock, RwLockReadGuard, RwLockWriteGuard};
+use std::task::{Context, Poll};
+use std::time::Duration;
+use tokio::io::AsyncWrite;
+
+use crate::diff::{diff_serialized, FieldChange};
+use crate::state_fs::{FileSystem, OsFileSystem};
+use crate::state_persistence::{AppState, OutputTarget, StatePersistence, DEFAULT_OUTPUT_LIMIT};
+
+/// Longest partial line an [`OutputWriter`] buffers; a line growing past it is recorded as
+/// is and the rest of it starts a new line.
+pub const MAX_PARTIAL_LINE: usize = 64 * 1024;
+
+/// A callback registered with [`StateStore::on_change`].
+type ChangeListener = Arc<dyn Fn(&[FieldChange]) + Send + Sync>;
+
+/// Shared handle around an [`AppState`].
+#[derive(Debug, Clone)]
+pub struct StateStore {
+    state: Arc<RwLock<AppState>>,
+    output_limit: usize,
+    listeners: Arc<Listeners>,
+    persistence: Option<Arc<Persistence>>,
+}
+
+#[derive(Default)]
+struct Listeners(Mutex<Vec<ChangeListener>>);
+
+impl Listeners {
+    fn snapshot(&self) -> Vec<ChangeListener> {
+        self.0
+            .lock()
+            .unwrap_or_else(|poisoned| poisoned.into_inner())
+            .clone()
+    }
+}
+
+impl fmt::Debug for Listeners {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{} listeners", self.snapshot().len())
+    }
+}
+
+/// Where a [`Persistence`] takes the state to write from.
+trait Snapshot: Send + Sync + 'static {
+    /// Returns the state to write, `None` if there is nothing to write yet.
+    fn snapshot(&self) -> Option<AppState>;
+}
+
+impl Snapshot for RwLock<AppState> {
+    fn snapshot(&self) -> Option<AppState> {
+        Some(
+            self.read()
+                .unwrap_or_else(|poisoned| poisoned.into_inner())
+                .clone(),
+        )
+    }
+}
+
+impl Snapshot for Mutex<Option<AppState>> {
+    fn snapshot(&self) -> Option<AppState> {
+        lock(self).clone()
+    }
+}
+
+/// Where and how often a persistent store writes its state.
+struct Persistence {
+    fs: Arc<dyn FileSystem>,
+    path: PathType,
+    debounce: Duration,
+    pending: Mutex<Pending>,
+    // Held while writing, so an older snapshot can't overwrite a newer one.
+    writing: Mutex<()>,
+}
+
+#[derive(Default)]
+struct Pending {
+    /// The state changed since it was last written.
+    dirty: bool,
+    /// A debounced write is waiting to run.
+    scheduled: bool,
+}
+
+impl Persistence {
+    fn new(fs: Arc<dyn FileSystem>, path: PathType, debounce: Duration) -> Arc<Self> {
+        Arc::new(Self {
+            fs,
+            path,
+            debounce,
+            pending: Mutex::default(),
+            writing: Mutex::default(),
+        })
+    }
+
+    fn changed<S: Snapshot>(self: &Arc<Self>, state: &Arc<S>) {
+        let schedule = {
+            let mut pending = lock(&self.pending);
+            pending.dirty = true;
+            !self.debounce.is_zero() && !std::mem::replace(&mut pending.scheduled, true)
+        };
+        if self.debounce.is_zero() {
+            self.write_now(state);
+            return;
+        }
+        if !schedule {
+            return;
+        }
+
+        let persistence = Arc::clone(self);
+        let state = Arc::clone(state);
+        match tokio::runtime::Handle::try_current() {
+            Ok(runtime) => {
+                runtime.spawn(async move {
+                    tokio::time::sleep(persistence.debounce).await;
+                    lock(&persistence.pending).scheduled = false;
+                    let _ = tokio::task::spawn_blocking(move || {
+                        persistence.write_logged(state.as_ref())
+                    })
+                    .await;
+                });
+            }
+            // Without a runtime there is nothing to wait on, so write right away.
+            Err(_) => {
+                lock(&persistence.pending).scheduled = false;
+                persistence.write_logged(state.as_ref());
+            }
+        }
+    }
+
+    /// Writes the state without waiting: on the blocking pool inside a tokio runtime, so
+    /// the calling worker isn't stalled by disk I/O, and in place outside one.
+    fn write_now<S: Snapshot>(self: &Arc<Self>, state: &Arc<S>) {
+        match tokio::runtime::Handle::try_current() {
+            Ok(runtime) => {
+                let persistence = Arc::clone(self);
+                let state = Arc::clone(state);
+                runtime.spawn_blocking(move || persistence.write_logged(state.as_ref()));
+            }
+            Err(_) => self.write_logged(state.as_ref()),
+        }
+    }
+
+    /// Writes the state if it changed since the last write. A failed write leaves it
+    /// marked as changed, so the next write tries again.
+    fn write<S: Snapshot>(&self, state: &S) -> Result<(), Box<dyn std::error::Error>> {
+        let _writing = lock(&self.writing);
+        if !std::mem::take(&mut lock(&self.pending).dirty) {
+            return Ok(());
+        }
+        let Some(snapshot) = state.snapshot() else {
+            return Ok(());
+        };
+        StatePersistence::save_state_fs(self.fs.as_ref(), &snapshot, &self.path).map_err(|err| {
+            lock(&self.pending).dirty = true;
+            err
+        })
+    }
+
+    fn write_logged<S: Snapshot>(&self, state: &S) {
+        if let Err(err) = self.write(state) {
+            log!(
+                LogLevel::Error,
+                "Failed to save state to {}: {}",
+                self.path,
+                err
+            );
+        }
+    }
+}
+
+impl fmt::Debug for Persistence {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.debug_struct("Persistence")
+            .field("path", &self.path)
+            .field("debounce", &self.debounce)
+            .finish()
+    }
+}
+
+fn lock<T>(mutex: &Mutex<T>) -> MutexGuard<'_, T> {
+    mutex
+        .lock()
+        .unwrap_or_else(|poisoned| poisoned.into_inner())
+}
+
+impl StateStore {
+    /// Wraps `state` in a new store, keeping at most [`DEFAULT_OUTPUT_LIMIT`] lines per stream.
+    pub fn new(state: AppState) -> Self {
+        Self {
+            state: Arc::new(RwLock::new(state)),
+            output_limit: DEFAULT_OUTPUT_LIMIT,
+            listeners: Arc::default(),
+            persistence: None,
+        }
+    }
+
+    /// Like [`StateStore::new`], but every [`StateStore::update`] also saves the state to
+    /// `path`, in the format of [`StatePersistence::save_state`]. The file is written to
+    /// `<path>.tmp`, synced and renamed into place, so readers never see a half written
+    /// state and a crash leaves either the previous or the new one.
+    ///
+    /// With a zero `debounce` every update starts a write right away; inside a tokio
+    /// runtime it runs on the blocking pool, outside one before `update` returns. Otherwise
+    /// the first update starts a timer and everything changed until it fires is written at
+    /// once, so a burst of output lines costs one write instead of one per line. Debounced
+    /// writes need a tokio runtime; updates made outside one are written right away. Call
+    /// [`StateStore::flush`] to wait for the latest state to be written, e.g. before
+    /// exiting.
+    ///
+    /// `update` can't return write errors, so they are logged and the write is retried on
+    /// the next update or flush.
+    pub fn persistent(state: AppState, path: PathType, debounce: Duration) -> Self {
+        Self::persistent_fs(Arc::new(OsFileSystem), state, path, debounce)
+    }
+
+    /// Like [`StateStore::persistent`], but saves through `fs`.
+    pub fn persistent_fs(
+        fs: Arc<dyn FileSystem>,
+        state: AppState,
+        path: PathType,
+        debounce: Duration,
+    ) -> Self {
+        let mut store = Self::new(state);
+        store.persistence = Some(Persistence::new(fs, path, debounce));
+        store
+    }
+
+    /// Sets how many stdout/stderr lines are retained before the oldest are dropped.
+    pub fn with_output_limit(mut self, limit: usize) -> Self {
+        self.output_limit = limit;
+        self
+    }
+
+    /// Returns a copy of the current state.
+    pub fn snapshot(&self) -> AppState {
+        self.read().clone()
+    }
+
+    /// Runs `f` with shared access to the state and returns its result.
+    /// Cheaper than [`StateStore::snapshot`] when only a few fields are needed.
+    pub fn inspect<F, R>(&self, f: F) -> R
+    where
+        F: FnOnce(&AppState) -> R,
+    {
+        f(&self.read())
+    }
+
+    /// Runs `f` with exclusive access to the state and returns its result.
+    ///
+    /// If callbacks are registered with [`StateStore::on_change`] and `f` changed any
+    /// field, they are called with the changes once the lock is released, so they may use
+    /// the store themselves.
+    pub fn update<F, R>(&self, f: F) -> R
+    where
+        F: FnOnce(&mut AppState) -> R,
+    {
+        let listeners = self.listeners.snapshot();
+        if listeners.is_empty() {
+            let result = f(&mut self.write());
+            self.save_changes();
+            return result;
+        }
+
+        let (result, changes) = {
+            let mut state = self.write();
+            let before = state.clone();
+            let result = f(&mut state);
+            // Serializing an `AppState` can't fail, the fallback only keeps this panic free.
+            (
+                result,
+                diff_serialized(&before, &*state).unwrap_or_default(),
+            )
+        };
+        self.save_changes();
+        if !changes.is_empty() {
+            for listener in listeners {
+                listener(&changes);
+            }
+        }
+        result
+    }
+
+    /// Registers `listener` to be called after every [`StateStore::update`] that changes
+    /// the state, with the changed fields as reported by
+    /// [`diff_serialized`](crate::diff::diff_serialized): top level and nested fields by
+    /// dotted path (`status`, `config.log_level`), lists such as `stdout` as a whole.
+    ///
+    /// Listeners are shared by all clones of the store. While any is registered, every
+    /// update clones and compares the state, so updates get more expensive.
+    ///
+    /// # Example
+    /// ```rust
+    /// # use artisan_middleware::state_store::StateStore;
+    /// # fn watch(store: &StateStore) {
+    /// store.on_change(|changes| {
+    ///     if changes.iter().any(|change| change.path == "status") {
+    ///         println!("status changed");
+    ///     }
+    /// });
+    /// # }
+    /// ```
+    pub fn on_change<F>(&self, listener: F)
+    where
+        F: Fn(&[FieldChange]) + Send + Sync + 'static,
+    {
+        self.listeners
+            .0
+            .lock()
+            .unwrap_or_else(|poisoned| poisoned.into_inner())
+            .push(Arc::new(listener));
+    }
+
+    /// Saves a snapshot of the current state with [`StatePersistence::save_state`].
+    /// The lock is not held while writing.
+    pub async fn persist(&self, path: &PathType) -> Result<(), Box<dyn std::error::Error>> {
+        let snapshot = self.snapshot();
+        StatePersistence::save_state(&snapshot, path).await
+    }
+
+    /// Writes a pending save of a [`StateStore::persistent`] store now, or waits for the
+    /// one already running. Does nothing if there is none or the store isn't persistent.
+    ///
+    /// # Errors
+    /// Returns an `Err` if serialization, encryption, writing or renaming fails. The save
+    /// stays pending then.
+    pub fn flush(&self) -> Result<(), Box<dyn std::error::Error>> {
+        match &self.persistence {
+            Some(persistence) => persistence.write(self.state.as_ref()),
+            None => Ok(()),
+        }
+    }
+
+    /// Returns a writer that appends every complete line it receives to [`AppState::stdout`].
+    pub fn stdout_writer(&self) -> OutputWriter {
+        OutputWriter::new(self.clone(), OutputTarget::Stdout)
+    }
+
+    /// Returns a writer that appends every complete line it receives to [`AppState::stderr`].
+    pub fn stderr_writer(&self) -> OutputWriter {
+        OutputWriter::new(self.clone(), OutputTarget::Stderr)
+    }
+
+    fn append_lines(&self, target: OutputTarget, lines: Vec<String>) {
+        let limit = self.output_limit;
+        self.update(|state| {
+            for line in lines {
+                state.append_output(target, line, limit);
+            }
+        });
+    }
+
+    fn save_changes(&self) {
+        if let Some(persistence) = &self.persistence {
+            persistence.changed(&self.state);
+        }
+    }
+
+    // A panic inside `update` must not take the state down with it, so poisoning is ignored.
+    fn read(&self) -> RwLockReadGuard<'_, AppState> {
+        self.state
+            .read()
+            .unwrap_or_else(|poisoned| poisoned.into_inner())
+    }
+
+    fn write(&self) -> RwLockWriteGuard<'_, AppState> {
+        self.state
+            .write()
+            .unwrap_or_else(|poisoned| poisoned.into_inner())
+    }
+}
+
+/// Writes the latest of the states handed to it to disk, at most once per interval, for
+/// code that changes its state too often to save after every change.
+///
+/// The first [`DebouncedSaver::schedule`] after a write starts a timer; when it fires, the
+/// state scheduled last is written, like [`StatePersistence::save_state_fs`] does. A burst
+/// of schedules therefore costs one write. Timers need a tokio runtime; states scheduled
+/// outside one are written right away.
+///
+/// Write errors are logged and retried with the next write. Call
+/// [`DebouncedSaver::close`] once done to write what is still pending and see its error.
+#[derive(Debug)]
+pub struct DebouncedSaver {
+    persistence: Arc<Persistence>,
+    latest: Arc<Mutex<Option<AppState>>>,
+}
+
+impl DebouncedSaver {
+    /// Saves to `path` at most once per `interval`. A zero `interval` starts writing every
+    /// state right away, like a zero debounce of [`StateStore::persistent`] does.
+    pub fn new(path: PathType, interval: Duration) -> Self {
+        Self::new_fs(Arc::new(OsFileSystem), path, interval)
+    }
+
+    /// Like [`DebouncedSaver::new`], but saves through `fs`.
+    pub fn new_fs(fs: Arc<dyn FileSystem>, path: PathType, interval: Duration) -> Self {
+        Self {
+            persistence: Persistence::new(fs, path, interval),
+            latest: Arc::default(),
+        }
+    }
+
+    /// Queues `state` to be written, replacing any state queued before it.
+    pub fn schedule(&self, state: AppState) {
+        *lock(&self.latest) = Some(state);
+        self.persistence.changed(&self.latest);
+    }
+
+    /// Writes the queued state now. Does nothing if it was written already.
+    ///
+    /// # Errors
+    /// Returns an `Err` if serialization, encryption, writing or renaming fails. The state
+    /// stays queued then.
+    pub fn flush(&self) -> Result<(), Box<dyn std::error::Error>> {
+        self.persistence.write(self.latest.as_ref())
+    }
+
+    /// Writes the queued state and drops the saver. A pending timer finds nothing left to
+    /// write when it fires.
+    ///
+    /// # Errors
+    /// Same as [`DebouncedSaver::flush`].
+    pub fn close(self) -> Result<(), Box<dyn std::error::Error>> {
+        self.flush()
+    }
+}
+
+/// A [`Write`] / [`AsyncWrite`] adapter feeding one output stream of a [`StateStore`].
+///
+/// Incoming bytes are split on `\n`; partial lines are buffered until their newline arrives
+/// and any remainder is recorded when the writer is shut down or dropped. A partial line
+/// is recorded early once it exceeds [`MAX_PARTIAL_LINE`] bytes.
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::state_store::StateStore;
+/// # async fn run(store: StateStore) -> std::io::Result<()> {
+/// let mut child = tokio::process::Command::new("ls")
+///     .stdout(std::process::Stdio::piped())
+///     .spawn()?;
+/// let mut stdout = child.stdout.take().unwrap();
+/// tokio::io::copy(&mut stdout, &mut store.stdout_writer()).await?;
+/// # Ok(())
+/// # }
+/// ```
+#[derive(Debug)]
+pub struct OutputWriter {
+    store: StateStore,
+    target: OutputTarget,
+    partial: Vec<u8>,
+}
+
+impl OutputWriter {
+    fn new(store: StateStore, target: OutputTarget) -> Self {
+        Self {
+            store,
+            target,
+            partial: Vec::new(),
+        }
+    }
+
+    fn take_complete_lines(&mut self) -> Vec<String> {
+        let mut lines = Vec::new();
+        if let Some(end) = self.partial.iter().rposition(|byte| *byte == b'\n') {
+            lines.extend(
+                self.partial[..end]
+                    .split(|byte| *byte == b'\n')
+                    .map(|line| {
+                        let line = line.strip_suffix(b"\r").unwrap_or(line);
+                        String::from_utf8_lossy(line).into_owned()
+                    }),
+            );
+            self.partial.drain(..=end);
+        }
+        if self.partial.len() > MAX_PARTIAL_LINE {
+            lines.push(String::from_utf8_lossy(&self.partial).into_owned());
+            self.partial.clear();
+        }
+        lines
+    }
+
+    fn finish(&mut self) {
+        if !self.partial.is_empty() {
+            let line = String::from_utf8_lossy(&self.partial).into_owned();
+            self.partial.clear();
+            self.store.append_lines(self.target, vec![line]);
+        }
+    }
+}
+
+impl Write for OutputWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.partial.extend_from_slice(buf);
+        let lines = self.take_complete_lines();
+        if !lines.is_empty() {
+            self.store.append_lines(self.target, lines);
+        }
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl AsyncWrite for OutputWriter {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        _cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        Poll::Ready(self.get_mut().write(buf))
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, _cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Poll::Ready(Ok(()))
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, _cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        self.get_mut().finish();
+        Poll::Ready(Ok(()))
+    }
+}
+
+impl Drop for OutputWriter {
+    fn drop(&mut self) {
+        self.finish();
+    }
+}
@@ -0,0 +1,91 @@
+//! # State Transaction
+//!
+//! Groups several edits of an [`AppState`] so that they are either all saved and applied,
+//! or not applied at all.
+//!
+//! [`StateTransaction::begin`] works on a copy of the state. The original is only replaced
+//! once [`StateTransaction::commit`] has saved the copy; a failed commit or a
+//! [`StateTransaction::rollback`] leaves both the original and the file on disk as they
+//! were.
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+
+use crate::state_fs::{write_atomic_async, FileSystem};
+use crate::state_persistence::{encode_state, AppState, StatePersistence};
+
+/// Pending edits to an [`AppState`], see the [module documentation](crate::state_transaction).
+///
+/// # Example
+/// ```rust,no_run
+/// # use artisan_middleware::aggregator::Status;
+/// # use artisan_middleware::state_persistence::AppState;
+/// # use artisan_middleware::state_transaction::StateTransaction;
+/// # use dusa_collection_utils::core::types::pathtype::PathType;
+/// # async fn stop(state: &mut AppState, path: &PathType) -> Result<(), Box<dyn std::error::Error>> {
+/// let mut tx = StateTransaction::begin(state);
+/// tx.state_mut().status = Status::Stopped;
+/// tx.state_mut().pid = 0;
+/// tx.commit(path).await?;
+/// # Ok(())
+/// # }
+/// ```
+#[derive(Debug)]
+#[must_use = "edits are discarded unless the transaction is committed"]
+pub struct StateTransaction<'a> {
+    target: &'a mut AppState,
+    working: AppState,
+}
+
+impl<'a> StateTransaction<'a> {
+    /// Starts a transaction on a copy of `state`.
+    pub fn begin(state: &'a mut AppState) -> Self {
+        let working = state.clone();
+        Self {
+            target: state,
+            working,
+        }
+    }
+
+    /// Returns the state with the edits made so far.
+    pub fn state(&self) -> &AppState {
+        &self.working
+    }
+
+    /// Returns the copy to edit.
+    pub fn state_mut(&mut self) -> &mut AppState {
+        &mut self.working
+    }
+
+    /// Saves the edited state to `path` in the format of [`StatePersistence::save_state`] and,
+    /// once that succeeded, applies it to the original. The file is written to `<path>.tmp`,
+    /// synced and renamed into place, so a failed commit leaves the previous file intact.
+    ///
+    /// # Errors
+    /// Returns an `Err` if serialization, encryption, writing or renaming fails; the
+    /// original state is unchanged then.
+    pub async fn commit(self, path: &PathType) -> Result<(), Box<dyn std::error::Error>> {
+        let data = encode_state(&self.working)?;
+        write_atomic_async(path.as_ref(), data.into_bytes(), None, true).await?;
+
+        *self.target = self.working;
+        Ok(())
+    }
+
+    /// Like [`StateTransaction::commit`], but saves through `fs` with
+    /// [`StatePersistence::save_state_fs`].
+    ///
+    /// # Errors
+    /// Same as [`StateTransaction::commit`].
+    pub fn commit_fs(
+        self,
+        fs: &dyn FileSystem,
+        path: &PathType,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        StatePersistence::save_state_fs(fs, &self.working, path)?;
+        *self.target = self.working;
+        Ok(())
+    }
+
+    /// Discards the edits. Dropping the transaction does the same.
+    pub fn rollback(self) {}
+}
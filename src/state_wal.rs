@@ -0,0 +1,136 @@
+//! # State WAL
+//!
+//! Crash safe state saving through a write-ahead log.
+//!
+//! [`WalStore::save`] first appends the encoded state to `<path>.wal` and syncs it, then
+//! writes the state file through a temporary file and rename, and finally truncates the
+//! log. If the process dies part way, the next [`WalStore::recover`] finds the logged state
+//! and finishes the write.
+//!
+//! Each log record is one line of JSON, `{"sequence":1,"state":"..."}`, where `state` is the
+//! same encrypted encoding [`StatePersistence::save_state`] writes, so the log is no easier
+//! to read than the state file itself.
+//!
+//! [`StatePersistence::save_state`]: crate::state_persistence::StatePersistence::save_state
+
+use dusa_collection_utils::core::types::pathtype::PathType;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tokio::fs::{self, OpenOptions};
+use tokio::io::AsyncWriteExt;
+
+use crate::state_fs::write_atomic_async;
+use crate::state_persistence::{encode_state, sibling_path, AppState, StateFormat};
+
+#[derive(Serialize, Deserialize)]
+struct WalRecord {
+    sequence: u64,
+    state: String,
+}
+
+/// Saves an [`AppState`] to one path, guarded by a write-ahead log next to it.
+#[derive(Debug)]
+pub struct WalStore {
+    path: PathBuf,
+    wal_path: PathBuf,
+    sequence: u64,
+}
+
+impl WalStore {
+    /// Creates a store for the state file at `path`, logging to `<path>.wal`. Call
+    /// [`WalStore::recover`] before the first save to finish any write interrupted by a
+    /// crash.
+    pub fn new(path: &PathType) -> Self {
+        let path = path.to_path_buf();
+        Self {
+            wal_path: sibling_path(&path, ".wal"),
+            path,
+            sequence: 0,
+        }
+    }
+
+    /// Returns the path of the state file.
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Returns the path of the write-ahead log.
+    pub fn wal_path(&self) -> &Path {
+        &self.wal_path
+    }
+
+    /// Durably saves `state`: logs it, replaces the state file, syncs its directory and only
+    /// then clears the log again, so the log is never emptied before the rename is on disk.
+    ///
+    /// # Errors
+    /// Returns an `Err` if encoding or any of the writes fail. If the log was written but
+    /// the state file wasn't, [`WalStore::recover`] still restores `state`.
+    pub async fn save(&mut self, state: &AppState) -> Result<(), Box<dyn std::error::Error>> {
+        let encoded = encode_state(state)?;
+        self.append(&encoded).await?;
+        write_atomic_async(&self.path, encoded.into_bytes(), None, true).await?;
+        OpenOptions::new()
+            .write(true)
+            .open(&self.wal_path)
+            .await?
+            .set_len(0)
+            .await?;
+        Ok(())
+    }
+
+    /// Replays an interrupted save. If `<path>.wal` holds a complete record, the newest one
+    /// is written to the state file, the log is deleted and the recovered state returned.
+    /// Returns `None` if there is nothing to recover; a log without a complete record (the
+    /// crash hit while logging) is deleted, leaving the previous state file in place.
+    ///
+    /// # Errors
+    /// Returns an `Err` if the log can't be read, the record can't be decoded or the state
+    /// file can't be written.
+    pub async fn recover(&mut self) -> Result<Option<AppState>, Box<dyn std::error::Error>> {
+        let log = match fs::read_to_string(&self.wal_path).await {
+            Ok(log) => log,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+            Err(err) => return Err(err.into()),
+        };
+
+        // Only newline terminated records were fully written; a torn tail is ignored.
+        let complete = match log.rfind('\n') {
+            Some(end) => &log[..end],
+            None => "",
+        };
+        let record = complete
+            .lines()
+            .rev()
+            .find_map(|line| serde_json::from_str::<WalRecord>(line).ok());
+
+        let state = match record {
+            Some(record) => {
+                let state = StateFormat::Encrypted.decode(&record.state)?;
+                write_atomic_async(&self.path, record.state.into_bytes(), None, true).await?;
+                self.sequence = self.sequence.max(record.sequence);
+                Some(state)
+            }
+            None => None,
+        };
+        fs::remove_file(&self.wal_path).await?;
+        Ok(state)
+    }
+
+    async fn append(&mut self, encoded: &str) -> Result<(), Box<dyn std::error::Error>> {
+        self.sequence += 1;
+        let mut line = serde_json::to_string(&WalRecord {
+            sequence: self.sequence,
+            state: encoded.to_string(),
+        })?;
+        line.push('\n');
+
+        let mut wal = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&self.wal_path)
+            .await?;
+        wal.write_all(line.as_bytes()).await?;
+        wal.sync_data().await?;
+        Ok(())
+    }
+}
@@ -0,0 +1,87 @@
+//! # Support Bundle
+//!
+//! Packs everything support needs to look at a misbehaving application into one zip
+//! archive, with secrets already scrubbed.
+//!
+//! The archive written by [`export_support_bundle`] contains:
+//!
+//! | Entry          | Content                                                          |
+//! |----------------|------------------------------------------------------------------|
+//! | `state.json`   | the [`AppState`] as pretty JSON, secrets redacted, output omitted |
+//! | `stdout.log`   | the captured stdout, one `<RFC 3339 time> <line>` per line        |
+//! | `stderr.log`   | the captured stderr, same layout                                 |
+//! | `errors.log`   | the error log, one `[severity] type: message` per line           |
+
+use chrono::SecondsFormat;
+use serde_json::Value;
+use std::io::{self, Write};
+
+use crate::config::SecretString;
+use crate::state_persistence::{output_time, AppState, Output};
+use crate::zip::ZipWriter;
+
+/// Writes a support bundle for `state` to `w` as a zip archive, see the
+/// [module documentation](crate::support_bundle) for its layout.
+///
+/// The archive is produced front to back, so `w` doesn't need to be seekable; a socket or
+/// an HTTP response body works as well as a file.
+///
+/// # Errors
+/// Returns an `Err` if the state can't be serialized or writing to `w` fails.
+pub fn export_support_bundle<W: Write>(w: W, state: &AppState) -> io::Result<()> {
+    let mut zip = ZipWriter::new(w, state.last_updated);
+    zip.add("state.json", redacted_state_json(state)?.as_bytes())?;
+    zip.add("stdout.log", output_log(&state.stdout).as_bytes())?;
+    zip.add("stderr.log", output_log(&state.stderr).as_bytes())?;
+
+    let mut errors = String::new();
+    for error in &state.error_log {
+        errors.push_str(&format!(
+            "[{}] {:?}: {}\n",
+            error.severity, error.err_type, error.err_mesg
+        ));
+    }
+    zip.add("errors.log", errors.as_bytes())?;
+
+    zip.finish()
+}
+
+/// JSON pointers of the secrets inside a serialized [`AppState`].
+pub(crate) const SECRET_POINTERS: &[&str] = &["/config/database/url"];
+
+/// Serializes `state` without its captured output and with every secret replaced.
+fn redacted_state_json(state: &AppState) -> io::Result<String> {
+    let mut value = serde_json::to_value(state)?;
+    if let Some(state) = value.as_object_mut() {
+        state.remove("stdout");
+        state.remove("stderr");
+    }
+    redact_secrets(&mut value, "");
+    Ok(serde_json::to_string_pretty(&value)?)
+}
+
+/// Replaces the [`SECRET_POINTERS`] in `value`, a serialized [`AppState`] or the part of
+/// it found at the JSON pointer `prefix`, with `[redacted]`.
+pub(crate) fn redact_secrets(value: &mut Value, prefix: &str) {
+    for pointer in SECRET_POINTERS {
+        let Some(relative) = pointer.strip_prefix(prefix) else {
+            continue;
+        };
+        if let Some(secret) = value.pointer_mut(relative) {
+            if !secret.is_null() {
+                *secret = Value::String(SecretString::default().to_string());
+            }
+        }
+    }
+}
+
+fn output_log(outputs: &[Output]) -> String {
+    let mut log = String::new();
+    for output in outputs {
+        log.push_str(&output_time(output).to_rfc3339_opts(SecondsFormat::Secs, true));
+        log.push(' ');
+        log.push_str(&output.1);
+        log.push('\n');
+    }
+    log
+}
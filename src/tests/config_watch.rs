@@ -0,0 +1,82 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::AppConfig;
+    use crate::config_watch::watch_config_file;
+    use config::ConfigError;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::fs;
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    type Reloads = Arc<Mutex<Vec<Option<usize>>>>;
+
+    fn recorder() -> (Reloads, impl FnMut(Result<AppConfig, ConfigError>)) {
+        let reloads: Reloads = Arc::default();
+        let sink = Arc::clone(&reloads);
+        let on_change = move |result: Result<AppConfig, ConfigError>| {
+            sink.lock()
+                .unwrap()
+                .push(result.ok().map(|config| config.max_ram_usage))
+        };
+        (reloads, on_change)
+    }
+
+    #[tokio::test]
+    async fn test_watch_config_file_debounces_writes() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("Settings.toml");
+        fs::write(&path, "max_ram_usage = 100\n").unwrap();
+
+        let (reloads, on_change) = recorder();
+        let _watcher = watch_config_file(
+            PathType::PathBuf(path.clone()),
+            Duration::from_millis(100),
+            on_change,
+        )
+        .unwrap();
+
+        for i in 1..=10 {
+            fs::write(&path, format!("max_ram_usage = {}\n", 100 + i)).unwrap();
+            tokio::time::sleep(Duration::from_millis(1)).await;
+        }
+        tokio::time::sleep(Duration::from_millis(400)).await;
+
+        let reloads = reloads.lock().unwrap();
+        assert!(
+            (1..=3).contains(&reloads.len()),
+            "reloaded {} times",
+            reloads.len()
+        );
+        assert_eq!(reloads.last(), Some(&Some(110)));
+    }
+
+    #[tokio::test]
+    async fn test_watch_config_file_follows_replaced_file() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("Settings.toml");
+        fs::write(&path, "max_ram_usage = 100\n").unwrap();
+
+        let (reloads, on_change) = recorder();
+        let _watcher = watch_config_file(
+            PathType::PathBuf(path.clone()),
+            Duration::from_millis(20),
+            on_change,
+        )
+        .unwrap();
+
+        for (round, size) in [200, 300].into_iter().enumerate() {
+            let tmp = dir.path().join("Settings.toml.tmp");
+            fs::write(&tmp, format!("max_ram_usage = {}\n", size)).unwrap();
+            fs::rename(&tmp, &path).unwrap();
+            tokio::time::sleep(Duration::from_millis(200)).await;
+            assert_eq!(reloads.lock().unwrap().len(), round + 1);
+            assert_eq!(reloads.lock().unwrap().last(), Some(&Some(size)));
+        }
+
+        // Other files in the directory are ignored.
+        fs::write(dir.path().join("other.toml"), "max_ram_usage = 1\n").unwrap();
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert_eq!(reloads.lock().unwrap().len(), 2);
+    }
+}
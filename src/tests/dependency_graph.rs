@@ -0,0 +1,63 @@
+#[cfg(test)]
+mod tests {
+    use crate::dependency_graph::{DependencyError, DependencyGraph};
+    use crate::state_persistence::AppState;
+    use crate::state_persistence_test::tests::sample_state;
+
+    fn app(name: &str, dependencies: &[&str]) -> AppState {
+        let mut state = sample_state();
+        state.name = name.to_string();
+        state.dependencies = dependencies.iter().map(|dep| dep.to_string()).collect();
+        state
+    }
+
+    fn services() -> Vec<AppState> {
+        vec![
+            app("web", &["api", "cache"]),
+            app("api", &["db", "queue"]),
+            app("worker", &["queue", "db"]),
+            app("db", &[]),
+            app("queue", &["db"]),
+            app("cache", &[]),
+        ]
+    }
+
+    #[test]
+    fn test_topological_order_and_dependents() {
+        let graph = DependencyGraph::build(&services()).unwrap();
+
+        assert_eq!(
+            graph.topological_order().unwrap(),
+            vec!["cache", "db", "queue", "api", "web", "worker"]
+        );
+        assert_eq!(graph.dependents_of("db"), vec!["api", "queue", "worker"]);
+        assert_eq!(graph.dependents_of("web"), Vec::<String>::new());
+        assert_eq!(graph.dependencies_of("web"), vec!["api", "cache"]);
+    }
+
+    #[test]
+    fn test_cycles_and_unknown_dependencies_are_errors() {
+        let mut states = services();
+        states[3].dependencies.push("worker".to_string());
+        let graph = DependencyGraph::build(&states).unwrap();
+        assert_eq!(
+            graph.topological_order().unwrap_err(),
+            DependencyError::Cyclic {
+                apps: vec![
+                    "api".to_string(),
+                    "db".to_string(),
+                    "queue".to_string(),
+                    "web".to_string(),
+                    "worker".to_string()
+                ]
+            }
+        );
+
+        let err = DependencyGraph::build(&[app("web", &["api"])]).unwrap_err();
+        assert_eq!(err.to_string(), "web depends on unknown application api");
+        assert_eq!(
+            DependencyGraph::build(&[app("db", &[]), app("db", &[])]).unwrap_err(),
+            DependencyError::DuplicateApp("db".to_string())
+        );
+    }
+}
@@ -1,6 +1,6 @@
 #[cfg(test)]
 mod tests {
-    use crate::encryption::{simple_decrypt, simple_encrypt};
+    use crate::encryption::{decrypt_with_key, encrypt_with_key, simple_decrypt, simple_encrypt};
 
     #[test]
     fn test_encrypt_decrypt_cycle() {
@@ -16,4 +16,16 @@ mod tests {
         let b = simple_encrypt(b"data").expect("encrypt");
         assert_ne!(a, b, "encryption should be nondeterministic");
     }
+
+    #[test]
+    fn test_keyed_encrypt_decrypt_cycle() {
+        let key = [1u8; 32];
+        let cipher = encrypt_with_key(b"hello world", &key).expect("encrypt");
+        assert_eq!(
+            decrypt_with_key(cipher.as_bytes(), &key).expect("decrypt"),
+            b"hello world"
+        );
+        assert!(decrypt_with_key(cipher.as_bytes(), &[2u8; 32]).is_err());
+        assert!(encrypt_with_key(b"data", &key[..16]).is_err());
+    }
 }
@@ -0,0 +1,70 @@
+#[cfg(test)]
+mod tests {
+    use crate::health::{check_health, HealthIssue};
+    use crate::state_persistence::Severity;
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+
+    #[test]
+    fn test_running_process_within_limits_is_healthy() {
+        let mut state = sample_state();
+        state.pid = std::process::id();
+        state.config.max_ram_usage = 0;
+        state.config.max_cpu_usage = 0;
+        assert_eq!(check_health(&state), Ok(()));
+    }
+
+    #[test]
+    fn test_checks_report_first_failure() {
+        let mut state = sample_state();
+        state.pid = 999_999_999;
+        assert_eq!(
+            check_health(&state),
+            Err(HealthIssue::NotRunning { pid: 999_999_999 })
+        );
+
+        state.append_error(
+            Severity::Fatal,
+            ErrorArrayItem::new(Errors::GeneralError, "disk full"),
+        );
+        let issue = check_health(&state).unwrap_err();
+        assert_eq!(
+            issue,
+            HealthIssue::FatalErrors {
+                count: 1,
+                latest: "disk full".into()
+            }
+        );
+        assert_eq!(issue.to_string(), "1 fatal error(s), latest: disk full");
+
+        state.record_event("crashed", "signal 11");
+        let issue = check_health(&state).unwrap_err();
+        assert!(matches!(issue, HealthIssue::Crashed { .. }));
+        assert!(issue.to_string().ends_with("signal 11"));
+
+        // Only the latest event counts, a restart clears the crash.
+        state.record_event("restarted", "");
+        assert!(matches!(
+            check_health(&state),
+            Err(HealthIssue::FatalErrors { .. })
+        ));
+    }
+
+    #[test]
+    fn test_resource_limits_are_checked_last() {
+        let mut state = sample_state();
+        assert_eq!(
+            check_health(&state),
+            Err(HealthIssue::NotRunning { pid: 0 })
+        );
+
+        // The test binary is always larger than a single megabyte.
+        state.pid = std::process::id();
+        state.config.max_ram_usage = 1;
+        let issue = check_health(&state).unwrap_err();
+        assert!(matches!(issue, HealthIssue::ResourcesExceeded(report) if report.ram_exceeded));
+        assert!(issue
+            .to_string()
+            .starts_with("over resource limits: RAM at"));
+    }
+}
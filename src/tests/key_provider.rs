@@ -0,0 +1,44 @@
+#[cfg(test)]
+mod tests {
+    use crate::key_provider::{EnvKeyProvider, FileKeyProvider, KeyProvider, StaticKeyProvider};
+    use tempfile::tempdir;
+
+    const KEY: [u8; 32] = [7; 32];
+
+    #[tokio::test]
+    async fn test_static_key_provider() {
+        let provider = StaticKeyProvider::new(KEY);
+        assert_eq!(provider.key().await.unwrap(), KEY);
+        assert!(!format!("{:?}", provider).contains('7'));
+    }
+
+    #[tokio::test]
+    async fn test_env_key_provider() {
+        let provider = EnvKeyProvider::new("ARTISAN_TEST_STATE_KEY");
+        assert!(provider.key().await.is_err());
+
+        std::env::set_var("ARTISAN_TEST_STATE_KEY", format!("{}\n", hex::encode(KEY)));
+        assert_eq!(provider.key().await.unwrap(), KEY);
+
+        std::env::set_var("ARTISAN_TEST_STATE_KEY", "not hex");
+        let err = provider.key().await.unwrap_err();
+        assert!(err.err_mesg.contains("ARTISAN_TEST_STATE_KEY"));
+        std::env::remove_var("ARTISAN_TEST_STATE_KEY");
+    }
+
+    #[tokio::test]
+    async fn test_file_key_provider() {
+        let dir = tempdir().unwrap();
+        let raw = dir.path().join("raw.key");
+        let hex_file = dir.path().join("hex.key");
+        std::fs::write(&raw, KEY).unwrap();
+        std::fs::write(&hex_file, format!("{}\n", hex::encode(KEY))).unwrap();
+
+        assert_eq!(FileKeyProvider::new(&raw).key().await.unwrap(), KEY);
+        assert_eq!(FileKeyProvider::new(&hex_file).key().await.unwrap(), KEY);
+        assert!(FileKeyProvider::new(dir.path().join("missing.key"))
+            .key()
+            .await
+            .is_err());
+    }
+}
@@ -0,0 +1,209 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::lifecycle::{
+        replay_events, Hook, Hooks, LifecycleAction, LifecycleError, LifecycleManager, ReplayError,
+    };
+    use crate::state_persistence::Event;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::timestamp::set_clock;
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    use std::cell::Cell;
+    use std::rc::Rc;
+    use std::sync::{Arc, Mutex};
+    use std::time::{Duration, UNIX_EPOCH};
+
+    fn recording(calls: &Arc<Mutex<Vec<&'static str>>>, name: &'static str) -> Option<Hook> {
+        let calls = Arc::clone(calls);
+        Some(Box::new(move |_| {
+            calls.lock().unwrap().push(name);
+            Ok(())
+        }))
+    }
+
+    #[test]
+    fn test_lifecycle_walks_init_start_stop_restart() {
+        let clock = Rc::new(Cell::new(1_000));
+        let source = Rc::clone(&clock);
+        let _clock = set_clock(move || UNIX_EPOCH + Duration::from_secs(source.get()));
+
+        let calls = Arc::new(Mutex::new(Vec::new()));
+        let hooks = Hooks {
+            on_init: recording(&calls, "init"),
+            on_start: recording(&calls, "start"),
+            on_stop: recording(&calls, "stop"),
+            on_restart: None,
+        };
+        let mut state = sample_state();
+        state.status = Status::Unknown;
+        let mut manager = LifecycleManager::new(state, hooks);
+
+        manager.init().unwrap();
+        assert_eq!(manager.state().status, Status::Stopped);
+        assert_eq!(manager.state().started_at, 0);
+        assert_eq!(manager.state().event_counter, 1);
+
+        clock.set(1_010);
+        manager.start().unwrap();
+        assert_eq!(manager.state().status, Status::Running);
+        assert_eq!(manager.state().started_at, 1_010);
+        assert_eq!(manager.state().event_counter, 2);
+
+        clock.set(1_020);
+        manager.stop().unwrap();
+        assert_eq!(manager.state().status, Status::Stopped);
+        assert_eq!(manager.state().started_at, 1_010);
+        assert_eq!(manager.state().last_updated, 1_020);
+        assert_eq!(manager.state().event_counter, 3);
+
+        // Restarting a stopped application only starts it.
+        clock.set(1_030);
+        manager.restart().unwrap();
+        assert_eq!(manager.state().status, Status::Running);
+        assert_eq!(manager.state().started_at, 1_030);
+        assert_eq!(manager.state().event_counter, 4);
+
+        clock.set(1_040);
+        match manager.start().unwrap_err() {
+            LifecycleError::InvalidTransition { action, from } => {
+                assert_eq!(action, LifecycleAction::Start);
+                assert_eq!(from, Status::Running);
+            }
+            err => panic!("unexpected error: {}", err),
+        }
+        assert_eq!(manager.state().started_at, 1_030);
+        assert_eq!(manager.state().event_counter, 4);
+
+        // A running application is stopped before it is started again.
+        manager.restart().unwrap();
+        assert_eq!(manager.state().started_at, 1_040);
+        assert_eq!(manager.state().event_counter, 5);
+
+        assert_eq!(
+            *calls.lock().unwrap(),
+            vec!["init", "start", "stop", "start", "stop", "start"]
+        );
+        let kinds: Vec<_> = manager
+            .into_state()
+            .events
+            .into_iter()
+            .map(|event| event.kind)
+            .collect();
+        assert_eq!(
+            kinds,
+            [
+                "initialized",
+                "started",
+                "stopped",
+                "restarted",
+                "restarted"
+            ]
+        );
+    }
+
+    #[test]
+    fn test_failing_hook_leaves_state_unchanged() {
+        let hooks = Hooks {
+            on_start: Some(Box::new(|state| {
+                state.pid = 42;
+                Err(ErrorArrayItem::new(
+                    Errors::SupervisedChild,
+                    "spawn failed".to_string(),
+                ))
+            })),
+            ..Hooks::default()
+        };
+        let mut state = sample_state();
+        state.status = Status::Stopped;
+        let mut manager = LifecycleManager::new(state.clone(), hooks);
+
+        let err = manager.start().unwrap_err();
+        assert!(matches!(
+            err,
+            LifecycleError::Hook {
+                action: LifecycleAction::Start,
+                ..
+            }
+        ));
+        assert!(err.to_string().contains("spawn failed"));
+        assert_eq!(manager.state(), &state);
+    }
+
+    fn event(timestamp: u64, kind: &str) -> Event {
+        Event {
+            timestamp,
+            kind: kind.to_string(),
+            detail: String::new(),
+        }
+    }
+
+    #[test]
+    fn test_replay_events_rebuilds_managed_state() {
+        let clock = Rc::new(Cell::new(1_000));
+        let source = Rc::clone(&clock);
+        let _clock = set_clock(move || UNIX_EPOCH + Duration::from_secs(source.get()));
+
+        let mut initial = sample_state();
+        initial.status = Status::Unknown;
+        let mut manager = LifecycleManager::new(initial.clone(), Hooks::default());
+        manager.init().unwrap();
+        clock.set(1_010);
+        manager.start().unwrap();
+        clock.set(1_020);
+        manager.restart().unwrap();
+        clock.set(1_030);
+        manager.stop().unwrap();
+
+        let mut events = manager.state().events.clone();
+        events.reverse();
+        let replayed = replay_events(&initial, &events).unwrap();
+        assert_eq!(&replayed, manager.state());
+        assert_eq!(replayed.started_at, 1_020);
+        assert_eq!(replayed.event_counter, 4);
+    }
+
+    #[test]
+    fn test_replay_events_keeps_status_for_other_events() {
+        let mut initial = sample_state();
+        initial.status = Status::Stopped;
+        let events = [
+            event(5, "started"),
+            event(6, "config-reloaded"),
+            event(6, "crashed"),
+        ];
+
+        let replayed = replay_events(&initial, &events).unwrap();
+        assert_eq!(replayed.status, Status::Running);
+        assert_eq!(replayed.last_updated, 6);
+        assert_eq!(replayed.events, events);
+        assert_eq!(replayed.event_counter, 3);
+    }
+
+    #[test]
+    fn test_replay_events_rejects_invalid_events() {
+        let mut initial = sample_state();
+        initial.status = Status::Stopped;
+        initial.last_updated = 100;
+
+        let err =
+            replay_events(&initial, &[event(101, "started"), event(102, "started")]).unwrap_err();
+        assert_eq!(
+            err,
+            ReplayError::InvalidTransition {
+                index: 1,
+                action: LifecycleAction::Start,
+                from: Status::Running,
+            }
+        );
+        assert!(err.to_string().contains("event 1"));
+
+        assert_eq!(
+            replay_events(&initial, &[event(99, "started")]).unwrap_err(),
+            ReplayError::BeforeInitial {
+                index: 0,
+                timestamp: 99,
+                last_updated: 100,
+            }
+        );
+    }
+}
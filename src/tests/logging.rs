@@ -0,0 +1,81 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::{AppConfig, LogConfig, LogFormat};
+    use crate::logging::Logger;
+    use dusa_collection_utils::core::logger::LogLevel;
+    use tempfile::tempdir;
+
+    fn config(log: LogConfig) -> AppConfig {
+        let mut cfg = AppConfig::dummy();
+        cfg.log_level = LogLevel::Info;
+        cfg.log = Some(log);
+        cfg
+    }
+
+    #[test]
+    fn test_json_records_respect_level() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("app.log");
+        let logger = Logger::from_config(&config(LogConfig {
+            format: LogFormat::Json,
+            output_path: Some(path.to_string_lossy().into_owned()),
+            ..LogConfig::default()
+        }))
+        .unwrap();
+
+        logger.log(LogLevel::Debug, "hidden").unwrap();
+        logger.log(LogLevel::Warn, "disk \"almost\" full").unwrap();
+        assert!(!logger.enabled(&LogLevel::Trace));
+
+        let content = std::fs::read_to_string(&path).unwrap();
+        let lines: Vec<&str> = content.lines().collect();
+        assert_eq!(lines.len(), 1);
+        let record: serde_json::Value = serde_json::from_str(lines[0]).unwrap();
+        assert_eq!(record["level"], "Warn");
+        assert_eq!(record["app"], "MyDummyApp");
+        assert_eq!(record["message"], "disk \"almost\" full");
+    }
+
+    #[test]
+    fn test_text_records_append_to_existing_file() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("app.log");
+        std::fs::write(&path, "earlier\n").unwrap();
+        let logger = Logger::from_config(&config(LogConfig {
+            output_path: Some(path.to_string_lossy().into_owned()),
+            ..LogConfig::default()
+        }))
+        .unwrap();
+        logger.log(LogLevel::Info, "started").unwrap();
+
+        let content = std::fs::read_to_string(&path).unwrap();
+        assert!(content.starts_with("earlier\n"));
+        assert!(content.ends_with(" Info  MyDummyApp: started\n"));
+    }
+
+    #[test]
+    fn test_rotation_keeps_max_backups() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("app.log");
+        let logger = Logger::from_config(&config(LogConfig {
+            output_path: Some(path.to_string_lossy().into_owned()),
+            max_size_mb: 1,
+            max_backups: 2,
+            ..LogConfig::default()
+        }))
+        .unwrap();
+
+        // Roughly 3.5 MiB in 4 KiB records, enough for three rotations.
+        let message = "x".repeat(4096);
+        for _ in 0..900 {
+            logger.log(LogLevel::Error, &message).unwrap();
+        }
+
+        let limit = 1024 * 1024;
+        for name in ["app.log", "app.log.1", "app.log.2"] {
+            let size = std::fs::metadata(dir.path().join(name)).unwrap().len();
+            assert!(size > 0 && size <= limit, "{} has {} bytes", name, size);
+        }
+        assert!(!dir.path().join("app.log.3").exists());
+    }
+}
@@ -0,0 +1,70 @@
+#[cfg(test)]
+mod tests {
+    use crate::name_claim::{claim_app_name, ClaimError};
+    use tempfile::tempdir;
+
+    /// The PID of a process that has exited and been reaped.
+    fn dead_pid() -> u32 {
+        let mut child = std::process::Command::new("true").spawn().unwrap();
+        let pid = child.id();
+        child.wait().unwrap();
+        pid
+    }
+
+    #[test]
+    fn test_claim_and_release() {
+        let dir = tempdir().unwrap();
+        let claim = claim_app_name(dir.path(), "api", std::process::id()).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(claim.path()).unwrap().trim(),
+            std::process::id().to_string()
+        );
+
+        let path = claim.path().to_path_buf();
+        claim.release().unwrap();
+        assert!(!path.exists());
+
+        let claim = claim_app_name(dir.path(), "api", std::process::id()).unwrap();
+        drop(claim);
+        assert!(!path.exists());
+    }
+
+    #[test]
+    fn test_live_claim_is_taken() {
+        let dir = tempdir().unwrap();
+        // PID 1 is always running.
+        let held = claim_app_name(dir.path(), "api", 1).unwrap();
+
+        match claim_app_name(dir.path(), "api", std::process::id()) {
+            Err(ClaimError::NameTaken { name, pid }) => {
+                assert_eq!((name.as_str(), pid), ("api", 1))
+            }
+            other => panic!("expected NameTaken, got {:?}", other),
+        }
+        assert!(claim_app_name(dir.path(), "web", std::process::id()).is_ok());
+        assert!(held.path().exists());
+    }
+
+    #[test]
+    fn test_stale_claim_is_reclaimed() {
+        let dir = tempdir().unwrap();
+        let stale = claim_app_name(dir.path(), "api", dead_pid()).unwrap();
+
+        let claim = claim_app_name(dir.path(), "api", std::process::id()).unwrap();
+        // Releasing the stale claim must not delete the one that replaced it.
+        drop(stale);
+        assert!(claim.path().exists());
+    }
+
+    #[test]
+    fn test_invalid_arguments() {
+        let dir = tempdir().unwrap();
+        for name in ["", "..", "a/b"] {
+            assert!(matches!(
+                claim_app_name(dir.path(), name, 1),
+                Err(ClaimError::Io(_))
+            ));
+        }
+        assert!(claim_app_name(dir.path(), "api", 0).is_err());
+    }
+}
@@ -3,9 +3,11 @@ mod tests {
     use crate::aggregator::Status;
     use crate::config::AppConfig;
     use crate::process_manager::{
-        spawn_complex_process, spawn_simple_process, ChildLock, SupervisedChild, SupervisedProcess,
+        is_process_alive, spawn_complex_process, spawn_simple_process, wait_for_process, ChildLock,
+        SupervisedChild, SupervisedProcess,
     };
     use crate::state_persistence::AppState;
+    use crate::state_persistence_test::tests::sample_state;
     use crate::timestamp::current_timestamp;
 
     use dusa_collection_utils::core::errors::Errors;
@@ -181,7 +183,7 @@ mod tests {
         let mut state = AppState {
             data: String::new(),
             event_counter: 0,
-            stared_at: current_timestamp(),
+            started_at: current_timestamp(),
             name: String::new(),
             version: SoftwareVersion::dummy(),
             status: Status::Building,
@@ -191,7 +193,15 @@ mod tests {
             config: AppConfig::dummy(),
             system_application: false,
             stderr: Vec::new(),
+            stdout_meta: Default::default(),
+            stderr_meta: Default::default(),
             stdout: Vec::new(),
+            events: Vec::new(),
+            generation: 0,
+            labels: Default::default(),
+            tags: Vec::new(),
+            dependencies: Vec::new(),
+            extra: Default::default(),
         };
         let state_path = PathType::PathBuf(PathBuf::from("/tmp/test_state.json"));
 
@@ -222,7 +232,7 @@ mod tests {
             data: String::new(),
             event_counter: 0,
             name: String::new(),
-            stared_at: current_timestamp(),
+            started_at: current_timestamp(),
             version: SoftwareVersion::dummy(),
             status: Status::Building,
             pid: 0,
@@ -231,7 +241,15 @@ mod tests {
             config: AppConfig::dummy(),
             system_application: false,
             stderr: Vec::new(),
+            stdout_meta: Default::default(),
+            stderr_meta: Default::default(),
             stdout: Vec::new(),
+            events: Vec::new(),
+            generation: 0,
+            labels: Default::default(),
+            tags: Vec::new(),
+            dependencies: Vec::new(),
+            extra: Default::default(),
         };
         let state_path = PathType::PathBuf(PathBuf::from("/tmp/test_state_inherit.json"));
 
@@ -254,7 +272,7 @@ mod tests {
             data: String::new(),
             event_counter: 0,
             name: String::new(),
-            stared_at: current_timestamp(),
+            started_at: current_timestamp(),
             version: SoftwareVersion::dummy(),
             status: Status::Building,
             pid: 0,
@@ -263,7 +281,15 @@ mod tests {
             config: AppConfig::dummy(),
             system_application: false,
             stderr: Vec::new(),
+            stdout_meta: Default::default(),
+            stderr_meta: Default::default(),
             stdout: Vec::new(),
+            events: Vec::new(),
+            generation: 0,
+            labels: Default::default(),
+            tags: Vec::new(),
+            dependencies: Vec::new(),
+            extra: Default::default(),
         };
         let state_path = PathType::PathBuf(PathBuf::from("/tmp/test_state_failure.json"));
 
@@ -307,4 +333,33 @@ mod tests {
         child.child.kill().await.expect("Failed to kill child");
         assert!(!ChildLock::running(pid as i32), "Child should be dead");
     }
+
+    #[tokio::test]
+    async fn test_process_liveness() {
+        let mut child = Command::new("sleep")
+            .arg("0.2")
+            .spawn()
+            .expect("Failed to spawn sleep");
+        let mut state = sample_state();
+        state.pid = child.id().expect("Child has no PID");
+        assert!(is_process_alive(&state).unwrap());
+
+        // Waiting gives up when the timeout expires while the child is still running.
+        let early = tokio::time::timeout(
+            Duration::from_millis(20),
+            wait_for_process(&state, Duration::from_millis(5)),
+        )
+        .await;
+        assert!(early.is_err());
+
+        // Reap the child, otherwise it lingers as a zombie that still answers signal 0.
+        child.wait().await.expect("Failed to wait for child");
+        wait_for_process(&state, Duration::from_millis(5))
+            .await
+            .unwrap();
+        assert!(!is_process_alive(&state).unwrap());
+
+        state.pid = 0;
+        assert!(!is_process_alive(&state).unwrap());
+    }
 }
@@ -0,0 +1,29 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::AppConfig;
+    use crate::resource_limits::check_resource_usage;
+    use std::io;
+
+    #[test]
+    fn test_check_resource_usage_limits() {
+        let mut cfg = AppConfig::dummy();
+        cfg.max_ram_usage = 0;
+        cfg.max_cpu_usage = 0;
+
+        let report = check_resource_usage(&cfg, std::process::id()).unwrap();
+        assert!(report.ram_bytes > 0);
+        assert!(report.cpu_percent >= 0.0);
+        assert!(!report.exceeded());
+
+        // The test binary is always larger than a single megabyte.
+        cfg.max_ram_usage = 1;
+        let report = check_resource_usage(&cfg, std::process::id()).unwrap();
+        assert!(report.ram_exceeded);
+    }
+
+    #[test]
+    fn test_check_resource_usage_missing_pid() {
+        let err = check_resource_usage(&AppConfig::dummy(), 999_999_999).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::NotFound);
+    }
+}
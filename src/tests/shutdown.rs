@@ -0,0 +1,52 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::shutdown::install_with_exit;
+    use crate::state_persistence::StatePersistence;
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::sync::atomic::{AtomicI32, Ordering};
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    static EXIT_CODE: AtomicI32 = AtomicI32::new(-1);
+
+    fn record_exit(code: i32) {
+        EXIT_CODE.store(code, Ordering::SeqCst);
+    }
+
+    #[tokio::test]
+    async fn test_shutdown_handler_saves_stopped_state() {
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.state").into();
+        let mut state = sample_state();
+        state.status = Status::Running;
+        state.event_counter = 12;
+
+        let handle = install_with_exit(
+            path.clone(),
+            move || state.clone(),
+            &[libc::SIGUSR2],
+            record_exit,
+        )
+        .unwrap();
+        assert!(handle.is_active());
+
+        unsafe {
+            libc::kill(libc::getpid(), libc::SIGUSR2);
+        }
+        for _ in 0..100 {
+            if EXIT_CODE.load(Ordering::SeqCst) != -1 {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        }
+
+        assert_eq!(EXIT_CODE.load(Ordering::SeqCst), 128 + libc::SIGUSR2);
+        assert!(!handle.is_active());
+        let saved = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(saved.status, Status::Stopped);
+        assert_eq!(saved.event_counter, 12);
+        assert!(saved.last_updated > 0);
+    }
+}
@@ -0,0 +1,96 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_archive::{archive_states, extract_archive, ArchivedState, MANIFEST_NAME};
+    use crate::state_persistence::StatePersistence;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::zip::{read_zip, ZipWriter};
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::fs;
+    use std::io;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_archive_round_trips_through_extraction() {
+        let dir = tempdir().unwrap();
+        let source = dir.path().join("states");
+        fs::create_dir(&source).unwrap();
+        for (name, last_updated) in [("alpha", 100), ("beta", 200), ("gamma", 300)] {
+            let mut state = sample_state();
+            state.name = name.to_string();
+            state.last_updated = last_updated;
+            let path = PathType::PathBuf(source.join(format!("{}.state", name)));
+            StatePersistence::save_state(&state, &path).await.unwrap();
+        }
+        fs::write(source.join("broken.state"), "garbage").unwrap();
+        fs::write(source.join("notes.txt"), "not a state").unwrap();
+
+        let archive = dir.path().join("states.zip");
+        let manifest = archive_states(&source, &archive, |_| true).unwrap();
+        assert_eq!(manifest.file_count, 3);
+        assert!(manifest.created_at > 0);
+        assert_eq!(
+            manifest.states[1],
+            ArchivedState {
+                file: "beta.state".to_string(),
+                name: "beta".to_string(),
+                last_updated: 200,
+            }
+        );
+
+        let entries = read_zip(&fs::read(&archive).unwrap()).unwrap();
+        let names: Vec<_> = entries.iter().map(|(name, _)| name.as_str()).collect();
+        assert_eq!(
+            names,
+            [MANIFEST_NAME, "alpha.state", "beta.state", "gamma.state"]
+        );
+
+        let target = dir.path().join("extracted");
+        assert_eq!(extract_archive(&archive, &target).unwrap(), manifest);
+        for name in ["alpha", "beta", "gamma"] {
+            let file = format!("{}.state", name);
+            assert_eq!(
+                fs::read(target.join(&file)).unwrap(),
+                fs::read(source.join(&file)).unwrap()
+            );
+            let loaded = StatePersistence::load_state(&PathType::PathBuf(target.join(&file)))
+                .await
+                .unwrap();
+            assert_eq!(loaded.name, name);
+        }
+        assert!(!target.join(MANIFEST_NAME).exists());
+
+        let filtered =
+            archive_states(&source, &archive, |state| state.last_updated >= 200).unwrap();
+        let names: Vec<_> = filtered
+            .states
+            .iter()
+            .map(|state| state.name.as_str())
+            .collect();
+        assert_eq!(names, ["beta", "gamma"]);
+    }
+
+    #[test]
+    fn test_extract_rejects_unsafe_entries() {
+        let dir = tempdir().unwrap();
+        let archive = dir.path().join("evil.zip");
+
+        let mut zip = ZipWriter::new(fs::File::create(&archive).unwrap(), 0);
+        zip.add(
+            MANIFEST_NAME,
+            br#"{"created_at":0,"file_count":1,"states":[]}"#,
+        )
+        .unwrap();
+        zip.add("../escape.state", b"x").unwrap();
+        zip.finish().unwrap();
+
+        let target = dir.path().join("out");
+        let err = extract_archive(&archive, &target).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+        assert!(!target.exists());
+        assert!(!dir.path().join("escape.state").exists());
+
+        fs::write(&archive, b"not a zip").unwrap();
+        let err = extract_archive(&archive, &target).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+    }
+}
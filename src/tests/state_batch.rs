@@ -0,0 +1,259 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_batch::{
+        gc_stale_states, gc_state_directory, list_orphaned_states, load_state_directory,
+        save_state_batch, save_state_directory, set_status_for_all, state_file_path,
+        BatchSaveOptions, SyncMode,
+    };
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::timestamp::current_timestamp;
+    use std::collections::BTreeMap;
+    use std::os::unix::fs::PermissionsExt;
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_save_and_load_state_directory() {
+        let dir = tempdir().unwrap();
+        let states: Vec<_> = ["gamma", "alpha", "beta"]
+            .iter()
+            .map(|name| {
+                let mut state = sample_state();
+                state.name = name.to_string();
+                state
+            })
+            .collect();
+
+        save_state_directory(dir.path(), &states, 0o600, 2)
+            .await
+            .unwrap();
+
+        let mode = std::fs::metadata(state_file_path(dir.path(), &states[0]))
+            .unwrap()
+            .permissions()
+            .mode();
+        assert_eq!(mode & 0o777, 0o600);
+
+        let loaded = load_state_directory(dir.path(), 2).await.unwrap();
+        let names: Vec<_> = loaded.iter().map(|state| state.name.as_str()).collect();
+        assert_eq!(names, vec!["alpha", "beta", "gamma"]);
+    }
+
+    #[tokio::test]
+    async fn test_save_state_directory_partial_failure() {
+        let dir = tempdir().unwrap();
+        let mut good = sample_state();
+        good.name = "good".into();
+        let mut bad = sample_state();
+        bad.name = "missing/bad".into();
+
+        let err = save_state_directory(dir.path(), &[good.clone(), bad.clone()], 0o644, 4)
+            .await
+            .unwrap_err();
+
+        assert_eq!(err.len(), 1);
+        assert_eq!(err.errors[0].0, state_file_path(dir.path(), &bad));
+        assert!(state_file_path(dir.path(), &good).exists());
+    }
+
+    #[tokio::test]
+    async fn test_save_state_directory_rejects_unsafe_and_duplicate_names() {
+        let root = tempdir().unwrap();
+        let dir = root.path().join("states");
+        std::fs::create_dir(&dir).unwrap();
+        let make = |name: &str, pid: u32| {
+            let mut state = sample_state();
+            state.name = name.into();
+            state.pid = pid;
+            state
+        };
+        let states = vec![
+            make("good", 1),
+            make("../escape", 2),
+            make("..", 3),
+            make("twin", 4),
+            make("twin", 5),
+        ];
+
+        let err = save_state_directory(&dir, &states, 0o644, 4)
+            .await
+            .unwrap_err();
+
+        assert_eq!(err.len(), 4);
+        assert!(err
+            .errors
+            .iter()
+            .all(|(_, err)| err.kind() == std::io::ErrorKind::InvalidInput));
+        assert!(!root.path().join("escape.state").exists());
+        assert!(!dir.join("twin.state").exists());
+        let loaded = load_state_directory(&dir, 2).await.unwrap();
+        assert_eq!(loaded, vec![states[0].clone()]);
+    }
+
+    #[tokio::test]
+    async fn test_set_status_for_all_only_touches_matching_states() {
+        let dir = tempdir().unwrap();
+        let states: Vec<_> = [
+            ("api", Status::Running),
+            ("worker", Status::Running),
+            ("cron", Status::Idle),
+        ]
+        .iter()
+        .map(|(name, status)| {
+            let mut state = sample_state();
+            state.name = name.to_string();
+            state.status = *status;
+            state
+        })
+        .collect();
+        save_state_directory(dir.path(), &states, 0o640, 2)
+            .await
+            .unwrap();
+        std::fs::write(dir.path().join("broken.state"), "not a state").unwrap();
+
+        let before = current_timestamp();
+        let (updated, errors) = set_status_for_all(
+            dir.path(),
+            Status::Stopped,
+            |state| state.status == Status::Running,
+            2,
+        )
+        .await;
+        assert_eq!(
+            updated,
+            vec![
+                dir.path().join("api.state"),
+                dir.path().join("worker.state")
+            ]
+        );
+        assert_eq!(errors.len(), 1);
+        assert_eq!(errors.errors[0].0, dir.path().join("broken.state"));
+
+        std::fs::remove_file(dir.path().join("broken.state")).unwrap();
+        let loaded = load_state_directory(dir.path(), 2).await.unwrap();
+        let statuses: Vec<_> = loaded
+            .iter()
+            .map(|state| (state.name.as_str(), state.status))
+            .collect();
+        assert_eq!(
+            statuses,
+            vec![
+                ("api", Status::Stopped),
+                ("cron", Status::Idle),
+                ("worker", Status::Stopped)
+            ]
+        );
+        assert!(loaded[0].last_updated >= before);
+        assert_eq!(loaded[1].last_updated, 0);
+
+        let mode = std::fs::metadata(dir.path().join("api.state"))
+            .unwrap()
+            .permissions()
+            .mode();
+        assert_eq!(mode & 0o777, 0o640);
+    }
+
+    #[tokio::test]
+    async fn test_gc_state_directory_removes_orphans() {
+        let dir = tempdir().unwrap();
+        let states: Vec<_> = ["a", "b", "c", "d", "e"]
+            .iter()
+            .map(|name| {
+                let mut state = sample_state();
+                state.name = name.to_string();
+                state
+            })
+            .collect();
+        save_state_directory(dir.path(), &states, 0o600, 4)
+            .await
+            .unwrap();
+        let known = ["a", "c", "e"];
+
+        let orphaned = list_orphaned_states(dir.path(), &known).await.unwrap();
+        let expected = vec![
+            state_file_path(dir.path(), &states[1]),
+            state_file_path(dir.path(), &states[3]),
+        ];
+        assert_eq!(orphaned, expected);
+        assert!(expected.iter().all(|path| path.exists()));
+
+        let deleted = gc_state_directory(dir.path(), &known).await.unwrap();
+        assert_eq!(deleted, expected);
+        assert!(expected.iter().all(|path| !path.exists()));
+        assert_eq!(load_state_directory(dir.path(), 4).await.unwrap().len(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_gc_stale_states() {
+        let dir = tempdir().unwrap();
+        let now = current_timestamp();
+        let day = 24 * 60 * 60;
+        let make = |name: &str, status: Status, age: u64| {
+            let mut state = sample_state();
+            state.name = name.into();
+            state.status = status;
+            state.last_updated = now - age;
+            state
+        };
+        let states = vec![
+            make("old-stopped", Status::Stopped, 90 * day),
+            make("old-running", Status::Running, 90 * day),
+            make("new-stopped", Status::Stopped, day),
+        ];
+        save_state_directory(dir.path(), &states, 0o600, 4)
+            .await
+            .unwrap();
+        let max_age = Duration::from_secs(30 * day);
+        let expected = vec![state_file_path(dir.path(), &states[0])];
+
+        let listed = gc_stale_states(dir.path(), max_age, true).await.unwrap();
+        assert_eq!(listed, expected);
+        assert!(expected[0].exists());
+
+        let removed = gc_stale_states(dir.path(), max_age, false).await.unwrap();
+        assert_eq!(removed, expected);
+        assert!(!expected[0].exists());
+        assert_eq!(load_state_directory(dir.path(), 4).await.unwrap().len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_save_state_batch() {
+        let dir = tempdir().unwrap();
+        let mut states = BTreeMap::new();
+        for name in ["api", "worker"] {
+            let mut state = sample_state();
+            state.name = name.to_string();
+            states.insert(name.to_string(), state);
+        }
+
+        for sync in [SyncMode::Never, SyncMode::EachFile, SyncMode::DirectoryOnce] {
+            let opts = BatchSaveOptions {
+                sync,
+                ..BatchSaveOptions::default()
+            };
+            save_state_batch(dir.path(), &states, opts).await.unwrap();
+
+            let loaded = load_state_directory(dir.path(), 2).await.unwrap();
+            assert_eq!(loaded, states.values().cloned().collect::<Vec<_>>());
+        }
+
+        let mut unsafe_keys = BTreeMap::new();
+        unsafe_keys.insert("../escape".to_string(), sample_state());
+        unsafe_keys.insert("missing/bad".to_string(), sample_state());
+        let nested = dir.path().join("nested");
+        std::fs::create_dir(&nested).unwrap();
+        let err = save_state_batch(&nested, &unsafe_keys, BatchSaveOptions::default())
+            .await
+            .unwrap_err();
+        assert_eq!(err.len(), 2);
+        assert!(!dir.path().join("escape.state").exists());
+
+        let missing = dir.path().join("missing");
+        let err = save_state_batch(&missing, &states, BatchSaveOptions::default())
+            .await
+            .unwrap_err();
+        // Both files and the final directory sync fail.
+        assert_eq!(err.len(), 3);
+    }
+}
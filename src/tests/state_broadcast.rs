@@ -0,0 +1,124 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::Aggregator;
+    use crate::state_broadcast::{StateBroadcaster, StateSubscriber, SUBSCRIBER_WRITE_TIMEOUT};
+    use crate::state_persistence_test::tests::sample_state;
+    use std::io;
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_broadcast_reaches_all_subscribers_in_order() {
+        let dir = tempdir().unwrap();
+        let config = Aggregator {
+            socket_path: dir.path().join("state.sock").display().to_string(),
+            socket_permission: Some(0o600),
+        };
+        let broadcaster = StateBroadcaster::bind(&config).unwrap();
+
+        let mut receivers = Vec::new();
+        for _ in 0..2 {
+            let mut subscriber = StateSubscriber::connect(broadcaster.path()).await.unwrap();
+            receivers.push(tokio::spawn(async move {
+                let mut pids = Vec::new();
+                for _ in 0..3 {
+                    pids.push(subscriber.receive().await.unwrap().pid);
+                }
+                pids
+            }));
+        }
+
+        while broadcaster.subscriber_count().await < 2 {
+            tokio::time::sleep(Duration::from_millis(5)).await;
+        }
+
+        for pid in 1..=3 {
+            let mut state = sample_state();
+            state.pid = pid;
+            broadcaster.broadcast(&state).await.unwrap();
+        }
+
+        for receiver in receivers {
+            assert_eq!(receiver.await.unwrap(), vec![1, 2, 3]);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_subscriber_sees_eof_when_broadcaster_drops() {
+        let dir = tempdir().unwrap();
+        let config = Aggregator {
+            socket_path: dir.path().join("state.sock").display().to_string(),
+            socket_permission: None,
+        };
+        let broadcaster = StateBroadcaster::bind(&config).unwrap();
+        let mut subscriber = StateSubscriber::connect(broadcaster.path()).await.unwrap();
+        while broadcaster.subscriber_count().await < 1 {
+            tokio::time::sleep(Duration::from_millis(5)).await;
+        }
+
+        let path = broadcaster.path().to_path_buf();
+        drop(broadcaster);
+        assert!(!path.exists());
+
+        let err = subscriber.receive().await.unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::UnexpectedEof);
+    }
+
+    #[tokio::test]
+    async fn test_bind_replaces_only_stale_sockets() {
+        let dir = tempdir().unwrap();
+        let config = Aggregator {
+            socket_path: dir.path().join("state.sock").display().to_string(),
+            socket_permission: None,
+        };
+
+        std::fs::write(&config.socket_path, "not a socket").unwrap();
+        let err = StateBroadcaster::bind(&config).err().unwrap();
+        assert_eq!(err.kind(), io::ErrorKind::AlreadyExists);
+        std::fs::remove_file(&config.socket_path).unwrap();
+
+        // A socket nobody listens on any more is stale and replaced.
+        drop(std::os::unix::net::UnixListener::bind(&config.socket_path).unwrap());
+        let broadcaster = StateBroadcaster::bind(&config).unwrap();
+
+        let err = StateBroadcaster::bind(&config).err().unwrap();
+        assert_eq!(err.kind(), io::ErrorKind::AddrInUse);
+        assert!(broadcaster.path().exists());
+    }
+
+    #[tokio::test]
+    async fn test_broadcast_drops_stalled_subscribers() {
+        let dir = tempdir().unwrap();
+        let config = Aggregator {
+            socket_path: dir.path().join("state.sock").display().to_string(),
+            socket_permission: None,
+        };
+        let broadcaster = StateBroadcaster::bind(&config).unwrap();
+
+        // Connected but never read, so its socket buffer fills up.
+        let _stalled = StateSubscriber::connect(broadcaster.path()).await.unwrap();
+        let mut reader = StateSubscriber::connect(broadcaster.path()).await.unwrap();
+        while broadcaster.subscriber_count().await < 2 {
+            tokio::time::sleep(Duration::from_millis(5)).await;
+        }
+        let received = tokio::spawn(async move {
+            let mut pids = Vec::new();
+            for _ in 0..2 {
+                pids.push(reader.receive().await.unwrap().pid);
+            }
+            pids
+        });
+
+        let mut state = sample_state();
+        state.data = "x".repeat(4 * 1024 * 1024);
+        for pid in 1..=2 {
+            state.pid = pid;
+            let started = std::time::Instant::now();
+            broadcaster.broadcast(&state).await.unwrap();
+            assert!(started.elapsed() < SUBSCRIBER_WRITE_TIMEOUT * 3);
+        }
+
+        assert_eq!(broadcaster.subscriber_count().await, 1);
+        assert_eq!(received.await.unwrap(), vec![1, 2]);
+    }
+}
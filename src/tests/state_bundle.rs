@@ -0,0 +1,38 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_bundle::StateBundle;
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_bundle_set_get_remove_and_round_trip() {
+        let mut bundle = StateBundle::new();
+        for name in ["api", "worker", "cron"] {
+            let mut state = sample_state();
+            state.name = name.to_string();
+            assert!(bundle.set(state).is_none());
+        }
+        assert_eq!(bundle.len(), 3);
+
+        let mut replacement = sample_state();
+        replacement.name = "worker".to_string();
+        replacement.status = Status::Stopped;
+        assert!(bundle.set(replacement).is_some());
+        assert_eq!(bundle.get("worker").unwrap().status, Status::Stopped);
+
+        assert_eq!(bundle.remove("cron").unwrap().name, "cron");
+        assert!(bundle.get("cron").is_none());
+
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("group.json"));
+        bundle.save(&path).await.unwrap();
+
+        let content = std::fs::read_to_string(&path).unwrap();
+        assert!(content.starts_with("{\n  \"apps\": {\n    \"api\": {"));
+
+        let loaded = StateBundle::load(&path).await.unwrap();
+        assert_eq!(loaded, bundle);
+    }
+}
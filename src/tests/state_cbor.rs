@@ -0,0 +1,64 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::{Aggregator, TlsConfig};
+    use crate::state_cbor::{decode_state_cbor, encode_state_cbor};
+    use crate::state_persistence::Event;
+    use crate::state_persistence_test::tests::sample_state;
+    use std::io;
+
+    #[test]
+    fn test_cbor_round_trip_keeps_optional_fields() {
+        let mut state = sample_state();
+        state.pid = 4321;
+        state.last_updated = 1_700_000_000;
+        state.stdout = vec![(1_700_000_000, "hello ünïcode".to_string())];
+        state.events = vec![Event {
+            timestamp: 1_700_000_001,
+            kind: "started".to_string(),
+            detail: String::new(),
+        }];
+        state.labels.insert("region".to_string(), "eu".to_string());
+        state.add_tag("edge");
+        state.config.aggregator = Some(Aggregator {
+            socket_path: "/tmp/agg.sock".to_string(),
+            socket_permission: Some(0o600),
+        });
+        state.config.tls = Some(TlsConfig {
+            ca_file: Some("/etc/ssl/ca.pem".to_string()),
+            ..TlsConfig::default()
+        });
+        state.config.listen_port = Some(9000);
+
+        let mut encoded = Vec::new();
+        encode_state_cbor(&mut encoded, &state).unwrap();
+        let json = serde_json::to_vec(&state).unwrap();
+        assert!(encoded.len() < json.len());
+
+        assert_eq!(decode_state_cbor(encoded.as_slice()).unwrap(), state);
+
+        let mut bare = sample_state();
+        bare.config.listen_port = None;
+        let mut encoded = Vec::new();
+        encode_state_cbor(&mut encoded, &bare).unwrap();
+        assert_eq!(decode_state_cbor(encoded.as_slice()).unwrap(), bare);
+    }
+
+    #[test]
+    fn test_cbor_decode_rejects_bad_input() {
+        let mut encoded = Vec::new();
+        encode_state_cbor(&mut encoded, &sample_state()).unwrap();
+        encoded.truncate(encoded.len() / 2);
+        let err = decode_state_cbor(encoded.as_slice()).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::UnexpectedEof);
+
+        // A byte string, then a map with an integer key.
+        for input in [&[0x41, 0x00][..], &[0xa1, 0x01, 0x02][..]] {
+            let err = decode_state_cbor(input).unwrap_err();
+            assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+        }
+
+        // Well formed CBOR that is no state: the text "hi".
+        let err = decode_state_cbor(&[0x62, b'h', b'i'][..]).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+    }
+}
@@ -0,0 +1,49 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_cluster::ClusterState;
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_merge_ten_nodes_and_round_trip() {
+        let mut cluster = ClusterState::new("eu-west");
+        for i in 0..10u32 {
+            let mut state = sample_state();
+            state.pid = 1000 + i;
+            state.last_updated = 100 + i as u64;
+            assert!(cluster.merge_node(format!("node-{}", i), state));
+        }
+        assert_eq!(cluster.nodes.len(), 10);
+        assert_eq!(cluster.last_updated, 109);
+        assert_eq!(cluster.node("node-4").unwrap().pid, 1004);
+        assert!(cluster.node("node-10").is_none());
+
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("cluster.json"));
+        cluster.save(&path).await.unwrap();
+        let loaded = ClusterState::load(&path).await.unwrap();
+        assert_eq!(loaded, cluster);
+        assert_eq!(loaded.node("node-7").unwrap().pid, 1007);
+    }
+
+    #[test]
+    fn test_merge_keeps_newer_node_state() {
+        let mut cluster = ClusterState::new("eu-west");
+        let mut newer = sample_state();
+        newer.last_updated = 200;
+        newer.status = Status::Running;
+        assert!(cluster.merge_node("node-1", newer));
+
+        let mut stale = sample_state();
+        stale.last_updated = 150;
+        stale.status = Status::Stopped;
+        assert!(!cluster.merge_node("node-1", stale));
+        assert_eq!(cluster.node("node-1").unwrap().status, Status::Running);
+        assert_eq!(cluster.last_updated, 200);
+
+        assert_eq!(cluster.remove_node("node-1").unwrap().last_updated, 200);
+        assert!(cluster.nodes.is_empty());
+    }
+}
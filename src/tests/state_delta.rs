@@ -0,0 +1,124 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_delta::{apply_deltas, apply_patch, diff_patch, DeltaWriter, PatchOp};
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use serde_json::json;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_diff_patch_round_trips() {
+        let base = json!({
+            "name": "api",
+            "a/b": {"x~y": 1},
+            "stdout": [[1, "one"], [2, "two"], [3, "three"]],
+            "tags": ["web", "eu"],
+            "gone": true,
+        });
+        let current = json!({
+            "name": "api",
+            "a/b": {"x~y": 2},
+            "stdout": [[2, "two"], [3, "three"], [4, "four"]],
+            "tags": ["eu"],
+            "pid": 7,
+        });
+
+        let ops = diff_patch(&base, &current);
+        assert!(ops.contains(&PatchOp::Replace {
+            path: "/a~1b/x~0y".into(),
+            value: json!(2),
+        }));
+        assert!(ops.contains(&PatchOp::Remove {
+            path: "/stdout/0".into()
+        }));
+        assert!(ops.contains(&PatchOp::Add {
+            path: "/stdout/-".into(),
+            value: json!([4, "four"]),
+        }));
+
+        let mut patched = base.clone();
+        apply_patch(&mut patched, &ops).unwrap();
+        assert_eq!(patched, current);
+        assert!(diff_patch(&current, &current).is_empty());
+    }
+
+    #[test]
+    fn test_apply_patch_follows_rfc_6902() {
+        // The op encoding of RFC 6902 section 3.
+        let ops: Vec<PatchOp> = serde_json::from_value(json!([
+            {"op": "test", "path": "/a/b/c", "value": "foo"},
+            {"op": "remove", "path": "/a/b/c"},
+            {"op": "add", "path": "/a/b/c", "value": ["foo", "bar"]},
+            {"op": "add", "path": "/a/b/c/1", "value": "baz"},
+            {"op": "replace", "path": "/a/b/c/0", "value": 42},
+        ]))
+        .unwrap();
+        let mut document = json!({"a": {"b": {"c": "foo"}}});
+        apply_patch(&mut document, &ops).unwrap();
+        assert_eq!(document, json!({"a": {"b": {"c": [42, "baz", "bar"]}}}));
+
+        let failing = [PatchOp::Test {
+            path: "/a/b/c/0".into(),
+            value: json!(0),
+        }];
+        assert_eq!(
+            apply_patch(&mut document, &failing).unwrap_err().path,
+            "/a/b/c/0"
+        );
+        let out_of_range = [PatchOp::Remove {
+            path: "/a/b/c/3".into(),
+        }];
+        assert!(apply_patch(&mut document, &out_of_range).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_patches_rebuild_the_latest_state() {
+        let dir = tempdir().unwrap();
+        for name in ["app.json", "app.state"] {
+            let path = PathType::PathBuf(dir.path().join(name));
+            let mut writer = DeltaWriter::new(&path);
+
+            let mut state = sample_state();
+            state.stdout = (0..500).map(|i| (i, format!("line {}", i))).collect();
+            writer.save(&state).await.unwrap();
+            let snapshot = std::fs::read(&path).unwrap();
+
+            for i in 500..510 {
+                state.stdout.push((i, format!("line {}", i)));
+                state.pid = i as u32;
+                writer.save(&state).await.unwrap();
+            }
+            assert_eq!(writer.pending_patches(), 10);
+            assert_eq!(std::fs::read(&path).unwrap(), snapshot);
+            let patches = std::fs::read_to_string(writer.patch_path()).unwrap();
+            assert!(patches.len() < snapshot.len(), "{}", name);
+            assert_eq!(name.ends_with(".json"), patches.contains("line 505"));
+
+            assert_eq!(apply_deltas(&path).await.unwrap(), state);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_compaction_skips_stale_patches() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("app.json"));
+        let mut writer = DeltaWriter::new(&path).with_compact_after(2);
+
+        let mut state = sample_state();
+        for pid in 1..=3 {
+            state.pid = pid;
+            writer.save(&state).await.unwrap();
+        }
+        assert_eq!(writer.pending_patches(), 2);
+        let stale = std::fs::read_to_string(writer.patch_path()).unwrap();
+
+        state.pid = 4;
+        writer.save(&state).await.unwrap();
+        assert_eq!(writer.pending_patches(), 0);
+        assert!(!writer.patch_path().exists());
+
+        // A crash after the snapshot was written but before the patches were deleted.
+        std::fs::write(writer.patch_path(), stale + "{\"base\":\"torn").unwrap();
+        assert_eq!(apply_deltas(&path).await.unwrap().pid, 4);
+    }
+}
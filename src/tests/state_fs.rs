@@ -0,0 +1,73 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_fs::{write_atomic, FileSystem, MemFileSystem, OsFileSystem};
+    use crate::state_persistence::StatePersistence;
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::io;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::Path;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_save_and_load_state_mem_fs() {
+        let fs = MemFileSystem::new();
+        let path = PathType::Str("/state/app.state".into());
+        let state = sample_state();
+
+        StatePersistence::save_state_fs(&fs, &state, &path).unwrap();
+        assert_eq!(
+            fs.paths(),
+            vec![Path::new("/state/app.state").to_path_buf()]
+        );
+
+        let loaded = StatePersistence::load_state_fs(&fs, &path).unwrap();
+        assert_eq!(loaded, state);
+    }
+
+    #[test]
+    fn test_load_state_mem_fs_missing_file() {
+        let fs = MemFileSystem::new();
+        let path = PathType::Str("/state/missing.state".into());
+
+        let err = StatePersistence::load_state_fs(&fs, &path).unwrap_err();
+        let io_err = err.downcast_ref::<io::Error>().unwrap();
+        assert_eq!(io_err.kind(), io::ErrorKind::NotFound);
+    }
+
+    #[test]
+    fn test_mem_fs_rename_and_stat() {
+        let fs = MemFileSystem::new();
+        let from = Path::new("/a");
+        let to = Path::new("/b");
+
+        fs.write_file(from, b"hello").unwrap();
+        fs.rename(from, to).unwrap();
+
+        assert_eq!(fs.stat(to).unwrap().len, 5);
+        assert_eq!(fs.stat(from).unwrap_err().kind(), io::ErrorKind::NotFound);
+    }
+
+    #[test]
+    fn test_write_atomic_mode() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("app.state");
+        let mode = |path: &Path| std::fs::metadata(path).unwrap().permissions().mode() & 0o777;
+
+        write_atomic(&path, b"first", Some(0o600), true).unwrap();
+        assert_eq!(mode(&path), 0o600);
+
+        let state_path = PathType::PathBuf(path.clone());
+        StatePersistence::save_state_fs(&OsFileSystem, &sample_state(), &state_path).unwrap();
+        assert_eq!(mode(&path), 0o600);
+        assert_eq!(
+            StatePersistence::load_state_fs(&OsFileSystem, &state_path).unwrap(),
+            sample_state()
+        );
+
+        write_atomic(&path, b"second", Some(0o640), false).unwrap();
+        assert_eq!(mode(&path), 0o640);
+        assert_eq!(std::fs::read(&path).unwrap(), b"second");
+        assert!(!dir.path().join("app.state.tmp").exists());
+    }
+}
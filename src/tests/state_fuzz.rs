@@ -0,0 +1,225 @@
+#[cfg(test)]
+mod tests {
+    //! Randomized tests of state decoding and encoding, in the spirit of fuzzing but
+    //! deterministic: case `n` always uses seed `n`, so a failure names the case that
+    //! reproduces it. Set `ARTISAN_FUZZ_CASES` to run more cases than the default.
+
+    use crate::aggregator::Status;
+    use crate::state_persistence::{
+        AppState, ErrorItem, Event, OutputMeta, Severity, StateFormat, StatePersistence,
+    };
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use tempfile::tempdir;
+
+    const DEFAULT_CASES: u64 = 256;
+
+    fn cases() -> u64 {
+        std::env::var("ARTISAN_FUZZ_CASES")
+            .ok()
+            .and_then(|cases| cases.parse().ok())
+            .unwrap_or(DEFAULT_CASES)
+    }
+
+    /// A small xorshift generator, enough to spread test inputs.
+    struct Rng(u64);
+
+    impl Rng {
+        fn new(seed: u64) -> Self {
+            Rng(seed.wrapping_mul(0x9E37_79B9_7F4A_7C15) | 1)
+        }
+
+        fn next(&mut self) -> u64 {
+            self.0 ^= self.0 << 13;
+            self.0 ^= self.0 >> 7;
+            self.0 ^= self.0 << 17;
+            self.0
+        }
+
+        fn below(&mut self, bound: usize) -> usize {
+            (self.next() % bound.max(1) as u64) as usize
+        }
+
+        fn chance(&mut self, one_in: usize) -> bool {
+            self.below(one_in) == 0
+        }
+
+        fn bytes(&mut self, max_len: usize) -> Vec<u8> {
+            (0..self.below(max_len + 1))
+                .map(|_| self.next() as u8)
+                .collect()
+        }
+
+        /// A string mixing plain text with quotes, escapes, control and non-ASCII
+        /// characters.
+        fn string(&mut self, max_len: usize) -> String {
+            const SPECIAL: &[char] = &[
+                '"', '\'', '\\', '\n', '\r', '\t', '\0', '=', '[', ']', '{', '}', '#', 'é', '字',
+                '🚀', '\u{7f}', '\u{feff}',
+            ];
+            (0..self.below(max_len + 1))
+                .map(|_| match self.chance(4) {
+                    true => SPECIAL[self.below(SPECIAL.len())],
+                    false => (b' ' + self.below(95) as u8) as char,
+                })
+                .collect()
+        }
+
+        /// A timestamp within the signed 64 bit range TOML integers are limited to.
+        fn timestamp(&mut self) -> u64 {
+            self.next() >> 24
+        }
+    }
+
+    fn random_state(rng: &mut Rng) -> AppState {
+        const STATUSES: [Status; 4] = [
+            Status::Running,
+            Status::Stopped,
+            Status::Unknown,
+            Status::Warning,
+        ];
+        const SEVERITIES: [Severity; 3] = [Severity::Warn, Severity::Error, Severity::Fatal];
+
+        let mut state = sample_state();
+        state.name = rng.string(32);
+        state.data = rng.string(256);
+        state.status = STATUSES[rng.below(STATUSES.len())].clone();
+        state.pid = rng.next() as u32;
+        state.last_updated = rng.timestamp();
+        state.started_at = rng.timestamp();
+        state.event_counter = rng.next() as u32;
+        state.system_application = rng.chance(2);
+        state.generation = rng.timestamp();
+
+        // Now and then a large buffer, as long running applications accumulate.
+        let lines = match rng.chance(16) {
+            true => 1_000,
+            false => rng.below(20),
+        };
+        state.stdout = (0..lines)
+            .map(|_| (rng.timestamp(), rng.string(80)))
+            .collect();
+        state.stderr = (0..rng.below(20))
+            .map(|_| (rng.timestamp(), rng.string(80)))
+            .collect();
+        state.stdout_meta = OutputMeta {
+            lines_written: rng.timestamp(),
+            lines_dropped: rng.timestamp(),
+        };
+        state.events = (0..rng.below(10))
+            .map(|_| Event {
+                timestamp: rng.timestamp(),
+                kind: rng.string(12),
+                detail: rng.string(40),
+            })
+            .collect();
+        state.error_log = (0..rng.below(5))
+            .map(|_| {
+                let error = ErrorArrayItem::new(Errors::GeneralError, rng.string(40));
+                let mut item = ErrorItem::new(SEVERITIES[rng.below(SEVERITIES.len())], error)
+                    .with_context(rng.string(8), rng.string(16));
+                item.first_seen = rng.timestamp();
+                item
+            })
+            .collect();
+        state.labels = (0..rng.below(5))
+            .map(|_| (rng.string(12), rng.string(24)))
+            .collect();
+        state.tags = (0..rng.below(5)).map(|_| rng.string(12)).collect();
+        state.dependencies = (0..rng.below(3)).map(|_| rng.string(16)).collect();
+        state
+    }
+
+    /// Damages `seed` the way a bad disk, a torn write or a careless edit might.
+    fn mutate(rng: &mut Rng, seed: &[u8]) -> Vec<u8> {
+        let mut data = seed.to_vec();
+        for _ in 0..=rng.below(4) {
+            let at = rng.below(data.len());
+            match rng.below(4) {
+                0 => data.truncate(at),
+                1 => {
+                    let garbage = rng.bytes(16);
+                    data.splice(at..at, garbage);
+                }
+                2 => {
+                    if let Some(byte) = data.get_mut(at) {
+                        *byte ^= 1 << rng.below(8);
+                    }
+                }
+                _ => {
+                    let end = (at + rng.below(64)).min(data.len());
+                    let copy = data[at..end].to_vec();
+                    data.splice(at..at, copy);
+                }
+            }
+        }
+        data
+    }
+
+    fn fixture(name: &str) -> Vec<u8> {
+        let path = std::path::Path::new(env!("CARGO_MANIFEST_DIR"))
+            .join("src/tests/fixtures")
+            .join(name);
+        std::fs::read(path).unwrap()
+    }
+
+    #[test]
+    fn test_decoding_arbitrary_input_never_panics() {
+        let corpus = [
+            (StateFormat::Json, fixture("current.json")),
+            (StateFormat::Toml, fixture("current.toml")),
+            (StateFormat::Encrypted, fixture("current.state")),
+        ];
+        for case in 0..cases() {
+            let mut rng = Rng::new(case);
+            for (format, seed) in &corpus {
+                let data = match rng.chance(4) {
+                    true => rng.bytes(512),
+                    false => mutate(&mut rng, seed),
+                };
+                let text = String::from_utf8_lossy(&data);
+                // Errors are fine, panics are not.
+                let _ = format.decode(&text);
+                let _ = format.decode_strict(&text);
+            }
+        }
+    }
+
+    #[test]
+    fn test_random_states_round_trip_byte_identical() {
+        for case in 0..cases() {
+            let mut rng = Rng::new(case);
+            let state = random_state(&mut rng);
+            for format in [StateFormat::Json, StateFormat::Toml] {
+                let encoded = format.encode(&state).unwrap();
+                let decoded = format.decode(&encoded).unwrap();
+                assert_eq!(decoded, state, "case {} in {:?}", case, format);
+                assert_eq!(
+                    format.encode(&decoded).unwrap(),
+                    encoded,
+                    "case {} in {:?}",
+                    case,
+                    format
+                );
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_random_states_survive_save_and_load() {
+        let dir = tempdir().unwrap();
+        // Files are slower than encoding in memory, so fewer cases go through them.
+        for case in 0..cases().div_ceil(8) {
+            let state = random_state(&mut Rng::new(case));
+            for name in ["app.state", "app.json", "app.toml"] {
+                let path = PathType::PathBuf(dir.path().join(name));
+                StatePersistence::save_state_auto(&state, &path)
+                    .await
+                    .unwrap();
+                let loaded = StatePersistence::load_state_auto(&path).await.unwrap();
+                assert_eq!(loaded, state, "case {} in {}", case, name);
+            }
+        }
+    }
+}
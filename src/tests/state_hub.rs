@@ -0,0 +1,63 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_hub::StateHub;
+    use crate::state_persistence_test::tests::sample_state;
+
+    #[tokio::test]
+    async fn test_watcher_receives_every_push_for_its_name() {
+        let hub = StateHub::new();
+        let mut watcher = hub.watch("api");
+
+        let pusher = hub.clone();
+        tokio::spawn(async move {
+            for pid in [1, 2] {
+                let mut state = sample_state();
+                state.name = "api".to_string();
+                state.pid = pid;
+                assert!(pusher.push(state));
+            }
+            let mut other = sample_state();
+            other.name = "worker".to_string();
+            pusher.push(other);
+        })
+        .await
+        .unwrap();
+
+        assert_eq!(watcher.changed().await.unwrap().pid, 1);
+        assert_eq!(watcher.changed().await.unwrap().pid, 2);
+        assert_eq!(hub.latest("api").unwrap().pid, 2);
+        assert!(hub.latest("worker").is_some());
+
+        drop(hub);
+        assert!(watcher.changed().await.is_none());
+    }
+
+    #[test]
+    fn test_push_ignores_unchanged_state() {
+        let hub = StateHub::new();
+        let state = sample_state();
+        assert!(hub.push(state.clone()));
+        assert!(!hub.push(state));
+        assert_eq!(hub.names().len(), 1);
+    }
+
+    #[test]
+    fn test_watch_only_entries_are_removed_with_their_last_watcher() {
+        let hub = StateHub::new();
+        let first = hub.watch("ghost");
+        let second = hub.watch("ghost");
+        assert_eq!(hub.entry_count(), 1);
+
+        drop(first);
+        assert_eq!(hub.entry_count(), 1);
+        drop(second);
+        assert_eq!(hub.entry_count(), 0);
+
+        let mut state = sample_state();
+        state.name = "api".to_string();
+        let watcher = hub.watch("api");
+        hub.push(state);
+        drop(watcher);
+        assert_eq!(hub.names(), vec!["api".to_string()]);
+    }
+}
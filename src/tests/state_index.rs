@@ -0,0 +1,68 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_index::StateIndex;
+    use crate::state_persistence::StateFormat;
+    use crate::state_persistence_test::tests::sample_state;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_build_state_index() {
+        let dir = tempdir().unwrap();
+        let apps = [
+            ("api", Status::Running, "state"),
+            ("worker", Status::Stopped, "state"),
+            ("cron", Status::Running, "json"),
+            ("proxy", Status::Warning, "toml"),
+            ("mailer", Status::Stopped, "state"),
+        ];
+        for (i, (name, status, ext)) in apps.iter().enumerate() {
+            let mut state = sample_state();
+            state.name = name.to_string();
+            state.status = *status;
+            state.pid = 100 + i as u32;
+            state.stdout = vec![(1, "x".repeat(1024)); 50];
+            let path = dir.path().join(format!("{}.{}", name, ext));
+            let format = StateFormat::from_path(&path).unwrap();
+            std::fs::write(&path, format.encode(&state).unwrap()).unwrap();
+        }
+        std::fs::write(dir.path().join("broken.json"), "{").unwrap();
+        std::fs::write(dir.path().join("notes.txt"), "not a state").unwrap();
+
+        let mut index = StateIndex::build(dir.path()).await.unwrap();
+        let names: Vec<&str> = index
+            .all()
+            .iter()
+            .map(|entry| entry.name.as_str())
+            .collect();
+        assert_eq!(names, vec!["api", "cron", "mailer", "proxy", "worker"]);
+
+        let cron = index.by_name("cron").unwrap();
+        assert_eq!(cron.path, dir.path().join("cron.json"));
+        assert_eq!(cron.status, Status::Running);
+        assert_eq!(cron.pid, 102);
+        assert_eq!(cron.last_updated, sample_state().last_updated);
+        assert_eq!(cron.version, sample_state().version);
+        assert!(index.by_name("missing").is_none());
+
+        let stopped: Vec<&str> = index
+            .filter_by_status(Status::Stopped)
+            .iter()
+            .map(|entry| entry.name.as_str())
+            .collect();
+        assert_eq!(stopped, vec!["mailer", "worker"]);
+
+        std::fs::remove_file(dir.path().join("worker.state")).unwrap();
+        index.refresh().await.unwrap();
+        assert_eq!(index.all().len(), 4);
+        assert!(index.by_name("worker").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_build_state_index_missing_dir() {
+        let dir = tempdir().unwrap();
+        assert!(StateIndex::build(&dir.path().join("missing"))
+            .await
+            .is_err());
+    }
+}
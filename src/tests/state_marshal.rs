@@ -0,0 +1,127 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::{DatabaseConfig, SecretString};
+    use crate::state_marshal::{state_from_flat_map, state_to_flat_map, StateMarshaler};
+    use crate::state_persistence::{ErrorItem, Severity};
+    use crate::state_persistence_test::tests::sample_state;
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    use serde_json::{json, Value};
+
+    fn timestamped_state() -> crate::state_persistence::AppState {
+        let mut state = sample_state();
+        state.last_updated = 1_738_937_100;
+        state.started_at = 1_738_933_500;
+        state.stdout = vec![(1_738_937_040, "ready".into())];
+        state.stderr = vec![(1_738_937_041, "warn".into())];
+        state.record_event("started", "boot");
+        state.events[0].timestamp = 1_738_933_500;
+        let mut error = ErrorItem::new(
+            Severity::Warn,
+            ErrorArrayItem::new(Errors::GeneralError, "health check timed out"),
+        );
+        error.retry_count = 1;
+        error.first_seen = 1_738_937_000;
+        error.next_retry_at = 1_738_937_060;
+        state.error_log.push(error);
+        state
+    }
+
+    fn fixture(name: &str) -> std::path::PathBuf {
+        std::path::Path::new(env!("CARGO_MANIFEST_DIR"))
+            .join("src/tests/fixtures")
+            .join(name)
+    }
+
+    #[test]
+    fn test_marshal_human_timestamps_shape() {
+        let state = timestamped_state();
+        let marshaler = StateMarshaler {
+            human_timestamps: true,
+        };
+
+        let value: Value = serde_json::from_slice(&marshaler.marshal(&state).unwrap()).unwrap();
+        let golden = std::fs::read(fixture("marshal_human.json")).unwrap();
+        assert_eq!(value, serde_json::from_slice::<Value>(&golden).unwrap());
+        assert_eq!(value["last_updated"], json!("2025-02-07T14:05:00Z"));
+        assert_eq!(value["stared_at"], json!("2025-02-07T13:05:00Z"));
+        assert_eq!(value["stdout"], json!([["2025-02-07T14:04:00Z", "ready"]]));
+        assert_eq!(value["stderr"], json!([["2025-02-07T14:04:01Z", "warn"]]));
+        assert_eq!(
+            value["events"],
+            json!([{
+                "timestamp": "2025-02-07T13:05:00Z",
+                "kind": "started",
+                "detail": "boot"
+            }])
+        );
+        assert_eq!(
+            value["error_log"][0]["first_seen"],
+            json!("2025-02-07T14:03:20Z")
+        );
+        assert_eq!(
+            value["error_log"][0]["next_retry_at"],
+            json!("2025-02-07T14:04:20Z")
+        );
+
+        let decoded = marshaler
+            .unmarshal(&marshaler.marshal(&state).unwrap())
+            .unwrap();
+        assert_eq!(decoded, state);
+    }
+
+    #[test]
+    fn test_marshal_default_matches_serde_json() {
+        let state = timestamped_state();
+        let marshaler = StateMarshaler::default();
+
+        let encoded = marshaler.marshal(&state).unwrap();
+        assert_eq!(encoded, serde_json::to_vec(&state).unwrap());
+        assert_eq!(marshaler.unmarshal(&encoded).unwrap(), state);
+    }
+
+    #[test]
+    fn test_unmarshal_rejects_bad_timestamp() {
+        let state = timestamped_state();
+        let mut value = serde_json::to_value(&state).unwrap();
+        value["last_updated"] = json!("yesterday");
+
+        let data = serde_json::to_vec(&value).unwrap();
+        assert!(StateMarshaler::default().unmarshal(&data).is_err());
+    }
+
+    #[test]
+    fn test_flat_map_round_trip() {
+        let mut state = timestamped_state();
+        state.set_label("region", "eu-west");
+        let nested = serde_json::to_value(&state).unwrap();
+
+        let map = state_to_flat_map(&state).unwrap();
+        assert_eq!(map["config.log_level"], nested["config"]["log_level"]);
+        assert_eq!(map["labels.region"], json!("eu-west"));
+        assert_eq!(map["error_log_count"], json!(state.error_log.len()));
+        assert_eq!(map["stdout_count"], json!(1));
+        assert!(!map.contains_key("config"));
+
+        assert_eq!(state_from_flat_map(&map).unwrap(), state);
+    }
+
+    #[test]
+    fn test_flat_map_redacts_secrets() {
+        let mut state = sample_state();
+        state.config.database = Some(DatabaseConfig {
+            url: SecretString::new("postgres://app:hunter2@db/orders"),
+            pool_size: 4,
+        });
+        let map = state_to_flat_map(&state).unwrap();
+        assert_eq!(map["config.database.url"], json!("[redacted]"));
+        assert_eq!(map["config.database.pool_size"], json!(4));
+        assert!(!serde_json::to_string(&map).unwrap().contains("hunter2"));
+    }
+
+    #[test]
+    fn test_flat_map_rejects_conflicting_keys() {
+        let mut map = state_to_flat_map(&sample_state()).unwrap();
+        map.insert("config".to_string(), json!("flat"));
+        assert!(state_from_flat_map(&map).is_err());
+    }
+}
@@ -0,0 +1,83 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_metrics::{render_influx, render_prometheus, StateCollector};
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_store::StateStore;
+
+    #[test]
+    fn test_render_prometheus() {
+        let mut state = sample_state();
+        state.name = "web\"app".to_string();
+        state.pid = 4242;
+        state.event_counter = 7;
+        state.started_at = 1_000;
+        state.status = Status::Running;
+        state.stdout = vec![(1_000, "a".into()), (1_001, "b".into())];
+        state.stderr = vec![(1_002, "c".into())];
+        state.error_log.clear();
+
+        let text = render_prometheus(&state, 1_060);
+
+        assert!(text.contains("# TYPE artisan_app_event_counter counter\n"));
+        assert!(text.contains("artisan_app_pid{app=\"web\\\"app\"} 4242\n"));
+        assert!(text.contains("artisan_app_event_counter{app=\"web\\\"app\"} 7\n"));
+        assert!(text.contains("artisan_app_error_count{app=\"web\\\"app\"} 0\n"));
+        assert!(text.contains("artisan_app_stdout_lines{app=\"web\\\"app\"} 2\n"));
+        assert!(text.contains("artisan_app_stderr_lines{app=\"web\\\"app\"} 1\n"));
+        assert!(text.contains("artisan_app_uptime_seconds{app=\"web\\\"app\"} 60\n"));
+        assert!(text.contains("artisan_app_status{app=\"web\\\"app\",status=\"Running\"} 1\n"));
+    }
+
+    #[test]
+    fn test_collector_reads_current_state() {
+        let store = StateStore::new(sample_state());
+        let collector = StateCollector::new(store.clone());
+
+        store.update(|state| state.event_counter = 99);
+
+        let expected = format!(
+            "artisan_app_event_counter{{app=\"{}\"}} 99\n",
+            store.snapshot().name
+        );
+        assert!(collector.gather().contains(&expected));
+    }
+
+    #[test]
+    fn test_render_influx_line_protocol() {
+        let mut state = sample_state();
+        state.name = "web app,eu".to_string();
+        state.pid = 4242;
+        state.event_counter = 7;
+        state.status = Status::Running;
+        state.last_updated = 1_700_000_000;
+        state.config.environment = "production".to_string();
+        state.config.max_ram_usage = 512;
+        state.config.max_cpu_usage = 80;
+        state.stdout = vec![(1, "a".into()), (2, "b".into())];
+        state.error_log.clear();
+        state.stderr.clear();
+
+        let line = render_influx(&state, "artisan app");
+
+        let tag = r"(?:[^,= \\]|\\.)+";
+        let pattern = format!(
+            r"^(?:[^, \\]|\\.)+(?:,{tag}={tag})* [a-z_]+=\d+i(?:,[a-z_]+=\d+i)* \d+$",
+            tag = tag
+        );
+        assert!(
+            regex::Regex::new(&pattern).unwrap().is_match(&line),
+            "{}",
+            line
+        );
+        assert_eq!(
+            line,
+            format!(
+                "artisan\\ app,environment=production,log_level={:?},name=web\\ app\\,eu,status=Running \
+                 pid=4242i,event_counter=7i,max_ram_usage=512i,max_cpu_usage=80i,error_count=0i,\
+                 stdout_lines=2i,stderr_lines=0i 1700000000000000000",
+                state.config.log_level
+            )
+        );
+    }
+}
@@ -0,0 +1,111 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_output::{
+        filter_output_by_time_range, filter_output_since, output_overflow_summary, search_output,
+        search_output_context, OutputSummary,
+    };
+    use crate::state_persistence::{Output, OutputTarget};
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::timestamp::current_timestamp;
+    use std::time::Duration;
+
+    fn lines() -> Vec<Output> {
+        (1..=20)
+            .map(|i| {
+                let text = if i == 5 || i == 15 {
+                    format!("line {} ERROR", i)
+                } else {
+                    format!("line {}", i)
+                };
+                (i, text)
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_search_output() {
+        let found = search_output(&lines(), r"ERROR$").unwrap();
+        let timestamps: Vec<u64> = found.iter().map(|output| output.0).collect();
+        assert_eq!(timestamps, vec![5, 15]);
+    }
+
+    #[test]
+    fn test_search_output_context() {
+        let groups = search_output_context(&lines(), "ERROR", 2, 1).unwrap();
+        let timestamps: Vec<Vec<u64>> = groups
+            .iter()
+            .map(|group| group.iter().map(|output| output.0).collect())
+            .collect();
+        assert_eq!(timestamps, vec![vec![3, 4, 5, 6], vec![13, 14, 15, 16]]);
+
+        // Windows that overlap are merged instead of repeating lines.
+        let merged = search_output_context(&lines(), "ERROR", 5, 5).unwrap();
+        assert_eq!(merged.len(), 1);
+        assert_eq!(merged[0].first().unwrap().0, 1);
+        assert_eq!(merged[0].last().unwrap().0, 20);
+    }
+
+    #[test]
+    fn test_search_output_invalid_pattern() {
+        let err = search_output(&lines(), "(unclosed").unwrap_err();
+        assert_eq!(err.pattern, "(unclosed");
+        assert!(std::error::Error::source(&err).is_some());
+        assert!(search_output_context(&lines(), "[", 0, 0).is_err());
+    }
+
+    #[test]
+    fn test_filter_output_by_time_range() {
+        let outputs: Vec<Output> = (0..100)
+            .map(|i| (1_000 + i, format!("line {}", i)))
+            .collect();
+
+        let window = filter_output_by_time_range(&outputs, 1_010, 1_019);
+        assert_eq!(window.len(), 10);
+        assert_eq!(window.first().unwrap().0, 1_010);
+        assert_eq!(window.last().unwrap().0, 1_019);
+
+        assert_eq!(filter_output_by_time_range(&outputs, 1_090, 0).len(), 10);
+        assert!(filter_output_by_time_range(&outputs, 1_050, 1_040).is_empty());
+        assert!(filter_output_by_time_range(&[], 0, 0).is_empty());
+    }
+
+    #[test]
+    fn test_filter_output_since() {
+        let now = current_timestamp();
+        let outputs: Vec<Output> = vec![
+            (now - 3_600, "old".into()),
+            (now - 30, "recent".into()),
+            (now, "now".into()),
+        ];
+
+        let recent = filter_output_since(&outputs, Duration::from_secs(60));
+        let texts: Vec<&str> = recent.iter().map(|output| output.1.as_str()).collect();
+        assert_eq!(texts, vec!["recent", "now"]);
+    }
+
+    #[test]
+    fn test_output_overflow_summary() {
+        let mut state = sample_state();
+        let mut dropped = 0;
+        for i in 0..300 {
+            dropped += state.append_output(OutputTarget::Stdout, format!("line {}", i), 200);
+        }
+        assert_eq!(dropped, 100);
+        assert_eq!(state.stdout[0].1, "line 100");
+
+        let summary = output_overflow_summary(&state, OutputTarget::Stdout);
+        assert_eq!(summary.total_lines_written, 300);
+        assert_eq!(summary.total_lines_dropped, 100);
+        assert_eq!(summary.current_line_count, 200);
+        assert_eq!(summary.oldest_timestamp, state.stdout[0].0);
+        assert_eq!(
+            output_overflow_summary(&state, OutputTarget::Stderr),
+            OutputSummary::default()
+        );
+
+        // The counters survive a round trip through the state file.
+        let json = serde_json::to_string(&state).unwrap();
+        let loaded: crate::state_persistence::AppState = serde_json::from_str(&json).unwrap();
+        assert_eq!(loaded.stdout_meta, state.stdout_meta);
+    }
+}
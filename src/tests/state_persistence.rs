@@ -1,30 +1,55 @@
 #[cfg(test)]
-mod tests {
+pub(crate) mod tests {
     use crate::aggregator::Status;
     use crate::config::AppConfig;
-    use crate::state_persistence::{AppState, StatePersistence};
+    use crate::encryption::simple_encrypt;
+    use crate::key_provider::StaticKeyProvider;
+    use crate::state_persistence::{
+        aggregate_errors, filter_states_by_label, filter_states_by_tag, output_time,
+        retry_transient, AppState, EqualOptions, ErrorItem, Event, LoadOptions, OutputTarget,
+        RetryOptions, SaveOptions, Severity, StateError, StateFormat, StateHeader,
+        StatePersistence, DEFAULT_MAX_STATE_FILE_BYTES, EVENT_LOG_LIMIT, FINGERPRINT_SAMPLE_BYTES,
+    };
+    use crate::timestamp::{current_timestamp, set_clock};
+    use chrono::{TimeZone, Utc};
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
     use dusa_collection_utils::core::types::pathtype::PathType;
     use dusa_collection_utils::core::version::SoftwareVersion;
+    use serde::{Deserialize, Serialize};
+    use std::cell::Cell;
+    use std::rc::Rc;
+    use std::time::{Duration, UNIX_EPOCH};
     use tempfile::tempdir;
 
-    #[tokio::test]
-    async fn test_save_and_load_state() {
-        let config = AppConfig::dummy();
-        let state = AppState {
+    pub(crate) fn sample_state() -> AppState {
+        AppState {
             name: "test".into(),
             version: SoftwareVersion::dummy(),
             data: "data".into(),
             status: Status::Running,
             pid: 0,
             last_updated: 0,
-            stared_at: 0,
+            started_at: 0,
             event_counter: 0,
             error_log: vec![],
-            config,
+            config: AppConfig::dummy(),
             system_application: false,
             stdout: vec![],
             stderr: vec![],
-        };
+            stdout_meta: Default::default(),
+            stderr_meta: Default::default(),
+            events: vec![],
+            generation: 0,
+            labels: Default::default(),
+            tags: Vec::new(),
+            dependencies: Vec::new(),
+            extra: Default::default(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_save_and_load_state() {
+        let state = sample_state();
 
         let dir = tempdir().unwrap();
         let path: PathType = dir.path().join("state.toml").into();
@@ -35,10 +60,1434 @@ mod tests {
         assert_eq!(state, loaded);
     }
 
+    #[tokio::test]
+    async fn test_load_state_header() {
+        let mut state = sample_state();
+        state.last_updated = 1_700_000_000;
+        state.stdout = (0..1_000).map(|i| (i, format!("line {}", i))).collect();
+
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("state.toml").into();
+        StatePersistence::save_state(&state, &path).await.unwrap();
+
+        let header = StatePersistence::load_state_header(&path).await.unwrap();
+        assert_eq!(
+            header,
+            StateHeader {
+                name: state.name.clone(),
+                version: state.version.clone(),
+                status: state.status,
+                pid: state.pid,
+                last_updated: state.last_updated,
+                config: state.config.clone(),
+            }
+        );
+
+        let config = StatePersistence::load_state_config(&path).await.unwrap();
+        assert_eq!(config, state.config);
+    }
+
+    #[test]
+    fn test_record_event_caps_timeline() {
+        let mut state = sample_state();
+        for i in 0..EVENT_LOG_LIMIT + 3 {
+            state.record_event("started", format!("run {}", i));
+        }
+
+        assert_eq!(state.events.len(), EVENT_LOG_LIMIT);
+        assert_eq!(state.events[0].detail, "run 3");
+        assert_eq!(state.events.last().unwrap().kind, "started");
+        assert_eq!(state.event_counter as usize, EVENT_LOG_LIMIT + 3);
+    }
+
+    #[tokio::test]
+    async fn test_save_and_load_state_auto() {
+        let mut state = sample_state();
+        state.stdout = vec![(1, "hello".into())];
+        let dir = tempdir().unwrap();
+
+        for (file, format) in [
+            ("app.state", StateFormat::Encrypted),
+            ("app.toml", StateFormat::Toml),
+            ("app.JSON", StateFormat::Json),
+            ("app", StateFormat::Encrypted),
+        ] {
+            let path: PathType = dir.path().join(file).into();
+            assert_eq!(
+                StateFormat::from_path(path.as_ref()).unwrap_or(StateFormat::Encrypted),
+                format
+            );
+
+            StatePersistence::save_state_auto(&state, &path)
+                .await
+                .unwrap();
+            let loaded = StatePersistence::load_state_auto(&path).await.unwrap();
+            assert_eq!(loaded, state, "{}", file);
+        }
+
+        let json: PathType = dir.path().join("app.JSON").into();
+        let raw = std::fs::read_to_string(&*json).unwrap();
+        assert!(raw.trim_start().starts_with('{'));
+    }
+
+    #[tokio::test]
+    async fn test_load_state_auto_lists_supported_formats() {
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.yaml").into();
+        std::fs::write(&*path, "name: app").unwrap();
+
+        let err = StatePersistence::load_state_auto(&path).await.unwrap_err();
+        assert!(err.to_string().contains(".state, .toml, .json"));
+    }
+
+    #[tokio::test]
+    async fn test_load_gzip_compressed_state() {
+        use flate2::write::GzEncoder;
+        use flate2::Compression;
+        use std::io::Write;
+
+        let state = sample_state();
+        let dir = tempdir().unwrap();
+        let plain: PathType = dir.path().join("plain.json").into();
+        StatePersistence::save_state(&state, &plain).await.unwrap();
+
+        let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+        encoder.write_all(&std::fs::read(&*plain).unwrap()).unwrap();
+        let compressed: PathType = dir.path().join("compressed.json").into();
+        std::fs::write(&*compressed, encoder.finish().unwrap()).unwrap();
+
+        assert_eq!(StatePersistence::load_state(&plain).await.unwrap(), state);
+        assert_eq!(
+            StatePersistence::load_state(&compressed).await.unwrap(),
+            state
+        );
+    }
+
+    #[tokio::test]
+    async fn test_labels_filter_and_round_trip() {
+        let mut web = sample_state();
+        web.name = "web".into();
+        web.set_label("region", "eu-west");
+        web.set_label("owner", "ops");
+        let mut db = sample_state();
+        db.name = "db".into();
+        db.set_label("region", "us-east");
+        let plain = sample_state();
+
+        let states = vec![web.clone(), db.clone(), plain];
+        let selected: Vec<&str> = filter_states_by_label(&states, "region", "eu-west")
+            .iter()
+            .map(|state| state.name.as_str())
+            .collect();
+        assert_eq!(selected, vec!["web"]);
+
+        db.remove_label("region");
+        assert_eq!(db.label("region"), None);
+
+        let dir = tempdir().unwrap();
+        for file in ["web.state", "web.json"] {
+            let path: PathType = dir.path().join(file).into();
+            StatePersistence::save_state_auto(&web, &path)
+                .await
+                .unwrap();
+            let loaded = StatePersistence::load_state_auto(&path).await.unwrap();
+            assert_eq!(loaded.label("owner"), Some("ops"));
+            assert_eq!(loaded, web);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_tags_add_remove_and_filter() {
+        let mut web = sample_state();
+        web.name = "web".into();
+        assert!(web.add_tag("production"));
+        assert!(!web.add_tag("production"));
+        assert!(web.add_tag("critical"));
+        assert_eq!(web.tags, vec!["production", "critical"]);
+
+        let mut canary = sample_state();
+        canary.name = "canary".into();
+        canary.add_tag("canary");
+        assert!(!canary.remove_tag("production"));
+        assert!(canary.has_tag("canary"));
+
+        let states = vec![web.clone(), canary, sample_state()];
+        let selected: Vec<&str> = filter_states_by_tag(&states, "production")
+            .iter()
+            .map(|state| state.name.as_str())
+            .collect();
+        assert_eq!(selected, vec!["web"]);
+
+        assert!(web.remove_tag("critical"));
+        assert!(!web.has_tag("critical"));
+
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("web.state").into();
+        StatePersistence::save_state(&web, &path).await.unwrap();
+        assert_eq!(StatePersistence::load_state(&path).await.unwrap(), web);
+    }
+
+    #[derive(Debug, PartialEq, Serialize, Deserialize)]
+    struct Deployment {
+        commit: String,
+        replicas: u32,
+        backend: Backend,
+    }
+
+    #[derive(Debug, PartialEq, Serialize, Deserialize)]
+    struct Backend {
+        host: String,
+        ports: Vec<u16>,
+    }
+
+    #[tokio::test]
+    async fn test_typed_data_round_trip() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("typed.state"));
+
+        let deployment = Deployment {
+            commit: "a1b2c3".to_string(),
+            replicas: 3,
+            backend: Backend {
+                host: "10.0.0.2".to_string(),
+                ports: vec![8080, 8443],
+            },
+        };
+        let mut state = sample_state();
+        state.set_data(&deployment).unwrap();
+        assert!(state.data.starts_with('{'));
+
+        StatePersistence::save_state(&state, &path).await.unwrap();
+        let loaded = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(loaded.data_as::<Deployment>().unwrap(), deployment);
+
+        state.data = String::new();
+        assert!(state.data_as::<Deployment>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_error_severity_filter_and_compat() {
+        let mut state = sample_state();
+        state.append_error(
+            Severity::Warn,
+            ErrorArrayItem::new(Errors::GeneralError, "slow start"),
+        );
+        state
+            .error_log
+            .push(ErrorArrayItem::new(Errors::Git, "fetch failed").into());
+        state.append_error(
+            Severity::Fatal,
+            ErrorArrayItem::new(Errors::InputOutput, "disk full"),
+        );
+
+        let fatal: Vec<String> = state
+            .errors_at_least(Severity::Fatal)
+            .iter()
+            .map(|error| error.err_mesg.to_string())
+            .collect();
+        assert_eq!(fatal, vec!["disk full"]);
+        assert_eq!(state.errors_at_least(Severity::Error).len(), 2);
+        assert_eq!(state.errors_at_least(Severity::Warn).len(), 3);
+
+        // Plain errors encode exactly like a bare ErrorArrayItem.
+        let plain = ErrorItem::from(ErrorArrayItem::new(Errors::Git, "fetch failed"));
+        assert_eq!(
+            serde_json::to_value(&plain).unwrap(),
+            serde_json::to_value(&plain.error).unwrap()
+        );
+        let legacy: ErrorItem =
+            serde_json::from_value(serde_json::to_value(&plain.error).unwrap()).unwrap();
+        assert_eq!(legacy.severity, Severity::Error);
+
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("errors.state"));
+        StatePersistence::save_state(&state, &path).await.unwrap();
+        let loaded = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(loaded.error_log, state.error_log);
+    }
+
+    #[test]
+    fn test_reset_for_restart_keeps_identity_and_config() {
+        let mut state = sample_state();
+        state.config.max_ram_usage = 256;
+        state.set_label("region", "eu-west");
+        state.status = Status::Warning;
+        state.event_counter = 12;
+        state.started_at = 1;
+        state.stdout.push((1, "out".to_string()));
+        state.stderr.push((1, "err".to_string()));
+        state.append_error(
+            Severity::Fatal,
+            ErrorArrayItem::new(Errors::GeneralError, "crashed"),
+        );
+
+        let before = state.clone();
+        state.reset_for_restart();
+
+        assert_eq!(state.name, before.name);
+        assert_eq!(state.version, before.version);
+        assert_eq!(state.config, before.config);
+        assert_eq!(state.labels, before.labels);
+        assert!(state.error_log.is_empty());
+        assert!(state.stdout.is_empty());
+        assert!(state.stderr.is_empty());
+        assert_eq!(state.event_counter, 0);
+        assert_eq!(state.status, Status::Starting);
+        assert!(state.started_at > 1);
+    }
+
+    #[test]
+    fn test_aggregate_errors_groups_by_type_and_message() {
+        let timeout = ErrorArrayItem::new(Errors::Network, "timeout");
+        let disk = ErrorArrayItem::new(Errors::InputOutput, "disk full");
+
+        let mut states = Vec::new();
+        for (name, updated, errors) in [
+            (
+                "api",
+                300,
+                vec![timeout.clone(), timeout.clone(), disk.clone()],
+            ),
+            ("worker", 100, vec![timeout.clone()]),
+            ("cron", 200, vec![disk.clone()]),
+        ] {
+            let mut state = sample_state();
+            state.name = name.to_string();
+            state.last_updated = updated;
+            state.error_log = errors.into_iter().map(ErrorItem::from).collect();
+            states.push(state);
+        }
+
+        let aggregated = aggregate_errors(&states);
+        assert_eq!(aggregated.len(), 2);
+
+        assert_eq!(aggregated[0].err_type, Errors::Network);
+        assert_eq!(aggregated[0].err_mesg, "timeout");
+        assert_eq!(aggregated[0].count, 3);
+        assert_eq!(aggregated[0].affected_apps, vec!["api", "worker"]);
+        assert_eq!(
+            (aggregated[0].first_seen, aggregated[0].last_seen),
+            (100, 300)
+        );
+
+        assert_eq!(aggregated[1].err_mesg, "disk full");
+        assert_eq!(aggregated[1].count, 2);
+        assert_eq!(aggregated[1].affected_apps, vec!["api", "cron"]);
+        assert_eq!(
+            (aggregated[1].first_seen, aggregated[1].last_seen),
+            (200, 300)
+        );
+    }
+
+    /// Serializes the tests that change the process wide state size limit, or read states
+    /// that only fit under the default one, so they can't see each other's limit.
+    pub(crate) static STATE_LIMIT_LOCK: std::sync::Mutex<()> = std::sync::Mutex::new(());
+
+    /// Sets the state size limit until dropped, holding [`STATE_LIMIT_LOCK`] meanwhile.
+    /// The default limit is restored even if the test panics.
+    pub(crate) struct StateLimitOverride {
+        _lock: std::sync::MutexGuard<'static, ()>,
+    }
+
+    impl StateLimitOverride {
+        pub(crate) fn new(limit: u64) -> Self {
+            let lock = STATE_LIMIT_LOCK
+                .lock()
+                .unwrap_or_else(|poisoned| poisoned.into_inner());
+            StatePersistence::set_max_state_file_bytes(limit);
+            Self { _lock: lock }
+        }
+    }
+
+    impl Drop for StateLimitOverride {
+        fn drop(&mut self) {
+            StatePersistence::set_max_state_file_bytes(DEFAULT_MAX_STATE_FILE_BYTES);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_load_rejects_oversized_state_files() {
+        use flate2::write::GzEncoder;
+        use flate2::Compression;
+        use std::io::Write;
+
+        const LIMIT: u64 = 1024 * 1024;
+        let limit = StateLimitOverride::new(LIMIT);
+
+        let dir = tempdir().unwrap();
+        let huge: PathType = dir.path().join("huge.state").into();
+        std::fs::write(&*huge, vec![b'a'; LIMIT as usize + 1]).unwrap();
+
+        let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+        encoder.write_all(&vec![b'a'; 4 * LIMIT as usize]).unwrap();
+        let bomb: PathType = dir.path().join("bomb.state").into();
+        std::fs::write(&*bomb, encoder.finish().unwrap()).unwrap();
+
+        let huge_err = StatePersistence::load_state(&huge).await.unwrap_err();
+        let bomb_err = StatePersistence::load_state_header(&bomb)
+            .await
+            .unwrap_err();
+        drop(limit);
+
+        assert_eq!(
+            huge_err.downcast_ref::<StateError>(),
+            Some(&StateError::TooLarge {
+                size: LIMIT + 1,
+                limit: LIMIT
+            })
+        );
+        assert!(matches!(
+            bomb_err.downcast_ref::<StateError>(),
+            Some(StateError::TooLarge { .. })
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_save_state_with_size_limit_trims_oldest_output() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("limited.state"));
+
+        let mut state = sample_state();
+        for i in 0..40 {
+            state
+                .stdout
+                .push((i, format!("stdout line {} {}", i, "x".repeat(64))));
+            state
+                .stderr
+                .push((i, format!("stderr line {} {}", i, "y".repeat(64))));
+        }
+
+        let empty = {
+            let mut copy = state.clone();
+            copy.stdout.clear();
+            copy.stderr.clear();
+            StatePersistence::save_state(&copy, &path).await.unwrap();
+            std::fs::metadata(&path).unwrap().len()
+        };
+        let max_bytes = empty + 2_000;
+
+        let report = StatePersistence::save_state_with_size_limit(&state, &path, max_bytes)
+            .await
+            .unwrap();
+        assert!(!report.exceeded);
+        assert!(report.dropped_lines > 0 && report.dropped_lines < 80);
+        assert!(std::fs::metadata(&path).unwrap().len() <= max_bytes);
+        assert_eq!(std::fs::metadata(&path).unwrap().len(), report.size);
+        assert_eq!(state.stdout.len(), 40);
+
+        let loaded = StatePersistence::load_state(&path).await.unwrap();
+        let kept = loaded.stdout.len() + loaded.stderr.len();
+        assert_eq!(kept, 80 - report.dropped_lines);
+        // Oldest lines go first and the streams are trimmed evenly.
+        assert_eq!(loaded.stdout.last(), state.stdout.last());
+        assert_eq!(loaded.stderr.last(), state.stderr.last());
+        assert!(loaded.stdout.len().abs_diff(loaded.stderr.len()) <= 1);
+
+        let report = StatePersistence::save_state_with_size_limit(&state, &path, 10)
+            .await
+            .unwrap();
+        assert!(report.exceeded);
+        assert_eq!(report.dropped_lines, 80);
+        assert_eq!(report.size, empty);
+    }
+
+    #[tokio::test]
+    async fn test_strict_load_rejects_unknown_fields() {
+        let dir = tempdir().unwrap();
+        let mut state = sample_state();
+        state.append_error(
+            Severity::Fatal,
+            ErrorArrayItem::new(Errors::GeneralError, "crashed"),
+        );
+        let clean: serde_json::Value =
+            serde_json::from_str(&StateFormat::Json.encode(&state).unwrap()).unwrap();
+
+        let good: PathType = dir.path().join("good.json").into();
+        std::fs::write(&*good, clean.to_string()).unwrap();
+        assert_eq!(
+            StatePersistence::load_state_strict(&good).await.unwrap(),
+            state
+        );
+
+        let mut top = clean.clone();
+        top["unknown_field"] = 1.into();
+        let mut nested = clean.clone();
+        nested["config"]["unknown_field"] = 1.into();
+
+        for (name, content, field) in [
+            ("top.json", top, "unknown_field"),
+            ("nested.json", nested, "config.unknown_field"),
+        ] {
+            let path: PathType = dir.path().join(name).into();
+            std::fs::write(&*path, content.to_string()).unwrap();
+
+            let err = StatePersistence::load_state_strict(&path)
+                .await
+                .unwrap_err();
+            assert_eq!(
+                err.downcast_ref::<StateError>(),
+                Some(&StateError::UnknownFields {
+                    fields: vec![field.to_string()]
+                })
+            );
+            assert!(err.to_string().contains(field));
+
+            // Lenient loads accept the extra key, keeping it only if it is top level.
+            let mut lenient =
+                StatePersistence::load_state_with_options(&path, LoadOptions::default())
+                    .await
+                    .unwrap();
+            assert_eq!(
+                lenient.extra.contains_key("unknown_field"),
+                !field.contains('.')
+            );
+            lenient.extra.clear();
+            assert_eq!(lenient, state);
+        }
+
+        // Encrypted states are checked the same way.
+        let encrypted: PathType = dir.path().join("app.state").into();
+        StatePersistence::save_state(&state, &encrypted)
+            .await
+            .unwrap();
+        assert!(StatePersistence::load_state_strict(&encrypted)
+            .await
+            .is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_unknown_top_level_fields_survive_load_and_save() {
+        let dir = tempdir().unwrap();
+        let state = sample_state();
+        let mut newer: serde_json::Value =
+            serde_json::from_str(&StateFormat::Json.encode(&state).unwrap()).unwrap();
+        newer["restart_policy"] = serde_json::json!({ "max_restarts": 3, "backoff": "exp" });
+        newer["tier"] = "gold".into();
+        newer["retired"] = serde_json::Value::Null;
+
+        let json: PathType = dir.path().join("newer.json").into();
+        std::fs::write(&*json, newer.to_string()).unwrap();
+        let loaded = StatePersistence::load_state_auto(&json).await.unwrap();
+        assert_eq!(loaded.extra.len(), 2);
+        assert_eq!(loaded.extra["tier"], "gold");
+
+        // Written back in every format, including the encrypted TOML one.
+        for name in ["copy.json", "copy.toml", "copy.state"] {
+            let path: PathType = dir.path().join(name).into();
+            StatePersistence::save_state_auto(&loaded, &path)
+                .await
+                .unwrap();
+            let reloaded = StatePersistence::load_state_auto(&path).await.unwrap();
+            assert_eq!(reloaded, loaded, "{}", name);
+        }
+        assert_eq!(
+            StatePersistence::load_state(&dir.path().join("copy.state").into())
+                .await
+                .unwrap()
+                .extra["restart_policy"]["max_restarts"],
+            3
+        );
+    }
+
+    #[tokio::test]
+    async fn test_unknown_fields_survive_every_json_codec() {
+        let dir = tempdir().unwrap();
+        let mut state = sample_state();
+        state
+            .extra
+            .insert("tier".to_string(), serde_json::json!({ "name": "gold" }));
+
+        let marshaler = crate::state_marshal::StateMarshaler {
+            human_timestamps: true,
+        };
+        let unmarshaled = marshaler
+            .unmarshal(&marshaler.marshal(&state).unwrap())
+            .unwrap();
+        assert_eq!(unmarshaled, state);
+
+        let flat = crate::state_marshal::state_to_flat_map(&state).unwrap();
+        assert_eq!(flat["tier.name"], "gold");
+        assert_eq!(
+            crate::state_marshal::state_from_flat_map(&flat).unwrap(),
+            state
+        );
+
+        let mut bundle = crate::state_bundle::StateBundle::new();
+        bundle.set(state.clone());
+        let bundle_path: PathType = dir.path().join("bundle.json").into();
+        bundle.save(&bundle_path).await.unwrap();
+        let loaded = crate::state_bundle::StateBundle::load(&bundle_path)
+            .await
+            .unwrap();
+        assert_eq!(loaded.get(&state.name), Some(&state));
+
+        let split_base: PathType = dir.path().join("split").into();
+        let mut split = crate::state_split::SplitStateStore::new(&split_base);
+        split.save(&state).await.unwrap();
+        assert_eq!(split.load().await.unwrap(), state);
+    }
+
+    #[tokio::test]
+    async fn test_state_file_fingerprint_and_content_hash() {
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.state").into();
+        let mut state = sample_state();
+        state.stdout = (0..2000).map(|i| (i, format!("line {}", i))).collect();
+        StatePersistence::save_state(&state, &path).await.unwrap();
+
+        let first = StatePersistence::state_file_fingerprint(&path)
+            .await
+            .unwrap();
+        assert_eq!(first.len(), 64);
+        assert_eq!(
+            StatePersistence::state_file_fingerprint(&path)
+                .await
+                .unwrap(),
+            first
+        );
+
+        // Same size and mtime, but a different middle byte: only the content hash sees it.
+        let mut data = std::fs::read(&*path).unwrap();
+        assert!(data.len() > 2 * FINGERPRINT_SAMPLE_BYTES);
+        let modified = std::fs::metadata(&*path).unwrap().modified().unwrap();
+        let middle = data.len() / 2;
+        data[middle] ^= 1;
+        std::fs::write(&*path, &data).unwrap();
+        std::fs::File::options()
+            .write(true)
+            .open(&*path)
+            .unwrap()
+            .set_modified(modified)
+            .unwrap();
+        assert_eq!(
+            StatePersistence::state_file_fingerprint(&path)
+                .await
+                .unwrap(),
+            first
+        );
+
+        data.push(b'\n');
+        std::fs::write(&*path, &data).unwrap();
+        assert_ne!(
+            StatePersistence::state_file_fingerprint(&path)
+                .await
+                .unwrap(),
+            first
+        );
+
+        let hash = state.content_hash().unwrap();
+        assert_eq!(state.clone().content_hash().unwrap(), hash);
+        state.stdout[1000].1.push('!');
+        assert_ne!(state.content_hash().unwrap(), hash);
+    }
+
+    #[tokio::test]
+    async fn test_empty_state_file_is_reported_and_reinitialized() {
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.state").into();
+        std::fs::write(&*path, b"").unwrap();
+
+        let err = StatePersistence::load_state(&path).await.unwrap_err();
+        assert_eq!(err.downcast_ref::<StateError>(), Some(&StateError::Empty));
+
+        // Malformed content is a different error and isn't overwritten.
+        let garbage: PathType = dir.path().join("garbage.state").into();
+        std::fs::write(&*garbage, b"not a state").unwrap();
+        let err = StatePersistence::load_state(&garbage).await.unwrap_err();
+        assert!(err.downcast_ref::<StateError>().is_none());
+        assert!(StatePersistence::load_or_init(&garbage, sample_state)
+            .await
+            .is_err());
+
+        let state = StatePersistence::load_or_init(&path, sample_state)
+            .await
+            .unwrap();
+        assert_eq!(state, sample_state());
+        assert_eq!(StatePersistence::load_state(&path).await.unwrap(), state);
+
+        let missing: PathType = dir.path().join("missing.state").into();
+        let mut stored = sample_state();
+        stored.pid = 7;
+        StatePersistence::load_or_init(&missing, || stored.clone())
+            .await
+            .unwrap();
+        let loaded = StatePersistence::load_or_init(&missing, sample_state)
+            .await
+            .unwrap();
+        assert_eq!(loaded.pid, 7);
+    }
+
+    #[test]
+    fn test_outputs_between_binary_searches_window() {
+        let mut state = sample_state();
+        // Three lines per second from 1_000 to 1_099.
+        state.stdout = (0..300)
+            .map(|i| (1_000 + i / 3, format!("line {}", i)))
+            .collect();
+        state.stderr = vec![(1_050, "boom".to_string())];
+
+        let window = state.stdout_between(1_010, 1_019);
+        assert_eq!(window.len(), 30);
+        assert_eq!(window.first().unwrap().1, "line 30");
+        assert_eq!(window.last().unwrap().1, "line 59");
+
+        assert_eq!(state.stdout_between(1_099, 1_099).len(), 3);
+        assert_eq!(state.stdout_between(0, u64::MAX).len(), 300);
+        assert!(state.stdout_between(2_000, 3_000).is_empty());
+        assert!(state.stdout_between(1_050, 1_040).is_empty());
+
+        assert_eq!(state.stderr_between(1_000, 1_050), &state.stderr[..]);
+        assert!(state.stderr_between(1_051, 1_100).is_empty());
+    }
+
+    #[test]
+    fn test_equal_with_ignores_requested_fields() {
+        let a = sample_state();
+        let mut b = a.clone();
+        assert!(a.equal_with(&b, EqualOptions::default()));
+
+        b.last_updated = 1_700_000_000;
+        b.started_at = 1_600_000_000;
+        b.stdout.push((1_700_000_000, "hello".to_string()));
+        b.stderr.push((1_700_000_000, "oops".to_string()));
+        b.pid = 4242;
+        assert!(!a.equal_with(&b, EqualOptions::default()));
+
+        let all = EqualOptions {
+            ignore_timestamps: true,
+            ignore_logs: true,
+            ignore_pid: true,
+        };
+        assert!(a.equal_with(&b, all));
+        for partial in [
+            EqualOptions {
+                ignore_timestamps: false,
+                ..all
+            },
+            EqualOptions {
+                ignore_logs: false,
+                ..all
+            },
+            EqualOptions {
+                ignore_pid: false,
+                ..all
+            },
+        ] {
+            assert!(!a.equal_with(&b, partial), "{:?}", partial);
+        }
+
+        b.status = Status::Stopped;
+        assert!(!a.equal_with(&b, all));
+    }
+
+    #[test]
+    fn test_error_retry_backoff() {
+        let clock = Rc::new(Cell::new(1_000));
+        let source = Rc::clone(&clock);
+        let _clock = set_clock(move || UNIX_EPOCH + Duration::from_secs(source.get()));
+
+        let mut item = ErrorItem::new(
+            Severity::Error,
+            ErrorArrayItem::new(Errors::Network, "connection reset".to_string()),
+        );
+        assert!(item.should_retry(3, current_timestamp()));
+
+        let mut backoff = Duration::from_secs(10);
+        for attempt in 1..=3 {
+            item.record_retry(backoff);
+            assert_eq!(item.retry_count, attempt);
+            assert_eq!(item.next_retry_at, clock.get() + backoff.as_secs());
+            assert!(!item.should_retry(3, item.next_retry_at - 1));
+
+            clock.set(item.next_retry_at);
+            backoff *= 2;
+        }
+        assert_eq!(item.next_retry_at, 1_070);
+        assert!(!item.should_retry(3, current_timestamp()));
+        assert!(item.should_retry(4, current_timestamp()));
+
+        // Retry bookkeeping round-trips and is left out until used.
+        let encoded = serde_json::to_string(&item).unwrap();
+        assert_eq!(serde_json::from_str::<ErrorItem>(&encoded).unwrap(), item);
+        let fresh = serde_json::to_string(&ErrorItem::from(item.error.clone())).unwrap();
+        assert!(!fresh.contains("retry"), "{}", fresh);
+    }
+
+    #[test]
+    fn test_last_error_and_errors_of_type() {
+        let mut state = sample_state();
+        assert!(state.last_error().is_none());
+        assert!(state.errors_of_type(&Errors::Git).is_empty());
+
+        state.append_error(
+            Severity::Error,
+            ErrorArrayItem::new(Errors::Git, "clone failed"),
+        );
+        state.append_error(
+            Severity::Warn,
+            ErrorArrayItem::new(Errors::Network, "timeout"),
+        );
+        state.append_error(
+            Severity::Error,
+            ErrorArrayItem::new(Errors::Git, "fetch failed"),
+        );
+
+        assert_eq!(
+            state.last_error().unwrap().err_mesg.to_string(),
+            "fetch failed"
+        );
+        let git: Vec<String> = state
+            .errors_of_type(&Errors::Git)
+            .iter()
+            .map(|error| error.err_mesg.to_string())
+            .collect();
+        assert_eq!(git, vec!["clone failed", "fetch failed"]);
+    }
+
+    fn fixture(name: &str) -> PathType {
+        std::path::Path::new(env!("CARGO_MANIFEST_DIR"))
+            .join("src/tests/fixtures")
+            .join(name)
+            .into()
+    }
+
+    #[tokio::test]
+    async fn test_fixtures_survive_round_trip() {
+        for name in [
+            "current.state",
+            "current.toml",
+            "current.json",
+            "legacy.state",
+        ] {
+            if let Err(err) = StatePersistence::verify_state_file(&fixture(name)).await {
+                panic!("{} is no longer compatible: {}", name, err);
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_fixture_formats_hold_the_same_state() {
+        let encrypted = StatePersistence::load_state(&fixture("current.state"))
+            .await
+            .unwrap();
+        for name in ["current.toml", "current.json"] {
+            let loaded = StatePersistence::load_state_auto(&fixture(name))
+                .await
+                .unwrap();
+            assert_eq!(loaded, encrypted, "{}", name);
+        }
+
+        assert_eq!(encrypted.name, "billing-api");
+        assert_eq!(encrypted.pid, 4242);
+        assert_eq!(encrypted.generation, 3);
+        assert_eq!(
+            encrypted.labels.get("team").map(String::as_str),
+            Some("payments")
+        );
+        assert_eq!(encrypted.stdout.len(), 2);
+        assert_eq!(encrypted.stdout_meta.lines_dropped, 1);
+        assert_eq!(encrypted.error_log[0].severity, Severity::Warn);
+    }
+
+    #[tokio::test]
+    async fn test_legacy_fixture_fills_in_defaults() {
+        let state = StatePersistence::load_state(&fixture("legacy.state"))
+            .await
+            .unwrap();
+
+        assert_eq!(state.name, "nightly-backup");
+        assert_eq!(state.status, Status::Stopped);
+        assert_eq!(state.error_log[0].severity, Severity::Error);
+        assert_eq!(state.generation, 0);
+        assert!(state.events.is_empty());
+        assert!(state.labels.is_empty());
+    }
+
+    /// The original field set, as written before `severity`, `generation`, the events and
+    /// the other later additions existed.
+    const LEGACY_FIXTURE: &str = r#"name = "nightly-backup"
+data = ""
+status = "Stopped"
+pid = 0
+last_updated = 1704067200
+stared_at = 1704060000
+event_counter = 2
+system_application = true
+stdout = [[1704060001, "backup started"], [1704063600, "backup finished"]]
+stderr = []
+
+[version.application]
+number = "0.0.0"
+code = "Alpha"
+
+[version.library]
+number = "0.0.0"
+code = "Alpha"
+
+[[error_log]]
+err_type = "GeneralError"
+err_mesg = "disk almost full"
+
+[config]
+app_name = "nightly-backup"
+max_ram_usage = 256
+max_cpu_usage = 50
+environment = "production"
+debug_mode = false
+log_level = "Info"
+"#;
+
+    fn current_fixture() -> AppState {
+        let mut state = sample_state();
+        state.name = "billing-api".into();
+        state.data = "listening on :8080".into();
+        state.pid = 4242;
+        state.last_updated = 1_735_689_600;
+        state.started_at = 1_735_686_000;
+        state.event_counter = 8;
+        state.error_log = vec![ErrorItem::new(
+            Severity::Warn,
+            ErrorArrayItem::new(Errors::GeneralError, "health check timed out"),
+        )];
+        state.stdout = vec![
+            (1_735_689_600, "accepted connection".into()),
+            (1_735_689_600, "request served".into()),
+        ];
+        state.stderr = vec![(1_735_689_600, "slow query: 1.2s".into())];
+        state.stdout_meta.lines_written = 3;
+        state.stdout_meta.lines_dropped = 1;
+        state.stderr_meta.lines_written = 1;
+        state.events = vec![Event {
+            timestamp: 1_735_689_600,
+            kind: "started".into(),
+            detail: "pid 4242".into(),
+        }];
+        state.generation = 3;
+        state.labels.insert("region".into(), "eu-west".into());
+        state.labels.insert("team".into(), "payments".into());
+        state.tags = vec!["critical".into()];
+        state.dependencies = vec!["postgres".into()];
+        state
+    }
+
+    /// Rewrites the files in `src/tests/fixtures`. Run it with the real
+    /// `dusa_collection_utils` whenever the on-disk format changes on purpose:
+    /// `cargo test regenerate_fixtures -- --ignored`.
+    #[tokio::test]
+    #[ignore]
+    async fn regenerate_fixtures() {
+        let state = current_fixture();
+        StatePersistence::save_state(&state, &fixture("current.state"))
+            .await
+            .unwrap();
+        for name in ["current.toml", "current.json"] {
+            StatePersistence::save_state_auto(&state, &fixture(name))
+                .await
+                .unwrap();
+        }
+
+        let legacy = simple_encrypt(LEGACY_FIXTURE.as_bytes()).unwrap();
+        std::fs::write(fixture("legacy.state"), legacy.to_string()).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_verify_state_file_reports_renamed_fields() {
+        let content = std::fs::read_to_string(fixture("current.json")).unwrap();
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("drifted.json").into();
+        std::fs::write(&path, content.replace("\"tags\"", "\"tag\"")).unwrap();
+
+        let err = StatePersistence::verify_state_file(&path)
+            .await
+            .unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<StateError>(),
+            Some(&StateError::UnknownFields {
+                fields: vec!["tag".to_string()]
+            })
+        );
+    }
+
+    #[tokio::test]
+    async fn test_save_and_load_state_with_key_provider() {
+        let state = sample_state();
+        let provider = StaticKeyProvider::new([3u8; 32]);
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("keyed.state").into();
+
+        StatePersistence::save_state_encrypted(&state, &path, &provider)
+            .await
+            .unwrap();
+        let loaded = StatePersistence::load_state_encrypted(&path, &provider)
+            .await
+            .unwrap();
+        assert_eq!(loaded, state);
+
+        let rotated = StaticKeyProvider::new([4u8; 32]);
+        assert!(StatePersistence::load_state_encrypted(&path, &rotated)
+            .await
+            .is_err());
+        assert!(StatePersistence::load_state(&path).await.is_err());
+    }
+
+    #[test]
+    fn test_stream_save_state_matches_pretty_json() {
+        let mut state = sample_state();
+        state.stdout = (0..10_000)
+            .map(|i| (i, format!("line {} \"quoted\"", i).into()))
+            .collect();
+        state.stderr = vec![(1, "boom".into())];
+        state.tags = vec!["a\u{e9}".into()];
+
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("state.json").into();
+        StatePersistence::stream_save_state(&state, &path).unwrap();
+
+        let written = std::fs::read_to_string(&path).unwrap();
+        assert_eq!(written, serde_json::to_string_pretty(&state).unwrap());
+        assert_eq!(StateFormat::Json.decode(&written).unwrap(), state);
+        assert!(!dir.path().join("state.json.tmp").exists());
+    }
+
+    /// Returns the peak resident set size since the last reset, in KiB.
+    #[cfg(target_os = "linux")]
+    fn peak_rss_kib() -> u64 {
+        let status = std::fs::read_to_string("/proc/self/status").unwrap();
+        status
+            .lines()
+            .find_map(|line| line.strip_prefix("VmHWM:"))
+            .and_then(|value| value.trim().trim_end_matches("kB").trim().parse().ok())
+            .unwrap()
+    }
+
+    /// Compares the peak memory of saving a state with a million output lines as JSON in
+    /// one piece and streamed. Run it on its own, other tests skew the numbers:
+    /// `cargo test bench_stream_save_state_peak_rss -- --ignored --nocapture`.
+    #[cfg(target_os = "linux")]
+    #[test]
+    #[ignore]
+    fn bench_stream_save_state_peak_rss() {
+        let mut state = sample_state();
+        state.stdout = (0..1_000_000)
+            .map(|i| (i, format!("request {} served in {}ms", i, i % 97)))
+            .collect();
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("state.json").into();
+
+        let measure = |save: &dyn Fn()| {
+            // Writing 5 resets VmHWM to the current resident set size.
+            std::fs::write("/proc/self/clear_refs", "5").unwrap();
+            let before = peak_rss_kib();
+            save();
+            peak_rss_kib() - before
+        };
+        let buffered = measure(&|| {
+            let content = StateFormat::Json.encode(&state).unwrap();
+            std::fs::write(&path, content).unwrap();
+        });
+        let streamed = measure(&|| StatePersistence::stream_save_state(&state, &path).unwrap());
+
+        println!(
+            "peak RSS growth: buffered {} KiB, streamed {} KiB",
+            buffered, streamed
+        );
+        assert!(streamed * 10 < buffered);
+    }
+
+    #[test]
+    fn test_normalize_makes_equivalent_states_equal() {
+        let error = ErrorItem::from(ErrorArrayItem::new(Errors::GeneralError, "disk full"));
+        let mut built = sample_state();
+        built.stdout = vec![(3, "c".into()), (1, "a".into()), (3, "d".into())];
+        built.stderr = vec![(9, "late".into()), (2, "early".into())];
+        built.error_log = vec![error.clone(), error.clone(), error.clone()];
+        built.tags = vec!["canary".into(), "prod".into(), "canary".into()];
+        built.extra.insert("gone".into(), serde_json::Value::Null);
+
+        let mut expected = sample_state();
+        expected.stdout = vec![(1, "a".into()), (3, "c".into()), (3, "d".into())];
+        expected.stderr = vec![(2, "early".into()), (9, "late".into())];
+        expected.error_log = vec![error];
+        expected.tags = vec!["canary".into(), "prod".into()];
+
+        built.normalize();
+        assert_eq!(built, expected);
+        assert_eq!(
+            built.content_hash().unwrap(),
+            expected.content_hash().unwrap()
+        );
+
+        let before = built.clone();
+        built.normalize();
+        assert_eq!(built, before);
+    }
+
+    fn errors_first_seen(times: impl IntoIterator<Item = u64>) -> Vec<ErrorItem> {
+        times
+            .into_iter()
+            .map(|first_seen| ErrorItem {
+                first_seen,
+                ..ErrorArrayItem::new(Errors::GeneralError, format!("at {}", first_seen)).into()
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_prune_old_errors_keeps_recent_window() {
+        let mut state = sample_state();
+        state.last_updated = 110;
+        state.error_log = errors_first_seen(100..110);
+
+        assert_eq!(state.prune_old_errors(Duration::from_secs(5)), 5);
+        let remaining: Vec<u64> = state.error_log.iter().map(|item| item.first_seen).collect();
+        assert_eq!(remaining, vec![105, 106, 107, 108, 109]);
+        assert_eq!(state.prune_old_errors(Duration::from_secs(5)), 0);
+
+        state.error_log = errors_first_seen([0]);
+        assert_eq!(state.prune_old_errors(Duration::ZERO), 0);
+    }
+
+    #[tokio::test]
+    async fn test_save_state_pruned_writes_pruned_state() {
+        let mut state = sample_state();
+        state.last_updated = 110;
+        state.error_log = errors_first_seen(100..110);
+
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.state").into();
+        let pruned = StatePersistence::save_state_pruned(&mut state, &path, Duration::from_secs(5))
+            .await
+            .unwrap();
+        assert_eq!(pruned, 5);
+
+        let loaded = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(loaded, state);
+        assert_eq!(loaded.error_log.len(), 5);
+        assert!(!dir.path().join("app.state.tmp").exists());
+    }
+
+    #[tokio::test]
+    async fn test_error_context_round_trip() {
+        let item = ErrorItem::from(ErrorArrayItem::new(Errors::GeneralError, "timeout"))
+            .with_context("request_id", "b41c")
+            .with_context("line", "42");
+        assert_eq!(item.context("request_id"), Some("b41c"));
+        assert_eq!(item.context("line"), Some("42"));
+        assert_eq!(item.context("file"), None);
+
+        let encoded = serde_json::to_value(&item).unwrap();
+        assert_eq!(encoded["context"]["request_id"], "b41c");
+        assert_eq!(serde_json::from_value::<ErrorItem>(encoded).unwrap(), item);
+
+        let plain = ErrorItem::from(ErrorArrayItem::new(Errors::GeneralError, "timeout"));
+        let encoded = serde_json::to_value(&plain).unwrap();
+        assert!(encoded.get("context").is_none());
+        assert_eq!(serde_json::from_value::<ErrorItem>(encoded).unwrap(), plain);
+
+        let mut state = sample_state();
+        state.error_log = vec![item, plain];
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("context.state"));
+        StatePersistence::save_state(&state, &path).await.unwrap();
+        let loaded = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(loaded.error_log, state.error_log);
+    }
+
+    #[tokio::test]
+    async fn test_save_state_excluding_logs() {
+        let mut state = sample_state();
+        for line in ["ready", "serving"] {
+            state.append_output(OutputTarget::Stdout, line.into(), 10);
+        }
+        state.append_output(OutputTarget::Stderr, "slow request".into(), 10);
+
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.json").into();
+        let opts = SaveOptions {
+            exclude_logs: true,
+            ..SaveOptions::default()
+        };
+        StatePersistence::save_state_with_options(&state, &path, opts)
+            .await
+            .unwrap();
+        assert_eq!(state.stdout.len(), 2);
+
+        let content = std::fs::read_to_string(&path).unwrap();
+        assert!(content.contains("\"stdout\": []"));
+        assert!(!content.contains("serving"));
+        let loaded = StatePersistence::load_state_auto(&path).await.unwrap();
+        assert!(loaded.stdout.is_empty() && loaded.stderr.is_empty());
+        assert_eq!(loaded.stdout_meta, state.stdout_meta);
+        assert_eq!(loaded.name, state.name);
+        assert_eq!(loaded.config, state.config);
+
+        StatePersistence::save_state_with_options(&state, &path, SaveOptions::default())
+            .await
+            .unwrap();
+        let loaded = StatePersistence::load_state_auto(&path).await.unwrap();
+        assert_eq!(loaded, state);
+    }
+
+    #[tokio::test]
+    async fn test_save_state_creates_missing_parent_dirs() {
+        let dir = tempdir().unwrap();
+        let nested = dir.path().join("a").join("b").join("c");
+        let path: PathType = nested.join("app.state").into();
+        let state = sample_state();
+
+        assert!(StatePersistence::save_state(&state, &path).await.is_err());
+        StatePersistence::save_state_ensure_dir(&state, &path, 0o700)
+            .await
+            .unwrap();
+        assert_eq!(StatePersistence::load_state(&path).await.unwrap(), state);
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = std::fs::metadata(&nested).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o700);
+        }
+
+        // Existing directories are fine too.
+        StatePersistence::save_state_ensure_dir(&state, &path, 0o700)
+            .await
+            .unwrap();
+
+        let path: PathType = dir
+            .path()
+            .join("x")
+            .join("y")
+            .join("z")
+            .join("app.json")
+            .into();
+        let opts = SaveOptions {
+            ensure_parent_dir: true,
+            ..SaveOptions::default()
+        };
+        StatePersistence::save_state_with_options(&state, &path, opts)
+            .await
+            .unwrap();
+        assert_eq!(
+            StatePersistence::load_state_auto(&path).await.unwrap(),
+            state
+        );
+    }
+
+    #[test]
+    fn test_started_at_loads_from_either_key() {
+        let mut state = sample_state();
+        state.started_at = 1_700_000_000;
+        let mut value = serde_json::to_value(&state).unwrap();
+        assert_eq!(value["stared_at"], 1_700_000_000);
+
+        let old = StateFormat::Json.decode(&value.to_string()).unwrap();
+        assert_eq!(old, state);
+        let started_at = value.as_object_mut().unwrap().remove("stared_at").unwrap();
+        value["started_at"] = started_at;
+        let new = StateFormat::Json.decode(&value.to_string()).unwrap();
+        assert_eq!(new, state);
+        assert!(new.extra.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_migrate_started_at_rewrites_the_key() {
+        let mut state = sample_state();
+        state.started_at = 1_700_000_000;
+        let dir = tempdir().unwrap();
+        for name in ["app.json", "app.toml", "app.state"] {
+            let path = PathType::PathBuf(dir.path().join(name));
+            StatePersistence::save_state_auto(&state, &path)
+                .await
+                .unwrap();
+
+            assert!(StatePersistence::migrate_started_at(&path).await.unwrap());
+            assert!(!StatePersistence::migrate_started_at(&path).await.unwrap());
+            assert_eq!(
+                StatePersistence::load_state_auto(&path).await.unwrap(),
+                state
+            );
+        }
+
+        let path = dir.path().join("app.json");
+        let migrated = std::fs::read_to_string(&path).unwrap();
+        assert!(migrated.contains("\"started_at\"") && !migrated.contains("\"stared_at\""));
+
+        let mut value: serde_json::Value = serde_json::from_str(&migrated).unwrap();
+        value["stared_at"] = serde_json::json!(1);
+        std::fs::write(&path, value.to_string()).unwrap();
+        let path = PathType::PathBuf(path);
+        assert!(StatePersistence::migrate_started_at(&path).await.is_err());
+    }
+
+    #[test]
+    fn test_checkpoint_restore_rolls_back_edits() {
+        let mut state = sample_state();
+        let before = state.clone();
+
+        let checkpoint = state.checkpoint();
+        state.event_counter += 5;
+        state.set_label("stage", "migrating");
+        state.stdout.push((1, "step one".into()));
+        assert_eq!(checkpoint.snapshot(), &before);
+
+        checkpoint.restore(&mut state);
+        assert_eq!(state, before);
+    }
+
+    #[tokio::test]
+    async fn test_save_state_cas_detects_conflicts() {
+        let dir = tempdir().unwrap();
+        let path: PathType = dir.path().join("app.state").into();
+
+        let mut first = sample_state();
+        StatePersistence::save_state_cas(&mut first, &path, 0)
+            .await
+            .unwrap();
+        assert_eq!(first.generation, 1);
+
+        // A second writer that loaded before the first save still expects generation 0.
+        let mut stale = sample_state();
+        stale.data = "stale".into();
+        let err = StatePersistence::save_state_cas(&mut stale, &path, 0)
+            .await
+            .unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<StateError>(),
+            Some(&StateError::GenerationConflict {
+                expected: 0,
+                found: 1
+            })
+        );
+        assert_eq!(stale.generation, 0);
+
+        // Reload and retry succeeds.
+        let mut reloaded = StatePersistence::load_state(&path).await.unwrap();
+        reloaded.data = "fresh".into();
+        let generation = reloaded.generation;
+        StatePersistence::save_state_cas(&mut reloaded, &path, generation)
+            .await
+            .unwrap();
+
+        let stored = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(stored.generation, 2);
+        assert_eq!(stored.data, "fresh");
+
+        let err = StatePersistence::save_state_cas(&mut reloaded, &path, u64::MAX)
+            .await
+            .unwrap_err();
+        let io_err = err.downcast_ref::<std::io::Error>().unwrap();
+        assert_eq!(io_err.kind(), std::io::ErrorKind::InvalidData);
+        assert_eq!(reloaded.generation, 2);
+    }
+
     #[tokio::test]
     async fn test_load_nonexistent_file() {
         let path: PathType = "/tmp/nonexistent_state.toml".into();
         let result = StatePersistence::load_state(&path).await;
         assert!(result.is_err());
     }
+
+    #[test]
+    fn test_timestamps_are_seconds() {
+        let mut state = sample_state();
+        let time = Utc.with_ymd_and_hms(2025, 2, 7, 14, 5, 0).unwrap();
+
+        state.set_last_updated(time);
+        assert_eq!(state.last_updated, 1_738_937_100);
+        assert_eq!(state.last_updated_time(), time);
+
+        state.started_at = 1_738_937_000;
+        assert_eq!(state.started_at_time().timestamp(), 1_738_937_000);
+
+        let line = (1_738_937_100, String::from("hello"));
+        assert_eq!(output_time(&line), time);
+    }
+
+    #[tokio::test]
+    async fn test_load_state_with_timeout_on_stalled_read() {
+        // A FIFO without a writer blocks the reader forever, standing in for a hung mount.
+        let dir = tempdir().unwrap();
+        let fifo = dir.path().join("stalled.state");
+        let status = std::process::Command::new("mkfifo")
+            .arg(&fifo)
+            .status()
+            .unwrap();
+        assert!(status.success());
+
+        let path: PathType = fifo.clone().into();
+        let err = StatePersistence::load_state_with_timeout(&path, Duration::from_millis(100))
+            .await
+            .unwrap_err();
+        let io_err = err.downcast_ref::<std::io::Error>().unwrap();
+        assert_eq!(io_err.kind(), std::io::ErrorKind::TimedOut);
+
+        // Release the blocked reader so the runtime can shut down.
+        drop(std::fs::OpenOptions::new().write(true).open(&fifo).unwrap());
+    }
+
+    fn quick_retries() -> RetryOptions {
+        RetryOptions {
+            max_attempts: 3,
+            initial_delay: Duration::from_millis(1),
+            max_delay: Duration::from_millis(4),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_retry_transient_recovers() {
+        let mut calls = 0;
+        let result = retry_transient(quick_retries(), || {
+            calls += 1;
+            let attempt = calls;
+            async move {
+                if attempt < 3 {
+                    Err(std::io::Error::from(std::io::ErrorKind::WouldBlock).into())
+                } else {
+                    Ok(attempt)
+                }
+            }
+        })
+        .await;
+        assert_eq!(result.unwrap(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_retry_transient_gives_up_and_skips_fatal() {
+        let mut calls = 0;
+        let result: Result<(), _> = retry_transient(quick_retries(), || {
+            calls += 1;
+            async { Err(std::io::Error::from(std::io::ErrorKind::StorageFull).into()) }
+        })
+        .await;
+        assert!(result.is_err());
+        assert_eq!(calls, 3);
+
+        let mut calls = 0;
+        let result: Result<(), _> = retry_transient(quick_retries(), || {
+            calls += 1;
+            async { Err(std::io::Error::from(std::io::ErrorKind::PermissionDenied).into()) }
+        })
+        .await;
+        assert!(result.is_err());
+        assert_eq!(calls, 1);
+    }
+
+    #[tokio::test]
+    async fn test_retry_transient_caps_initial_delay() {
+        let opts = RetryOptions {
+            max_attempts: 3,
+            initial_delay: Duration::from_secs(3600),
+            max_delay: Duration::from_millis(1),
+        };
+        let mut calls = 0;
+        let retried = retry_transient(opts, || {
+            calls += 1;
+            async { Err::<(), _>(std::io::Error::from(std::io::ErrorKind::WouldBlock).into()) }
+        });
+        let result = tokio::time::timeout(Duration::from_secs(5), retried)
+            .await
+            .expect("slept longer than max_delay");
+        assert!(result.is_err());
+        assert_eq!(calls, 3);
+    }
 }
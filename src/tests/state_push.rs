@@ -0,0 +1,139 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_persistence::AppState;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_push::{push_state, PushError, PushOptions, StateReceiver};
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+
+    async fn receiver(token: &str) -> (StateReceiver, Arc<Mutex<Vec<AppState>>>) {
+        let received = Arc::new(Mutex::new(Vec::new()));
+        let sink = Arc::clone(&received);
+        let receiver = StateReceiver::bind("127.0.0.1:0", Some(token.to_string()), move |state| {
+            if state.name == "rejected" {
+                return Err(ErrorArrayItem::new(
+                    Errors::GeneralError,
+                    "not managed here",
+                ));
+            }
+            sink.lock().unwrap().push(state);
+            Ok(())
+        })
+        .await
+        .unwrap();
+        (receiver, received)
+    }
+
+    #[tokio::test]
+    async fn test_push_state_round_trip() {
+        let (receiver, received) = receiver("s3cret").await;
+        let url = format!("http://{}/states", receiver.local_addr());
+        let mut state = sample_state();
+        state.status = Status::Running;
+        state.stdout = vec![(1, "ready".repeat(500))];
+
+        for compress in [false, true] {
+            let opts = PushOptions {
+                timeout: Some(Duration::from_secs(5)),
+                auth_token: Some("s3cret".to_string()),
+                compress,
+            };
+            push_state(&url, &state, &opts).await.unwrap();
+        }
+
+        let received = received.lock().unwrap();
+        assert_eq!(received.len(), 2);
+        assert!(received.iter().all(|pushed| *pushed == state));
+    }
+
+    #[tokio::test]
+    async fn test_push_state_rejections() {
+        let (receiver, received) = receiver("s3cret").await;
+        let url = format!("http://{}/", receiver.local_addr());
+
+        let wrong_token = PushOptions {
+            auth_token: Some("guess".to_string()),
+            ..PushOptions::default()
+        };
+        match push_state(&url, &sample_state(), &wrong_token).await {
+            Err(PushError::Rejected { status, .. }) => assert_eq!(status, 401),
+            other => panic!("unexpected result: {:?}", other),
+        }
+
+        let opts = PushOptions {
+            auth_token: Some("s3cret".to_string()),
+            ..PushOptions::default()
+        };
+        let mut state = sample_state();
+        state.name = "rejected".to_string();
+        match push_state(&url, &state, &opts).await {
+            Err(PushError::Rejected { status, message }) => {
+                assert_eq!(status, 500);
+                assert_eq!(message, "not managed here");
+            }
+            other => panic!("unexpected result: {:?}", other),
+        }
+
+        let response = reqwest::Client::new()
+            .get(&url)
+            .bearer_auth("s3cret")
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(response.status().as_u16(), 405);
+        assert!(received.lock().unwrap().is_empty());
+    }
+
+    /// Sends `request` over a raw connection and returns the status code of the reply.
+    async fn raw_status(receiver: &StateReceiver, request: &[u8]) -> u16 {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+        let mut stream = tokio::net::TcpStream::connect(receiver.local_addr())
+            .await
+            .unwrap();
+        stream.write_all(request).await.unwrap();
+        let mut reply = Vec::new();
+        stream.read_to_end(&mut reply).await.unwrap();
+        let reply = String::from_utf8_lossy(&reply);
+        reply.split(' ').nth(1).unwrap().parse().unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_receiver_parses_headers_strictly() {
+        let (receiver, received) = receiver("s3cret").await;
+        let body = serde_json::to_string(&sample_state()).unwrap();
+        let request = |headers: &str| {
+            format!(
+                "POST / HTTP/1.1\r\nAuthorization: Bearer s3cret\r\n{}\r\n{}",
+                headers, body
+            )
+        };
+
+        let mixed_case = format!(
+            "content-type: Application/JSON\r\nContent-Encoding: IDENTITY\r\n\
+             content-length: {}\r\n",
+            body.len()
+        );
+        assert_eq!(
+            raw_status(&receiver, request(&mixed_case).as_bytes()).await,
+            204
+        );
+
+        for lengths in [
+            format!("Content-Length: {0}\r\nContent-Length: {0}\r\n", body.len()),
+            format!("Content-Length: {0}\r\ncontent-length: 1\r\n", body.len()),
+            format!("Content-Length: {0}, {0}\r\n", body.len()),
+            format!("Content-Length: +{}\r\n", body.len()),
+        ] {
+            let headers = format!("Content-Type: application/json\r\n{}", lengths);
+            assert_eq!(
+                raw_status(&receiver, request(&headers).as_bytes()).await,
+                400,
+                "{}",
+                lengths
+            );
+        }
+        assert_eq!(received.lock().unwrap().len(), 1);
+    }
+}
@@ -0,0 +1,101 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_persistence::{StateFormat, StatePersistence};
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_recovery::load_state_best_effort;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_truncated_json_keeps_fields_before_the_cut() {
+        let mut state = sample_state();
+        state.name = "billing-api".into();
+        state.pid = 4242;
+        state.stdout = (0..50).map(|i| (i, format!("line {}", i).into())).collect();
+        let encoded = StateFormat::Json.encode(&state).unwrap();
+        let cut = encoded.find("line 25").unwrap();
+
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("state.json");
+        std::fs::write(&path, &encoded[..cut]).unwrap();
+
+        let recovered = load_state_best_effort(&PathType::PathBuf(path))
+            .await
+            .unwrap();
+        assert_eq!(recovered.state.name, "billing-api");
+        assert_eq!(recovered.state.pid, 4242);
+        assert_eq!(recovered.state.version, state.version);
+        assert_eq!(recovered.state.config, state.config);
+        assert!(recovered.is_recovered("config"));
+        assert!(recovered
+            .recovered_fields
+            .windows(2)
+            .all(|pair| pair[0] < pair[1]));
+        assert!(!recovered.is_recovered("stdout"));
+        assert!(recovered.state.stdout.is_empty());
+        assert_eq!(recovered.errors.len(), 1);
+        assert_eq!(recovered.errors[0].field.as_deref(), Some("stdout"));
+    }
+
+    #[tokio::test]
+    async fn test_corrupted_toml_line_is_dropped() {
+        let mut state = sample_state();
+        state.pid = 4242;
+        state.status = Status::Stopped;
+        let encoded = StateFormat::Toml.encode(&state).unwrap();
+        let corrupted: Vec<String> = encoded
+            .lines()
+            .map(|line| match line.starts_with("pid = ") {
+                true => "pid = ???".to_string(),
+                false => line.to_string(),
+            })
+            .collect();
+
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("state.toml");
+        std::fs::write(&path, corrupted.join("\n")).unwrap();
+
+        let recovered = load_state_best_effort(&PathType::PathBuf(path))
+            .await
+            .unwrap();
+        assert_eq!(recovered.state.pid, 0);
+        assert!(!recovered.is_recovered("pid"));
+        assert_eq!(recovered.state.status, Status::Stopped);
+        assert_eq!(recovered.state.config, state.config);
+        assert_eq!(recovered.errors.len(), 1);
+        assert_eq!(recovered.errors[0].field.as_deref(), Some("pid"));
+    }
+
+    #[tokio::test]
+    async fn test_mistyped_field_keeps_placeholder() {
+        let state = sample_state();
+        let mut value = serde_json::to_value(&state).unwrap();
+        value["pid"] = serde_json::json!("not a number");
+
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("state.json");
+        std::fs::write(&path, value.to_string()).unwrap();
+
+        let recovered = load_state_best_effort(&PathType::PathBuf(path))
+            .await
+            .unwrap();
+        assert_eq!(recovered.state.name, state.name);
+        assert!(!recovered.is_recovered("pid"));
+        assert_eq!(recovered.errors.len(), 1);
+        assert_eq!(recovered.errors[0].field.as_deref(), Some("pid"));
+    }
+
+    #[tokio::test]
+    async fn test_damaged_encrypted_file_is_an_error() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("state.state"));
+        StatePersistence::save_state(&sample_state(), &path)
+            .await
+            .unwrap();
+        let content = std::fs::read_to_string(&path).unwrap();
+        std::fs::write(&path, &content[..content.len() / 2]).unwrap();
+
+        assert!(load_state_best_effort(&path).await.is_err());
+    }
+}
@@ -0,0 +1,100 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_persistence::{StateError, StatePersistence};
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_remote::{load_state_ssh, RemoteStateError, SshAuth, SshTarget};
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    /// Stands in for `ssh`: runs the remote command locally, rejects the user `denied` and
+    /// hangs for the host `slow.example`.
+    const FAKE_SSH: &str = r#"#!/bin/sh
+for arg; do last=$arg; done
+case " $* " in
+    *" -l denied "*) echo "denied@host: Permission denied (publickey)." >&2; exit 255 ;;
+    *" slow.example "*) sleep 5 ;;
+esac
+exec sh -c "$last"
+"#;
+
+    fn target(addr: &str, user: &str) -> SshTarget {
+        SshTarget {
+            addr: addr.to_string(),
+            user: user.to_string(),
+            auth: SshAuth::IdentityFile("/dev/null".into()),
+        }
+    }
+
+    // All cases share one test since `SSH_PATH` is process wide.
+    #[tokio::test]
+    async fn test_load_state_ssh() {
+        let dir = tempdir().unwrap();
+        let ssh = dir.path().join("ssh");
+        fs::write(&ssh, FAKE_SSH).unwrap();
+        fs::set_permissions(&ssh, fs::Permissions::from_mode(0o755)).unwrap();
+        std::env::set_var("SSH_PATH", &ssh);
+
+        let mut state = sample_state();
+        state.pid = 77;
+        let path = dir.path().join("it's a state");
+        StatePersistence::save_state(&state, &PathType::PathBuf(path.clone()))
+            .await
+            .unwrap();
+        let remote = path.to_str().unwrap();
+        let timeout = Duration::from_secs(2);
+
+        let loaded = load_state_ssh(&target("app01:2222", "ops"), remote, timeout)
+            .await
+            .unwrap();
+        assert_eq!(loaded, state);
+
+        let err = load_state_ssh(&target("app01", "denied"), remote, timeout)
+            .await
+            .unwrap_err();
+        assert!(
+            matches!(&err, RemoteStateError::AuthFailed { destination } if destination == "denied@app01"),
+            "{}",
+            err
+        );
+
+        let missing = dir.path().join("missing").display().to_string();
+        let err = load_state_ssh(&target("[::1]:22", "ops"), &missing, timeout)
+            .await
+            .unwrap_err();
+        assert!(matches!(err, RemoteStateError::NotFound { path } if path == missing));
+
+        // A path that exists but can't be read isn't reported as missing.
+        let err = load_state_ssh(
+            &target("app01", "ops"),
+            dir.path().to_str().unwrap(),
+            timeout,
+        )
+        .await
+        .unwrap_err();
+        assert!(matches!(err, RemoteStateError::Ssh(_)), "{}", err);
+
+        let empty = dir.path().join("empty");
+        fs::write(&empty, "").unwrap();
+        let err = load_state_ssh(&target("app01", "ops"), empty.to_str().unwrap(), timeout)
+            .await
+            .unwrap_err();
+        match err {
+            RemoteStateError::Decode(err) => {
+                assert!(matches!(err.downcast_ref(), Some(StateError::Empty)))
+            }
+            err => panic!("unexpected error: {}", err),
+        }
+
+        let err = load_state_ssh(
+            &target("slow.example", "ops"),
+            remote,
+            Duration::from_millis(200),
+        )
+        .await
+        .unwrap_err();
+        assert!(matches!(err, RemoteStateError::TimedOut(_)));
+    }
+}
@@ -0,0 +1,92 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_render::{format_bytes, parse_bytes, print_state, PrintOptions};
+
+    #[test]
+    fn test_render_fields() {
+        let mut state = sample_state();
+        state.name = "web".into();
+        state.pid = 42;
+        state.status = Status::Stopped;
+        state.config.max_ram_usage = 512;
+
+        assert_eq!(
+            state
+                .render("{{name}}|{{ pid }}|{{status}}|{{uptime}}")
+                .unwrap(),
+            "web|42|Stopped|-"
+        );
+        assert_eq!(state.render("{{max_ram}}").unwrap(), "512.0 MiB");
+        state.config.max_ram_usage = 0;
+        assert_eq!(state.render("{{max_ram}}").unwrap(), "unlimited");
+        assert_eq!(state.render("no fields").unwrap(), "no fields");
+    }
+
+    #[test]
+    fn test_render_builtin_templates() {
+        let state = sample_state();
+
+        assert!(state
+            .render_builtin("short")
+            .unwrap()
+            .starts_with("test Running"));
+        assert!(state
+            .render_builtin("full")
+            .unwrap()
+            .contains("Status: Running\n"));
+        assert!(state.render_builtin("wide").is_err());
+    }
+
+    #[test]
+    fn test_render_rejects_bad_templates() {
+        let state = sample_state();
+
+        assert!(state.render("{{nope}}").is_err());
+        assert!(state.render("{{name").is_err());
+    }
+
+    #[test]
+    fn test_format_bytes() {
+        assert_eq!(format_bytes(0), "0 B");
+        assert_eq!(format_bytes(1536), "1.5 KiB");
+        assert_eq!(format_bytes(3 * 1024 * 1024 * 1024), "3.0 GiB");
+    }
+
+    #[test]
+    fn test_parse_bytes() {
+        assert_eq!(parse_bytes("2048").unwrap(), 2048);
+        assert_eq!(parse_bytes("4GiB").unwrap(), 4 * 1024 * 1024 * 1024);
+        assert_eq!(parse_bytes("512 mb").unwrap(), 512 * 1024 * 1024);
+        assert_eq!(parse_bytes("1.5 KiB").unwrap(), 1536);
+        assert_eq!(
+            parse_bytes(&format_bytes(3 * 1024 * 1024)).unwrap(),
+            3 * 1024 * 1024
+        );
+
+        for bad in ["", "GiB", "4 XB", "1.2.3M", "-1", "16777216PiB"] {
+            assert!(parse_bytes(bad).is_err(), "{:?} parsed", bad);
+        }
+    }
+
+    #[test]
+    fn test_print_state_plain() {
+        let mut state = sample_state();
+        state.name = "web".into();
+        state.stdout = vec![(1_738_937_100, "listening".into())];
+
+        let mut buffer = Vec::new();
+        let opts = PrintOptions {
+            color: false,
+            verbose: true,
+        };
+        print_state(&mut buffer, &state, opts).unwrap();
+
+        let text = String::from_utf8(buffer).unwrap();
+        assert!(!text.contains('\u{1b}'));
+        assert!(text.contains("Name           web\n"));
+        assert!(text.contains("Status         Running\n"));
+        assert!(text.contains("2025-02-07T14:05:00Z listening\n"));
+    }
+}
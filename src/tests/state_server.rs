@@ -0,0 +1,133 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::{AppConfig, DatabaseConfig, SecretString};
+    use crate::state_persistence::{AppState, ErrorItem, Output, Severity};
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_server::StateServer;
+    use crate::state_store::StateStore;
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    use serde::de::DeserializeOwned;
+
+    fn store() -> StateStore {
+        let mut state = sample_state();
+        state.stdout = (0..100).map(|i| (i, format!("line {}", i))).collect();
+        state.stderr = vec![(7, "warning".to_string())];
+        state.append_error(
+            Severity::Warn,
+            ErrorArrayItem::new(Errors::GeneralError, "disk almost full"),
+        );
+        StateStore::new(state)
+    }
+
+    async fn get<T: DeserializeOwned>(server: &StateServer, path: &str) -> T {
+        let response = reqwest::get(format!("http://{}{}", server.local_addr(), path))
+            .await
+            .unwrap();
+        assert_eq!(response.status(), 200, "{}", path);
+        assert_eq!(
+            response.headers()["content-type"],
+            "application/json",
+            "{}",
+            path
+        );
+        serde_json::from_slice(&response.bytes().await.unwrap()).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_state_server_endpoints() {
+        let store = store();
+        let server = StateServer::bind("127.0.0.1:0", store.clone())
+            .await
+            .unwrap();
+        let expected = store.snapshot();
+
+        assert_eq!(get::<AppState>(&server, "/state").await, expected);
+        assert_eq!(
+            get::<AppConfig>(&server, "/state/config").await,
+            expected.config
+        );
+        assert_eq!(
+            get::<Vec<ErrorItem>>(&server, "/state/errors").await,
+            expected.error_log
+        );
+        assert_eq!(
+            get::<Vec<Output>>(&server, "/state/output?target=stdout&lines=50").await,
+            expected.stdout[50..]
+        );
+        assert_eq!(
+            get::<Vec<Output>>(&server, "/state/output?target=stderr&lines=500").await,
+            expected.stderr
+        );
+        assert_eq!(
+            get::<Vec<Output>>(&server, "/state/output").await,
+            expected.stdout
+        );
+
+        store.update(|state| state.pid = 4242);
+        assert_eq!(get::<AppState>(&server, "/state").await.pid, 4242);
+    }
+
+    #[tokio::test]
+    async fn test_state_server_redacts_secrets() {
+        let store = store();
+        store.update(|state| {
+            state.config.database = Some(DatabaseConfig {
+                url: SecretString::new("postgres://app:hunter2@db/orders"),
+                pool_size: 4,
+            })
+        });
+        let server = StateServer::bind("127.0.0.1:0", store).await.unwrap();
+
+        let state: serde_json::Value = get(&server, "/state").await;
+        assert_eq!(state["config"]["database"]["url"], "[redacted]");
+        assert_eq!(state["config"]["database"]["pool_size"], 4);
+        let config: serde_json::Value = get(&server, "/state/config").await;
+        assert_eq!(config["database"]["url"], "[redacted]");
+    }
+
+    #[tokio::test]
+    async fn test_state_server_rejections() {
+        let server = StateServer::bind("127.0.0.1:0", store()).await.unwrap();
+        let client = reqwest::Client::new();
+        let url = |path: &str| format!("http://{}{}", server.local_addr(), path);
+
+        for (path, status) in [
+            ("/state/unknown", 404),
+            ("/state/output?target=both", 400),
+            ("/state/output?lines=many", 400),
+        ] {
+            let response = client.get(url(path)).send().await.unwrap();
+            assert_eq!(response.status(), status, "{}", path);
+            assert_eq!(response.headers()["content-type"], "application/json");
+            let body: serde_json::Value =
+                serde_json::from_slice(&response.bytes().await.unwrap()).unwrap();
+            assert!(body["error"].is_string(), "{}", path);
+        }
+
+        let response = client.post(url("/state")).send().await.unwrap();
+        assert_eq!(response.status(), 405);
+        let response = client.get(url("/state")).body("x").send().await.unwrap();
+        assert_eq!(response.status(), 400);
+        let large = vec![b'x'; 64 * 1024];
+        let response = client.get(url("/state")).body(large).send().await.unwrap();
+        assert_eq!(response.status(), 413);
+
+        server.set_basic_auth("ops", "s3cret");
+        let response = client.get(url("/state")).send().await.unwrap();
+        assert_eq!(response.status(), 401);
+        let response = client
+            .get(url("/state"))
+            .basic_auth("ops", Some("guess"))
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(response.status(), 401);
+        let response = client
+            .get(url("/state"))
+            .basic_auth("ops", Some("s3cret"))
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(response.status(), 200);
+    }
+}
@@ -0,0 +1,93 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_persistence::OutputTarget;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_split::SplitStateStore;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::time::{Duration, SystemTime};
+    use tempfile::tempdir;
+
+    fn set_mtime_to_epoch(path: &std::path::Path) {
+        let file = std::fs::File::options().write(true).open(path).unwrap();
+        file.set_modified(SystemTime::UNIX_EPOCH).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_status_update_leaves_output_files_alone() {
+        let dir = tempdir().unwrap();
+        let base = PathType::PathBuf(dir.path().join("api"));
+        let mut store = SplitStateStore::new(&base);
+
+        let mut state = sample_state();
+        state.stdout = vec![(1, "ready".into()), (2, "serving".into())];
+        state.stderr = vec![(3, "slow request".into())];
+        store.save(&state).await.unwrap();
+
+        let stdout_path = store.output_path(OutputTarget::Stdout);
+        let stderr_path = store.output_path(OutputTarget::Stderr);
+        set_mtime_to_epoch(&stdout_path);
+        set_mtime_to_epoch(&stderr_path);
+
+        state.status = Status::Stopped;
+        store.save(&state).await.unwrap();
+        for path in [&stdout_path, &stderr_path] {
+            let modified = std::fs::metadata(path).unwrap().modified().unwrap();
+            assert_eq!(modified, SystemTime::UNIX_EPOCH);
+        }
+
+        state.stdout.push((4, "shutting down".into()));
+        store.save(&state).await.unwrap();
+        let modified = std::fs::metadata(&stdout_path).unwrap().modified().unwrap();
+        assert!(modified > SystemTime::UNIX_EPOCH + Duration::from_secs(1));
+
+        let loaded = SplitStateStore::new(&base).load().await.unwrap();
+        assert_eq!(loaded, state);
+    }
+
+    #[tokio::test]
+    async fn test_lazy_load_reads_outputs_on_demand() {
+        let dir = tempdir().unwrap();
+        let base = PathType::PathBuf(dir.path().join("worker"));
+        let mut state = sample_state();
+        state.stdout = vec![(1, "ready".into())];
+        SplitStateStore::new(&base).save(&state).await.unwrap();
+
+        let mut store = SplitStateStore::new(&base).with_lazy(true);
+        let mut loaded = store.load().await.unwrap();
+        assert!(loaded.stdout.is_empty());
+
+        // Saving before the output is loaded must not wipe it on disk.
+        loaded.status = Status::Running;
+        store.save(&loaded).await.unwrap();
+
+        let stdout = store
+            .load_outputs(&mut loaded, OutputTarget::Stdout)
+            .await
+            .unwrap();
+        assert_eq!(stdout, &state.stdout);
+    }
+
+    #[tokio::test]
+    async fn test_lazy_output_is_written_only_when_dirty() {
+        let dir = tempdir().unwrap();
+        let base = PathType::PathBuf(dir.path().join("worker"));
+        let mut state = sample_state();
+        state.stderr = vec![(1, "disk full".into())];
+        SplitStateStore::new(&base).save(&state).await.unwrap();
+
+        let mut store = SplitStateStore::new(&base).with_lazy(true);
+        let mut loaded = store.load().await.unwrap();
+        loaded.stderr = vec![(2, "unrelated".into())];
+        store.save(&loaded).await.unwrap();
+        let on_disk = SplitStateStore::new(&base).load().await.unwrap();
+        assert_eq!(on_disk.stderr, state.stderr);
+
+        // Clearing an unloaded output takes effect once it is marked dirty.
+        loaded.stderr.clear();
+        store.mark_output_dirty(OutputTarget::Stderr);
+        store.save(&loaded).await.unwrap();
+        let on_disk = SplitStateStore::new(&base).load().await.unwrap();
+        assert!(on_disk.stderr.is_empty());
+    }
+}
@@ -0,0 +1,188 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_fs::{FileStat, FileSystem, MemFileSystem};
+    use crate::state_persistence::StatePersistence;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_store::{DebouncedSaver, StateStore, MAX_PARTIAL_LINE};
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::io::{self, Write};
+    use std::path::Path;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_stdout_writer_splits_lines() {
+        let store = StateStore::new(sample_state());
+        let mut writer = store.stdout_writer();
+
+        writer.write_all(b"hel").unwrap();
+        assert!(store.snapshot().stdout.is_empty());
+
+        writer.write_all(b"lo\r\nwor").unwrap();
+        writer.write_all(b"ld\npartial").unwrap();
+        drop(writer);
+
+        let lines: Vec<String> = store.snapshot().stdout.into_iter().map(|l| l.1).collect();
+        assert_eq!(lines, vec!["hello", "world", "partial"]);
+        assert!(store.snapshot().stderr.is_empty());
+    }
+
+    #[test]
+    fn test_stdout_writer_caps_partial_line() {
+        let store = StateStore::new(sample_state());
+        let mut writer = store.stdout_writer();
+
+        let long = vec![b'a'; MAX_PARTIAL_LINE + 1];
+        writer.write_all(&long).unwrap();
+        writer.write_all(b"b\nc\nd").unwrap();
+        assert_eq!(store.snapshot().stdout.len(), 3);
+        drop(writer);
+
+        let lines: Vec<String> = store.snapshot().stdout.into_iter().map(|l| l.1).collect();
+        assert_eq!(lines[0].len(), MAX_PARTIAL_LINE + 1);
+        assert_eq!(&lines[1..], ["b", "c", "d"]);
+    }
+
+    #[test]
+    fn test_output_writer_trims_to_limit() {
+        let store = StateStore::new(sample_state()).with_output_limit(3);
+        let mut writer = store.stderr_writer();
+        for i in 0..5 {
+            writeln!(writer, "line {}", i).unwrap();
+        }
+
+        let lines: Vec<String> = store.snapshot().stderr.into_iter().map(|l| l.1).collect();
+        assert_eq!(lines, vec!["line 2", "line 3", "line 4"]);
+    }
+
+    #[test]
+    fn test_on_change_reports_changed_fields_after_unlocking() {
+        let store = StateStore::new(sample_state());
+        let seen = Arc::new(Mutex::new(Vec::new()));
+
+        let recorder = Arc::clone(&seen);
+        let inner = store.clone();
+        store.on_change(move |changes| {
+            // Reading the store from the callback must not deadlock.
+            let pid = inner.inspect(|state| state.pid);
+            let paths: Vec<String> = changes.iter().map(|change| change.path.clone()).collect();
+            recorder.lock().unwrap().push((pid, paths));
+        });
+
+        store.update(|state| {
+            state.status = Status::Stopped;
+            state.pid = 9;
+        });
+        writeln!(store.stdout_writer(), "hello").unwrap();
+        store.update(|_| {});
+
+        assert_eq!(
+            *seen.lock().unwrap(),
+            vec![
+                (9, vec!["pid".to_string(), "status".to_string()]),
+                (9, vec!["stdout".to_string(), "stdout_meta".to_string()]),
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_persistent_store_writes_through() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("app.state"));
+        let store = StateStore::persistent(sample_state(), path.clone(), Duration::ZERO);
+
+        store.update(|state| state.status = Status::Stopped);
+        store.flush().unwrap();
+        let loaded = StatePersistence::load_state(&path).await.unwrap();
+        assert_eq!(loaded.status, Status::Stopped);
+        assert!(!dir.path().join("app.state.tmp").exists());
+    }
+
+    #[tokio::test]
+    async fn test_persistent_store_debounces_writes() {
+        let fs = MemFileSystem::new();
+        let path = PathType::Str("/state/app.state".into());
+        let store = StateStore::persistent_fs(
+            Arc::new(fs.clone()),
+            sample_state(),
+            path.clone(),
+            Duration::from_secs(3600),
+        );
+
+        for pid in 1..=10 {
+            store.update(|state| state.pid = pid);
+        }
+        assert!(fs.paths().is_empty());
+
+        store.flush().unwrap();
+        let loaded = StatePersistence::load_state_fs(&fs, &path).unwrap();
+        assert_eq!(loaded.pid, 10);
+
+        let fs = MemFileSystem::new();
+        let store = StateStore::persistent_fs(
+            Arc::new(fs.clone()),
+            sample_state(),
+            path.clone(),
+            Duration::from_millis(20),
+        );
+        store.update(|state| state.pid = 42);
+        tokio::time::sleep(Duration::from_millis(500)).await;
+        let loaded = StatePersistence::load_state_fs(&fs, &path).unwrap();
+        assert_eq!(loaded.pid, 42);
+    }
+
+    /// Counts the writes reaching a [`MemFileSystem`].
+    #[derive(Default)]
+    struct CountingFileSystem {
+        inner: MemFileSystem,
+        writes: AtomicUsize,
+    }
+
+    impl FileSystem for CountingFileSystem {
+        fn read_file(&self, path: &Path) -> io::Result<Vec<u8>> {
+            self.inner.read_file(path)
+        }
+
+        fn write_file(&self, path: &Path, data: &[u8]) -> io::Result<()> {
+            self.writes.fetch_add(1, Ordering::SeqCst);
+            self.inner.write_file(path, data)
+        }
+
+        fn rename(&self, from: &Path, to: &Path) -> io::Result<()> {
+            self.inner.rename(from, to)
+        }
+
+        fn stat(&self, path: &Path) -> io::Result<FileStat> {
+            self.inner.stat(path)
+        }
+    }
+
+    #[tokio::test]
+    async fn test_debounced_saver_coalesces_writes() {
+        let fs = Arc::new(CountingFileSystem::default());
+        let path = PathType::Str("/state/app.state".into());
+        let saver = DebouncedSaver::new_fs(fs.clone(), path.clone(), Duration::from_millis(50));
+
+        let mut state = sample_state();
+        for counter in 1..=1_000 {
+            state.event_counter = counter;
+            saver.schedule(state.clone());
+        }
+        tokio::time::sleep(Duration::from_millis(300)).await;
+
+        let writes = fs.writes.load(Ordering::SeqCst);
+        assert!((1..10).contains(&writes), "{} writes", writes);
+        let loaded = StatePersistence::load_state_fs(&fs.inner, &path).unwrap();
+        assert_eq!(loaded.event_counter, 1_000);
+
+        state.pid = 7;
+        saver.schedule(state);
+        saver.close().unwrap();
+        let loaded = StatePersistence::load_state_fs(&fs.inner, &path).unwrap();
+        assert_eq!(loaded.pid, 7);
+        assert_eq!(fs.writes.load(Ordering::SeqCst), writes + 1);
+    }
+}
@@ -0,0 +1,77 @@
+#[cfg(test)]
+mod tests {
+    use crate::aggregator::Status;
+    use crate::state_fs::{FileStat, FileSystem, MemFileSystem};
+    use crate::state_persistence::StatePersistence;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_transaction::StateTransaction;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use std::io;
+    use std::path::Path;
+    use tempfile::tempdir;
+
+    /// Fails every write, like a full disk.
+    struct FullDisk(MemFileSystem);
+
+    impl FileSystem for FullDisk {
+        fn read_file(&self, path: &Path) -> io::Result<Vec<u8>> {
+            self.0.read_file(path)
+        }
+
+        fn write_file(&self, _path: &Path, _data: &[u8]) -> io::Result<()> {
+            Err(io::Error::new(
+                io::ErrorKind::Other,
+                "no space left on device",
+            ))
+        }
+
+        fn rename(&self, from: &Path, to: &Path) -> io::Result<()> {
+            self.0.rename(from, to)
+        }
+
+        fn stat(&self, path: &Path) -> io::Result<FileStat> {
+            self.0.stat(path)
+        }
+    }
+
+    #[tokio::test]
+    async fn test_commit_saves_and_applies_edits() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("app.state"));
+        let mut state = sample_state();
+
+        let mut tx = StateTransaction::begin(&mut state);
+        tx.state_mut().status = Status::Stopped;
+        tx.state_mut().event_counter += 1;
+        tx.commit(&path).await.unwrap();
+
+        assert_eq!(state.status, Status::Stopped);
+        assert_eq!(StatePersistence::load_state(&path).await.unwrap(), state);
+    }
+
+    #[test]
+    fn test_failed_commit_and_rollback_leave_everything_unchanged() {
+        let mem = MemFileSystem::new();
+        let path = PathType::Str("/state/app.state".into());
+        let mut state = sample_state();
+        StatePersistence::save_state_fs(&mem, &state, &path).unwrap();
+        let before = state.clone();
+        let on_disk = mem.read_file(Path::new("/state/app.state")).unwrap();
+
+        let mut tx = StateTransaction::begin(&mut state);
+        tx.state_mut().status = Status::Stopped;
+        assert!(tx.commit_fs(&FullDisk(mem.clone()), &path).is_err());
+        assert_eq!(state, before);
+        assert_eq!(
+            mem.read_file(Path::new("/state/app.state")).unwrap(),
+            on_disk
+        );
+
+        let mut tx = StateTransaction::begin(&mut state);
+        tx.state_mut().pid = 0;
+        tx.state_mut().stdout.clear();
+        assert_eq!(tx.state().pid, 0);
+        tx.rollback();
+        assert_eq!(state, before);
+    }
+}
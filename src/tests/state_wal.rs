@@ -0,0 +1,57 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_persistence::{encode_state, StatePersistence};
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::state_wal::WalStore;
+    use dusa_collection_utils::core::types::pathtype::PathType;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_save_clears_the_log() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("app.state"));
+        let mut store = WalStore::new(&path);
+        assert!(store.recover().await.unwrap().is_none());
+
+        let state = sample_state();
+        store.save(&state).await.unwrap();
+
+        assert_eq!(StatePersistence::load_state(&path).await.unwrap(), state);
+        assert_eq!(std::fs::metadata(store.wal_path()).unwrap().len(), 0);
+        assert!(store.recover().await.unwrap().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_recover_replays_last_complete_record() {
+        let dir = tempdir().unwrap();
+        let path = PathType::PathBuf(dir.path().join("app.state"));
+        let mut store = WalStore::new(&path);
+
+        let mut old = sample_state();
+        old.pid = 1;
+        store.save(&old).await.unwrap();
+
+        // Crash after logging two states and tearing a third, before any rename.
+        let mut log = String::new();
+        for (sequence, pid) in [(2, 2), (3, 3)] {
+            let mut state = sample_state();
+            state.pid = pid;
+            log.push_str(
+                &serde_json::json!({ "sequence": sequence, "state": encode_state(&state).unwrap() })
+                    .to_string(),
+            );
+            log.push('\n');
+        }
+        log.push_str("{\"sequence\":4,\"sta");
+        std::fs::write(store.wal_path(), log).unwrap();
+
+        let mut store = WalStore::new(&path);
+        let recovered = store.recover().await.unwrap().unwrap();
+        assert_eq!(recovered.pid, 3);
+        assert_eq!(
+            StatePersistence::load_state(&path).await.unwrap(),
+            recovered
+        );
+        assert!(!store.wal_path().exists());
+    }
+}
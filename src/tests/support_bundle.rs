@@ -0,0 +1,80 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::DatabaseConfig;
+    use crate::state_persistence::Severity;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::support_bundle::export_support_bundle;
+    use dusa_collection_utils::core::errors::{ErrorArrayItem, Errors};
+    use flate2::read::DeflateDecoder;
+    use std::collections::BTreeMap;
+    use std::io::Read;
+
+    /// Reads the entries of an archive by walking its local headers.
+    fn read_zip(data: &[u8]) -> BTreeMap<String, String> {
+        let u16_at = |at: usize| u16::from_le_bytes([data[at], data[at + 1]]) as usize;
+        let u32_at = |at: usize| u32::from_le_bytes(data[at..at + 4].try_into().unwrap());
+
+        let mut entries = BTreeMap::new();
+        let mut at = 0;
+        while u32_at(at) == 0x0403_4b50 {
+            let crc = u32_at(at + 14);
+            let compressed = u32_at(at + 18) as usize;
+            let name_len = u16_at(at + 26);
+            let start = at + 30 + name_len + u16_at(at + 28);
+            let name = String::from_utf8(data[at + 30..at + 30 + name_len].to_vec()).unwrap();
+
+            let mut content = String::new();
+            DeflateDecoder::new(&data[start..start + compressed])
+                .read_to_string(&mut content)
+                .unwrap();
+            let mut check = flate2::Crc::new();
+            check.update(content.as_bytes());
+            assert_eq!(check.sum(), crc, "crc of {}", name);
+
+            entries.insert(name, content);
+            at = start + compressed;
+        }
+        assert_eq!(u32_at(data.len() - 22), 0x0605_4b50);
+        entries
+    }
+
+    #[test]
+    fn test_export_support_bundle() {
+        let mut state = sample_state();
+        state.config.database = Some(DatabaseConfig {
+            url: "postgres://admin:hunter2@db/app".into(),
+            pool_size: 4,
+        });
+        state.stdout = vec![(0, "listening".to_string()), (60, "ready".to_string())];
+        state.stderr = vec![(0, "warning: low disk".to_string())];
+        state.append_error(
+            Severity::Fatal,
+            ErrorArrayItem::new(Errors::InputOutput, "disk full"),
+        );
+
+        let mut archive = Vec::new();
+        export_support_bundle(&mut archive, &state).unwrap();
+        let entries = read_zip(&archive);
+
+        assert_eq!(
+            entries.keys().collect::<Vec<_>>(),
+            vec!["errors.log", "state.json", "stderr.log", "stdout.log"]
+        );
+        assert_eq!(
+            entries["stdout.log"],
+            "1970-01-01T00:00:00Z listening\n1970-01-01T00:01:00Z ready\n"
+        );
+        assert_eq!(
+            entries["stderr.log"],
+            "1970-01-01T00:00:00Z warning: low disk\n"
+        );
+        assert_eq!(entries["errors.log"], "[fatal] InputOutput: disk full\n");
+
+        let json = &entries["state.json"];
+        assert!(!json.contains("hunter2"));
+        let value: serde_json::Value = serde_json::from_str(json).unwrap();
+        assert_eq!(value["name"], state.name.as_str());
+        assert_eq!(value["config"]["database"]["url"], "[redacted]");
+        assert!(value.get("stdout").is_none());
+    }
+}
@@ -0,0 +1,50 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_fs::{FileSystem, MemFileSystem};
+    use crate::state_persistence::OutputTarget;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::timestamp::{current_timestamp, freeze_clock, now, set_clock};
+    use std::cell::Cell;
+    use std::path::Path;
+    use std::rc::Rc;
+    use std::time::{Duration, UNIX_EPOCH};
+
+    #[test]
+    fn test_frozen_clock_stamps_state() {
+        let frozen = UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        let _clock = freeze_clock(frozen);
+
+        let mut state = sample_state();
+        state.reset_for_restart();
+        state.append_output(OutputTarget::Stdout, "ready".to_string(), 10);
+        state.record_event("started", "");
+
+        assert_eq!(state.started_at, 1_700_000_000);
+        assert_eq!(state.last_updated, 1_700_000_000);
+        assert_eq!(state.stdout, vec![(1_700_000_000, "ready".to_string())]);
+        assert_eq!(state.events.last().unwrap().timestamp, 1_700_000_000);
+
+        let fs = MemFileSystem::new();
+        fs.write_file(Path::new("/state.json"), b"{}").unwrap();
+        assert_eq!(fs.stat(Path::new("/state.json")).unwrap().modified, frozen);
+    }
+
+    #[test]
+    fn test_clock_guards_restore_previous_clock() {
+        let ticks = Rc::new(Cell::new(100));
+        let source = Rc::clone(&ticks);
+        let outer = set_clock(move || UNIX_EPOCH + Duration::from_secs(source.get()));
+        assert_eq!(current_timestamp(), 100);
+        ticks.set(160);
+        assert_eq!(current_timestamp(), 160);
+
+        {
+            let _inner = freeze_clock(UNIX_EPOCH);
+            assert_eq!(current_timestamp(), 0);
+        }
+        assert_eq!(current_timestamp(), 160);
+
+        drop(outer);
+        assert!(now() > UNIX_EPOCH + Duration::from_secs(1_700_000_000));
+    }
+}
@@ -0,0 +1,98 @@
+#[cfg(test)]
+mod tests {
+    use crate::state_persistence::AppState;
+    use crate::state_persistence_test::tests::sample_state;
+    use crate::version::{filter_states_by_min_version, parse_version, SemVer};
+    use dusa_collection_utils::core::types::stringy::Stringy;
+    use std::cmp::Ordering;
+
+    fn state_at(name: &str, version: &str) -> AppState {
+        let mut state = sample_state();
+        state.name = name.into();
+        state.version.application.number = Stringy::from(version);
+        state
+    }
+
+    #[test]
+    fn test_parse_version_with_prerelease_and_build() {
+        assert_eq!(
+            parse_version("v1.4.0-rc.1+build.7").unwrap(),
+            SemVer {
+                major: 1,
+                minor: 4,
+                patch: 0,
+                prerelease: Some("rc.1".into()),
+            }
+        );
+        assert_eq!(parse_version("2.0.10").unwrap().to_string(), "2.0.10");
+        for invalid in [
+            "1.2",
+            "1.2.3.4",
+            "1.02.3",
+            "1.2.x",
+            "1.2.3-",
+            "1.2.3-rc..1",
+            "1.0.0-rc.01",
+            "1.0.0-00",
+            "1.+2.3",
+            "+1.0.0",
+            "1..3",
+            "",
+        ] {
+            assert!(parse_version(invalid).is_err(), "{}", invalid);
+        }
+    }
+
+    #[test]
+    fn test_ordering_follows_semver_precedence() {
+        // The example list of semver.org, section 11, in ascending order.
+        let ordered = [
+            "1.0.0-alpha",
+            "1.0.0-alpha.1",
+            "1.0.0-alpha.beta",
+            "1.0.0-beta",
+            "1.0.0-beta.2",
+            "1.0.0-beta.11",
+            "1.0.0-rc.1",
+            "1.0.0",
+            "1.0.1",
+            "1.1.0",
+            "2.0.0",
+        ];
+        let versions: Vec<SemVer> = ordered.iter().map(|v| parse_version(v).unwrap()).collect();
+        for pair in versions.windows(2) {
+            assert_eq!(
+                pair[0].compare(&pair[1]),
+                Ordering::Less,
+                "{} < {}",
+                pair[0],
+                pair[1]
+            );
+        }
+        let with_build = parse_version("1.0.0+build.1").unwrap();
+        assert_eq!(with_build.compare(&versions[7]), Ordering::Equal);
+
+        assert!(versions[0].is_compatible(&versions[9]));
+        assert!(!versions[9].is_compatible(&versions[10]));
+    }
+
+    #[test]
+    fn test_filter_states_by_min_version() {
+        let states = [
+            state_at("old", "1.1.9"),
+            state_at("rc", "1.2.0-rc.1"),
+            state_at("release", "1.2.0"),
+            state_at("next", "2.0.0"),
+        ];
+        let refs: Vec<&AppState> = states.iter().collect();
+
+        let kept = filter_states_by_min_version(&refs, "1.2.0").unwrap();
+        let names: Vec<&str> = kept.iter().map(|state| state.name.as_str()).collect();
+        assert_eq!(names, ["release", "next"]);
+
+        assert!(filter_states_by_min_version(&refs, "latest").is_err());
+        let broken = state_at("broken", "unknown");
+        let err = filter_states_by_min_version(&[&broken], "1.0.0").unwrap_err();
+        assert_eq!(err.version, "unknown");
+    }
+}
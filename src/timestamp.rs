@@ -1,12 +1,65 @@
+use chrono::{DateTime, NaiveDateTime, TimeZone, Utc};
 use chrono::{Datelike, Local, NaiveDate};
-use chrono::{NaiveDateTime, TimeZone, Utc};
 use dusa_collection_utils::{core::logger::LogLevel, core::types::stringy::Stringy, log};
+use std::cell::RefCell;
+use std::rc::Rc;
 use std::time::{Duration, SystemTime, UNIX_EPOCH};
 
+type Clock = Rc<dyn Fn() -> SystemTime>;
+
+thread_local! {
+    static CLOCK: RefCell<Option<Clock>> = RefCell::new(None);
+}
+
+/// Returns the current time. Every timestamp the crate takes, from [`current_timestamp`]
+/// to output lines, events and `AppState::last_updated`, goes through here, which makes it
+/// the override point for tests: see [`set_clock`].
+pub fn now() -> SystemTime {
+    CLOCK
+        .with(|clock| clock.borrow().clone())
+        .map_or_else(SystemTime::now, |clock| clock())
+}
+
+/// Replaces the clock behind [`now`] with `clock` until the returned guard is dropped,
+/// which restores the previous one.
+///
+/// The override only applies to the calling thread, so tests running in parallel keep
+/// their own clocks. Work moved to other threads, such as tasks on a multi-threaded tokio
+/// runtime, still sees the system clock; `#[tokio::test]` runs on the current thread.
+///
+/// # Example
+/// ```rust
+/// # use artisan_middleware::timestamp::{current_timestamp, set_clock};
+/// # use std::time::{Duration, UNIX_EPOCH};
+/// let _clock = set_clock(|| UNIX_EPOCH + Duration::from_secs(1_700_000_000));
+/// assert_eq!(current_timestamp(), 1_700_000_000);
+/// ```
+pub fn set_clock<F: Fn() -> SystemTime + 'static>(clock: F) -> ClockGuard {
+    let previous = CLOCK.with(|current| current.borrow_mut().replace(Rc::new(clock)));
+    ClockGuard { previous }
+}
+
+/// Freezes [`now`] at `time`, see [`set_clock`].
+pub fn freeze_clock(time: SystemTime) -> ClockGuard {
+    set_clock(move || time)
+}
+
+/// Restores the previous clock when dropped, returned by [`set_clock`].
+#[must_use = "the clock is restored as soon as the guard is dropped"]
+pub struct ClockGuard {
+    previous: Option<Clock>,
+}
+
+impl Drop for ClockGuard {
+    fn drop(&mut self) {
+        let previous = self.previous.take();
+        CLOCK.with(|clock| *clock.borrow_mut() = previous);
+    }
+}
+
 /// Retrieves the current Unix timestamp in seconds.
 pub fn current_timestamp() -> u64 {
-    use std::time::{SystemTime, UNIX_EPOCH};
-    let start = SystemTime::now();
+    let start = now();
     let since_the_epoch = start
         .duration_since(UNIX_EPOCH)
         .expect("Time went backwards");
@@ -17,7 +70,7 @@ pub fn current_timestamp() -> u64 {
 pub fn timesince_unix_timestamp(timestamp: u64) -> Stringy {
     let duration: Duration = Duration::from_secs(timestamp);
     let datetime: SystemTime = UNIX_EPOCH + duration;
-    let now: SystemTime = SystemTime::now();
+    let now: SystemTime = now();
 
     let data = if let Ok(elapsed) = now.duration_since(datetime) {
         let seconds = elapsed.as_secs();
@@ -58,6 +111,22 @@ pub fn format_unix_timestamp(timestamp: u64) -> String {
     }
 }
 
+/// Converts a `u64` Unix timestamp (seconds since epoch) into a UTC [`DateTime`].
+///
+/// Values that cannot be represented by `chrono` collapse to the Unix epoch.
+pub fn unix_timestamp_to_datetime(timestamp: u64) -> DateTime<Utc> {
+    Utc.timestamp_opt(timestamp as i64, 0)
+        .single()
+        .unwrap_or_default()
+}
+
+/// Converts a UTC [`DateTime`] into a `u64` Unix timestamp (seconds since epoch).
+///
+/// Anything before the epoch is clamped to `0`, sub-second precision is dropped.
+pub fn datetime_to_unix_timestamp(datetime: DateTime<Utc>) -> u64 {
+    datetime.timestamp().max(0) as u64
+}
+
 pub fn time_to_unix_timestamp(datetime: &str) -> Option<u64> {
     match NaiveDateTime::parse_from_str(datetime, "%Y-%m-%d %H:%M:%S") {
         Ok(naive_dt) => Some(Utc.from_utc_datetime(&naive_dt).timestamp() as u64),
@@ -73,7 +142,7 @@ pub fn time_to_unix_timestamp(datetime: &str) -> Option<u64> {
 }
 
 pub fn days_in_current_month() -> f64 {
-    let today = Local::now().date_naive();
+    let today = DateTime::<Local>::from(now()).date_naive();
     let (year, month) = (today.year(), today.month());
 
     // Move to the first day of the next month
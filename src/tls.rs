@@ -0,0 +1,220 @@
+//! # TLS
+//!
+//! Turns a [`TlsConfig`] into ready to use [`rustls`] client and server configurations.
+//!
+//! Certificates, keys and CA bundles are read from the PEM files named in the config. A
+//! server needs `cert_file` and `key_file`; setting `ca_file` additionally requires clients
+//! to present a certificate signed by one of its CAs. A client verifies the server against
+//! `ca_file` and presents `cert_file` and `key_file` when both are set.
+
+use std::io;
+use std::path::Path;
+use std::sync::Arc;
+
+use rustls::client::danger::{HandshakeSignatureValid, ServerCertVerified, ServerCertVerifier};
+use rustls::crypto::{self, CryptoProvider};
+use rustls::pki_types::pem::{self, PemObject};
+use rustls::pki_types::{CertificateDer, PrivateKeyDer, ServerName, UnixTime};
+use rustls::server::WebPkiClientVerifier;
+use rustls::{ClientConfig, DigitallySignedStruct, RootCertStore, ServerConfig, SignatureScheme};
+
+use crate::config::TlsConfig;
+
+/// Checks that every file named in `cfg` exists and holds what it should: at least one
+/// certificate in `cert_file` and `ca_file`, and a private key in `key_file`. `cert_file`
+/// and `key_file` must be set together.
+///
+/// # Errors
+/// Returns an `Err` of kind [`io::ErrorKind::NotFound`] if a file is missing,
+/// [`io::ErrorKind::InvalidData`] if it can't be parsed and
+/// [`io::ErrorKind::InvalidInput`] if only one of `cert_file` and `key_file` is set.
+pub fn validate_tls_config(cfg: &TlsConfig) -> io::Result<()> {
+    identity(cfg)?;
+    if let Some(ca_file) = &cfg.ca_file {
+        root_store(ca_file)?;
+    }
+    Ok(())
+}
+
+/// Builds a server configuration presenting `cert_file` and `key_file`. When `ca_file` is
+/// set, clients must authenticate with a certificate issued by one of its CAs.
+///
+/// # Errors
+/// Returns the errors of [`validate_tls_config`], an `Err` of kind
+/// [`io::ErrorKind::InvalidInput`] if no certificate is configured and one of kind
+/// [`io::ErrorKind::InvalidData`] if the key doesn't match the certificate.
+pub fn build_server_config(cfg: &TlsConfig) -> io::Result<Arc<ServerConfig>> {
+    let (certs, key) = identity(cfg)?.ok_or_else(|| {
+        io::Error::new(
+            io::ErrorKind::InvalidInput,
+            "tls.cert_file and tls.key_file are required for a server",
+        )
+    })?;
+
+    let provider = Arc::new(crypto::ring::default_provider());
+    let builder = ServerConfig::builder_with_provider(Arc::clone(&provider))
+        .with_safe_default_protocol_versions()
+        .map_err(invalid_data)?;
+    let builder = match &cfg.ca_file {
+        Some(ca_file) => {
+            let verifier = WebPkiClientVerifier::builder_with_provider(
+                Arc::new(root_store(ca_file)?),
+                provider,
+            )
+            .build()
+            .map_err(invalid_data)?;
+            builder.with_client_cert_verifier(verifier)
+        }
+        None => builder.with_no_client_auth(),
+    };
+
+    Ok(Arc::new(
+        builder.with_single_cert(certs, key).map_err(invalid_data)?,
+    ))
+}
+
+/// Builds a client configuration trusting the CAs in `ca_file`, or any server at all when
+/// `insecure_skip_verify` is set. `cert_file` and `key_file`, if set, are presented for
+/// client authentication.
+///
+/// # Errors
+/// Returns the errors of [`validate_tls_config`] and an `Err` of kind
+/// [`io::ErrorKind::InvalidInput`] if neither `ca_file` nor `insecure_skip_verify` is set,
+/// since there would be nothing to verify the server against.
+pub fn build_client_config(cfg: &TlsConfig) -> io::Result<Arc<ClientConfig>> {
+    let identity = identity(cfg)?;
+
+    let provider = Arc::new(crypto::ring::default_provider());
+    let builder = ClientConfig::builder_with_provider(Arc::clone(&provider))
+        .with_safe_default_protocol_versions()
+        .map_err(invalid_data)?;
+    let builder = if cfg.insecure_skip_verify {
+        builder
+            .dangerous()
+            .with_custom_certificate_verifier(Arc::new(SkipServerVerification(provider)))
+    } else {
+        let ca_file = cfg.ca_file.as_ref().ok_or_else(|| {
+            io::Error::new(
+                io::ErrorKind::InvalidInput,
+                "tls.ca_file is required unless tls.insecure_skip_verify is set",
+            )
+        })?;
+        builder.with_root_certificates(root_store(ca_file)?)
+    };
+
+    Ok(Arc::new(match identity {
+        Some((certs, key)) => builder
+            .with_client_auth_cert(certs, key)
+            .map_err(invalid_data)?,
+        None => builder.with_no_client_auth(),
+    }))
+}
+
+type Identity = (Vec<CertificateDer<'static>>, PrivateKeyDer<'static>);
+
+/// Loads the certificate chain and key, `None` if neither is configured.
+fn identity(cfg: &TlsConfig) -> io::Result<Option<Identity>> {
+    match (&cfg.cert_file, &cfg.key_file) {
+        (Some(cert_file), Some(key_file)) => {
+            let certs = load_certs(cert_file)?;
+            let key =
+                PrivateKeyDer::from_pem_file(key_file).map_err(|err| pem_error(key_file, err))?;
+            Ok(Some((certs, key)))
+        }
+        (None, None) => Ok(None),
+        _ => Err(io::Error::new(
+            io::ErrorKind::InvalidInput,
+            "tls.cert_file and tls.key_file must be set together",
+        )),
+    }
+}
+
+fn root_store(ca_file: &str) -> io::Result<RootCertStore> {
+    let mut roots = RootCertStore::empty();
+    for cert in load_certs(ca_file)? {
+        roots.add(cert).map_err(|err| {
+            io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("{}: invalid CA certificate: {}", ca_file, err),
+            )
+        })?;
+    }
+    Ok(roots)
+}
+
+fn load_certs(path: &str) -> io::Result<Vec<CertificateDer<'static>>> {
+    let certs = CertificateDer::pem_file_iter(path)
+        .and_then(|certs| certs.collect::<Result<Vec<_>, _>>())
+        .map_err(|err| pem_error(path, err))?;
+    if certs.is_empty() {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidData,
+            format!("{}: no certificates found", path),
+        ));
+    }
+    Ok(certs)
+}
+
+/// Keeps the kind of I/O errors, so a missing file stays [`io::ErrorKind::NotFound`], and
+/// reports everything else as invalid data. Both name the offending file.
+fn pem_error(path: &str, err: pem::Error) -> io::Error {
+    let kind = match &err {
+        pem::Error::Io(err) => err.kind(),
+        _ => io::ErrorKind::InvalidData,
+    };
+    io::Error::new(kind, format!("{}: {}", Path::new(path).display(), err))
+}
+
+fn invalid_data<E: std::error::Error + Send + Sync + 'static>(err: E) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, err)
+}
+
+/// Accepts every server certificate while still checking handshake signatures, backing
+/// [`TlsConfig::insecure_skip_verify`].
+#[derive(Debug)]
+struct SkipServerVerification(Arc<CryptoProvider>);
+
+impl ServerCertVerifier for SkipServerVerification {
+    fn verify_server_cert(
+        &self,
+        _end_entity: &CertificateDer<'_>,
+        _intermediates: &[CertificateDer<'_>],
+        _server_name: &ServerName<'_>,
+        _ocsp_response: &[u8],
+        _now: UnixTime,
+    ) -> Result<ServerCertVerified, rustls::Error> {
+        Ok(ServerCertVerified::assertion())
+    }
+
+    fn verify_tls12_signature(
+        &self,
+        message: &[u8],
+        cert: &CertificateDer<'_>,
+        dss: &DigitallySignedStruct,
+    ) -> Result<HandshakeSignatureValid, rustls::Error> {
+        crypto::verify_tls12_signature(
+            message,
+            cert,
+            dss,
+            &self.0.signature_verification_algorithms,
+        )
+    }
+
+    fn verify_tls13_signature(
+        &self,
+        message: &[u8],
+        cert: &CertificateDer<'_>,
+        dss: &DigitallySignedStruct,
+    ) -> Result<HandshakeSignatureValid, rustls::Error> {
+        crypto::verify_tls13_signature(
+            message,
+            cert,
+            dss,
+            &self.0.signature_verification_algorithms,
+        )
+    }
+
+    fn supported_verify_schemes(&self) -> Vec<SignatureScheme> {
+        self.0.signature_verification_algorithms.supported_schemes()
+    }
+}
@@ -3,6 +3,11 @@ use dusa_collection_utils::{
     core::version::{Version, VersionCode},
 };
 
+use std::cmp::Ordering;
+use std::fmt;
+use std::str::FromStr;
+
+use crate::state_persistence::AppState;
 use crate::RELEASEINFO;
 
 pub fn aml_version() -> Version {
@@ -36,3 +41,201 @@ pub fn str_to_version(cargo_pkg_version: &str, release_code: Option<VersionCode>
         code,
     }
 }
+
+/// A semantic version as in [semver.org](https://semver.org), e.g. `1.4.0-rc.1`.
+///
+/// Ordered by semver precedence: a prerelease sorts before its release, and
+/// prerelease identifiers compare numerically when both are numbers. Build metadata
+/// (`+...`) is accepted by [`parse_version`] but dropped, as it carries no precedence.
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub struct SemVer {
+    pub major: u32,
+    pub minor: u32,
+    pub patch: u32,
+    /// The prerelease part after `-`, without the dash, if any.
+    pub prerelease: Option<String>,
+}
+
+impl SemVer {
+    /// Compares by semver precedence, same as [`Ord::cmp`].
+    pub fn compare(&self, other: &SemVer) -> Ordering {
+        self.cmp(other)
+    }
+
+    /// Returns `true` if both versions have the same major version.
+    pub fn is_compatible(&self, other: &SemVer) -> bool {
+        self.major == other.major
+    }
+}
+
+impl Ord for SemVer {
+    fn cmp(&self, other: &Self) -> Ordering {
+        (self.major, self.minor, self.patch)
+            .cmp(&(other.major, other.minor, other.patch))
+            .then_with(|| match (&self.prerelease, &other.prerelease) {
+                (None, None) => Ordering::Equal,
+                (None, Some(_)) => Ordering::Greater,
+                (Some(_), None) => Ordering::Less,
+                (Some(a), Some(b)) => compare_prerelease(a, b),
+            })
+    }
+}
+
+impl PartialOrd for SemVer {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl fmt::Display for SemVer {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{}.{}.{}", self.major, self.minor, self.patch)?;
+        if let Some(prerelease) = &self.prerelease {
+            write!(f, "-{}", prerelease)?;
+        }
+        Ok(())
+    }
+}
+
+impl FromStr for SemVer {
+    type Err = VersionError;
+
+    fn from_str(version: &str) -> Result<Self, Self::Err> {
+        parse_version(version)
+    }
+}
+
+/// Returned by [`parse_version`] and [`filter_states_by_min_version`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VersionError {
+    /// The string that failed to parse.
+    pub version: String,
+    /// What is wrong with it.
+    pub reason: String,
+}
+
+impl fmt::Display for VersionError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "invalid version {:?}: {}", self.version, self.reason)
+    }
+}
+
+impl std::error::Error for VersionError {}
+
+/// Parses `MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]`, with an optional leading `v`.
+///
+/// # Errors
+/// Returns a [`VersionError`] if a component is missing, isn't a number or has a leading
+/// zero, or if the prerelease has an empty identifier.
+///
+/// # Example
+/// ```rust
+/// # use artisan_middleware::version::parse_version;
+/// let rc = parse_version("1.4.0-rc.1").unwrap();
+/// assert!(rc < parse_version("1.4.0").unwrap());
+/// assert!(rc.is_compatible(&parse_version("1.0.2").unwrap()));
+/// ```
+pub fn parse_version(version: &str) -> Result<SemVer, VersionError> {
+    let error = |reason: &str| VersionError {
+        version: version.to_string(),
+        reason: reason.to_string(),
+    };
+
+    let trimmed = version.trim();
+    let trimmed = trimmed.strip_prefix('v').unwrap_or(trimmed);
+    let without_build = match trimmed.split_once('+') {
+        Some((_, build)) if build.is_empty() => return Err(error("empty build metadata")),
+        Some((rest, _)) => rest,
+        None => trimmed,
+    };
+    let (core, prerelease) = match without_build.split_once('-') {
+        Some((core, prerelease)) => (core, Some(prerelease)),
+        None => (without_build, None),
+    };
+
+    let mut numbers = [0u32; 3];
+    let mut parts = core.split('.');
+    for (number, name) in numbers.iter_mut().zip(["major", "minor", "patch"]) {
+        let part = parts
+            .next()
+            .ok_or_else(|| error(&format!("missing {} version", name)))?;
+        let not_a_number = || error(&format!("{} version {:?} is not a number", name, part));
+        // `u32::from_str` accepts a leading `+`, semver only digits.
+        if part.is_empty() || !part.bytes().all(|byte| byte.is_ascii_digit()) {
+            return Err(not_a_number());
+        }
+        if part.len() > 1 && part.starts_with('0') {
+            return Err(error(&format!("{} version has a leading zero", name)));
+        }
+        *number = part.parse().map_err(|_| not_a_number())?;
+    }
+    if parts.next().is_some() {
+        return Err(error("more than three version numbers"));
+    }
+
+    if let Some(prerelease) = prerelease {
+        let valid =
+            |id: &str| !id.is_empty() && id.chars().all(|c| c.is_ascii_alphanumeric() || c == '-');
+        // Numeric identifiers follow the rule of the version numbers: no leading zeros.
+        let leading_zero = |id: &str| {
+            id.len() > 1 && id.starts_with('0') && id.chars().all(|c| c.is_ascii_digit())
+        };
+        if !prerelease.split('.').all(valid) {
+            return Err(error("invalid prerelease identifier"));
+        }
+        if prerelease.split('.').any(leading_zero) {
+            return Err(error("numeric prerelease identifier has a leading zero"));
+        }
+    }
+
+    Ok(SemVer {
+        major: numbers[0],
+        minor: numbers[1],
+        patch: numbers[2],
+        prerelease: prerelease.map(str::to_string),
+    })
+}
+
+/// Keeps the states whose application version is at least `min_version`, in their
+/// original order.
+///
+/// # Errors
+/// Returns a [`VersionError`] if `min_version` or the version of any state doesn't
+/// parse, rather than guessing on which side of the minimum it falls.
+pub fn filter_states_by_min_version<'a>(
+    states: &[&'a AppState],
+    min_version: &str,
+) -> Result<Vec<&'a AppState>, VersionError> {
+    let min_version = parse_version(min_version)?;
+    let mut kept = Vec::new();
+    for state in states {
+        if parse_version(&state.version.application.number)? >= min_version {
+            kept.push(*state);
+        }
+    }
+    Ok(kept)
+}
+
+/// Compares dot separated prerelease identifiers by semver rules: numeric identifiers
+/// numerically and below alphanumeric ones, and a shorter list first if all else is equal.
+fn compare_prerelease(a: &str, b: &str) -> Ordering {
+    let mut a_ids = a.split('.');
+    let mut b_ids = b.split('.');
+    loop {
+        let (a_id, b_id) = match (a_ids.next(), b_ids.next()) {
+            (None, None) => return Ordering::Equal,
+            (None, Some(_)) => return Ordering::Less,
+            (Some(_), None) => return Ordering::Greater,
+            (Some(a_id), Some(b_id)) => (a_id, b_id),
+        };
+        let ordering = match (a_id.parse::<u64>(), b_id.parse::<u64>()) {
+            (Ok(a_num), Ok(b_num)) => a_num.cmp(&b_num),
+            (Ok(_), Err(_)) => Ordering::Less,
+            (Err(_), Ok(_)) => Ordering::Greater,
+            (Err(_), Err(_)) => a_id.cmp(b_id),
+        };
+        if ordering != Ordering::Equal {
+            return ordering;
+        }
+    }
+}
@@ -0,0 +1,233 @@
+//! # Zip
+//!
+//! The minimal zip support shared by the [support bundle](crate::support_bundle) and the
+//! [state archive](crate::state_archive): a streaming writer and a reader for archives that
+//! fit in memory.
+
+use chrono::{Datelike, Timelike};
+use flate2::read::DeflateDecoder;
+use flate2::write::DeflateEncoder;
+use flate2::{Compression, Crc};
+use std::io::{self, Read, Write};
+
+use crate::timestamp::unix_timestamp_to_datetime;
+
+/// A zip entry that has been written, remembered for the central directory.
+struct ZipEntry {
+    name: String,
+    crc: u32,
+    compressed_size: u32,
+    size: u32,
+    offset: u32,
+}
+
+/// Minimal streaming zip writer: deflated entries, no zip64, so each entry and the whole
+/// archive must stay below 4 GiB, far beyond any support bundle or state archive.
+pub(crate) struct ZipWriter<W: Write> {
+    inner: W,
+    written: u32,
+    entries: Vec<ZipEntry>,
+    dos_time: u16,
+    dos_date: u16,
+}
+
+impl<W: Write> ZipWriter<W> {
+    /// Starts an archive whose entries are all stamped with `timestamp`.
+    pub(crate) fn new(inner: W, timestamp: u64) -> Self {
+        let time = unix_timestamp_to_datetime(timestamp);
+        // DOS dates start in 1980; pin anything earlier to the epoch of the format.
+        let (dos_time, dos_date) = if time.year() < 1980 {
+            (0, (1 << 5) | 1)
+        } else {
+            (
+                ((time.hour() << 11) | (time.minute() << 5) | (time.second() / 2)) as u16,
+                ((((time.year() - 1980) as u32) << 9) | (time.month() << 5) | time.day()) as u16,
+            )
+        };
+        Self {
+            inner,
+            written: 0,
+            entries: Vec::new(),
+            dos_time,
+            dos_date,
+        }
+    }
+
+    /// Compresses `data` and writes it as the entry `name`.
+    pub(crate) fn add(&mut self, name: &str, data: &[u8]) -> io::Result<()> {
+        let mut encoder = DeflateEncoder::new(Vec::new(), Compression::default());
+        encoder.write_all(data)?;
+        let compressed = encoder.finish()?;
+        let mut crc = Crc::new();
+        crc.update(data);
+
+        let entry = ZipEntry {
+            name: name.to_string(),
+            crc: crc.sum(),
+            compressed_size: to_u32(compressed.len())?,
+            size: to_u32(data.len())?,
+            offset: self.written,
+        };
+
+        let mut header = Vec::with_capacity(30 + name.len());
+        header.extend_from_slice(&0x0403_4b50u32.to_le_bytes());
+        self.common_fields(&mut header, &entry);
+        header.extend_from_slice(&0u16.to_le_bytes()); // extra field length
+        header.extend_from_slice(name.as_bytes());
+
+        self.write(&header)?;
+        self.write(&compressed)?;
+        self.entries.push(entry);
+        Ok(())
+    }
+
+    /// Writes the central directory and flushes the underlying writer.
+    pub(crate) fn finish(mut self) -> io::Result<()> {
+        let directory_offset = self.written;
+        let entries = std::mem::take(&mut self.entries);
+        for entry in &entries {
+            let mut header = Vec::with_capacity(46 + entry.name.len());
+            header.extend_from_slice(&0x0201_4b50u32.to_le_bytes());
+            header.extend_from_slice(&20u16.to_le_bytes()); // version made by
+            self.common_fields(&mut header, entry);
+            header.extend_from_slice(&0u16.to_le_bytes()); // extra field length
+            header.extend_from_slice(&0u16.to_le_bytes()); // comment length
+            header.extend_from_slice(&0u16.to_le_bytes()); // disk number
+            header.extend_from_slice(&0u16.to_le_bytes()); // internal attributes
+            header.extend_from_slice(&0u32.to_le_bytes()); // external attributes
+            header.extend_from_slice(&entry.offset.to_le_bytes());
+            header.extend_from_slice(entry.name.as_bytes());
+            self.write(&header)?;
+        }
+        let directory_size = self.written - directory_offset;
+
+        let count = u16::try_from(entries.len())
+            .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "too many zip entries"))?;
+        let mut end = Vec::with_capacity(22);
+        end.extend_from_slice(&0x0605_4b50u32.to_le_bytes());
+        end.extend_from_slice(&0u16.to_le_bytes()); // this disk
+        end.extend_from_slice(&0u16.to_le_bytes()); // disk with the directory
+        end.extend_from_slice(&count.to_le_bytes());
+        end.extend_from_slice(&count.to_le_bytes());
+        end.extend_from_slice(&directory_size.to_le_bytes());
+        end.extend_from_slice(&directory_offset.to_le_bytes());
+        end.extend_from_slice(&0u16.to_le_bytes()); // comment length
+        self.write(&end)?;
+
+        self.inner.flush()
+    }
+
+    /// The fields shared by local and central headers, from "version needed" up to the
+    /// file name length.
+    fn common_fields(&self, header: &mut Vec<u8>, entry: &ZipEntry) {
+        header.extend_from_slice(&20u16.to_le_bytes()); // version needed: deflate
+        header.extend_from_slice(&0x0800u16.to_le_bytes()); // flags: UTF-8 names
+        header.extend_from_slice(&8u16.to_le_bytes()); // method: deflate
+        header.extend_from_slice(&self.dos_time.to_le_bytes());
+        header.extend_from_slice(&self.dos_date.to_le_bytes());
+        header.extend_from_slice(&entry.crc.to_le_bytes());
+        header.extend_from_slice(&entry.compressed_size.to_le_bytes());
+        header.extend_from_slice(&entry.size.to_le_bytes());
+        header.extend_from_slice(&(entry.name.len() as u16).to_le_bytes());
+    }
+
+    fn write(&mut self, data: &[u8]) -> io::Result<()> {
+        self.inner.write_all(data)?;
+        self.written = self
+            .written
+            .checked_add(to_u32(data.len())?)
+            .ok_or_else(|| io::Error::new(io::ErrorKind::InvalidInput, "zip archive too large"))?;
+        Ok(())
+    }
+}
+
+fn to_u32(len: usize) -> io::Result<u32> {
+    u32::try_from(len)
+        .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "zip entry too large"))
+}
+
+/// Reads every entry of the zip archive in `data`, in central directory order, checking
+/// sizes and checksums. Stored and deflated entries are supported, zip64 is not.
+pub(crate) fn read_zip(data: &[u8]) -> io::Result<Vec<(String, Vec<u8>)>> {
+    // The end of central directory record is 22 bytes plus a comment of up to 64 KiB.
+    let search_from = data.len().saturating_sub(22 + u16::MAX as usize);
+    let end = (search_from..data.len().saturating_sub(21))
+        .rev()
+        .find(|&offset| data[offset..].starts_with(&0x0605_4b50u32.to_le_bytes()))
+        .ok_or_else(|| invalid("not a zip archive"))?;
+    let count = read_u16(data, end + 10)?;
+    let mut offset = read_u32(data, end + 16)? as usize;
+
+    let mut entries = Vec::with_capacity(count as usize);
+    for _ in 0..count {
+        if read_u32(data, offset)? != 0x0201_4b50 {
+            return Err(invalid("corrupt zip central directory"));
+        }
+        let method = read_u16(data, offset + 10)?;
+        let crc = read_u32(data, offset + 16)?;
+        let compressed_size = read_u32(data, offset + 20)? as usize;
+        let size = read_u32(data, offset + 24)? as usize;
+        let name_len = read_u16(data, offset + 28)? as usize;
+        let extra_len = read_u16(data, offset + 30)? as usize;
+        let comment_len = read_u16(data, offset + 32)? as usize;
+        let local = read_u32(data, offset + 42)? as usize;
+        let name = String::from_utf8(slice(data, offset + 46, name_len)?.to_vec())
+            .map_err(|_| invalid("zip entry name is not UTF-8"))?;
+        offset += 46 + name_len + extra_len + comment_len;
+
+        if read_u32(data, local)? != 0x0403_4b50 {
+            return Err(invalid("corrupt zip local header"));
+        }
+        let start = local
+            + 30
+            + read_u16(data, local + 26)? as usize
+            + read_u16(data, local + 28)? as usize;
+        let compressed = slice(data, start, compressed_size)?;
+        let content = match method {
+            0 => compressed.to_vec(),
+            8 => {
+                let mut content = Vec::new();
+                DeflateDecoder::new(compressed)
+                    .take(size as u64 + 1)
+                    .read_to_end(&mut content)?;
+                content
+            }
+            _ => {
+                return Err(invalid(&format!(
+                    "unsupported compression method {} for {}",
+                    method, name
+                )))
+            }
+        };
+
+        let mut actual = Crc::new();
+        actual.update(&content);
+        if content.len() != size || actual.sum() != crc {
+            return Err(invalid(&format!("zip entry {} is corrupt", name)));
+        }
+        entries.push((name, content));
+    }
+
+    Ok(entries)
+}
+
+fn slice(data: &[u8], offset: usize, len: usize) -> io::Result<&[u8]> {
+    offset
+        .checked_add(len)
+        .and_then(|end| data.get(offset..end))
+        .ok_or_else(|| invalid("truncated zip archive"))
+}
+
+fn read_u16(data: &[u8], offset: usize) -> io::Result<u16> {
+    let bytes = slice(data, offset, 2)?;
+    Ok(u16::from_le_bytes([bytes[0], bytes[1]]))
+}
+
+fn read_u32(data: &[u8], offset: usize) -> io::Result<u32> {
+    let bytes = slice(data, offset, 4)?;
+    Ok(u32::from_le_bytes([bytes[0], bytes[1], bytes[2], bytes[3]]))
+}
+
+fn invalid(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message.to_string())
+}